@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"for/pkg/config"
+	"for/pkg/logger"
+	"for/pkg/ssh"
+	"for/pkg/tasks"
+	"for/pkg/utils"
+	"for/pkg/vault"
+)
+
+// loadConfig loads the config file at path. An empty path is discovered
+// with config.FindConfig, falling back to defaultConfigPath. When no
+// inventory is configured, an inventory or hosts file in the working
+// directory is used as inventory_file.
+func loadConfig(path string) (*config.Config, error) {
+	source := "-config"
+	if path == "" {
+		if path = config.FindConfig("."); path == "" {
+			path, source = defaultConfigPath, "default"
+		} else {
+			source = "discovered"
+		}
+	}
+	logger.L.Debug("config file", "path", path, "source", source)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := ssh.CheckAlgorithms(cfg.SSHCiphers, cfg.SSHKeyExchanges, cfg.SSHMACs); err != nil {
+		return nil, utils.Mark(fmt.Errorf("%s: %w", path, err), config.ErrConfigInvalid)
+	}
+	if cfg.InventoryFile == "" && cfg.InventoryScript == "" && len(cfg.InventorySources) == 0 {
+		if cfg.InventoryFile = config.FindInventory("."); cfg.InventoryFile != "" {
+			logger.L.Debug("inventory file", "path", cfg.InventoryFile, "source", "discovered")
+		}
+	}
+	return cfg, nil
+}
+
+// decryptConfig decrypts the vault-encrypted credential fields of cfg in
+// place and returns their plaintexts. Values encrypted with a label must be
+// bound to their config key.
+func decryptConfig(cfg *config.Config, password string) ([]string, error) {
+	fields := map[string]*string{
+		"ssh_password":   &cfg.SSHPassword,
+		"ssh_key_path":   &cfg.SSHKeyPath,
+		"ssh_user":       &cfg.SSHUser,
+		"winrm_user":     &cfg.WinRMUser,
+		"winrm_password": &cfg.WinRMPassword,
+	}
+	var secrets []string
+	for key, f := range fields {
+		if vault.IsEncrypted(*f) {
+			plain, err := vault.DecryptWithAAD(*f, password, key)
+			if err != nil {
+				return nil, fmt.Errorf("decrypting config value %s: %w", key, err)
+			}
+			*f = plain
+			secrets = append(secrets, plain)
+		}
+	}
+	return secrets, nil
+}
+
+// hostFlags are the command-line settings shared by every command that
+// connects to hosts; see hostOptions.
+type hostFlags struct {
+	forks           int
+	factTimeout     time.Duration
+	connectionDebug bool
+	sshMux          bool
+	connectRate     int
+	become          bool
+	becomePassword  string
+	limit           []string
+}
+
+// hostOptions builds the RunOptions that decide how hosts are reached,
+// from cfg with f overriding it, so that the run and ping commands connect
+// the same way. Callers add their command's own settings.
+func hostOptions(cfg *config.Config, f hostFlags) tasks.RunOptions {
+	forks := cfg.Forks
+	if f.forks > 0 {
+		forks = f.forks
+	}
+	factTimeout := cfg.FactTimeout
+	if f.factTimeout > 0 {
+		factTimeout = f.factTimeout
+	}
+	return tasks.RunOptions{
+		SSHUser:         cfg.SSHUser,
+		SSHKeyPath:      cfg.SSHKeyPath,
+		SSHPassword:     cfg.SSHPassword,
+		SSHPort:         cfg.SSHPort,
+		JumpHost:        cfg.JumpHost,
+		KnownHostsFile:  cfg.KnownHostsFile,
+		HostKeyChecking: cfg.HostKeyChecking,
+		SSHCiphers:      cfg.SSHCiphers,
+		SSHKeyExchanges: cfg.SSHKeyExchanges,
+		SSHMACs:         cfg.SSHMACs,
+		ConnectionDebug: f.connectionDebug,
+		SSHMux:          f.sshMux,
+		ConnectRate:     f.connectRate,
+		RunLocally:      cfg.RunLocally,
+		Forks:           forks,
+		FactTimeout:     factTimeout,
+		WinRMUser:       cfg.WinRMUser,
+		WinRMPassword:   cfg.WinRMPassword,
+		WinRMPort:       cfg.WinRMPort,
+		WinRMHTTPS:      cfg.WinRMHTTPS,
+		WinRMInsecure:   cfg.WinRMInsecure,
+		WinRMShell:      cfg.WinRMShell,
+		RemoteTmp:       cfg.RemoteTmp,
+		Become:          f.become || cfg.Become,
+		BecomeUser:      cfg.BecomeUser,
+		BecomeMethod:    cfg.BecomeMethod,
+		BecomePassword:  f.becomePassword,
+		Limit:           f.limit,
+	}
+}
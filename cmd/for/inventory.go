@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"for/pkg/config"
+	"for/pkg/inventory"
+	"for/pkg/utils"
+	"for/pkg/vault"
+)
+
+// loadInventory loads the dynamic inventory script if one is configured (the
+// CLI override takes precedence), otherwise the inventory_file location, which
+// may be a plain path or a source URI. With inventory_sources, all locations
+// are loaded concurrently and merged; unless inventory_fail_fast is set, a
+// failing source is reported as a warning and the others are used.
+func loadInventory(cfg *config.Config, scriptOverride string) (*inventory.Inventory, error) {
+	script := cfg.InventoryScript
+	if scriptOverride != "" {
+		script = scriptOverride
+	}
+	if script != "" {
+		return inventory.ScriptSource{Path: script}.Load()
+	}
+	if len(cfg.InventorySources) == 0 {
+		return inventory.LoadInventory(cfg.InventoryFile)
+	}
+	var uris []string
+	if cfg.InventoryFile != "" {
+		uris = append(uris, cfg.InventoryFile)
+	}
+	uris = append(uris, cfg.InventorySources...)
+	inv, err := inventory.LoadInventories(uris, inventory.LoadOptions{FailFast: cfg.InventoryFailFast})
+	if err != nil && inv != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		return inv, nil
+	}
+	return inv, err
+}
+
+// runInventoryCommand implements "for inventory --list", printing the resolved
+// inventory as dynamic-inventory JSON.
+func runInventoryCommand(args []string) int {
+	fs := flag.NewFlagSet("inventory", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to the configuration file (default: $FOR_CONFIG, ./for.yaml, ./config.yaml, ~/.config/for/config.yaml)")
+	inventoryScript := fs.String("inventory-script", "", "Path to executable that returns JSON inventory")
+	list := fs.Bool("list", false, "Print the resolved inventory as JSON")
+	noStrict := fs.Bool("no-strict", false, "Ignore unknown keys in the config file")
+	strictInventory := fs.Bool("strict-inventory", false, "Fail on INI inventory lines that cannot be parsed")
+	vaultPasswordFile := fs.String("vault-password-file", "", "Path to file containing vault decryption password")
+	fs.Parse(args)
+	utils.StrictYAML = !*noStrict
+	inventory.StrictINI = *strictInventory
+
+	if !*list {
+		fs.Usage()
+		return 1
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	vaultPass := cfg.VaultPasswordFile
+	if *vaultPasswordFile != "" {
+		vaultPass = *vaultPasswordFile
+	}
+	if vaultPass != "" {
+		password, err := vault.LoadPassword(vaultPass)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading vault password: %v\n", err)
+			return 1
+		}
+		inventory.VaultPassword = password
+	}
+	inv, err := loadInventory(cfg, *inventoryScript)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading inventory: %v\n", err)
+		return 1
+	}
+	data, err := inventory.ExportDynamic(inv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting inventory: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(data))
+	return 0
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"for/pkg/config"
 	"for/pkg/inventory"
 	"for/pkg/logger"
+	"for/pkg/printer"
 	"for/pkg/tasks"
+	"for/pkg/utils"
 	"for/pkg/vault"
 )
 
@@ -19,43 +24,201 @@ const defaultConfigPath = "./config.yaml"
 var version = "dev"
 
 func main() {
-	configFile   := flag.String("config", defaultConfigPath, "Path to the configuration file")
+	if len(os.Args) > 1 && os.Args[1] == "inventory" {
+		os.Exit(runInventoryCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ping" {
+		os.Exit(runPingCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "vault" {
+		os.Exit(runVaultCommand(os.Args[2:]))
+	}
+
+	configFile   := flag.String("config", "", "Path to the configuration file (default: $FOR_CONFIG, ./for.yaml, ./config.yaml, ~/.config/for/config.yaml)")
 	playbookFile := flag.String("playbook", "", "Path to the playbook file")
 	showHelp     := flag.Bool("help", false, "Show help message")
 	showVersion  := flag.Bool("version", false, "Print version and exit")
-	adHocTask    := flag.String("t", "", "Ad hoc task / command to run")
+	adHocTask    := flag.String("t", "", "Ad hoc task / command to run, or @file with one command per line")
 	adHocGroup   := flag.String("g", "", "Group to run ad hoc task on")
 	runLocalFlag := flag.Bool("local", false, "Run locally without SSH (overrides run_locally in config)")
 	dryRun       := flag.Bool("dry-run", false, "Print tasks without executing them")
+	showDiff     := flag.Bool("diff", false, "With -dry-run, show the diff each copy task would make on the target")
 	failFast     := flag.Bool("fail-fast", false, "Abort on first failure")
+	keepGoing    := flag.Bool("keep-going", false, "Never abort on failure; list every failure after the recap (overrides -fail-fast)")
 	forks        := flag.Int("forks", 0, "Parallel host connections (0 = use config default)")
 	tagsArg      := flag.String("tags", "", "Comma-separated tags to run")
 	skipTagsArg  := flag.String("skip-tags", "", "Comma-separated tags to skip")
+	adHocChangedWhen   := flag.String("changed-when", "", "With -t, report a host changed when this template (with .output and .rc) holds")
+	adHocFailedWhen    := flag.String("failed-when", "", "With -t, report a host failed exactly when this template (with .output and .rc) holds")
 	logFile            := flag.String("log-file", "", "Optional log file path (appended to stdout)")
+	outputFile         := flag.String("output-file", "", "Also write the printed output, without colours or the progress line, to this file")
 	vaultPasswordFile  := flag.String("vault-password-file", "", "Path to file containing vault decryption password")
+	becomePasswordFile := flag.String("become-password-file", "", "Path to file containing the sudo password for become (may be vault-encrypted)")
+	sshPasswordFile    := flag.String("ssh-password-file", "", "Path to file containing the SSH password (may be vault-encrypted)")
+	askPass            := flag.Bool("ask-pass", false, "Prompt once for the SSH password (overrides -ssh-password-file)")
+	askBecomePass      := flag.Bool("ask-become-pass", false, "Prompt once for the sudo password for become (overrides -become-password-file)")
+	becomeFlag         := flag.Bool("become", false, "Run every task through sudo unless its play or task sets become: false (overrides become in config)")
 	gatherFacts        := flag.Bool("gather-facts", false, "Gather remote host facts before running tasks")
+	factTimeout        := flag.Duration("fact-timeout", 0, "Stop waiting for a host's facts after this long, e.g. 30s, and continue with those received (overrides fact_timeout in config)")
 	inventoryScript    := flag.String("inventory-script", "", "Path to executable that returns JSON inventory")
+	strictInventory    := flag.Bool("strict-inventory", false, "Fail on INI inventory lines that cannot be parsed instead of skipping them with a warning")
+	noColor            := flag.Bool("no-color", false, "Disable ANSI colours and the live progress line")
+	limitArg           := flag.String("limit", "", "Comma-separated hosts to run on, or @file (e.g. @playbook.retry)")
+	sliceArg           := flag.String("slice", "", "Run only chunk i of n of each play's hosts, e.g. 2/3 (after -limit)")
+	listTags           := flag.Bool("list-tags", false, "List the tags used by each play in the playbook and exit")
+	listPlayHosts      := flag.Bool("list-plays-with-hosts", false, "List the hosts each play would target after -limit and -slice, then exit")
+	listHosts          := flag.Bool("list-hosts", false, "List the hosts the playbook or -g group would target after -limit and -slice, then exit")
+	outputFormat       := flag.String("output", "text", "Output format of -list-hosts: text or json (host, groups and merged vars)")
+	syntaxCheck        := flag.Bool("syntax-check", false, "Check the playbook, its services and their templates without running anything, then exit")
+	diffOnly           := flag.Bool("diff-only", false, "Report drift of file tasks against hosts without changing anything (exit 2 on drift)")
+	outputWidth        := flag.Int("output-width", 0, "Banner width in columns (0 = detect from the terminal, 72 if unknown)")
+	parallelPlays      := flag.Bool("parallel-plays", false, "Run plays on disjoint hosts concurrently (plays sharing hosts stay in order)")
+	noStrict           := flag.Bool("no-strict", false, "Ignore unknown keys in config, playbook and service YAML instead of failing")
+	oneLineOut         := flag.Bool("one-line", false, "Print one line per host result (host | STATUS | rc=N | stdout)")
+	detectChanges      := flag.Bool("detect-changes", false, "Report commands changed only when their output differs from the previous run")
+	runTimeout         := flag.Duration("run-timeout", 0, "Abort the whole playbook or ad hoc run after this long, e.g. 30m (exit 124)")
+	verbosity          := flag.Int("v", 0, "Verbosity level; debug tasks with a higher verbosity are skipped")
+	connectionDebug    := flag.Bool("connection-debug", false, "Log each SSH connection's dial target, auth attempts, negotiated algorithms and failure stage")
+	sshMux             := flag.Bool("ssh-mux", false, "Run SSH through the system ssh client with ControlMaster multiplexing, reusing connections across runs")
+	connectRate        := flag.Int("connect-rate", 0, "Start at most this many new SSH connections per second (0 = no limit)")
+	vvv                := flag.Bool("vvv", false, "Same as -v 3")
+	maxOutputBytes     := flag.Int("max-output-bytes", 0, "Truncate printed task output after this many bytes (0 = no limit)")
+	profileTasks       := flag.Bool("profile-tasks", false, "Print the slowest tasks across all hosts after the recap")
+	changedOnly        := flag.Bool("changed-only", false, "Skip tasks that were ok on a host in the previous run of the playbook")
+	renderOnly         := flag.Bool("render-only", false, "Print each task's rendered command per host without running anything, then exit")
+	summaryOnly        := flag.Bool("summary-only", false, "Print only the recap and any failures, not per-task output")
+	stream             := flag.Bool("stream", false, "Print command output line by line as it arrives, prefixed with the host")
+	resultFile         := flag.String("result-file", "", "Write every task's result per host to this file at the end of the run (YAML for .yaml/.yml, else JSON)")
+	retriesPerHost     := flag.Int("retries-per-host", 0, "Re-run each play on the hosts that failed it up to N times (a play's retries_per_host overrides)")
+	retryDelay         := flag.Duration("retry-delay", 0, "Wait this long before each -retries-per-host retry, e.g. 30s")
+	ignoreUnreachable  := flag.Bool("ignore-unreachable", false, "Let reachable hosts finish when others are unreachable; the run still exits 3")
+	okOnUnreachable    := flag.Bool("ok-on-unreachable", false, "With -ignore-unreachable, exit 0 when the only problem was unreachable hosts")
+
+	flag.BoolVar(dryRun, "check", false, "Alias for -dry-run")
+	flag.BoolVar(summaryOnly, "q", false, "Alias for -summary-only")
 
-	flag.Parse()
+	// Bad flags exit with ExitUsage rather than the flag package's 2,
+	// which means drift or pending changes.
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(tasks.ExitOK)
+		}
+		os.Exit(tasks.ExitUsage)
+	}
+
+	// -vvv, like -v 3 or higher, also debugs SSH connections.
+	if *vvv {
+		*verbosity = max(*verbosity, 3)
+	}
+	if *verbosity >= 3 {
+		*connectionDebug = true
+	}
 
 	if *showVersion {
 		fmt.Printf("for %s\n", version)
 		os.Exit(0)
 	}
 
-	if *showHelp || (*adHocTask == "" && *playbookFile == "") {
+	if *showHelp {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(tasks.ExitOK)
+	}
+	if *adHocTask == "" && *playbookFile == "" && (!*listHosts || *adHocGroup == "") {
+		flag.Usage()
+		os.Exit(tasks.ExitUsage)
 	}
 
-	// Initialise logger (stdout + optional file).
+	if *noColor {
+		printer.ColorsEnabled = false
+	}
+	printer.OneLine = *oneLineOut
+	printer.SummaryOnly = *summaryOnly
+	printer.DiffCounts = *showDiff || *diffOnly
+	printer.OutputWidth = *outputWidth
+	utils.StrictYAML = !*noStrict
+	inventory.StrictINI = *strictInventory
+
+	// Initialise logger (stdout + optional file). JSON listings keep stdout
+	// for the document.
+	if *listHosts && *outputFormat == "json" {
+		logger.Console = os.Stderr
+	}
 	cleanup, err := logger.Init(*logFile)
 	if err != nil {
 		fmt.Printf("Error initialising logger: %v\n", err)
-		os.Exit(1)
+		os.Exit(tasks.ExitConfig)
 	}
 	defer cleanup()
 
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			fmt.Printf("Error opening output file: %v\n", err)
+			os.Exit(tasks.ExitConfig)
+		}
+		defer f.Close()
+		printer.SetTranscript(f)
+	}
+
+	if *listTags {
+		if *playbookFile == "" {
+			fmt.Println("Error: --list-tags requires -playbook")
+			os.Exit(tasks.ExitUsage)
+		}
+		playbook, err := tasks.LoadTasks(*playbookFile)
+		if err != nil {
+			fmt.Printf("Error loading playbook: %v\n", err)
+			os.Exit(tasks.ExitSyntax)
+		}
+		servicesPath := tasks.DefaultServicesPath
+		if cfg, err := loadConfig(*configFile); err == nil && !*runLocalFlag {
+			servicesPath = cfg.ServicesPath
+		}
+		playTags, err := tasks.ListTags(playbook, servicesPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(tasks.ExitSyntax)
+		}
+		for i, pt := range playTags {
+			fmt.Printf("play #%d (%s): TAGS: [%s]\n", i+1, pt.Play, strings.Join(pt.Tags, ", "))
+		}
+		os.Exit(0)
+	}
+
+	if *listPlayHosts && *playbookFile == "" {
+		fmt.Println("Error: --list-plays-with-hosts requires -playbook")
+		os.Exit(tasks.ExitUsage)
+	}
+	if *listHosts && *playbookFile == "" && *adHocGroup == "" {
+		fmt.Println("Error: --list-hosts requires -playbook or -g")
+		os.Exit(tasks.ExitUsage)
+	}
+	if *okOnUnreachable && !*ignoreUnreachable {
+		fmt.Println("Error: --ok-on-unreachable requires --ignore-unreachable")
+		os.Exit(tasks.ExitUsage)
+	}
+	if *sshMux && (*sshPasswordFile != "" || *askPass) {
+		fmt.Println("Error: --ssh-mux cannot pass an SSH password to ssh; authenticate with a key or the agent instead of -ssh-password-file or -ask-pass")
+		os.Exit(tasks.ExitUsage)
+	}
+	if (*adHocChangedWhen != "" || *adHocFailedWhen != "") && (*playbookFile != "" || *runLocalFlag) {
+		fmt.Println("Error: --changed-when and --failed-when apply to remote -t ad hoc runs only; in a playbook, set changed_when on the task")
+		os.Exit(tasks.ExitUsage)
+	}
+	if *outputFormat != "text" && *outputFormat != "json" {
+		fmt.Printf("Error: unknown -output %q (want text or json)\n", *outputFormat)
+		os.Exit(tasks.ExitUsage)
+	}
+
+	if *syntaxCheck {
+		if *playbookFile == "" {
+			fmt.Println("Error: --syntax-check requires -playbook")
+			os.Exit(tasks.ExitUsage)
+		}
+		os.Exit(runSyntaxCheck(*playbookFile, *configFile, *inventoryScript, *runLocalFlag))
+	}
+
 	parseTags := func(s string) []string {
 		if s == "" {
 			return nil
@@ -67,21 +230,86 @@ func main() {
 		return parts
 	}
 
+	if !*listPlayHosts && !*listHosts {
+		printer.Notice("Run ID: %s", logger.RunID)
+	}
+
+	// Vault password from the CLI; the remote path falls back to the config's
+	// vault_password_file below. --local uses it for vault-encrypted secrets.
+	var password string
+	if *vaultPasswordFile != "" {
+		if password, err = vault.LoadPassword(*vaultPasswordFile); err != nil {
+			fmt.Printf("Error loading vault password: %v\n", err)
+			os.Exit(tasks.ExitConfig)
+		}
+	}
+
 	// Local execution – no config or inventory required.
 	if *runLocalFlag {
 		localOpts := tasks.RunOptions{
-			RunLocally:   true,
-			DryRun:       *dryRun,
-			FailFast:     *failFast,
-			Forks:        *forks,
-			Tags:         parseTags(*tagsArg),
-			SkipTags:     parseTags(*skipTagsArg),
-			ServicesPath: tasks.DefaultServicesPath,
+			RunLocally:     true,
+			DryRun:         *dryRun,
+			Diff:           *showDiff,
+			FailFast:       *failFast,
+			Forks:          *forks,
+			Tags:           parseTags(*tagsArg),
+			SkipTags:       parseTags(*skipTagsArg),
+			ServicesPath:   tasks.DefaultServicesPath,
+			DriftCheck:     *diffOnly,
+			Verbosity:      *verbosity,
+			RunTimeout:     *runTimeout,
+			MaxOutputBytes: *maxOutputBytes,
+			KeepGoing:      *keepGoing,
+			ProfileTasks:   *profileTasks,
+			ChangedOnly:    *changedOnly,
+			RenderOnly:     *renderOnly,
+			SummaryOnly:    *summaryOnly,
+			Stream:         *stream,
+			ResultFile:     *resultFile,
+			RetriesPerHost: *retriesPerHost,
+			RetryDelay:     *retryDelay,
+			Become:         *becomeFlag,
+		}
+
+		if *becomePasswordFile != "" {
+			pw, err := readSecretFile(*becomePasswordFile, password)
+			if err != nil {
+				fmt.Printf("Error loading become password: %v\n", err)
+				os.Exit(tasks.ExitConfig)
+			}
+			localOpts.BecomePassword = pw
+		}
+		if *askBecomePass {
+			if localOpts.BecomePassword, err = askSecret("ask-become-pass", "BECOME password: "); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(tasks.ExitUsage)
+			}
+		}
+
+		if *listPlayHosts {
+			os.Exit(printPlayHosts(*playbookFile, nil, localOpts))
+		}
+		if *listHosts {
+			os.Exit(printHosts(*playbookFile, *adHocGroup, nil, localOpts, *outputFormat))
 		}
 
 		if *adHocTask != "" {
-			if err := tasks.RunLocalAdHocCommand(*adHocTask); err != nil {
-				os.Exit(1)
+			runner := &tasks.Runner{Inventory: tasks.LocalInventory(), Options: localOpts, Printer: printer.Default()}
+			run := func() (tasks.Result, error) {
+				return runner.RunAdHoc(context.Background(), tasks.LocalGroup, *adHocTask)
+			}
+			if strings.HasPrefix(*adHocTask, "@") {
+				commands, err := tasks.ParseAdHocCommands(*adHocTask)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(tasks.ExitUsage)
+				}
+				run = func() (tasks.Result, error) {
+					return runner.RunAdHocCommands(context.Background(), tasks.LocalGroup, commands)
+				}
+			}
+			if _, err := run(); err != nil {
+				exitOnRunError(err)
 			}
 			os.Exit(0)
 		}
@@ -90,21 +318,35 @@ func main() {
 			playbook, err := tasks.LoadTasks(*playbookFile)
 			if err != nil {
 				fmt.Printf("Error loading playbook: %v\n", err)
-				os.Exit(1)
+				os.Exit(tasks.ExitSyntax)
 			}
-			if err := tasks.RunPlaybook(playbook, nil, localOpts); err != nil {
-				fmt.Printf("Error: %v\n", err)
-				os.Exit(1)
+			if *changedOnly {
+				localOpts.StateFile = strings.TrimSuffix(*playbookFile, filepath.Ext(*playbookFile)) + ".state.json"
+			}
+			if *detectChanges {
+				localOpts.ChangeCacheFile = strings.TrimSuffix(*playbookFile, filepath.Ext(*playbookFile)) + ".changes.json"
+			}
+			runner := &tasks.Runner{Options: localOpts, Printer: printer.Default()}
+			if _, err := runner.RunPlaybook(context.Background(), playbook); err != nil {
+				exitOnRunError(err)
 			}
 			os.Exit(0)
 		}
 	}
 
 	// SSH / config-driven execution.
-	cfg, err := config.LoadConfig(*configFile)
+	cfg, err := loadConfig(*configFile)
 	if err != nil {
 		fmt.Printf("Error loading config: %v\n", err)
-		os.Exit(1)
+		os.Exit(tasks.ExitConfig)
+	}
+	if !tasks.ValidBecomeMethod(cfg.BecomeMethod) {
+		fmt.Printf("Error loading config: unknown become_method %q (want %q or %q)\n", cfg.BecomeMethod, tasks.BecomeSudo, tasks.BecomeDoas)
+		os.Exit(tasks.ExitConfig)
+	}
+	if *sshMux && cfg.SSHPassword != "" {
+		fmt.Println("Error loading config: --ssh-mux cannot pass ssh_password to ssh; authenticate with a key or the agent")
+		os.Exit(tasks.ExitConfig)
 	}
 
 	// Override log file from CLI if provided.
@@ -112,81 +354,144 @@ func main() {
 		cleanup, err = logger.Init(cfg.LogFile)
 		if err != nil {
 			fmt.Printf("Error initialising logger: %v\n", err)
-			os.Exit(1)
+			os.Exit(tasks.ExitConfig)
 		}
 	}
 
 	// Load vault password and decrypt config if provided.
-	vaultPass := cfg.VaultPasswordFile
-	if *vaultPasswordFile != "" {
-		vaultPass = *vaultPasswordFile
-	}
-	if vaultPass != "" {
-		password, err := vault.LoadPassword(vaultPass)
+	if *vaultPasswordFile == "" && cfg.VaultPasswordFile != "" {
+		password, err = vault.LoadPassword(cfg.VaultPasswordFile)
 		if err != nil {
 			fmt.Printf("Error loading vault password: %v\n", err)
-			os.Exit(1)
+			os.Exit(tasks.ExitConfig)
 		}
-		// Decrypt any encrypted string fields in config.
-		fields := []*string{&cfg.SSHPassword, &cfg.SSHKeyPath, &cfg.SSHUser}
-		for _, f := range fields {
-			if vault.IsEncrypted(*f) {
-				plain, err := vault.Decrypt(*f, password)
-				if err != nil {
-					fmt.Printf("Error decrypting config value: %v\n", err)
-					os.Exit(1)
-				}
-				*f = plain
-			}
+	}
+	// secrets are redacted from diffs printed under -dry-run -diff.
+	var secrets []string
+	if *vaultPasswordFile != "" || cfg.VaultPasswordFile != "" {
+		inventory.VaultPassword = password
+		if secrets, err = decryptConfig(cfg, password); err != nil {
+			fmt.Printf("Error %v\n", err)
+			os.Exit(tasks.ExitConfig)
 		}
 	}
 
-	// Load inventory – dynamic script takes precedence.
-	script := cfg.InventoryScript
-	if *inventoryScript != "" {
-		script = *inventoryScript
+	if *sshPasswordFile != "" {
+		cfg.SSHPassword, err = readSecretFile(*sshPasswordFile, password)
+		if err != nil {
+			fmt.Printf("Error loading SSH password: %v\n", err)
+			os.Exit(tasks.ExitConfig)
+		}
+		secrets = append(secrets, cfg.SSHPassword)
 	}
-	var inv *inventory.Inventory
-	if script != "" {
-		inv, err = inventory.LoadDynamic(script)
-	} else {
-		inv, err = inventory.LoadInventory(cfg.InventoryFile)
+	if *askPass {
+		if cfg.SSHPassword, err = askSecret("ask-pass", "SSH password: "); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(tasks.ExitUsage)
+		}
+		secrets = append(secrets, cfg.SSHPassword)
+	}
+
+	var becomePassword string
+	if *becomePasswordFile != "" {
+		becomePassword, err = readSecretFile(*becomePasswordFile, password)
+		if err != nil {
+			fmt.Printf("Error loading become password: %v\n", err)
+			os.Exit(tasks.ExitConfig)
+		}
 	}
+	if *askBecomePass {
+		if becomePassword, err = askSecret("ask-become-pass", "BECOME password: "); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(tasks.ExitUsage)
+		}
+	}
+
+	// Load inventory – dynamic script takes precedence.
+	inv, err := loadInventory(cfg, *inventoryScript)
 	if err != nil {
 		fmt.Printf("Error loading inventory: %v\n", err)
-		os.Exit(1)
+		os.Exit(tasks.ExitConfig)
 	}
 
-	effectiveForks := cfg.Forks
-	if *forks > 0 {
-		effectiveForks = *forks
+	limit, err := inventory.ParseLimit(*limitArg)
+	if err != nil {
+		fmt.Printf("Error parsing limit: %v\n", err)
+		os.Exit(tasks.ExitUsage)
+	}
+	slice, err := inventory.ParseSlice(*sliceArg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(tasks.ExitUsage)
 	}
 
-	opts := tasks.RunOptions{
-		SSHUser:        cfg.SSHUser,
-		SSHKeyPath:     cfg.SSHKeyPath,
-		SSHPassword:    cfg.SSHPassword,
-		SSHPort:        cfg.SSHPort,
-		JumpHost:       cfg.JumpHost,
-		KnownHostsFile: cfg.KnownHostsFile,
-		ServicesPath:   cfg.ServicesPath,
-		RunLocally:     *runLocalFlag || cfg.RunLocally,
-		DryRun:         *dryRun,
-		FailFast:       *failFast || cfg.FailFast,
-		Forks:          effectiveForks,
-		Tags:           parseTags(*tagsArg),
-		SkipTags:       parseTags(*skipTagsArg),
-		GatherFacts:    *gatherFacts || cfg.GatherFacts,
+	opts := hostOptions(cfg, hostFlags{
+		forks:           *forks,
+		factTimeout:     *factTimeout,
+		connectionDebug: *connectionDebug,
+		sshMux:          *sshMux,
+		connectRate:     *connectRate,
+		become:          *becomeFlag,
+		becomePassword:  becomePassword,
+		limit:           limit,
+	})
+	opts.ServicesPath = cfg.ServicesPath
+	opts.RunLocally = opts.RunLocally || *runLocalFlag
+	opts.DryRun = *dryRun
+	opts.Diff = *showDiff
+	opts.FailFast = *failFast || cfg.FailFast
+	opts.KeepGoing = *keepGoing
+	opts.ProfileTasks = *profileTasks
+	opts.ChangedOnly = *changedOnly
+	opts.RenderOnly = *renderOnly
+	opts.SummaryOnly = *summaryOnly
+	opts.Stream = *stream
+	opts.ResultFile = *resultFile
+	opts.RetriesPerHost = *retriesPerHost
+	opts.RetryDelay = *retryDelay
+	opts.IgnoreUnreachable = *ignoreUnreachable
+	opts.OkOnUnreachable = *okOnUnreachable
+	opts.Tags = parseTags(*tagsArg)
+	opts.SkipTags = parseTags(*skipTagsArg)
+	opts.GatherFacts = *gatherFacts || cfg.GatherFacts
+	opts.PreRunHook = cfg.PreRunHook
+	opts.PostRunHook = cfg.PostRunHook
+	opts.Slice = slice
+	opts.DriftCheck = *diffOnly
+	opts.ParallelPlays = *parallelPlays
+	opts.Verbosity = *verbosity
+	opts.RunTimeout = *runTimeout
+	opts.MaxOutputBytes = *maxOutputBytes
+	opts.Secrets = secrets
+	opts.AdHocChangedWhen = *adHocChangedWhen
+	opts.AdHocFailedWhen = *adHocFailedWhen
+
+	if *listPlayHosts {
+		os.Exit(printPlayHosts(*playbookFile, inv, opts))
+	}
+	if *listHosts {
+		os.Exit(printHosts(*playbookFile, *adHocGroup, inv, opts, *outputFormat))
 	}
 
 	if *adHocTask != "" {
 		if *adHocGroup == "" {
 			fmt.Println("Error: Group must be specified with -g for ad hoc tasks")
-			os.Exit(1)
+			os.Exit(tasks.ExitUsage)
 		}
-		if err := tasks.RunAdHocCommand(inv, *adHocGroup, *adHocTask, opts); err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+		runner := &tasks.Runner{Inventory: inv, Options: opts, Printer: printer.Default()}
+		run := func() (tasks.Result, error) { return runner.RunAdHoc(context.Background(), *adHocGroup, *adHocTask) }
+		if strings.HasPrefix(*adHocTask, "@") {
+			commands, err := tasks.ParseAdHocCommands(*adHocTask)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(tasks.ExitUsage)
+			}
+			run = func() (tasks.Result, error) {
+				return runner.RunAdHocCommands(context.Background(), *adHocGroup, commands)
+			}
+		}
+		if _, err := run(); err != nil {
+			exitOnRunError(err)
 		}
 		os.Exit(0)
 	}
@@ -195,15 +500,151 @@ func main() {
 		playbook, err := tasks.LoadTasks(*playbookFile)
 		if err != nil {
 			fmt.Printf("Error loading playbook: %v\n", err)
-			os.Exit(1)
+			os.Exit(tasks.ExitSyntax)
 		}
-		if err := tasks.RunPlaybook(playbook, inv, opts); err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+		opts.PlaybookFile = *playbookFile
+		opts.RetryFile = strings.TrimSuffix(*playbookFile, filepath.Ext(*playbookFile)) + ".retry"
+		if *changedOnly {
+			opts.StateFile = strings.TrimSuffix(*playbookFile, filepath.Ext(*playbookFile)) + ".state.json"
+		}
+		if *detectChanges {
+			opts.ChangeCacheFile = strings.TrimSuffix(*playbookFile, filepath.Ext(*playbookFile)) + ".changes.json"
+		}
+		runner := &tasks.Runner{Inventory: inv, Options: opts, Printer: printer.Default()}
+		if _, err := runner.RunPlaybook(context.Background(), playbook); err != nil {
+			exitOnRunError(err)
 		}
 		os.Exit(0)
 	}
 
 	fmt.Println("No tasks or commands specified")
-	os.Exit(1)
+	os.Exit(tasks.ExitUsage)
+}
+
+// printPlayHosts implements --list-plays-with-hosts: it prints the hosts
+// each play of playbookFile would target and returns the exit code.
+func printPlayHosts(playbookFile string, inv *inventory.Inventory, opts tasks.RunOptions) int {
+	playbook, err := tasks.LoadTasks(playbookFile)
+	if err != nil {
+		fmt.Printf("Error loading playbook: %v\n", err)
+		return tasks.ExitSyntax
+	}
+	for _, ph := range tasks.ListPlayHosts(playbook, inv, opts) {
+		fmt.Println(ph)
+	}
+	return 0
+}
+
+// printHosts implements --list-hosts: it prints the hosts the plays of
+// playbookFile, or else group, would target, as an indented list or as a
+// JSON array of inventory.HostInfo, and returns the exit code.
+func printHosts(playbookFile, group string, inv *inventory.Inventory, opts tasks.RunOptions, format string) int {
+	patterns := []string{group}
+	if playbookFile != "" {
+		playbook, err := tasks.LoadTasks(playbookFile)
+		if err != nil {
+			fmt.Printf("Error loading playbook: %v\n", err)
+			return tasks.ExitSyntax
+		}
+		patterns = patterns[:0]
+		for _, play := range playbook {
+			patterns = append(patterns, play.Hosts)
+		}
+	}
+	hosts := tasks.ListHosts(patterns, inv, opts)
+	if format == "json" {
+		data, err := json.MarshalIndent(hosts, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+	fmt.Printf("  hosts (%d):\n", len(hosts))
+	for _, h := range hosts {
+		fmt.Printf("    %s\n", h.Host)
+	}
+	return 0
+}
+
+// runSyntaxCheck loads playbookFile and prints tasks.SyntaxCheck findings.
+// Inventory vars are taken into account when the config and inventory load.
+// It returns the exit code: tasks.ExitSyntax when the playbook does not load
+// or a template is malformed, 0 otherwise (warnings included).
+func runSyntaxCheck(playbookFile, configFile, inventoryScript string, local bool) int {
+	playbook, err := tasks.LoadTasks(playbookFile)
+	if err != nil {
+		fmt.Printf("Error loading playbook: %v\n", err)
+		return tasks.ExitSyntax
+	}
+	servicesPath := tasks.DefaultServicesPath
+	var inv *inventory.Inventory
+	if cfg, err := loadConfig(configFile); err == nil && !local {
+		servicesPath = cfg.ServicesPath
+		if inv, err = loadInventory(cfg, inventoryScript); err != nil {
+			fmt.Printf("Warning: inventory not loaded, its vars are treated as unknown: %v\n", err)
+		}
+	}
+	findings, err := tasks.SyntaxCheck(playbook, inv, servicesPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return tasks.ExitSyntax
+	}
+	code := tasks.ExitOK
+	for _, f := range findings {
+		fmt.Println(f)
+		if f.Error {
+			code = tasks.ExitSyntax
+		}
+	}
+	if len(findings) == 0 {
+		fmt.Printf("playbook: %s: syntax OK\n", playbookFile)
+	}
+	return code
+}
+
+// readSecretFile returns the trimmed content of file, decrypting it with
+// vaultPassword when it is vault-encrypted. Errors never include the secret.
+func readSecretFile(file, vaultPassword string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if !vault.IsEncrypted(secret) {
+		return secret, nil
+	}
+	if vaultPassword == "" {
+		return "", fmt.Errorf("%s is vault-encrypted: a vault password is required (--vault-password-file)", file)
+	}
+	plain, err := vault.Decrypt(secret, vaultPassword)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	return plain, nil
+}
+
+// askSecret prompts on the terminal for the secret requested by the named
+// -ask-* flag. The answer is read without echo and never printed.
+func askSecret(flagName, prompt string) (string, error) {
+	secret, err := utils.PromptSecret(os.Stdin, os.Stderr, prompt)
+	if errors.Is(err, utils.ErrNoTerminal) {
+		return "", fmt.Errorf("-%s needs a terminal to prompt on; use a password file instead", flagName)
+	}
+	if err != nil {
+		return "", fmt.Errorf("-%s: %w", flagName, err)
+	}
+	return secret, nil
+}
+
+// exitOnRunError reports a playbook or ad hoc error and exits with its
+// tasks.ExitStatus. Drift and pending changes (ExitChanges) are reported
+// by the recap already.
+func exitOnRunError(err error) {
+	status := tasks.ExitStatus(err)
+	if status != tasks.ExitChanges {
+		fmt.Printf("Error: %v\n", err)
+	}
+	os.Exit(status)
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"for/pkg/config"
+	"for/pkg/tasks"
+)
+
+// harnessArgs carries the command line for a test binary re-run as the
+// for command; see TestMain and runFor.
+const harnessArgs = "FOR_TEST_HARNESS_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(harnessArgs); ok {
+		os.Args = append([]string{"for"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runFor runs the for command with args in dir and returns its exit code.
+func runFor(t *testing.T, dir string, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), harnessArgs+"="+strings.Join(args, "\n"), "FOR_CONFIG=")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		t.Logf("for %s:\n%s", strings.Join(args, " "), out)
+		return exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("running for %s: %v", strings.Join(args, " "), err)
+	}
+	return 0
+}
+
+// writeFiles writes files, keyed by path relative to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := strconv.Itoa(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.yaml":            "inventory_file: hosts\nssh_user: deploy\n",
+		"bad-config.yaml":        "inventory_file: hosts\nno_such_setting: true\n",
+		"missing-inventory.yaml": "inventory_file: no-such-hosts\n",
+		"password.yaml":          "inventory_file: hosts\nssh_password: secret\n",
+		"hosts": "[web]\n" +
+			"w1 connection=local\n" +
+			"w2 connection=local\n" +
+			"[down]\n" +
+			"127.0.0.1 ssh_port=" + closedPort + "\n",
+		"services/check/tasks/main.yaml":   "- name: check\n  command: test {{ .inventory_hostname }} = w1\n",
+		"services/broken/tasks/main.yaml":  "- name: broken\n  shell: exit 1\n",
+		"services/typo/tasks/main.yaml":    "- name: typo\n  command: echo {{ .name\n",
+		"services/unknown/tasks/main.yaml": "- name: unknown\n  comand: true\n",
+		"partial.yaml":                     "- hosts: web\n  services:\n    - service: check\n",
+		"cmds":                             "test {{ .inventory_hostname }} = w1\n",
+		"all-failed.yaml":                  "- hosts: web\n  services:\n    - service: broken\n",
+		"down.yaml":                        "- hosts: down\n  services:\n    - service: broken\n",
+		"typo.yaml":                        "- hosts: web\n  services:\n    - service: typo\n",
+		"malformed.yaml":                   "- hosts: [web\n",
+		"unknown-key.yaml":                 "- hosts: web\n  services:\n    - service: check\n    - service: unknown\n",
+	})
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"no arguments", nil, tasks.ExitUsage},
+		{"unknown flag", []string{"-no-such-flag"}, tasks.ExitUsage},
+		{"flag needing another", []string{"-playbook", "partial.yaml", "-ok-on-unreachable"}, tasks.ExitUsage},
+		{"ssh-mux with a password file", []string{"-config", "config.yaml", "-ssh-mux", "-ssh-password-file", "pw", "-t", "true", "-g", "web"}, tasks.ExitUsage},
+		{"ssh-mux with a config password", []string{"-config", "password.yaml", "-ssh-mux", "-t", "true", "-g", "web"}, tasks.ExitConfig},
+		{"changed-when with a playbook", []string{"-config", "config.yaml", "-playbook", "partial.yaml", "-changed-when", "true"}, tasks.ExitUsage},
+		{"failed-when with local", []string{"-local", "-t", "true", "-g", "web", "-failed-when", "true"}, tasks.ExitUsage},
+		{"invalid config", []string{"-config", "bad-config.yaml", "-t", "true", "-g", "web"}, tasks.ExitConfig},
+		{"missing inventory", []string{"-config", "missing-inventory.yaml", "-t", "true", "-g", "web"}, tasks.ExitConfig},
+		{"malformed playbook", []string{"-config", "config.yaml", "-playbook", "malformed.yaml"}, tasks.ExitSyntax},
+		{"service that does not load", []string{"-config", "config.yaml", "-playbook", "unknown-key.yaml"}, tasks.ExitSyntax},
+		{"local service that does not load", []string{"-config", "config.yaml", "-local", "-playbook", "unknown-key.yaml"}, tasks.ExitSyntax},
+		{"syntax check error", []string{"-config", "config.yaml", "-playbook", "typo.yaml", "-syntax-check"}, tasks.ExitSyntax},
+		{"success", []string{"-config", "config.yaml", "-t", "true", "-g", "web"}, tasks.ExitOK},
+		{"partial failure", []string{"-config", "config.yaml", "-playbook", "partial.yaml"}, tasks.ExitFailed},
+		{"partial ad hoc failure", []string{"-config", "config.yaml", "-t", "@cmds", "-g", "web"}, tasks.ExitFailed},
+		{"every host failed", []string{"-config", "config.yaml", "-playbook", "all-failed.yaml"}, tasks.ExitAllFailed},
+		{"unreachable", []string{"-config", "config.yaml", "-playbook", "down.yaml", "-ignore-unreachable"}, tasks.ExitUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runFor(t, dir, tt.args...); got != tt.want {
+				t.Errorf("expected exit code %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestOutputFile_RecordsRunID(t *testing.T) {
+	dir := t.TempDir()
+	if code := runFor(t, dir, "-local", "-t", "true", "-output-file", "run.log"); code != tasks.ExitOK {
+		t.Fatalf("expected exit 0, got %d", code)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "run.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "Run ID: ") {
+		t.Errorf("expected the transcript to start with the run ID, got:\n%s", data)
+	}
+}
+
+func TestHostOptions(t *testing.T) {
+	cfg := &config.Config{SSHUser: "deploy", Forks: 5, FactTimeout: time.Minute, Become: true, BecomeMethod: tasks.BecomeDoas}
+	opts := hostOptions(cfg, hostFlags{forks: 20, sshMux: true, connectRate: 4, limit: []string{"w1"}})
+	if opts.SSHUser != "deploy" || opts.Forks != 20 || opts.FactTimeout != time.Minute {
+		t.Errorf("expected the config's settings with -forks overriding, got %+v", opts)
+	}
+	if !opts.SSHMux || opts.ConnectRate != 4 || len(opts.Limit) != 1 {
+		t.Errorf("expected the connection flags, got %+v", opts)
+	}
+	if !opts.Become || opts.BecomeMethod != tasks.BecomeDoas {
+		t.Errorf("expected the config's become settings, got %+v", opts)
+	}
+
+	opts = hostOptions(&config.Config{Forks: 5}, hostFlags{factTimeout: time.Second, become: true})
+	if opts.Forks != 5 || opts.FactTimeout != time.Second || !opts.Become {
+		t.Errorf("expected config forks, -fact-timeout and -become, got %+v", opts)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"for/pkg/inventory"
+	"for/pkg/logger"
+	"for/pkg/printer"
+	"for/pkg/tasks"
+	"for/pkg/utils"
+	"for/pkg/vault"
+)
+
+// runPingCommand implements "for ping -g <group>": it runs a ping task on
+// every host of the group and prints which answered, which were
+// unreachable and which failed the check, with timings. Nothing on the
+// hosts is changed. It returns 0 only when every host answered.
+func runPingCommand(args []string) int {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to the configuration file (default: $FOR_CONFIG, ./for.yaml, ./config.yaml, ~/.config/for/config.yaml)")
+	group := fs.String("g", "", "Group to check")
+	inventoryScript := fs.String("inventory-script", "", "Path to executable that returns JSON inventory")
+	limitArg := fs.String("limit", "", "Comma-separated hosts to check, or @file (e.g. @playbook.retry)")
+	forks := fs.Int("forks", 0, "Parallel host connections (0 = use config default)")
+	connectRate := fs.Int("connect-rate", 0, "Start at most this many new SSH connections per second (0 = no limit)")
+	noColor := fs.Bool("no-color", false, "Disable ANSI colours")
+	noStrict := fs.Bool("no-strict", false, "Ignore unknown keys in the config file")
+	strictInventory := fs.Bool("strict-inventory", false, "Fail on INI inventory lines that cannot be parsed")
+	vaultPasswordFile := fs.String("vault-password-file", "", "Path to file containing vault decryption password")
+	sshPasswordFile := fs.String("ssh-password-file", "", "Path to file containing the SSH password (may be vault-encrypted)")
+	askPass := fs.Bool("ask-pass", false, "Prompt once for the SSH password (overrides -ssh-password-file)")
+	sshMux := fs.Bool("ssh-mux", false, "Run SSH through the system ssh client with ControlMaster multiplexing, reusing connections across runs")
+	connectionDebug := fs.Bool("connection-debug", false, "Log each SSH connection's dial target, auth attempts, negotiated algorithms and failure stage to stderr")
+	fs.Parse(args)
+	utils.StrictYAML = !*noStrict
+	inventory.StrictINI = *strictInventory
+	if *connectionDebug {
+		logger.Console = os.Stderr
+		if _, err := logger.Init(""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error initialising logger: %v\n", err)
+			return 1
+		}
+	}
+	if *noColor {
+		printer.ColorsEnabled = false
+	}
+
+	if *group == "" {
+		fs.Usage()
+		return 1
+	}
+	if *sshMux && (*sshPasswordFile != "" || *askPass) {
+		fmt.Fprintln(os.Stderr, "Error: --ssh-mux cannot pass an SSH password to ssh; authenticate with a key or the agent instead of -ssh-password-file or -ask-pass")
+		return 1
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	if !tasks.ValidBecomeMethod(cfg.BecomeMethod) {
+		fmt.Fprintf(os.Stderr, "Error loading config: unknown become_method %q (want %q or %q)\n", cfg.BecomeMethod, tasks.BecomeSudo, tasks.BecomeDoas)
+		return 1
+	}
+	if *sshMux && cfg.SSHPassword != "" {
+		fmt.Fprintln(os.Stderr, "Error loading config: --ssh-mux cannot pass ssh_password to ssh; authenticate with a key or the agent")
+		return 1
+	}
+	vaultPass := cfg.VaultPasswordFile
+	if *vaultPasswordFile != "" {
+		vaultPass = *vaultPasswordFile
+	}
+	var password string
+	if vaultPass != "" {
+		if password, err = vault.LoadPassword(vaultPass); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading vault password: %v\n", err)
+			return 1
+		}
+		inventory.VaultPassword = password
+		if _, err := decryptConfig(cfg, password); err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			return 1
+		}
+	}
+	if *sshPasswordFile != "" {
+		if cfg.SSHPassword, err = readSecretFile(*sshPasswordFile, password); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading SSH password: %v\n", err)
+			return 1
+		}
+	}
+	if *askPass {
+		if cfg.SSHPassword, err = askSecret("ask-pass", "SSH password: "); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	inv, err := loadInventory(cfg, *inventoryScript)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading inventory: %v\n", err)
+		return 1
+	}
+	limit, err := inventory.ParseLimit(*limitArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing limit: %v\n", err)
+		return 1
+	}
+	opts := hostOptions(cfg, hostFlags{
+		forks:           *forks,
+		connectionDebug: *connectionDebug,
+		sshMux:          *sshMux,
+		connectRate:     *connectRate,
+		limit:           limit,
+	})
+	results, err := tasks.PingHosts(inv, *group, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	printer.PingReport(results)
+	for _, r := range results {
+		if r.Err != nil {
+			return 1
+		}
+	}
+	return 0
+}
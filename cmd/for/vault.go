@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"for/pkg/vault"
+	"golang.org/x/term"
+)
+
+// runVaultCommand implements "for vault view <file>", printing the plaintext
+// of a whole-file-encrypted file to stdout without writing it anywhere, and
+// "for vault edit <file>", editing it in $EDITOR (default vi) and encrypting
+// the result back.
+func runVaultCommand(args []string) int {
+	fs := flag.NewFlagSet("vault", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to the configuration file (default: $FOR_CONFIG, ./for.yaml, ./config.yaml, ~/.config/for/config.yaml)")
+	vaultPasswordFile := fs.String("vault-password-file", "", "Path to file containing vault decryption password (prompted for on a terminal when unset)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: for vault view|edit [flags] <file>")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || (args[0] != "view" && args[0] != "edit") {
+		fs.Usage()
+		return 1
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+
+	password, err := vaultPassword(*vaultPasswordFile, *configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if args[0] == "edit" {
+		editor := os.Getenv("EDITOR")
+		if editor == "" {
+			editor = "vi"
+		}
+		err = vault.Edit(fs.Arg(0), password, editor)
+	} else {
+		err = vault.View(os.Stdout, fs.Arg(0), password)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// vaultPassword loads the vault password from file, else from the config's
+// vault_password_file, else prompts for it on the terminal.
+func vaultPassword(file, configFile string) (string, error) {
+	if file == "" {
+		if cfg, err := loadConfig(configFile); err == nil {
+			file = cfg.VaultPasswordFile
+		}
+	}
+	if file != "" {
+		return vault.LoadPassword(file)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("a vault password is required (--vault-password-file)")
+	}
+	fmt.Fprint(os.Stderr, "Vault password: ")
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("reading vault password: %w", err)
+	}
+	return string(b), nil
+}
@@ -1,11 +1,19 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"time"
 
+	"for/pkg/utils"
 	"gopkg.in/yaml.v3"
 )
 
+// ErrConfigInvalid marks config files that could be read but not parsed:
+// malformed YAML, a non-mapping document or, with utils.StrictYAML, unknown
+// keys. The *utils.YAMLError describing the problem stays in the chain.
+var ErrConfigInvalid = errors.New("invalid config")
+
 // Config holds the application configuration loaded from config.yaml.
 type Config struct {
 	InventoryFile string `yaml:"inventory_file"`
@@ -16,8 +24,17 @@ type Config struct {
 	SSHPort        int    `yaml:"ssh_port"`
 	// JumpHost is an optional bastion/jump host (host:port).
 	JumpHost       string `yaml:"jump_host"`
-	// KnownHostsFile for SSH host key verification. Defaults to insecure if unset.
+	// KnownHostsFile for SSH host key verification. Defaults to ~/.ssh/known_hosts.
 	KnownHostsFile string `yaml:"known_hosts_file"`
+	// HostKeyChecking is "strict" (default), "ask" to prompt for unknown host
+	// keys, or "insecure" to skip host key checks.
+	HostKeyChecking string `yaml:"host_key_checking"`
+	// SSHCiphers, SSHKeyExchanges and SSHMACs restrict the SSH algorithms
+	// offered, in order of preference. Unset means every algorithm of the
+	// kind that is not considered insecure.
+	SSHCiphers      []string `yaml:"ssh_ciphers"`
+	SSHKeyExchanges []string `yaml:"ssh_key_exchanges"`
+	SSHMACs         []string `yaml:"ssh_macs"`
 	// ServicesPath is the base directory for service task files. Defaults to "services".
 	ServicesPath string `yaml:"services_path"`
 	RunLocally   bool   `yaml:"run_locally"`
@@ -29,19 +46,61 @@ type Config struct {
 	VaultPasswordFile string `yaml:"vault_password_file"`
 	// GatherFacts controls whether remote host facts are collected before running tasks.
 	GatherFacts bool `yaml:"gather_facts"`
+	// InventorySources are further inventory locations (paths or URIs),
+	// loaded concurrently with inventory_file and merged after it.
+	InventorySources []string `yaml:"inventory_sources"`
+	// InventoryFailFast aborts when any inventory source fails instead of
+	// warning and continuing with the sources that loaded.
+	InventoryFailFast bool `yaml:"inventory_fail_fast"`
 	// InventoryScript is the path to an executable that returns a dynamic JSON inventory.
 	InventoryScript string `yaml:"inventory_script"`
+	// WinRM credentials and transport for hosts using connection: winrm.
+	// WinRMPassword may be vault-encrypted.
+	WinRMUser     string `yaml:"winrm_user"`
+	WinRMPassword string `yaml:"winrm_password"`
+	WinRMPort     int    `yaml:"winrm_port"`
+	WinRMHTTPS    bool   `yaml:"winrm_https"`
+	WinRMInsecure bool   `yaml:"winrm_insecure"`
+	// WinRMShell is "powershell" (default) or "cmd".
+	WinRMShell string `yaml:"winrm_shell"`
+	// Become, BecomeUser and BecomeMethod are the become defaults for every
+	// task; plays and tasks that set their own override them. BecomeMethod
+	// is "sudo" (default) or "doas".
+	Become       bool   `yaml:"become"`
+	BecomeUser   string `yaml:"become_user"`
+	BecomeMethod string `yaml:"become_method"`
+	// RemoteTmp is the directory on SSH hosts under which scripts and copied
+	// files are staged. Defaults to /tmp.
+	RemoteTmp string `yaml:"remote_tmp"`
+	// PreRunHook and PostRunHook are local shell commands run before and
+	// after each playbook or ad hoc run; a failing pre-run hook aborts it.
+	PreRunHook  string `yaml:"pre_run_hook"`
+	PostRunHook string `yaml:"post_run_hook"`
+	// FactTimeout caps how long fact gathering waits for each host, e.g.
+	// "30s"; see tasks.RunOptions.FactTimeout.
+	FactTimeout time.Duration `yaml:"fact_timeout"`
 }
 
+// LoadConfig reads file and applies defaults. Unknown keys are rejected
+// unless utils.StrictYAML is disabled. Parse errors match ErrConfigInvalid;
+// read errors are returned as is.
 func LoadConfig(file string) (*Config, error) {
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 
+	root, err := utils.ParseYAML(file, data)
+	if err != nil {
+		return nil, utils.Mark(err, ErrConfigInvalid)
+	}
+	if root != nil && root.Kind != yaml.MappingNode {
+		return nil, utils.Mark(utils.NodeError(file, root, "config must be a mapping of settings, got %s", utils.NodeKind(root)), ErrConfigInvalid)
+	}
+
 	var cfg Config
-	if err = yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	if err = utils.DecodeYAML(file, data, &cfg); err != nil {
+		return nil, utils.Mark(err, ErrConfigInvalid)
 	}
 
 	if cfg.SSHPort == 0 {
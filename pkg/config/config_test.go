@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"for/pkg/utils"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig_Valid(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, "inventory_file: hosts.ini\nssh_user: root\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SSHUser != "root" || cfg.InventoryFile != "hosts.ini" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if cfg.SSHPort != 22 || cfg.Forks != 5 || cfg.ServicesPath != "services" {
+		t.Errorf("expected defaults to be applied, got %+v", cfg)
+	}
+}
+
+func TestLoadConfig_BecomeDefaults(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, "become: true\nbecome_user: deploy\nbecome_method: doas\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Become || cfg.BecomeUser != "deploy" || cfg.BecomeMethod != "doas" {
+		t.Errorf("unexpected become settings %+v", cfg)
+	}
+}
+
+func TestLoadConfig_UnknownKey(t *testing.T) {
+	path := writeConfig(t, "inventory_file: hosts.ini\nssh_usr: root\n")
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("expected unknown key to be rejected")
+	}
+	for _, want := range []string{path + ":2:", "ssh_usr"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_NoStrict(t *testing.T) {
+	utils.StrictYAML = false
+	defer func() { utils.StrictYAML = true }()
+
+	cfg, err := LoadConfig(writeConfig(t, "ssh_user: deploy\nfuture_option: true\n"))
+	if err != nil {
+		t.Fatalf("expected unknown key to be ignored, got %v", err)
+	}
+	if cfg.SSHUser != "deploy" {
+		t.Errorf("expected ssh_user to be parsed, got %q", cfg.SSHUser)
+	}
+}
+
+func TestLoadConfig_Malformed(t *testing.T) {
+	cases := map[string]string{
+		"ssh_user: root\n\tforks: 1\n":  ":2: found a tab character",
+		"- ssh_user: root\n":            ":1:1: config must be a mapping of settings, got a list",
+		"ssh_user: root\nforks: many\n": ":2: cannot unmarshal a string `many` into int",
+	}
+	for content, want := range cases {
+		path := writeConfig(t, content)
+		_, err := LoadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), path+want) {
+			t.Errorf("%q: expected error containing %q, got %v", content, path+want, err)
+		}
+	}
+}
+
+func TestLoadConfig_ErrorKinds(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, "ssh_user: root\nforks: many\n"))
+	var yamlErr *utils.YAMLError
+	if !errors.Is(err, ErrConfigInvalid) || !errors.As(err, &yamlErr) || yamlErr.Line != 2 {
+		t.Errorf("expected an ErrConfigInvalid carrying the YAMLError, got %v", err)
+	}
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if !errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("expected a missing file not to be an invalid config, got %v", err)
+	}
+}
+
+func TestLoadConfig_FactTimeout(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, "fact_timeout: 45s\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.FactTimeout != 45*time.Second {
+		t.Errorf("expected a 45s fact timeout, got %v", cfg.FactTimeout)
+	}
+	if _, err := LoadConfig(writeConfig(t, "fact_timeout: soon\n")); !errors.Is(err, ErrConfigInvalid) {
+		t.Errorf("expected an invalid duration to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// EnvConfig names the environment variable that points at a config file
+// when -config is not given.
+const EnvConfig = "FOR_CONFIG"
+
+// ConfigNames are the config file names looked for in the working
+// directory, in order.
+var ConfigNames = []string{"for.yaml", "config.yaml"}
+
+// InventoryNames are the inventory file names looked for in the working
+// directory, in order, when inventory_file is unset.
+var InventoryNames = []string{"inventory", "hosts"}
+
+// FindConfig returns the config file to use when none was given on the
+// command line: $FOR_CONFIG if set (whether or not it exists, so a typo is
+// reported), then ConfigNames in dir, then $HOME/.config/for/config.yaml.
+// It returns "" when nothing is found.
+func FindConfig(dir string) string {
+	if p := os.Getenv(EnvConfig); p != "" {
+		return p
+	}
+	var candidates []string
+	for _, name := range ConfigNames {
+		candidates = append(candidates, filepath.Join(dir, name))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".config", "for", "config.yaml"))
+	}
+	return firstFile(candidates)
+}
+
+// FindInventory returns the first of InventoryNames that is a file in dir,
+// or "" when there is none.
+func FindInventory(dir string) string {
+	var candidates []string
+	for _, name := range InventoryNames {
+		candidates = append(candidates, filepath.Join(dir, name))
+	}
+	return firstFile(candidates)
+}
+
+func firstFile(paths []string) string {
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindConfig_Order(t *testing.T) {
+	dir := t.TempDir()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(EnvConfig, "")
+
+	if got := FindConfig(dir); got != "" {
+		t.Errorf("expected no config, got %q", got)
+	}
+
+	homeCfg := filepath.Join(home, ".config", "for", "config.yaml")
+	touch(t, homeCfg)
+	if got := FindConfig(dir); got != homeCfg {
+		t.Errorf("expected %q, got %q", homeCfg, got)
+	}
+
+	touch(t, filepath.Join(dir, "config.yaml"))
+	if got := FindConfig(dir); got != filepath.Join(dir, "config.yaml") {
+		t.Errorf("expected the working directory's config.yaml, got %q", got)
+	}
+
+	touch(t, filepath.Join(dir, "for.yaml"))
+	if got := FindConfig(dir); got != filepath.Join(dir, "for.yaml") {
+		t.Errorf("expected for.yaml to win over config.yaml, got %q", got)
+	}
+
+	t.Setenv(EnvConfig, "/etc/for/missing.yaml")
+	if got := FindConfig(dir); got != "/etc/for/missing.yaml" {
+		t.Errorf("expected $%s to win even when missing, got %q", EnvConfig, got)
+	}
+}
+
+func TestFindInventory_Order(t *testing.T) {
+	dir := t.TempDir()
+	if got := FindInventory(dir); got != "" {
+		t.Errorf("expected no inventory, got %q", got)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "inventory"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, filepath.Join(dir, "hosts"))
+	if got := FindInventory(dir); got != filepath.Join(dir, "hosts") {
+		t.Errorf("expected a directory named inventory to be skipped, got %q", got)
+	}
+
+	dir = t.TempDir()
+	touch(t, filepath.Join(dir, "hosts"))
+	touch(t, filepath.Join(dir, "inventory"))
+	if got := FindInventory(dir); got != filepath.Join(dir, "inventory") {
+		t.Errorf("expected inventory to win over hosts, got %q", got)
+	}
+}
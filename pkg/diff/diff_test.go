@@ -0,0 +1,41 @@
+package diff
+
+import "testing"
+
+func TestUnified_Identical(t *testing.T) {
+	if got := Unified("a\nb\n", "a\nb\n", "a", "b"); got != "" {
+		t.Errorf("expected empty diff, got %q", got)
+	}
+}
+
+func TestUnified_SingleChange(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n"
+	want := "--- before\n+++ after\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"
+	if got := Unified(a, b, "before", "after"); got != want {
+		t.Errorf("unexpected diff:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnified_SeparateHunks(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	b := "A\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nL\n"
+	want := "--- x\n+++ y\n@@ -1,4 +1,4 @@\n-a\n+A\n b\n c\n d\n@@ -9,4 +9,4 @@\n i\n j\n k\n-l\n+L\n"
+	if got := Unified(a, b, "x", "y"); got != want {
+		t.Errorf("unexpected diff:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnified_NewFile(t *testing.T) {
+	want := "--- x\n+++ y\n@@ -0,0 +1,2 @@\n+one\n+two\n"
+	if got := Unified("", "one\ntwo\n", "x", "y"); got != want {
+		t.Errorf("unexpected diff:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStat(t *testing.T) {
+	added, removed := Stat("a\nb\nc\n", "a\nB\nc\nd\n")
+	if added != 2 || removed != 1 {
+		t.Errorf("expected +2 -1, got +%d -%d", added, removed)
+	}
+}
@@ -3,17 +3,121 @@
 package facts
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"os/exec"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"for/pkg/inventory"
 	"for/pkg/ssh"
+	"for/pkg/utils"
 )
 
 // Facts is a map from fact name to value, directly usable as template data.
 type Facts map[string]interface{}
 
+// Runner executes a shell command on a target and returns its combined output.
+type Runner func(command string) (string, error)
+
+// StreamRunner is a Runner that also writes the output to w as it arrives.
+type StreamRunner func(command string, w io.Writer) (string, error)
+
+// remoteFact pairs a fact name with the shell command that produces it and
+// the subset it belongs to.
+type remoteFact struct {
+	key    string
+	cmd    string
+	subset string
+}
+
+// numericFacts are parsed as ints so templates can compare them as numbers,
+// e.g. {{ if ge .cpu_count 4 }}.
+var numericFacts = map[string]bool{"cpu_count": true, "total_memory": true}
+
+// remoteFacts lists the facts collected from remote hosts, in output order.
+var remoteFacts = []remoteFact{
+	{"os", "uname -s | tr '[:upper:]' '[:lower:]'", SubsetMin},
+	{"arch", "uname -m", SubsetMin},
+	{"kernel", "uname -r", SubsetPlatform},
+	{"hostname", "hostname 2>/dev/null || echo \"$FOR_HOST\"", SubsetMin},
+	{"fqdn", "hostname -f 2>/dev/null || hostname 2>/dev/null || echo \"$FOR_HOST\"", SubsetNetwork},
+	{"distro", "grep ^ID= /etc/os-release 2>/dev/null | cut -d= -f2 | tr -d '\"' || echo unknown", SubsetDistribution},
+	{"distro_version", "grep ^VERSION_ID= /etc/os-release 2>/dev/null | cut -d= -f2 | tr -d '\"' || echo unknown", SubsetDistribution},
+	{"cpu_count", "nproc 2>/dev/null || sysctl -n hw.ncpu 2>/dev/null || echo 1", SubsetHardware},
+	{"total_memory", "free -m 2>/dev/null | awk '/^Mem:/{print $2}' || echo unknown", SubsetHardware},
+}
+
+// Fact subsets, named by gather_subset to gather only some facts.
+const (
+	// SubsetAll is every fact.
+	SubsetAll = "all"
+	// SubsetMin is os, arch and hostname; it is gathered unless excluded
+	// with "!min".
+	SubsetMin          = "min"
+	SubsetPlatform     = "platform"
+	SubsetNetwork      = "network"
+	SubsetDistribution = "distribution"
+	SubsetHardware     = "hardware"
+)
+
+// Subsets lists the subset names Select accepts.
+var Subsets = []string{SubsetAll, SubsetMin, SubsetPlatform, SubsetNetwork, SubsetDistribution, SubsetHardware}
+
+// Select returns the facts a gather_subset list selects, as a set of fact
+// names. Entries name subsets to gather, or, prefixed with "!", subsets to
+// leave out; a list of exclusions only starts from every fact, so
+// ["!hardware"] gathers all but the hardware facts. The min subset is always
+// gathered unless the list excludes it. An empty list selects every fact,
+// returned as a nil set.
+func Select(subset []string) (map[string]bool, error) {
+	if len(subset) == 0 {
+		return nil, nil
+	}
+	include := map[string]bool{}
+	exclude := map[string]bool{}
+	for _, entry := range subset {
+		name, excluded := strings.CutPrefix(strings.TrimSpace(entry), "!")
+		if !slices.Contains(Subsets, name) {
+			return nil, fmt.Errorf("unknown fact subset %q (want one of %s)", entry, strings.Join(Subsets, ", "))
+		}
+		if excluded {
+			exclude[name] = true
+		} else {
+			include[name] = true
+		}
+	}
+	if len(include) == 0 {
+		include[SubsetAll] = true
+	}
+	if !exclude[SubsetMin] {
+		include[SubsetMin] = true
+	}
+	all := include[SubsetAll] && !exclude[SubsetAll]
+	selected := map[string]bool{}
+	for _, rf := range remoteFacts {
+		if (all || include[rf.subset]) && !exclude[rf.subset] {
+			selected[rf.key] = true
+		}
+	}
+	return selected, nil
+}
+
+// Names returns the name of every fact that may be gathered, for checking
+// template references before a run.
+func Names() []string {
+	names := []string{"inventory_hostname"}
+	for _, rf := range remoteFacts {
+		names = append(names, rf.key)
+	}
+	return names
+}
+
 // GatherLocal collects facts from the local machine.
 func GatherLocal() Facts {
 	f := Facts{
@@ -33,28 +137,148 @@ func GatherLocal() Facts {
 	return f
 }
 
-// GatherRemote collects facts from a remote host via SSH.
-// Facts that cannot be collected are silently omitted.
+// GatherRemote collects facts from a remote host via SSH using a single
+// connection. Facts that cannot be collected are silently omitted.
 func GatherRemote(host inventory.Host, cfg ssh.Config) Facts {
+	return Gather(host.Address, func(command string) (string, error) {
+		return ssh.RunCommandOutput(host.Address, command, cfg)
+	})
+}
+
+// Gather collects facts by running one batched script through run. Each fact
+// is emitted as a key=value line only when its command succeeds, so facts that
+// cannot be collected are silently omitted.
+func Gather(hostname string, run Runner) Facts {
+	return GatherSelected(hostname, nil, run)
+}
+
+// GatherSelected is Gather limited to the facts in selected, as returned
+// by Select; the batched script runs only their commands. A nil selected
+// gathers every fact.
+func GatherSelected(hostname string, selected map[string]bool, run Runner) Facts {
 	f := Facts{
-		"inventory_hostname": host.Address,
+		"inventory_hostname": hostname,
 	}
+	// The script may exit non-zero when its last fact fails; whatever
+	// lines were printed are still valid.
+	out, _ := run(batchScript(hostname, selected))
+	for k, v := range parseFacts(out) {
+		f[k] = v
+	}
+	return f
+}
+
+// GatherWithin is GatherSelected giving up on run once ctx is done, e.g. at
+// a fact timeout. It then returns the facts from the complete lines run has
+// written to w so far, possibly none, and false. run should stop when ctx is
+// done, e.g. by closing its session, so nothing is left running on the host.
+func GatherWithin(ctx context.Context, hostname string, selected map[string]bool, run StreamRunner) (Facts, bool) {
+	var partial lockedBuffer
+	done := make(chan Facts, 1)
+	go func() {
+		done <- GatherSelected(hostname, selected, func(command string) (string, error) {
+			return run(command, &partial)
+		})
+	}()
+	select {
+	case f := <-done:
+		return f, true
+	case <-ctx.Done():
+	}
+	out := partial.String()
+	f := parseFacts(out[:strings.LastIndex(out, "\n")+1])
+	f["inventory_hostname"] = hostname
+	return f, false
+}
+
+// lockedBuffer is a bytes.Buffer safe for one writer and concurrent readers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// GatherAll runs gather for every host concurrently, with at most workers
+// gatherers in flight, and returns the facts keyed by host address.
+func GatherAll(hosts []inventory.Host, workers int, gather func(inventory.Host) Facts) map[string]Facts {
+	if workers <= 0 {
+		workers = 1
+	}
+	out := make(map[string]Facts, len(hosts))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+
+	for _, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(h inventory.Host) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f := gather(h)
+			mu.Lock()
+			out[h.Address] = f
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return out
+}
 
-	cmds := map[string]string{
-		"os":             "uname -s | tr '[:upper:]' '[:lower:]'",
-		"arch":           "uname -m",
-		"kernel":         "uname -r",
-		"hostname":       "hostname 2>/dev/null || echo " + host.Address,
-		"fqdn":           "hostname -f 2>/dev/null || hostname 2>/dev/null || echo " + host.Address,
-		"distro":         "grep ^ID= /etc/os-release 2>/dev/null | cut -d= -f2 | tr -d '\"' || echo unknown",
-		"distro_version": "grep ^VERSION_ID= /etc/os-release 2>/dev/null | cut -d= -f2 | tr -d '\"' || echo unknown",
-		"cpu_count":      "nproc 2>/dev/null || sysctl -n hw.ncpu 2>/dev/null || echo 1",
-		"total_memory":   "free -m 2>/dev/null | awk '/^Mem:/{print $2}' || echo unknown",
+// Keep removes from f the facts not in selected, keeping
+// inventory_hostname. A nil selected keeps every fact.
+func (f Facts) Keep(selected map[string]bool) {
+	if selected == nil {
+		return
 	}
+	for k := range f {
+		if k != "inventory_hostname" && !selected[k] {
+			delete(f, k)
+		}
+	}
+}
 
-	for key, cmd := range cmds {
-		if out, err := ssh.RunCommandOutput(host.Address, cmd, cfg); err == nil {
-			f[key] = strings.TrimSpace(out)
+// batchScript builds a single shell script printing one key=value line per
+// fact in selected, or per fact when selected is nil.
+func batchScript(hostname string, selected map[string]bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "FOR_HOST=%s\n", utils.ShellQuote(hostname))
+	for _, rf := range remoteFacts {
+		if selected != nil && !selected[rf.key] {
+			continue
+		}
+		fmt.Fprintf(&b, "v=$(%s) && printf '%%s=%%s\\n' %s \"$v\"\n", rf.cmd, utils.ShellQuote(rf.key))
+	}
+	return b.String()
+}
+
+// parseFacts parses key=value lines, ignoring malformed lines and empty
+// values. numericFacts become ints when they parse as one.
+func parseFacts(out string) Facts {
+	f := Facts{}
+	for _, line := range strings.Split(out, "\n") {
+		key, val, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || key == "" {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		if val == "" {
+			continue
+		}
+		f[key] = val
+		if n, err := strconv.Atoi(val); err == nil && numericFacts[key] {
+			f[key] = n
 		}
 	}
 	return f
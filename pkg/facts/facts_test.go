@@ -0,0 +1,204 @@
+package facts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"for/pkg/inventory"
+)
+
+func TestParseFacts_CombinedOutput(t *testing.T) {
+	blob := "os=linux\narch=x86_64\nkernel=6.1.0-18-amd64\n" +
+		"hostname=web1\nfqdn=web1.example.com\ndistro=debian\n" +
+		"distro_version=12\ncpu_count=4\ntotal_memory=7951\n"
+
+	got := parseFacts(blob)
+	want := Facts{
+		"os": "linux", "arch": "x86_64", "kernel": "6.1.0-18-amd64",
+		"hostname": "web1", "fqdn": "web1.example.com", "distro": "debian",
+		"distro_version": "12", "cpu_count": 4, "total_memory": 7951,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d facts, got %d: %v", len(want), len(got), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("fact %s: expected %#v, got %#v", k, v, got[k])
+		}
+	}
+}
+
+func TestParseFacts_SkipsMalformedAndEmpty(t *testing.T) {
+	got := parseFacts("os=linux\ngarbage line\n=novalue\narch=\n\r\n")
+	if len(got) != 1 || got["os"] != "linux" {
+		t.Errorf("expected only os=linux, got %v", got)
+	}
+}
+
+func TestGather_SingleInvocation(t *testing.T) {
+	calls := 0
+	f := Gather("web1", func(command string) (string, error) {
+		calls++
+		out, err := exec.Command("sh", "-c", command).CombinedOutput()
+		return string(out), err
+	})
+	if calls != 1 {
+		t.Errorf("expected 1 remote invocation, got %d", calls)
+	}
+	if f["inventory_hostname"] != "web1" {
+		t.Errorf("expected inventory_hostname=web1, got %v", f["inventory_hostname"])
+	}
+	if f["kernel"] == nil || f["kernel"] == "" {
+		t.Errorf("expected kernel fact from batched script, got %v", f)
+	}
+}
+
+func TestGather_ConnectionFailureOmitsFacts(t *testing.T) {
+	f := Gather("web1", func(string) (string, error) {
+		return "", errors.New("dial tcp: connection refused")
+	})
+	if len(f) != 1 || f["inventory_hostname"] != "web1" {
+		t.Errorf("expected only inventory_hostname, got %v", f)
+	}
+}
+
+func TestGatherAll_BoundedConcurrency(t *testing.T) {
+	hosts := []inventory.Host{{Address: "a"}, {Address: "b"}, {Address: "c"}, {Address: "d"}}
+	var inFlight, peak int32
+	out := GatherAll(hosts, 2, func(h inventory.Host) Facts {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return Facts{"inventory_hostname": h.Address}
+	})
+	if len(out) != len(hosts) {
+		t.Fatalf("expected facts for %d hosts, got %d", len(hosts), len(out))
+	}
+	if peak > 2 {
+		t.Errorf("expected at most 2 concurrent gatherers, saw %d", peak)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		subset []string
+		want   []string
+	}{
+		{[]string{"min"}, []string{"os", "arch", "hostname"}},
+		{[]string{"network"}, []string{"os", "arch", "hostname", "fqdn"}},
+		{[]string{"hardware", "!min"}, []string{"cpu_count", "total_memory"}},
+		{[]string{"!hardware"}, []string{"os", "arch", "kernel", "hostname", "fqdn", "distro", "distro_version"}},
+		{[]string{"!all"}, []string{"os", "arch", "hostname"}},
+		{[]string{"all", "!distribution", "!platform"}, []string{"os", "arch", "hostname", "fqdn", "cpu_count", "total_memory"}},
+	}
+	for _, tt := range tests {
+		got, err := Select(tt.subset)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.subset, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: expected %v, got %v", tt.subset, tt.want, got)
+			continue
+		}
+		for _, name := range tt.want {
+			if !got[name] {
+				t.Errorf("%v: expected %s to be selected, got %v", tt.subset, name, got)
+			}
+		}
+	}
+}
+
+func TestSelect_AllByDefault(t *testing.T) {
+	got, err := Select(nil)
+	if err != nil || got != nil {
+		t.Errorf("expected every fact (nil set), got %v, %v", got, err)
+	}
+}
+
+func TestSelect_UnknownSubset(t *testing.T) {
+	if _, err := Select([]string{"!virtual"}); err == nil || !strings.Contains(err.Error(), `"!virtual"`) {
+		t.Errorf("expected an unknown subset error, got %v", err)
+	}
+}
+
+func TestGatherSelected_RunsOnlySubsetCommands(t *testing.T) {
+	selected, err := Select([]string{"min"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var script string
+	f := GatherSelected("web1", selected, func(command string) (string, error) {
+		script = command
+		return "os=linux\narch=x86_64\nhostname=web1\n", nil
+	})
+	for _, cmd := range []string{"uname -s", "uname -m", "hostname 2>/dev/null"} {
+		if !strings.Contains(script, cmd) {
+			t.Errorf("expected the script to run %q, got:\n%s", cmd, script)
+		}
+	}
+	for _, cmd := range []string{"uname -r", "hostname -f", "os-release", "nproc", "free -m"} {
+		if strings.Contains(script, cmd) {
+			t.Errorf("expected the script not to run %q, got:\n%s", cmd, script)
+		}
+	}
+	if len(f) != 4 || f["os"] != "linux" || f["inventory_hostname"] != "web1" {
+		t.Errorf("expected os, arch, hostname and inventory_hostname, got %v", f)
+	}
+}
+
+func TestFactsKeep(t *testing.T) {
+	f := Facts{"inventory_hostname": "w1", "os": "linux", "kernel": "6.1"}
+	f.Keep(map[string]bool{"os": true})
+	if len(f) != 2 || f["os"] != "linux" || f["inventory_hostname"] != "w1" {
+		t.Errorf("expected os and inventory_hostname, got %v", f)
+	}
+}
+
+func TestGatherWithin_TimeoutKeepsPartialFacts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stopped := make(chan struct{})
+	start := time.Now()
+	f, ok := GatherWithin(ctx, "web1", nil, func(command string, w io.Writer) (string, error) {
+		io.WriteString(w, "os=linux\narch=x8")
+		<-ctx.Done()
+		close(stopped)
+		return "os=linux\narch=x8", ctx.Err()
+	})
+	if ok {
+		t.Fatal("expected the gather to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to stop waiting after the timeout, took %s", elapsed)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("expected the command to be told to stop at the timeout")
+	}
+	// arch is cut off mid-line, so only os counts.
+	if len(f) != 2 || f["os"] != "linux" || f["inventory_hostname"] != "web1" {
+		t.Errorf("expected os and inventory_hostname only, got %v", f)
+	}
+}
+
+func TestGatherWithin_InTime(t *testing.T) {
+	f, ok := GatherWithin(context.Background(), "web1", nil, func(command string, w io.Writer) (string, error) {
+		return "os=linux\narch=x86_64\n", nil
+	})
+	if !ok || f["arch"] != "x86_64" {
+		t.Errorf("expected every fact in time, got %v, %v", f, ok)
+	}
+}
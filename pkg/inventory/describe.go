@@ -0,0 +1,87 @@
+package inventory
+
+import "sort"
+
+// HostInfo describes one host as --list-hosts reports it: the groups it is
+// listed under and its vars merged across them.
+type HostInfo struct {
+	Host   string                 `json:"host"`
+	Groups []string               `json:"groups"`
+	Vars   map[string]interface{} `json:"vars"`
+}
+
+// Describe returns a HostInfo for each of hosts, in order. Groups are
+// sorted by name and include parents of the host's groups. Vars merge the
+// vars of those groups, parents before children and otherwise by name, then
+// the host's own vars from every group listing it.
+func (inv *Inventory) Describe(hosts []Host) []HostInfo {
+	order := inv.groupOrder()
+	out := make([]HostInfo, 0, len(hosts))
+	for _, h := range hosts {
+		info := HostInfo{Host: h.Address, Groups: []string{}, Vars: make(map[string]interface{})}
+		var hostVars []map[string]interface{}
+		for _, group := range order {
+			for _, member := range inv.Hosts[group] {
+				if member.Address != h.Address {
+					continue
+				}
+				info.Groups = append(info.Groups, group)
+				for k, v := range inv.GroupVars[group] {
+					info.Vars[k] = v
+				}
+				hostVars = append(hostVars, member.Vars)
+				break
+			}
+		}
+		hostVars = append(hostVars, h.Vars)
+		for _, vars := range hostVars {
+			for k, v := range vars {
+				info.Vars[k] = v
+			}
+		}
+		sort.Strings(info.Groups)
+		out = append(out, info)
+	}
+	return out
+}
+
+// groupOrder lists inv's groups with every parent before its children
+// (see Children) and otherwise by name, the order their vars apply in.
+func (inv *Inventory) groupOrder() []string {
+	parents := make(map[string][]string)
+	for parent, children := range inv.Children {
+		for _, child := range children {
+			parents[child] = append(parents[child], parent)
+		}
+	}
+	depth := make(map[string]int)
+	var depthOf func(group string, visiting map[string]bool) int
+	depthOf = func(group string, visiting map[string]bool) int {
+		if d, ok := depth[group]; ok {
+			return d
+		}
+		if visiting[group] {
+			return 0
+		}
+		visiting[group] = true
+		d := 0
+		for _, p := range parents[group] {
+			d = max(d, depthOf(p, visiting)+1)
+		}
+		depth[group] = d
+		return d
+	}
+
+	groups := make([]string, 0, len(inv.Hosts))
+	for group := range inv.Hosts {
+		groups = append(groups, group)
+		depthOf(group, map[string]bool{})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if depth[groups[i]] != depth[groups[j]] {
+			return depth[groups[i]] < depth[groups[j]]
+		}
+		return groups[i] < groups[j]
+	})
+	return groups
+}
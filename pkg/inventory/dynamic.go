@@ -3,15 +3,27 @@ package inventory
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os/exec"
+
+	"for/pkg/utils"
 )
 
 // DynamicGroup is one entry in the JSON produced by a dynamic inventory script.
 type DynamicGroup struct {
-	Hosts []string          `json:"hosts"`
-	Vars  map[string]string `json:"vars"`
+	Hosts    []string               `json:"hosts,omitempty"`
+	Vars     map[string]interface{} `json:"vars,omitempty"`
+	Children []string               `json:"children,omitempty"`
+}
+
+// DynamicMeta is the optional "_meta" entry carrying per-host variables.
+type DynamicMeta struct {
+	HostVars map[string]map[string]interface{} `json:"hostvars"`
 }
 
+// metaKey is the reserved top-level key holding DynamicMeta.
+const metaKey = "_meta"
+
 // LoadDynamic executes a script and parses its stdout as a JSON inventory.
 //
 // Expected JSON format:
@@ -23,6 +35,12 @@ type DynamicGroup struct {
 //	  },
 //	  "dbservers": {
 //	    "hosts": ["192.168.1.20"]
+//	  },
+//	  "production": {
+//	    "children": ["webservers", "dbservers"]
+//	  },
+//	  "_meta": {
+//	    "hostvars": {"192.168.1.10": {"ssh_port": "2222"}}
 //	  }
 //	}
 func LoadDynamic(script string) (*Inventory, error) {
@@ -30,27 +48,97 @@ func LoadDynamic(script string) (*Inventory, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dynamic inventory script %q: %w", script, err)
 	}
+	return parseDynamic(out)
+}
 
-	var raw map[string]DynamicGroup
-	if err := json.Unmarshal(out, &raw); err != nil {
-		return nil, fmt.Errorf("parsing dynamic inventory JSON: %w", err)
+func parseDynamic(data []byte) (*Inventory, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, utils.Mark(fmt.Errorf("parsing dynamic inventory JSON: %w", err), ErrInventoryParse)
+	}
+
+	var meta DynamicMeta
+	if m, ok := raw[metaKey]; ok {
+		if err := json.Unmarshal(m, &meta); err != nil {
+			return nil, utils.Mark(fmt.Errorf("parsing dynamic inventory %s: %w", metaKey, err), ErrInventoryParse)
+		}
+		delete(raw, metaKey)
 	}
 
 	inv := &Inventory{
 		Hosts:     make(map[string][]Host),
-		GroupVars: make(map[string]map[string]string),
+		GroupVars: make(map[string]map[string]interface{}),
+		Children:  make(map[string][]string),
 	}
 
-	for group, data := range raw {
+	for group, msg := range raw {
+		var data DynamicGroup
+		if err := json.Unmarshal(msg, &data); err != nil {
+			return nil, utils.Mark(fmt.Errorf("parsing dynamic inventory group %q: %w", group, err), ErrInventoryParse)
+		}
 		for _, addr := range data.Hosts {
+			vars := make(map[string]interface{})
+			for k, v := range meta.HostVars[addr] {
+				vars[k] = jsonVar(v)
+			}
 			inv.Hosts[group] = append(inv.Hosts[group], Host{
 				Address: addr,
-				Vars:    make(map[string]string),
+				Vars:    vars,
 			})
 		}
 		if len(data.Vars) > 0 {
+			for k, v := range data.Vars {
+				data.Vars[k] = jsonVar(v)
+			}
 			inv.GroupVars[group] = data.Vars
 		}
+		if len(data.Children) > 0 {
+			inv.Children[group] = data.Children
+		}
 	}
+	inv.resolveChildren()
 	return inv, nil
 }
+
+// jsonVar converts a whole JSON number to an int, so a var like "port": 22
+// is an int as it would be from YAML.
+func jsonVar(v interface{}) interface{} {
+	if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int(f)
+	}
+	return v
+}
+
+// ExportDynamic renders inv in the dynamic inventory JSON format accepted by
+// LoadDynamic (and by Ansible), including "_meta.hostvars".
+func ExportDynamic(inv *Inventory) ([]byte, error) {
+	out := make(map[string]interface{})
+	meta := DynamicMeta{HostVars: make(map[string]map[string]interface{})}
+
+	groups := make(map[string]bool)
+	for g := range inv.Hosts {
+		groups[g] = true
+	}
+	for g := range inv.GroupVars {
+		groups[g] = true
+	}
+	for g := range inv.Children {
+		groups[g] = true
+	}
+
+	for g := range groups {
+		entry := DynamicGroup{
+			Vars:     inv.GroupVars[g],
+			Children: inv.Children[g],
+		}
+		for _, h := range inv.Hosts[g] {
+			entry.Hosts = append(entry.Hosts, h.Address)
+			if len(h.Vars) > 0 {
+				meta.HostVars[h.Address] = h.Vars
+			}
+		}
+		out[g] = entry
+	}
+	out[metaKey] = meta
+	return json.MarshalIndent(out, "", "  ")
+}
@@ -0,0 +1,160 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// EC2 host address types for EC2Source.AddressType.
+const (
+	EC2AddressPrivate = "private"
+	EC2AddressPublic  = "public"
+)
+
+// EC2Source lists running EC2 instances. Every instance is placed in the
+// "ec2" group and a group named after its region; when GroupTag is set it is
+// also placed in a group named after that tag's value. Instance tags are
+// exposed as ec2_tag_<Key> host vars.
+//
+// URI form: ec2://[region,...][?group_by=Role&address=private|public]
+// Without regions the region of the standard AWS configuration is used.
+// Credentials come from the standard AWS chain (env, shared config, IMDS).
+type EC2Source struct {
+	Regions     []string
+	GroupTag    string
+	AddressType string
+
+	// newClient builds the client for one region; overridden in tests.
+	newClient func(ctx context.Context, region string) (ec2.DescribeInstancesAPIClient, error)
+}
+
+func init() {
+	RegisterSource("ec2", newEC2Source)
+}
+
+func newEC2Source(uri string) (Source, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ec2 inventory URI: %w", err)
+	}
+	src := EC2Source{
+		GroupTag:    u.Query().Get("group_by"),
+		AddressType: u.Query().Get("address"),
+	}
+	for _, r := range strings.Split(u.Host, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			src.Regions = append(src.Regions, r)
+		}
+	}
+	switch src.AddressType {
+	case "":
+		src.AddressType = EC2AddressPrivate
+	case EC2AddressPrivate, EC2AddressPublic:
+	default:
+		return nil, fmt.Errorf("ec2 inventory: address must be %q or %q, got %q", EC2AddressPrivate, EC2AddressPublic, src.AddressType)
+	}
+	return src, nil
+}
+
+// defaultEC2Client builds an EC2 client from the standard AWS configuration.
+func defaultEC2Client(ctx context.Context, region string) (ec2.DescribeInstancesAPIClient, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ec2.NewFromConfig(cfg), nil
+}
+
+// Load implements Source.
+func (s EC2Source) Load() (*Inventory, error) {
+	ctx := context.Background()
+	newClient := s.newClient
+	if newClient == nil {
+		newClient = defaultEC2Client
+	}
+	regions := s.Regions
+	if len(regions) == 0 {
+		regions = []string{""}
+	}
+
+	inv := &Inventory{
+		Hosts:     make(map[string][]Host),
+		GroupVars: make(map[string]map[string]interface{}),
+		Children:  make(map[string][]string),
+	}
+	for _, region := range regions {
+		client, err := newClient(ctx, region)
+		if err != nil {
+			return nil, fmt.Errorf("ec2 inventory: configuring client for region %q: %w", region, err)
+		}
+		input := &ec2.DescribeInstancesInput{
+			Filters: []types.Filter{{Name: aws.String("instance-state-name"), Values: []string{"running"}}},
+		}
+		pages := ec2.NewDescribeInstancesPaginator(client, input)
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("ec2 inventory: describing instances in %q: %w", region, err)
+			}
+			for _, r := range page.Reservations {
+				for _, instance := range r.Instances {
+					s.addInstance(inv, region, instance)
+				}
+			}
+		}
+	}
+	for _, hosts := range inv.Hosts {
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].Address < hosts[j].Address })
+	}
+	return inv, nil
+}
+
+func (s EC2Source) addInstance(inv *Inventory, region string, instance types.Instance) {
+	address := aws.ToString(instance.PrivateIpAddress)
+	if s.AddressType == EC2AddressPublic {
+		address = aws.ToString(instance.PublicIpAddress)
+	}
+	if address == "" {
+		return
+	}
+	if region == "" && instance.Placement != nil {
+		// Availability zone minus its trailing letter, e.g. eu-west-1a -> eu-west-1.
+		if az := aws.ToString(instance.Placement.AvailabilityZone); az != "" {
+			region = az[:len(az)-1]
+		}
+	}
+
+	vars := map[string]interface{}{
+		"ec2_instance_id":   aws.ToString(instance.InstanceId),
+		"ec2_instance_type": string(instance.InstanceType),
+		"ec2_private_ip":    aws.ToString(instance.PrivateIpAddress),
+		"ec2_public_ip":     aws.ToString(instance.PublicIpAddress),
+		"ec2_region":        region,
+	}
+	groups := []string{"ec2"}
+	if region != "" {
+		groups = append(groups, region)
+	}
+	for _, tag := range instance.Tags {
+		key, value := aws.ToString(tag.Key), aws.ToString(tag.Value)
+		vars["ec2_tag_"+key] = value
+		if key == s.GroupTag && value != "" {
+			groups = append(groups, value)
+		}
+	}
+	for _, g := range groups {
+		inv.Hosts[g] = append(inv.Hosts[g], Host{Address: address, Vars: vars})
+	}
+}
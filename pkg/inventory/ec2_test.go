@@ -0,0 +1,138 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type fakeEC2 struct {
+	pages []*ec2.DescribeInstancesOutput
+	calls int
+}
+
+func (f *fakeEC2) DescribeInstances(_ context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	if len(in.Filters) != 1 || aws.ToString(in.Filters[0].Name) != "instance-state-name" {
+		return nil, errors.New("expected running-state filter")
+	}
+	page := f.pages[f.calls]
+	f.calls++
+	if f.calls < len(f.pages) {
+		page.NextToken = aws.String("next")
+	}
+	return page, nil
+}
+
+func instance(id, private, public string, tags map[string]string) types.Instance {
+	i := types.Instance{
+		InstanceId:       aws.String(id),
+		InstanceType:     types.InstanceTypeT3Micro,
+		PrivateIpAddress: aws.String(private),
+	}
+	if public != "" {
+		i.PublicIpAddress = aws.String(public)
+	}
+	for k, v := range tags {
+		i.Tags = append(i.Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return i
+}
+
+func ec2SourceWith(t *testing.T, uri string, clients map[string]*fakeEC2) EC2Source {
+	t.Helper()
+	src, err := NewSource(uri)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := src.(EC2Source)
+	s.newClient = func(_ context.Context, region string) (ec2.DescribeInstancesAPIClient, error) {
+		return clients[region], nil
+	}
+	return s
+}
+
+func TestEC2Source_GroupsByTagAndRegion(t *testing.T) {
+	clients := map[string]*fakeEC2{
+		"eu-west-1": {pages: []*ec2.DescribeInstancesOutput{
+			{Reservations: []types.Reservation{{Instances: []types.Instance{
+				instance("i-1", "10.0.0.1", "", map[string]string{"Role": "web", "Name": "web-1"}),
+			}}}},
+			{Reservations: []types.Reservation{{Instances: []types.Instance{
+				instance("i-2", "10.0.0.2", "", map[string]string{"Role": "db"}),
+			}}}},
+		}},
+		"us-east-1": {pages: []*ec2.DescribeInstancesOutput{
+			{Reservations: []types.Reservation{{Instances: []types.Instance{
+				instance("i-3", "10.1.0.1", "", map[string]string{"Role": "web"}),
+			}}}},
+		}},
+	}
+	inv, err := ec2SourceWith(t, "ec2://eu-west-1,us-east-1?group_by=Role", clients).Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if clients["eu-west-1"].calls != 2 {
+		t.Errorf("expected both pages to be fetched, got %d calls", clients["eu-west-1"].calls)
+	}
+
+	want := map[string][]string{
+		"ec2":       {"10.0.0.1", "10.0.0.2", "10.1.0.1"},
+		"web":       {"10.0.0.1", "10.1.0.1"},
+		"db":        {"10.0.0.2"},
+		"eu-west-1": {"10.0.0.1", "10.0.0.2"},
+		"us-east-1": {"10.1.0.1"},
+	}
+	for group, addrs := range want {
+		hosts := inv.Hosts[group]
+		if len(hosts) != len(addrs) {
+			t.Errorf("group %s: expected %v, got %+v", group, addrs, hosts)
+			continue
+		}
+		for i, a := range addrs {
+			if hosts[i].Address != a {
+				t.Errorf("group %s: expected %v, got %+v", group, addrs, hosts)
+			}
+		}
+	}
+}
+
+func TestEC2Source_HostVarsAndPublicAddress(t *testing.T) {
+	clients := map[string]*fakeEC2{
+		"eu-west-1": {pages: []*ec2.DescribeInstancesOutput{
+			{Reservations: []types.Reservation{{Instances: []types.Instance{
+				instance("i-1", "10.0.0.1", "203.0.113.7", map[string]string{"Name": "web-1", "Env": "prod"}),
+				instance("i-2", "10.0.0.2", "", nil), // no public IP – skipped
+			}}}},
+		}},
+	}
+	inv, err := ec2SourceWith(t, "ec2://eu-west-1?address=public", clients).Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hosts := inv.Hosts["ec2"]
+	if len(hosts) != 1 || hosts[0].Address != "203.0.113.7" {
+		t.Fatalf("expected only the public address, got %+v", hosts)
+	}
+	vars := hosts[0].Vars
+	for k, v := range map[string]string{
+		"ec2_instance_id": "i-1",
+		"ec2_private_ip":  "10.0.0.1",
+		"ec2_region":      "eu-west-1",
+		"ec2_tag_Name":    "web-1",
+		"ec2_tag_Env":     "prod",
+	} {
+		if vars[k] != v {
+			t.Errorf("expected %s=%s, got %q", k, v, vars[k])
+		}
+	}
+}
+
+func TestEC2Source_InvalidAddress(t *testing.T) {
+	if _, err := NewSource("ec2://eu-west-1?address=elastic"); err == nil {
+		t.Error("expected invalid address type to be rejected")
+	}
+}
@@ -2,81 +2,296 @@ package inventory
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"for/pkg/utils"
+	"for/pkg/vault"
 )
 
 // Host represents a single target host with optional per-host variables.
+// Vars keep the type they were loaded with: INI files give strings, while
+// YAML vars files and dynamic inventories also give numbers and booleans.
 type Host struct {
 	Address string
-	Vars    map[string]string
+	Vars    map[string]interface{}
+}
+
+// StringVar returns vars[name] as a string, formatting numbers and booleans
+// and giving "" for null, for settings that are strings whatever the type
+// of the var. ok is false when the var is not set.
+func StringVar(vars map[string]interface{}, name string) (s string, ok bool) {
+	v, ok := vars[name]
+	switch v := v.(type) {
+	case nil:
+		return "", ok
+	case string:
+		return v, true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// Var returns the host var name as a string (see StringVar).
+func (h Host) Var(name string) (string, bool) {
+	return StringVar(h.Vars, name)
+}
+
+// VarAnsibleHost is the host var naming the address to connect to when it
+// differs from the host's inventory name.
+const VarAnsibleHost = "ansible_host"
+
+// DialAddress returns the address connections should dial: ansible_host
+// when set, otherwise the inventory name. Output, results and templates
+// keep using Address.
+func (h Host) DialAddress() string {
+	if v, _ := h.Var(VarAnsibleHost); v != "" {
+		return v
+	}
+	return h.Address
 }
 
 // Inventory holds parsed host groups and group-level variables.
 type Inventory struct {
 	Hosts     map[string][]Host
-	GroupVars map[string]map[string]string
+	GroupVars map[string]map[string]interface{}
+	// Children maps a group to its child groups ([group:children] sections).
+	// Hosts of child groups are also listed under the parent in Hosts.
+	Children map[string][]string
+}
+
+// ErrInventoryParse marks inventory content that could be read but not
+// parsed: malformed dynamic inventory JSON, group_vars/host_vars files that
+// are not mappings of scalars, or INI lines the scanner cannot read.
+var ErrInventoryParse = errors.New("inventory parse error")
+
+// StrictINI makes INI inventories fail on lines they cannot parse instead
+// of skipping them with a warning. It is set from --strict-inventory.
+var StrictINI bool
+
+// Warnings receives the warnings for INI lines that were skipped or look
+// suspicious.
+var Warnings io.Writer = os.Stderr
+
+// VaultPassword decrypts inventory files whose whole content is
+// vault-encrypted. It is set from --vault-password-file.
+var VaultPassword string
+
+// loadINI parses a static INI inventory file, decrypting it first when the
+// whole file is vault-encrypted, then merges the group_vars/ and host_vars/
+// directories next to it (see loadVarsDirs).
+func loadINI(file string) (*Inventory, error) {
+	data, err := readInventoryFile(file)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := parseINI(file, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadVarsDirs(inv, filepath.Dir(file)); err != nil {
+		return nil, err
+	}
+	return inv, nil
 }
 
-func LoadInventory(file string) (*Inventory, error) {
-	f, err := os.Open(file)
+// readInventoryFile reads file, decrypting it when its whole content is
+// vault-encrypted.
+func readInventoryFile(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	if content := strings.TrimSpace(string(data)); vault.IsEncrypted(content) {
+		if VaultPassword == "" {
+			return nil, fmt.Errorf("inventory %s is vault-encrypted: a vault password is required (--vault-password-file)", file)
+		}
+		plain, err := vault.Decrypt(content, VaultPassword)
+		if err != nil {
+			return nil, fmt.Errorf("inventory %s: %w", file, err)
+		}
+		data = []byte(plain)
+	}
+	return data, nil
+}
 
+// parseINI parses INI inventory content read from file. Lines that do not
+// parse are reported with their line number: skipped with a warning to
+// Warnings or, with StrictINI, returned as an ErrInventoryParse error.
+func parseINI(file string, data []byte) (*Inventory, error) {
 	inv := &Inventory{
 		Hosts:     make(map[string][]Host),
-		GroupVars: make(map[string]map[string]string),
+		GroupVars: make(map[string]map[string]interface{}),
+		Children:  make(map[string][]string),
 	}
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	var group string
-	var isVarsSection bool
+	var isVarsSection, isChildrenSection, badSection bool
+	lineNo := 0
+	problem := func(format string, args ...interface{}) error {
+		msg := fmt.Sprintf("%s:%d: %s", file, lineNo, fmt.Sprintf(format, args...))
+		if StrictINI {
+			return utils.Mark(errors.New(msg), ErrInventoryParse)
+		}
+		fmt.Fprintf(Warnings, "Warning: %s\n", msg)
+		return nil
+	}
 
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		lineNo++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
 		// Skip empty lines and comments
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			inner := line[1 : len(line)-1]
-			if strings.HasSuffix(inner, ":vars") {
+		if indent := raw[:len(raw)-len(strings.TrimLeft(raw, " \t"))]; strings.Contains(indent, " ") && strings.Contains(indent, "\t") {
+			if err := problem("mixed tabs and spaces in indentation"); err != nil {
+				return nil, err
+			}
+		}
+		if strings.HasPrefix(line, "[") || strings.HasSuffix(line, "]") {
+			inner, err := sectionName(line)
+			if err != nil {
+				// Lines up to the next header belong to no known group.
+				group, badSection = "", true
+				if err := problem("%v; skipping the section", err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			isVarsSection, isChildrenSection, badSection = false, false, false
+			switch {
+			case strings.HasSuffix(inner, ":vars"):
 				group = strings.TrimSuffix(inner, ":vars")
 				isVarsSection = true
-			} else {
+			case strings.HasSuffix(inner, ":children"):
+				group = strings.TrimSuffix(inner, ":children")
+				isChildrenSection = true
+			default:
 				group = inner
-				isVarsSection = false
 			}
-		} else if group != "" {
-			if isVarsSection {
-				if inv.GroupVars[group] == nil {
-					inv.GroupVars[group] = make(map[string]string)
-				}
-				key, val, _ := strings.Cut(line, "=")
-				inv.GroupVars[group][strings.TrimSpace(key)] = strings.TrimSpace(val)
-			} else {
-				inv.Hosts[group] = append(inv.Hosts[group], parseHostLine(line))
+			continue
+		}
+		if badSection {
+			continue
+		}
+		var err error
+		switch {
+		case group == "":
+			err = problem("%q is outside any [group] section", line)
+		case isChildrenSection:
+			if strings.ContainsAny(line, " \t=") {
+				err = problem("%q is not a group name in [%s:children]", line, group)
+				break
+			}
+			inv.Children[group] = append(inv.Children[group], line)
+		case isVarsSection:
+			key, val, ok := strings.Cut(line, "=")
+			if key = strings.TrimSpace(key); !ok || key == "" {
+				err = problem("%q is not key=value in [%s:vars]", line, group)
+				break
+			}
+			if inv.GroupVars[group] == nil {
+				inv.GroupVars[group] = make(map[string]interface{})
+			}
+			inv.GroupVars[group][key] = strings.TrimSpace(val)
+		default:
+			host, herr := parseHostLine(line)
+			if herr != nil {
+				err = problem("%v in [%s]", herr, group)
+				break
+			}
+			inv.Hosts[group] = append(inv.Hosts[group], host)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, utils.Mark(err, ErrInventoryParse)
+	}
+	inv.resolveChildren()
+	return inv, nil
+}
+
+// resolveChildren adds the hosts of every child group (recursively) to its
+// parent groups, skipping hosts already present.
+func (inv *Inventory) resolveChildren() {
+	var collect func(group string, visited map[string]bool) []Host
+	collect = func(group string, visited map[string]bool) []Host {
+		if visited[group] {
+			return nil
+		}
+		visited[group] = true
+		hosts := append([]Host(nil), inv.Hosts[group]...)
+		for _, child := range inv.Children[group] {
+			hosts = append(hosts, collect(child, visited)...)
+		}
+		return hosts
+	}
+
+	resolved := make(map[string][]Host, len(inv.Children))
+	for group := range inv.Children {
+		seen := make(map[string]bool)
+		var hosts []Host
+		for _, h := range collect(group, map[string]bool{}) {
+			if !seen[h.Address] {
+				seen[h.Address] = true
+				hosts = append(hosts, h)
 			}
 		}
+		resolved[group] = hosts
+	}
+	for group, hosts := range resolved {
+		inv.Hosts[group] = hosts
 	}
+}
 
-	return inv, scanner.Err()
+// sectionName returns the name inside a [group], [group:vars] or
+// [group:children] header.
+func sectionName(line string) (string, error) {
+	inner, opened := strings.CutPrefix(line, "[")
+	inner, closed := strings.CutSuffix(inner, "]")
+	switch {
+	case !opened:
+		return "", fmt.Errorf("group header %q is missing its opening [", line)
+	case !closed:
+		return "", fmt.Errorf("group header %q is missing its closing ]", line)
+	case strings.TrimSpace(inner) == "" || strings.ContainsAny(inner, "[] \t"):
+		return "", fmt.Errorf("invalid group header %q", line)
+	}
+	return inner, nil
 }
 
 // parseHostLine parses a host entry such as:
 //
 //	192.168.1.10 ssh_port=2222 ansible_user=admin
-func parseHostLine(line string) Host {
+func parseHostLine(line string) (Host, error) {
 	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return Host{}, errors.New("empty host line")
+	}
+	if strings.ContainsAny(parts[0], "=[]") {
+		return Host{}, fmt.Errorf("%q is not a host name", parts[0])
+	}
 	host := Host{
 		Address: parts[0],
-		Vars:    make(map[string]string),
+		Vars:    make(map[string]interface{}),
 	}
 	for _, part := range parts[1:] {
-		key, val, _ := strings.Cut(part, "=")
-		host.Vars[strings.TrimSpace(key)] = strings.TrimSpace(val)
+		key, val, ok := strings.Cut(part, "=")
+		if !ok || key == "" {
+			return Host{}, fmt.Errorf("host %s: %q is not key=value", parts[0], part)
+		}
+		host.Vars[key] = val
 	}
-	return host
+	return host, nil
 }
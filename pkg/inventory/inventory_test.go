@@ -1,8 +1,16 @@
 package inventory
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"for/pkg/vault"
 )
 
 func TestLoadInventory_SkipsCommentsAndBlanks(t *testing.T) {
@@ -47,6 +55,33 @@ func TestLoadInventory_HostVars(t *testing.T) {
 	}
 }
 
+func TestHost_DialAddress(t *testing.T) {
+	f := writeTempFile(t, `
+[web]
+web1 ansible_host=10.0.0.5
+web2
+`)
+	inv, err := LoadInventory(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hosts := inv.Hosts["web"]
+	if hosts[0].Address != "web1" || hosts[0].DialAddress() != "10.0.0.5" {
+		t.Errorf("expected web1 to dial 10.0.0.5, got %s -> %s", hosts[0].Address, hosts[0].DialAddress())
+	}
+	if hosts[1].DialAddress() != "web2" {
+		t.Errorf("expected web2 to dial its inventory name, got %s", hosts[1].DialAddress())
+	}
+
+	dyn, err := parseDynamic([]byte(`{"web": {"hosts": ["web1"]}, "_meta": {"hostvars": {"web1": {"ansible_host": "10.0.0.5"}}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h := dyn.Hosts["web"][0]; h.Address != "web1" || h.DialAddress() != "10.0.0.5" {
+		t.Errorf("expected dynamic web1 to dial 10.0.0.5, got %s -> %s", h.Address, h.DialAddress())
+	}
+}
+
 func TestLoadInventory_GroupVars(t *testing.T) {
 	f := writeTempFile(t, `
 [webservers]
@@ -101,3 +136,361 @@ func writeTempFile(t *testing.T, content string) string {
 	f.Close()
 	return f.Name()
 }
+
+func TestParseLimit_CommaList(t *testing.T) {
+	hosts, err := ParseLimit("192.168.1.10, 192.168.1.11,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hosts) != 2 || hosts[0] != "192.168.1.10" || hosts[1] != "192.168.1.11" {
+		t.Errorf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestParseLimit_RetryFile(t *testing.T) {
+	f := writeTempFile(t, "192.168.1.11\n\n# comment\n192.168.1.20\n")
+	hosts, err := ParseLimit("@" + f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hosts) != 2 || hosts[0] != "192.168.1.11" || hosts[1] != "192.168.1.20" {
+		t.Errorf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestFilterHosts(t *testing.T) {
+	all := []Host{{Address: "a"}, {Address: "b"}, {Address: "c"}}
+	got := FilterHosts(all, []string{"c", "a"})
+	if len(got) != 2 || got[0].Address != "a" || got[1].Address != "c" {
+		t.Errorf("expected [a c] in inventory order, got %v", got)
+	}
+	if len(FilterHosts(all, nil)) != 3 {
+		t.Error("expected empty limit to keep all hosts")
+	}
+}
+
+func TestSliceHosts(t *testing.T) {
+	var all []Host
+	for i := 0; i < 10; i++ {
+		all = append(all, Host{Address: fmt.Sprintf("h%d", i)})
+	}
+	for _, n := range []int{2, 3, 4} {
+		seen := make(map[string]int)
+		var joined []string
+		for i := 1; i <= n; i++ {
+			chunk := SliceHosts(all, Slice{Index: i, Count: n})
+			if len(chunk) < len(all)/n || len(chunk) > len(all)/n+1 {
+				t.Errorf("slice %d/%d: unbalanced chunk of %d hosts", i, n, len(chunk))
+			}
+			for _, h := range chunk {
+				seen[h.Address]++
+				joined = append(joined, h.Address)
+			}
+		}
+		if len(seen) != len(all) || len(joined) != len(all) {
+			t.Errorf("n=%d: expected disjoint chunks covering all hosts, got %v", n, joined)
+		}
+		for i, h := range all {
+			if joined[i] != h.Address {
+				t.Errorf("n=%d: expected contiguous chunks in inventory order, got %v", n, joined)
+				break
+			}
+		}
+	}
+
+	if got := SliceHosts(all, Slice{Index: 2, Count: 3}); got[0].Address != "h3" || len(got) != 3 {
+		t.Errorf("expected 2/3 to be h3..h5, got %v", got)
+	}
+	if len(SliceHosts(all, Slice{})) != 10 {
+		t.Error("expected the zero slice to keep all hosts")
+	}
+}
+
+func TestParseSlice(t *testing.T) {
+	if s, err := ParseSlice(" 2/3 "); err != nil || s != (Slice{Index: 2, Count: 3}) {
+		t.Errorf("expected {2 3}, got %v, %v", s, err)
+	}
+	if s, err := ParseSlice(""); err != nil || s != (Slice{}) {
+		t.Errorf("expected the zero slice, got %v, %v", s, err)
+	}
+	for _, bad := range []string{"3", "0/3", "4/3", "1/0", "a/b", "-1/2"} {
+		if _, err := ParseSlice(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestLoadInventory_Children(t *testing.T) {
+	f := writeTempFile(t, `
+[web]
+10.0.0.1
+
+[db]
+10.0.0.2
+
+[prod:children]
+web
+db
+`)
+	inv, err := LoadInventory(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(inv.Children["prod"]) != 2 {
+		t.Errorf("expected 2 children of prod, got %v", inv.Children["prod"])
+	}
+	hosts := inv.Hosts["prod"]
+	if len(hosts) != 2 || hosts[0].Address != "10.0.0.1" || hosts[1].Address != "10.0.0.2" {
+		t.Errorf("expected prod to contain hosts of web and db, got %v", hosts)
+	}
+}
+
+// captureWarnings collects the warnings parseINI writes during the test.
+func captureWarnings(t *testing.T) *strings.Builder {
+	t.Helper()
+	var buf strings.Builder
+	prev := Warnings
+	Warnings = &buf
+	t.Cleanup(func() { Warnings = prev })
+	return &buf
+}
+
+const malformedINI = "[web]\n10.0.0.1\n \t \n[db\n10.0.0.9\n[app]\n10.0.0.2 port\n10.0.0.3 port=80\n\t  10.0.0.4\n[app:vars]\nnovalue\n"
+
+func TestLoadInventory_MalformedLines(t *testing.T) {
+	warnings := captureWarnings(t)
+	f := writeTempFile(t, malformedINI)
+	inv, err := LoadInventory(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := hostAddresses(inv.Hosts["web"]); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("expected hosts under a malformed header to be skipped, got web %v", got)
+	}
+	if _, ok := inv.Hosts["[db"]; ok {
+		t.Errorf("expected no group for the malformed header, got %v", inv.Hosts)
+	}
+	if got := hostAddresses(inv.Hosts["app"]); !reflect.DeepEqual(got, []string{"10.0.0.3", "10.0.0.4"}) {
+		t.Errorf("expected the bad host line to be skipped, got app %v", got)
+	}
+	want := []string{
+		f + `:4: group header "[db" is missing its closing ]`,
+		f + `:7: host 10.0.0.2: "port" is not key=value in [app]`,
+		f + `:9: mixed tabs and spaces in indentation`,
+		f + `:11: "novalue" is not key=value in [app:vars]`,
+	}
+	lines := strings.Split(strings.TrimSpace(warnings.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d warnings, got %q", len(want), warnings.String())
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(lines[i], "Warning: "+w) {
+			t.Errorf("warning %d: got %q, want %q", i, lines[i], w)
+		}
+	}
+}
+
+func TestLoadInventory_StrictINI(t *testing.T) {
+	captureWarnings(t)
+	StrictINI = true
+	t.Cleanup(func() { StrictINI = false })
+
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"[web\n10.0.0.1\n", `:1: group header "[web" is missing its closing ]`},
+		{"web]\n", `:1: group header "web]" is missing its opening [`},
+		{"[web]\n  \t\n10.0.0.1 =x\n", `:3: host 10.0.0.1: "=x" is not key=value`},
+		{"10.0.0.1\n[web]\n", `:1: "10.0.0.1" is outside any [group] section`},
+		{"[web]\n \t10.0.0.1\n", ":2: mixed tabs and spaces"},
+	}
+	for _, tt := range tests {
+		_, err := LoadInventory(writeTempFile(t, tt.content))
+		if !errors.Is(err, ErrInventoryParse) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected ErrInventoryParse containing %q, got %v", tt.content, tt.want, err)
+		}
+	}
+	if _, err := LoadInventory(writeTempFile(t, "[web]\n  \n10.0.0.1 port=22\n")); err != nil {
+		t.Errorf("expected a well-formed inventory with a blank line to load, got %v", err)
+	}
+}
+
+func TestParseHostLine_Empty(t *testing.T) {
+	if _, err := parseHostLine(" \t "); err == nil {
+		t.Error("expected an error for an empty host line")
+	}
+}
+
+func hostAddresses(hosts []Host) []string {
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		addrs[i] = h.Address
+	}
+	return addrs
+}
+
+func TestDescribe(t *testing.T) {
+	f := writeTempFile(t, `
+[web]
+10.0.0.1 role=frontend
+10.0.0.3
+
+[db]
+10.0.0.2 port=5433
+10.0.0.3 role=both
+
+[prod:children]
+web
+db
+
+[prod:vars]
+env=prod
+port=22
+
+[db:vars]
+port=5432
+`)
+	inv, err := LoadInventory(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := inv.Describe([]Host{{Address: "10.0.0.2"}, {Address: "10.0.0.3"}, {Address: "10.0.0.1"}})
+	want := []HostInfo{
+		{Host: "10.0.0.2", Groups: []string{"db", "prod"}, Vars: map[string]interface{}{"env": "prod", "port": "5433"}},
+		{Host: "10.0.0.3", Groups: []string{"db", "prod", "web"}, Vars: map[string]interface{}{"env": "prod", "port": "5432", "role": "both"}},
+		{Host: "10.0.0.1", Groups: []string{"prod", "web"}, Vars: map[string]interface{}{"env": "prod", "port": "22", "role": "frontend"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+
+	data, err := json.Marshal(got[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"host":"10.0.0.2","groups":["db","prod"],"vars":{"env":"prod","port":"5433"}}]`; string(data) != want {
+		t.Errorf("got JSON %s, want %s", data, want)
+	}
+}
+
+func TestParseDynamic_VarTypes(t *testing.T) {
+	inv, err := parseDynamic([]byte(`{"web": {"hosts": ["w1"], "vars": {"port": 8080, "ratio": 0.5, "tls": true, "env": "prod"}},
+		"_meta": {"hostvars": {"w1": {"weight": 3}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"port": 8080, "ratio": 0.5, "tls": true, "env": "prod"}
+	if got := inv.GroupVars["web"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got group vars %#v, want %#v", got, want)
+	}
+	if h := inv.Hosts["web"][0]; h.Vars["weight"] != 3 {
+		t.Errorf("expected weight to be the int 3, got %#v", h.Vars["weight"])
+	}
+	if s, ok := StringVar(inv.GroupVars["web"], "port"); !ok || s != "8080" {
+		t.Errorf("expected StringVar to format the port, got %q, %v", s, ok)
+	}
+}
+
+func TestExportDynamic_RoundTrip(t *testing.T) {
+	f := writeTempFile(t, `
+[webservers]
+192.168.1.10 ssh_port=2222 ansible_user=admin
+192.168.1.11
+
+[dbservers]
+192.168.1.20
+
+[webservers:vars]
+env=production
+
+[prod:children]
+webservers
+dbservers
+`)
+	orig, err := LoadInventory(f)
+	if err != nil {
+		t.Fatalf("LoadInventory: %v", err)
+	}
+	data, err := ExportDynamic(orig)
+	if err != nil {
+		t.Fatalf("ExportDynamic: %v", err)
+	}
+
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "inventory.json")
+	script := filepath.Join(dir, "inventory.sh")
+	os.WriteFile(jsonPath, data, 0o644)
+	os.WriteFile(script, []byte("#!/bin/sh\ncat "+jsonPath+"\n"), 0o755)
+
+	got, err := LoadDynamic(script)
+	if err != nil {
+		t.Fatalf("LoadDynamic: %v", err)
+	}
+
+	for group, hosts := range orig.Hosts {
+		gotHosts := got.Hosts[group]
+		if len(gotHosts) != len(hosts) {
+			t.Errorf("group %s: expected %d hosts, got %d", group, len(hosts), len(gotHosts))
+			continue
+		}
+		want := map[string]Host{}
+		for _, h := range hosts {
+			want[h.Address] = h
+		}
+		for _, h := range gotHosts {
+			w, ok := want[h.Address]
+			if !ok {
+				t.Errorf("group %s: unexpected host %s", group, h.Address)
+				continue
+			}
+			if !reflect.DeepEqual(w.Vars, h.Vars) {
+				t.Errorf("host %s: expected vars %v, got %v", h.Address, w.Vars, h.Vars)
+			}
+		}
+	}
+	if !reflect.DeepEqual(orig.GroupVars, got.GroupVars) {
+		t.Errorf("expected group vars %v, got %v", orig.GroupVars, got.GroupVars)
+	}
+	if !reflect.DeepEqual(orig.Children, got.Children) {
+		t.Errorf("expected children %v, got %v", orig.Children, got.Children)
+	}
+}
+
+func TestLoadInventory_VaultEncryptedFile(t *testing.T) {
+	plain := "[web]\nw1 ansible_user=deploy\nw2\n\n[web:vars]\nport=8080\n\n[prod:children]\nweb\n"
+	enc, err := vault.Encrypt(plain, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encFile := writeTempFile(t, enc+"\n")
+
+	prev := VaultPassword
+	t.Cleanup(func() { VaultPassword = prev })
+
+	VaultPassword = ""
+	if _, err := LoadInventory(encFile); err == nil || !strings.Contains(err.Error(), "inventory "+encFile+" is vault-encrypted") {
+		t.Errorf("expected vault-encrypted error without a password, got %v", err)
+	}
+
+	VaultPassword = "wrong"
+	if _, err := LoadInventory(encFile); err == nil {
+		t.Error("expected error with the wrong password")
+	}
+
+	VaultPassword = "s3cret"
+	got, err := LoadInventory(encFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want, err := LoadInventory(writeTempFile(t, plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decrypted inventory differs from plaintext:\n got %+v\nwant %+v", got, want)
+	}
+	if len(got.Hosts["prod"]) != 2 || got.Hosts["web"][0].Vars["ansible_user"] != "deploy" {
+		t.Errorf("unexpected groups/hosts %+v", got.Hosts)
+	}
+}
@@ -0,0 +1,104 @@
+package inventory
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseLimit parses a --limit argument into a list of host addresses.
+// The argument is either a comma-separated list of hosts or "@file", where
+// file lists one host per line (blank lines and # comments are skipped), as
+// written to a .retry file.
+func ParseLimit(arg string) ([]string, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(arg, "@") {
+		return readHostList(strings.TrimPrefix(arg, "@"))
+	}
+	var hosts []string
+	for _, h := range strings.Split(arg, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+func readHostList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading limit file: %w", err)
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, scanner.Err()
+}
+
+// FilterHosts returns the hosts whose address appears in limit, preserving
+// order. An empty limit returns hosts unchanged.
+func FilterHosts(hosts []Host, limit []string) []Host {
+	if len(limit) == 0 {
+		return hosts
+	}
+	allowed := make(map[string]bool, len(limit))
+	for _, h := range limit {
+		allowed[h] = true
+	}
+	var out []Host
+	for _, h := range hosts {
+		if allowed[h.Address] {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// Slice selects chunk Index of Count (1-based) of a host list, for splitting
+// one run across several workers. The zero Slice selects every host.
+type Slice struct {
+	Index int
+	Count int
+}
+
+// ParseSlice parses a --slice argument such as "2/3". An empty argument
+// returns the zero Slice.
+func ParseSlice(arg string) (Slice, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return Slice{}, nil
+	}
+	i, n, ok := strings.Cut(arg, "/")
+	index, err1 := strconv.Atoi(strings.TrimSpace(i))
+	count, err2 := strconv.Atoi(strings.TrimSpace(n))
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 1 || index > count {
+		return Slice{}, fmt.Errorf("invalid slice %q: want i/n with 1 <= i <= n", arg)
+	}
+	return Slice{Index: index, Count: count}, nil
+}
+
+// SliceHosts returns the contiguous chunk of hosts selected by s, preserving
+// order. Chunks differ in size by at most one host, and the chunks 1..Count
+// together cover every host exactly once, so the split is stable for the same
+// host order.
+func SliceHosts(hosts []Host, s Slice) []Host {
+	if s.Count <= 1 {
+		return hosts
+	}
+	start := (s.Index - 1) * len(hosts) / s.Count
+	end := s.Index * len(hosts) / s.Count
+	return hosts[start:end]
+}
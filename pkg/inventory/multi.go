@@ -0,0 +1,157 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// DefaultSourceWorkers bounds how many sources LoadSources loads at once when
+// LoadOptions.Workers is unset.
+const DefaultSourceWorkers = 4
+
+// NamedSource is a Source labelled for error messages, usually with its URI.
+type NamedSource struct {
+	Name   string
+	Source Source
+}
+
+// SourceError reports that one source of a multi-source load failed.
+type SourceError struct {
+	Source string
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("inventory source %s: %v", e.Source, e.Err)
+}
+
+func (e *SourceError) Unwrap() error { return e.Err }
+
+// LoadOptions controls LoadSources.
+type LoadOptions struct {
+	// Workers bounds concurrent loads; 0 means DefaultSourceWorkers.
+	Workers int
+	// FailFast aborts on the first failing source. Otherwise the sources
+	// that loaded are merged and returned together with the failures.
+	FailFast bool
+}
+
+// LoadSources loads sources concurrently, at most opts.Workers at a time, and
+// merges them in the given order (see Merge). Failures are *SourceError
+// values naming the source. With FailFast the first failure is returned
+// with a nil inventory and no further sources are started; otherwise the
+// merged inventory of the other sources is returned along with all failures
+// joined.
+func LoadSources(sources []NamedSource, opts LoadOptions) (*Inventory, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultSourceWorkers
+	}
+
+	loaded := make([]*Inventory, len(sources))
+	errs := make([]error, len(sources))
+	finished := make(chan int, len(sources))
+	// failed is set before a failing load frees its slot, so with FailFast
+	// the launcher sees it before starting another source.
+	var failed atomic.Bool
+
+	go func() {
+		sem := make(chan struct{}, workers)
+		for i := range sources {
+			sem <- struct{}{}
+			if failed.Load() {
+				return
+			}
+			go func(i int) {
+				loaded[i], errs[i] = sources[i].Source.Load()
+				if errs[i] != nil && opts.FailFast {
+					failed.Store(true)
+				}
+				finished <- i
+				<-sem
+			}(i)
+		}
+	}()
+
+	for range sources {
+		i := <-finished
+		if errs[i] != nil && opts.FailFast {
+			return nil, &SourceError{Source: sources[i].Name, Err: errs[i]}
+		}
+	}
+
+	inv := &Inventory{
+		Hosts:     make(map[string][]Host),
+		GroupVars: make(map[string]map[string]interface{}),
+		Children:  make(map[string][]string),
+	}
+	var failures []error
+	for i, src := range sources {
+		if errs[i] != nil {
+			failures = append(failures, &SourceError{Source: src.Name, Err: errs[i]})
+			continue
+		}
+		inv.Merge(loaded[i])
+	}
+	inv.resolveChildren()
+	return inv, errors.Join(failures...)
+}
+
+// LoadInventories loads every inventory location in uris (see NewSource)
+// with LoadSources. Errors are named by URI.
+func LoadInventories(uris []string, opts LoadOptions) (*Inventory, error) {
+	named := make([]NamedSource, 0, len(uris))
+	for _, uri := range uris {
+		src, err := NewSource(uri)
+		if err != nil {
+			return nil, err
+		}
+		named = append(named, NamedSource{Name: uri, Source: src})
+	}
+	return LoadSources(named, opts)
+}
+
+// Merge adds other's groups to inv. A host already in a group gets other's
+// vars merged over its own; group vars are merged key by key with other
+// winning; children are combined.
+func (inv *Inventory) Merge(other *Inventory) {
+	if other == nil {
+		return
+	}
+	for group, hosts := range other.Hosts {
+		for _, h := range hosts {
+			existing := -1
+			for i, cur := range inv.Hosts[group] {
+				if cur.Address == h.Address {
+					existing = i
+					break
+				}
+			}
+			if existing < 0 {
+				inv.Hosts[group] = append(inv.Hosts[group], h)
+				continue
+			}
+			inv.Hosts[group][existing].Vars = mergeVars(inv.Hosts[group][existing].Vars, h.Vars)
+		}
+	}
+	for group, vars := range other.GroupVars {
+		inv.GroupVars[group] = mergeVars(inv.GroupVars[group], vars)
+	}
+	for group, children := range other.Children {
+		for _, child := range children {
+			if !containsString(inv.Children[group], child) {
+				inv.Children[group] = append(inv.Children[group], child)
+			}
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package inventory
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// funcSource adapts a function to the Source interface.
+type funcSource func() (*Inventory, error)
+
+func (f funcSource) Load() (*Inventory, error) { return f() }
+
+// slowSource returns inv after delay, tracking the peak number of loads in flight.
+func slowSource(inv *Inventory, delay time.Duration, inFlight, peak *int32) Source {
+	return funcSource(func() (*Inventory, error) {
+		n := atomic.AddInt32(inFlight, 1)
+		defer atomic.AddInt32(inFlight, -1)
+		for {
+			p := atomic.LoadInt32(peak)
+			if n <= p || atomic.CompareAndSwapInt32(peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		return inv, nil
+	})
+}
+
+func TestLoadSources_ConcurrentBestEffort(t *testing.T) {
+	var inFlight, peak int32
+	errCMDB := errors.New("connection refused")
+	sources := []NamedSource{
+		{Name: "slow-a", Source: slowSource(&Inventory{
+			Hosts:     map[string][]Host{"web": {{Address: "w1", Vars: map[string]interface{}{"role": "a"}}}},
+			GroupVars: map[string]map[string]interface{}{"web": {"env": "staging", "tier": "front"}},
+		}, 100*time.Millisecond, &inFlight, &peak)},
+		{Name: "https://cmdb.example.com", Source: funcSource(func() (*Inventory, error) { return nil, errCMDB })},
+		{Name: "slow-b", Source: slowSource(&Inventory{
+			Hosts:     map[string][]Host{"web": {{Address: "w1", Vars: map[string]interface{}{"role": "b"}}, {Address: "w2"}}},
+			GroupVars: map[string]map[string]interface{}{"web": {"env": "production"}},
+		}, 100*time.Millisecond, &inFlight, &peak)},
+	}
+
+	start := time.Now()
+	inv, err := LoadSources(sources, LoadOptions{})
+	if elapsed := time.Since(start); elapsed > 180*time.Millisecond {
+		t.Errorf("expected sources to load concurrently, took %s", elapsed)
+	}
+	if peak < 2 {
+		t.Errorf("expected concurrent loads, peak in flight was %d", peak)
+	}
+
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || srcErr.Source != "https://cmdb.example.com" || !errors.Is(err, errCMDB) {
+		t.Fatalf("expected a SourceError naming the failing source, got %v", err)
+	}
+	if want := "inventory source https://cmdb.example.com: connection refused"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err)
+	}
+
+	hosts := inv.Hosts["web"]
+	if len(hosts) != 2 || hosts[0].Vars["role"] != "b" {
+		t.Errorf("expected w1 merged with the later source's vars and w2 added, got %+v", hosts)
+	}
+	if vars := inv.GroupVars["web"]; vars["env"] != "production" || vars["tier"] != "front" {
+		t.Errorf("expected group vars merged with later sources winning, got %v", vars)
+	}
+}
+
+func TestLoadSources_BoundedWorkers(t *testing.T) {
+	var inFlight, peak int32
+	var sources []NamedSource
+	for i := 0; i < 5; i++ {
+		sources = append(sources, NamedSource{Name: "s", Source: slowSource(&Inventory{}, 20*time.Millisecond, &inFlight, &peak)})
+	}
+	if _, err := LoadSources(sources, LoadOptions{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if peak > 2 {
+		t.Errorf("expected at most 2 loads in flight, got %d", peak)
+	}
+}
+
+func TestLoadSources_FailFast(t *testing.T) {
+	var started int32
+	sources := []NamedSource{
+		{Name: "broken", Source: funcSource(func() (*Inventory, error) { return nil, errors.New("boom") })},
+		{Name: "later", Source: funcSource(func() (*Inventory, error) {
+			atomic.AddInt32(&started, 1)
+			time.Sleep(50 * time.Millisecond)
+			return &Inventory{}, nil
+		})},
+	}
+	inv, err := LoadSources(sources, LoadOptions{Workers: 1, FailFast: true})
+	var srcErr *SourceError
+	if inv != nil || !errors.As(err, &srcErr) || srcErr.Source != "broken" {
+		t.Fatalf("expected only the named failure, got %v, %v", inv, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&started); n != 0 {
+		t.Errorf("expected no further sources after the failure, %d started", n)
+	}
+}
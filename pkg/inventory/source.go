@@ -0,0 +1,121 @@
+package inventory
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source loads an inventory from one location.
+type Source interface {
+	Load() (*Inventory, error)
+}
+
+// SourceFactory builds a Source from a full inventory URI.
+type SourceFactory func(uri string) (Source, error)
+
+// sources maps a URI scheme to its factory. Locations without a scheme are
+// treated as "file".
+var sources = map[string]SourceFactory{
+	"file": func(uri string) (Source, error) {
+		return FileSource{Path: strings.TrimPrefix(uri, "file://")}, nil
+	},
+	"script": func(uri string) (Source, error) {
+		return ScriptSource{Path: strings.TrimPrefix(uri, "script://")}, nil
+	},
+	"http":  newHTTPSource,
+	"https": newHTTPSource,
+}
+
+// RegisterSource makes a Source available under scheme, replacing any
+// existing registration.
+func RegisterSource(scheme string, factory SourceFactory) {
+	sources[scheme] = factory
+}
+
+// NewSource returns the Source for uri, e.g. "hosts.ini", "file://hosts.ini",
+// "script://./inventory.sh" or "https://cmdb.example.com/inventory".
+func NewSource(uri string) (Source, error) {
+	scheme := "file"
+	if i := strings.Index(uri, "://"); i > 0 {
+		scheme = uri[:i]
+	}
+	factory, ok := sources[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown inventory scheme %q (known: %s)", scheme, strings.Join(sourceSchemes(), ", "))
+	}
+	return factory(uri)
+}
+
+func sourceSchemes() []string {
+	schemes := make([]string, 0, len(sources))
+	for s := range sources {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// LoadInventory loads the inventory at uri using the Source registered for
+// its scheme. A plain path is read as a static INI file.
+func LoadInventory(uri string) (*Inventory, error) {
+	src, err := NewSource(uri)
+	if err != nil {
+		return nil, err
+	}
+	return src.Load()
+}
+
+// FileSource reads a static INI inventory file.
+type FileSource struct {
+	Path string
+}
+
+// Load implements Source.
+func (s FileSource) Load() (*Inventory, error) {
+	return loadINI(s.Path)
+}
+
+// ScriptSource runs an executable that prints dynamic inventory JSON.
+type ScriptSource struct {
+	Path string
+}
+
+// Load implements Source.
+func (s ScriptSource) Load() (*Inventory, error) {
+	return LoadDynamic(s.Path)
+}
+
+// HTTPSource fetches dynamic inventory JSON with a GET request.
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func newHTTPSource(uri string) (Source, error) {
+	return HTTPSource{URL: uri, Client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Load implements Source.
+func (s HTTPSource) Load() (*Inventory, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching inventory %s: %w", s.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching inventory %s: unexpected status %s", s.URL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading inventory %s: %w", s.URL, err)
+	}
+	return parseDynamic(data)
+}
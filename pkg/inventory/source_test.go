@@ -0,0 +1,106 @@
+package inventory
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewSource_SchemeDispatch(t *testing.T) {
+	cases := map[string]Source{
+		"hosts.ini":                 FileSource{Path: "hosts.ini"},
+		"file:///etc/for/hosts.ini": FileSource{Path: "/etc/for/hosts.ini"},
+		"script://./inventory.sh":   ScriptSource{Path: "./inventory.sh"},
+	}
+	for uri, want := range cases {
+		got, err := NewSource(uri)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", uri, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %#v, want %#v", uri, got, want)
+		}
+	}
+
+	src, err := NewSource("https://cmdb.example.com/inventory")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h, ok := src.(HTTPSource); !ok || h.URL != "https://cmdb.example.com/inventory" {
+		t.Errorf("expected HTTPSource, got %#v", src)
+	}
+}
+
+func TestNewSource_UnknownScheme(t *testing.T) {
+	_, err := NewSource("ldap://directory")
+	if err == nil || !strings.Contains(err.Error(), `"ldap"`) {
+		t.Errorf("expected unknown scheme error, got %v", err)
+	}
+}
+
+type staticSource struct{ inv *Inventory }
+
+func (s staticSource) Load() (*Inventory, error) { return s.inv, nil }
+
+func TestRegisterSource(t *testing.T) {
+	want := &Inventory{Hosts: map[string][]Host{"web": {{Address: "10.0.0.1"}}}}
+	RegisterSource("test", func(string) (Source, error) { return staticSource{want}, nil })
+	defer delete(sources, "test")
+
+	got, err := LoadInventory("test://anything")
+	if err != nil || got != want {
+		t.Errorf("expected registered source to be used, got %v, %v", got, err)
+	}
+}
+
+func TestLoadInventory_ScriptScheme(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "inv.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\necho '{\"db\": {\"hosts\": [\"10.0.0.5\"]}}'\n"), 0o755)
+
+	inv, err := LoadInventory("script://" + script)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hosts := inv.Hosts["db"]; len(hosts) != 1 || hosts[0].Address != "10.0.0.5" {
+		t.Errorf("unexpected hosts %+v", hosts)
+	}
+}
+
+func TestHTTPSource_Load(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/inventory" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{
+  "web": {"hosts": ["10.0.0.1", "10.0.0.2"], "vars": {"env": "prod"}},
+  "_meta": {"hostvars": {"10.0.0.1": {"ssh_port": "2222"}}}
+}`)
+	}))
+	defer srv.Close()
+
+	inv, err := LoadInventory(srv.URL + "/inventory")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hosts := inv.Hosts["web"]
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, got %d", len(hosts))
+	}
+	if inv.GroupVars["web"]["env"] != "prod" {
+		t.Errorf("expected group var env=prod, got %v", inv.GroupVars["web"])
+	}
+	for _, h := range hosts {
+		if h.Address == "10.0.0.1" && h.Vars["ssh_port"] != "2222" {
+			t.Errorf("expected hostvars to be applied, got %v", h.Vars)
+		}
+	}
+
+	if _, err := LoadInventory(srv.URL + "/missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected status error, got %v", err)
+	}
+}
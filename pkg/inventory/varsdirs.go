@@ -0,0 +1,114 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"for/pkg/utils"
+)
+
+// AllGroup names the group_vars file whose vars apply to every host.
+const AllGroup = "all"
+
+// loadVarsDirs merges group_vars/<group>.yml and host_vars/<host>.yml files
+// found in dir into inv. Precedence, lowest first: group_vars/all, inline
+// [group:vars], group_vars/<group>; inline host vars, host_vars/<host>.
+// Missing directories and files are skipped; ".yaml" and no extension are
+// accepted as well as ".yml".
+func loadVarsDirs(inv *Inventory, dir string) error {
+	all, err := readVarsFile(filepath.Join(dir, "group_vars"), AllGroup)
+	if err != nil {
+		return err
+	}
+	if all != nil {
+		inv.GroupVars[AllGroup] = mergeVars(all, inv.GroupVars[AllGroup])
+	}
+	for group := range inv.Hosts {
+		vars, err := readVarsFile(filepath.Join(dir, "group_vars"), group)
+		if err != nil {
+			return err
+		}
+		merged := mergeVars(all, inv.GroupVars[group], vars)
+		if len(merged) > 0 {
+			inv.GroupVars[group] = merged
+		}
+	}
+
+	hostVars := make(map[string]map[string]interface{})
+	for _, hosts := range inv.Hosts {
+		for i, h := range hosts {
+			vars, seen := hostVars[h.Address]
+			if !seen {
+				if vars, err = readVarsFile(filepath.Join(dir, "host_vars"), h.Address); err != nil {
+					return err
+				}
+				hostVars[h.Address] = vars
+			}
+			if vars != nil {
+				hosts[i].Vars = mergeVars(h.Vars, vars)
+			}
+		}
+	}
+	return nil
+}
+
+// readVarsFile reads the vars file for name in dir, returning nil when there
+// is none. Files may be vault-encrypted as a whole.
+func readVarsFile(dir, name string) (map[string]interface{}, error) {
+	for _, file := range []string{name + ".yml", name + ".yaml", name} {
+		path := filepath.Join(dir, file)
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		data, err := readInventoryFile(path)
+		if err != nil {
+			return nil, err
+		}
+		vars, err := parseVarsFile(path, data)
+		return vars, utils.Mark(err, ErrInventoryParse)
+	}
+	return nil, nil
+}
+
+// parseVarsFile parses a mapping of scalar vars, which keep their YAML type
+// (string, int, float64, bool or nil for null). Lists and mappings are
+// rejected.
+func parseVarsFile(path string, data []byte) (map[string]interface{}, error) {
+	root, err := utils.ParseYAML(path, data)
+	if err != nil || root == nil {
+		return map[string]interface{}{}, err
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, utils.NodeError(path, root, "vars file must be a mapping, got %s", utils.NodeKind(root))
+	}
+	vars := make(map[string]interface{}, len(root.Content)/2)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			return nil, utils.NodeError(path, value, "var %q must be a scalar, got %s", key.Value, utils.NodeKind(value))
+		}
+		var v interface{}
+		if err := value.Decode(&v); err != nil {
+			return nil, utils.NodeError(path, value, "var %q: %v", key.Value, err)
+		}
+		vars[key.Value] = v
+	}
+	return vars, nil
+}
+
+// mergeVars merges maps into a new map; later maps win. It returns nil
+// when every map is empty.
+func mergeVars(maps ...map[string]interface{}) map[string]interface{} {
+	var out map[string]interface{}
+	for _, m := range maps {
+		for k, v := range m {
+			if out == nil {
+				out = make(map[string]interface{})
+			}
+			out[k] = v
+		}
+	}
+	return out
+}
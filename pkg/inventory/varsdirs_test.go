@@ -0,0 +1,98 @@
+package inventory
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"for/pkg/utils"
+)
+
+// writeVarsTree writes hosts.ini and the given relative files under a temp
+// dir and returns the inventory path.
+func writeVarsTree(t *testing.T, ini string, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "hosts.ini")
+	os.WriteFile(path, []byte(ini), 0o644)
+	return path
+}
+
+func TestLoadInventory_VarsDirs(t *testing.T) {
+	path := writeVarsTree(t, `[webservers]
+192.168.1.10 http_port=81 ansible_user=inline
+192.168.1.11
+
+[db]
+192.168.1.20
+
+[webservers:vars]
+http_port=80
+region=inline
+`, map[string]string{
+		"group_vars/all.yml":          "ntp_server: ntp.example.com\nregion: global\n",
+		"group_vars/webservers.yml":   "region: eu-west\nmax_clients: 200\n",
+		"host_vars/192.168.1.10.yml":  "ansible_user: deploy\nrole: primary\n",
+		"host_vars/192.168.1.99.yaml": "role: absent\n",
+	})
+	inv, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web := inv.GroupVars["webservers"]
+	// INI vars stay strings; YAML scalars keep their type.
+	for key, want := range map[string]interface{}{"http_port": "80", "region": "eu-west", "max_clients": 200, "ntp_server": "ntp.example.com"} {
+		if web[key] != want {
+			t.Errorf("webservers %s: expected %#v, got %#v", key, want, web[key])
+		}
+	}
+	if db := inv.GroupVars["db"]; db["ntp_server"] != "ntp.example.com" || db["region"] != "global" {
+		t.Errorf("expected group_vars/all to reach db, got %v", db)
+	}
+
+	h10, h11 := inv.Hosts["webservers"][0], inv.Hosts["webservers"][1]
+	if h10.Vars["ansible_user"] != "deploy" || h10.Vars["role"] != "primary" || h10.Vars["http_port"] != "81" {
+		t.Errorf("expected host_vars to override inline host vars, got %v", h10.Vars)
+	}
+	if _, ok := h11.Vars["role"]; ok {
+		t.Errorf("expected host_vars to apply only to their host, got %v", h11.Vars)
+	}
+}
+
+func TestLoadInventory_VarsDirsMissingAndInvalid(t *testing.T) {
+	if _, err := LoadInventory(writeVarsTree(t, "[web]\nw1\n", nil)); err != nil {
+		t.Errorf("expected missing vars directories to be skipped, got %v", err)
+	}
+
+	path := writeVarsTree(t, "[web]\nw1\n", map[string]string{"group_vars/web.yml": "packages:\n  - nginx\n"})
+	_, err := LoadInventory(path)
+	want := filepath.Join(filepath.Dir(path), "group_vars", "web.yml") + `:2:3: var "packages" must be a scalar, got a list`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+}
+
+func TestLoadInventory_ParseErrorKind(t *testing.T) {
+	path := writeVarsTree(t, "[web]\nw1\n", map[string]string{"host_vars/w1": "- not\n- a mapping\n"})
+	_, err := LoadInventory(path)
+	var yamlErr *utils.YAMLError
+	if !errors.Is(err, ErrInventoryParse) || !errors.As(err, &yamlErr) {
+		t.Errorf("expected an ErrInventoryParse carrying the YAMLError, got %v", err)
+	}
+	if _, err := parseDynamic([]byte(`{"web": {"hosts": "web1"}}`)); !errors.Is(err, ErrInventoryParse) {
+		t.Errorf("expected malformed dynamic inventory to be ErrInventoryParse, got %v", err)
+	}
+	if _, err := LoadInventory(filepath.Join(t.TempDir(), "missing.ini")); errors.Is(err, ErrInventoryParse) {
+		t.Errorf("expected a missing file not to be a parse error, got %v", err)
+	}
+}
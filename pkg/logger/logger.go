@@ -1,23 +1,43 @@
 package logger
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"log/slog"
 	"os"
+	"time"
 )
 
 // L is the global structured logger. It is initialised to stdout by default.
+// Every record carries a run_id attribute set to RunID.
 var L *slog.Logger
 
+// RunID identifies this process's run, so records from several runs that
+// share a log file can be told apart.
+var RunID = NewRunID()
+
+// Console is where Init writes records besides the log file. Commands
+// printing machine-readable output on stdout point it at os.Stderr first.
+var Console io.Writer = os.Stdout
+
 func init() {
-	L = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	L = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})).With("run_id", RunID)
+}
+
+// NewRunID returns a run identifier made of the UTC start time and 32
+// random bits, e.g. 20260102T150405Z-9f86d081.
+func NewRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
 }
 
 // Init configures the global logger. If logFile is non-empty the output is
-// written to both stdout and the file. Returns a cleanup function that must
+// written to both Console (stdout by default) and the file. Returns a cleanup function that must
 // be deferred by the caller.
 func Init(logFile string) (func(), error) {
-	writers := []io.Writer{os.Stdout}
+	writers := []io.Writer{Console}
 	cleanup := func() {}
 
 	if logFile != "" {
@@ -30,7 +50,7 @@ func Init(logFile string) (func(), error) {
 	}
 
 	w := io.MultiWriter(writers...)
-	L = slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	L = slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})).With("run_id", RunID)
 	slog.SetDefault(L)
 	return cleanup, nil
 }
@@ -0,0 +1,48 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestInit_RunIDOnEveryRecord(t *testing.T) {
+	if !regexp.MustCompile(`^\d{8}T\d{6}Z-[0-9a-f]{8}$`).MatchString(RunID) {
+		t.Fatalf("unexpected run ID format %q", RunID)
+	}
+	if NewRunID() == RunID {
+		t.Error("expected a fresh run ID to differ from this run's")
+	}
+
+	file := filepath.Join(t.TempDir(), "for.log")
+	cleanup, err := Init(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L.Info("first")
+	L.Debug("second", "host", "web1")
+	cleanup()
+	// Re-initialising within the same run keeps the same ID.
+	cleanup, err = Init(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L.Warn("third")
+	cleanup()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 records, got %q", lines)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "run_id="+RunID) {
+			t.Errorf("expected run_id=%s on %q", RunID, line)
+		}
+	}
+}
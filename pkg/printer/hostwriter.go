@@ -0,0 +1,273 @@
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// HostWriter collects one host's output so it can be emitted as a single
+// contiguous block, keeping concurrent hosts from interleaving line by line.
+// Its methods mirror the package-level output functions.
+type HostWriter struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	buffered bool
+	// p is the Printer the output goes to and whose settings it follows.
+	p *Printer
+	// parent receives this writer's output instead of stdout; see Nested.
+	parent *HostWriter
+}
+
+// NewHostWriter returns a writer for one host. When buffered is false every
+// line is written immediately, exactly like the package-level functions;
+// otherwise output is held until Flush.
+func NewHostWriter(buffered bool) *HostWriter {
+	return std.NewHostWriter(buffered)
+}
+
+// NewHostWriter is the package-level NewHostWriter for output to p.
+func (p *Printer) NewHostWriter(buffered bool) *HostWriter {
+	return &HostWriter{buffered: buffered, p: p}
+}
+
+// Nested returns a writer whose output goes into w instead of stdout, so the
+// host blocks of a play can be collected into the play's own block.
+func (w *HostWriter) Nested(buffered bool) *HostWriter {
+	return &HostWriter{buffered: buffered, p: w.p, parent: w}
+}
+
+func (w *HostWriter) printf(format string, args ...interface{}) {
+	w.write([]byte(fmt.Sprintf(format, args...)))
+}
+
+func (w *HostWriter) write(p []byte) {
+	switch {
+	case w.buffered:
+		w.mu.Lock()
+		w.buf.Write(p)
+		w.mu.Unlock()
+	case w.parent != nil:
+		w.parent.write(p)
+	case !w.p.settings().summaryOnly:
+		w.p.writeOut(p)
+	}
+}
+
+// Flush writes everything collected so far as one block to the parent writer
+// or, for top-level writers, to stdout under the shared output lock so it
+// never interleaves with other hosts or the progress line.
+func (w *HostWriter) Flush() {
+	w.mu.Lock()
+	data := append([]byte(nil), w.buf.Bytes()...)
+	w.buf.Reset()
+	w.mu.Unlock()
+	if len(data) == 0 {
+		return
+	}
+	if w.parent != nil {
+		w.parent.write(data)
+		return
+	}
+	if !w.p.settings().summaryOnly {
+		w.p.writeOut(data)
+	}
+}
+
+// PlayHeader is the HostWriter form of the package-level PlayHeader.
+func (w *HostWriter) PlayHeader(name string) {
+	if w.p.settings().oneLine {
+		return
+	}
+	sep := banner("*", "PLAY ["+name+"] ")
+	w.printf("\n%s [%s] %s\n", w.p.c(ansiBold+ansiBlue, "PLAY"), w.p.c(ansiBold, name), sep)
+}
+
+// TaskHeader is the HostWriter form of the package-level TaskHeader.
+func (w *HostWriter) TaskHeader(name string) {
+	if w.p.settings().oneLine {
+		return
+	}
+	sep := banner("-", "TASK ["+name+"] ")
+	w.printf("\n%s [%s] %s\n", w.p.c(ansiBold, "TASK"), name, sep)
+}
+
+// HandlerHeader is the HostWriter form of the package-level HandlerHeader.
+func (w *HostWriter) HandlerHeader(name string) {
+	if w.p.settings().oneLine {
+		return
+	}
+	sep := banner("-", "HANDLER ["+name+"] ")
+	w.printf("\n%s [%s] %s\n", w.p.c(ansiBold, "HANDLER"), name, sep)
+}
+
+// HostHeader is the HostWriter form of the package-level HostHeader.
+func (w *HostWriter) HostHeader(host string) {
+	if w.p.settings().oneLine {
+		return
+	}
+	w.printf("\n%s\n", w.p.c(ansiCyan, "  HOST ["+host+"]"))
+}
+
+// OK is the HostWriter form of the package-level OK.
+func (w *HostWriter) OK(host, output string) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiGreen, oneLine(host, "SUCCESS", 0, output)))
+		return
+	}
+	w.printf("  %s: [%s]\n", w.p.c(ansiGreen, "ok"), host)
+	if strings.TrimSpace(output) != "" {
+		w.Output("stdout", output)
+	}
+}
+
+// Changed is the HostWriter form of the package-level Changed.
+func (w *HostWriter) Changed(host, output string) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiYellow, oneLine(host, "CHANGED", 0, output)))
+		return
+	}
+	w.printf("  %s: [%s]\n", w.p.c(ansiYellow, "changed"), host)
+	if strings.TrimSpace(output) != "" {
+		w.Output("stdout", output)
+	}
+}
+
+// Failed is the HostWriter form of the package-level Failed.
+func (w *HostWriter) Failed(host string, err error) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiRed, oneLine(host, "FAILED", errExitStatus(err), errText(err))))
+		return
+	}
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	w.printf("  %s: [%s]\n", w.p.c(ansiRed, "FAILED"), host)
+	if msg != "" {
+		w.printf("  %s\n", strings.TrimSpace(msg))
+	}
+}
+
+// Unreachable is the HostWriter form of the package-level Unreachable.
+func (w *HostWriter) Unreachable(host string, err error) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiRed, oneLine(host, "UNREACHABLE", 0, errText(err))))
+		return
+	}
+	w.printf("  %s: [%s]\n", w.p.c(ansiRed, "UNREACHABLE"), host)
+	if err != nil {
+		w.printf("  %s\n", strings.TrimSpace(err.Error()))
+	}
+}
+
+// Ignored is the HostWriter form of the package-level Ignored.
+func (w *HostWriter) Ignored(host string, err error) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiYellow, oneLine(host, "FAILED (ignored)", errExitStatus(err), errText(err))))
+		return
+	}
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	w.printf("  %s: [%s] (ignored)\n", w.p.c(ansiYellow, "failed"), host)
+	if msg != "" {
+		w.printf("  %s\n", strings.TrimSpace(msg))
+	}
+}
+
+// Debug is the HostWriter form of the package-level Debug.
+func (w *HostWriter) Debug(host, msg string) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiGreen, oneLine(host, "SUCCESS", 0, msg)))
+		return
+	}
+	w.printf("  %s: [%s] =>\n", w.p.c(ansiGreen, "ok"), host)
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		w.printf("    %s\n", line)
+	}
+}
+
+// Skipped is the HostWriter form of the package-level Skipped.
+func (w *HostWriter) Skipped(host string) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiCyan, oneLine(host, "SKIPPED", 0, "")))
+		return
+	}
+	w.printf("  %s: [%s]\n", w.p.c(ansiCyan, "skipping"), host)
+}
+
+// SkippedItem is the HostWriter form of the package-level SkippedItem.
+func (w *HostWriter) SkippedItem(host string, item interface{}) {
+	if w.p.settings().oneLine {
+		w.printf("%s\n", w.p.c(ansiCyan, oneLine(host, "SKIPPED", 0, fmt.Sprintf("item=%v", item))))
+		return
+	}
+	w.printf("  %s: [%s] => (item=%v)\n", w.p.c(ansiCyan, "skipping"), host, item)
+}
+
+// DryRun is the HostWriter form of the package-level DryRun.
+func (w *HostWriter) DryRun(msg string) {
+	w.printf("  %s %s\n", w.p.c(ansiCyan, "[dry-run]"), msg)
+}
+
+// Copied is the HostWriter form of the package-level Copied.
+func (w *HostWriter) Copied(src, dest string) {
+	w.printf("  Copied %s -> %s\n", src, dest)
+}
+
+// Output is the HostWriter form of the package-level Output.
+func (w *HostWriter) Output(label, output string) {
+	if strings.TrimSpace(output) == "" {
+		return
+	}
+	w.printf("  %s:\n", w.p.c(ansiBold, label))
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		w.printf("    %s\n", line)
+	}
+}
+
+// RegisterNote is the HostWriter form of the package-level RegisterNote.
+func (w *HostWriter) RegisterNote(varName, value string) {
+	if w.p.settings().oneLine {
+		return
+	}
+	if strings.TrimSpace(value) != "" {
+		w.printf("  %s => %s: %s\n", w.p.c(ansiBlue, "registered"), varName, strings.TrimSpace(value))
+	} else {
+		w.printf("  %s => %s\n", w.p.c(ansiBlue, "registered"), varName)
+	}
+}
+
+// Diff is the HostWriter form of the package-level Diff.
+func (w *HostWriter) Diff(text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			w.printf("    %s\n", w.p.c(ansiBold, line))
+		case strings.HasPrefix(line, "+"):
+			w.printf("    %s\n", w.p.c(ansiGreen, line))
+		case strings.HasPrefix(line, "-"):
+			w.printf("    %s\n", w.p.c(ansiRed, line))
+		case strings.HasPrefix(line, "@@"):
+			w.printf("    %s\n", w.p.c(ansiCyan, line))
+		default:
+			w.printf("    %s\n", line)
+		}
+	}
+}
+
+// Drift is the HostWriter form of the package-level Drift.
+func (w *HostWriter) Drift(host, path string) {
+	w.printf("  %s: [%s] %s\n", w.p.c(ansiYellow, "drift"), host, path)
+}
+
+// Retry is the HostWriter form of the package-level Retry.
+func (w *HostWriter) Retry(attempt, retries int) {
+	w.printf("    retry %d/%d\n", attempt, retries)
+}
@@ -0,0 +1,75 @@
+package printer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHostWriter_UnbufferedWritesImmediately(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		w := NewHostWriter(false)
+		w.OK("web1", "")
+		if std.out.(fmt.Stringer).String() == "" {
+			t.Error("expected unbuffered writer to print before Flush")
+		}
+		w.Flush()
+	})
+	if got != "  ok: [web1]\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
+func TestHostWriter_BufferedHoldsUntilFlush(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		w := NewHostWriter(true)
+		w.HostHeader("web1")
+		w.OK("web1", "")
+		if std.out.(fmt.Stringer).String() != "" {
+			t.Error("expected buffered writer to hold output until Flush")
+		}
+		w.Flush()
+		w.Flush() // nothing left – must not repeat output
+	})
+	if got != "\n  HOST [web1]\n  ok: [web1]\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
+func TestHostWriter_ConcurrentHostsAreContiguous(t *testing.T) {
+	const hosts, lines = 8, 50
+	got := captureOutput(t, false, func() {
+		var wg sync.WaitGroup
+		for i := 0; i < hosts; i++ {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				w := NewHostWriter(true)
+				for j := 0; j < lines; j++ {
+					w.OK(host, "")
+				}
+				w.Flush()
+			}(fmt.Sprintf("host%d", i))
+		}
+		wg.Wait()
+	})
+
+	all := strings.Split(strings.TrimRight(got, "\n"), "\n")
+	if len(all) != hosts*lines {
+		t.Fatalf("expected %d lines, got %d", hosts*lines, len(all))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < len(all); i += lines {
+		block := all[i : i+lines]
+		for _, line := range block {
+			if line != block[0] {
+				t.Fatalf("interleaved output in block starting at line %d: %q vs %q", i, block[0], line)
+			}
+		}
+		if seen[block[0]] {
+			t.Fatalf("host block %q printed twice", block[0])
+		}
+		seen[block[0]] = true
+	}
+}
@@ -2,9 +2,15 @@
 package printer
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 // ANSI colour codes.
@@ -18,8 +24,110 @@ const (
 	ansiCyan   = "\033[36m"
 )
 
-// ColorsEnabled controls ANSI output. Auto-detected from stdout; can be overridden.
-var ColorsEnabled = isTerminal()
+// ColorsEnabled controls ANSI output. Auto-detected from stdout and off when
+// NO_COLOR is set; can be overridden.
+var ColorsEnabled = isTerminal() && os.Getenv("NO_COLOR") == ""
+
+// Terminal reports whether output goes to a terminal. When false, the recaps
+// use a layout meant for logs: titles without the * fill, columns only as
+// wide as their contents, no trailing spaces and no ANSI codes even if
+// ColorsEnabled is forced on.
+var Terminal = isTerminal()
+
+// OneLine switches to one line per host result (host | STATUS | rc=N | stdout)
+// and suppresses the PLAY/TASK/HANDLER/HOST banners.
+var OneLine bool
+
+// DiffCounts adds a diff column to the PLAY RECAP counting, per host, the
+// files whose diff was shown (HostSummary.Diffs). Set it for --diff runs.
+var DiffCounts bool
+
+// SummaryOnly suppresses everything written through HostWriters and the
+// package-level per-task functions (banners, result lines, output), leaving
+// only the recaps and reports. Buffered writers still collect their output;
+// it is dropped when it would reach stdout.
+var SummaryOnly bool
+
+// Printer is one destination for printer output with its own settings and
+// progress line, so that several runs can print at once without sharing
+// state. The package-level functions print through the default Printer,
+// which writes to stdout (see SetOutput) and takes its settings from the
+// package-level variables.
+type Printer struct {
+	// Colors, Terminal, OneLine, DiffCounts and SummaryOnly are the
+	// settings of a Printer made with New, as ColorsEnabled and the
+	// package-level variables of the same names are for the default one.
+	Colors      bool
+	Terminal    bool
+	OneLine     bool
+	DiffCounts  bool
+	SummaryOnly bool
+
+	// std marks the default Printer, whose settings are the package-level
+	// variables.
+	std bool
+	// mu serialises output with the progress line.
+	mu  sync.Mutex
+	out io.Writer
+	// transcript receives a copy of the output; see SetTranscript. Guarded
+	// by mu.
+	transcript io.Writer
+	// active is the progress tracker currently drawn, if any, and drawn
+	// whether its line is on screen. Guarded by mu.
+	active *Progress
+	drawn  bool
+	// stdout is the unbuffered writer behind the package-level output
+	// functions.
+	stdout *HostWriter
+}
+
+// New returns a Printer writing to w, or discarding its output when w is
+// nil. Its settings start out in the layout meant for logs: no colours, no
+// progress line and recaps without the * fill.
+func New(w io.Writer) *Printer {
+	if w == nil {
+		w = io.Discard
+	}
+	p := &Printer{out: w}
+	p.stdout = &HostWriter{p: p}
+	return p
+}
+
+// std is the default Printer.
+var std = func() *Printer {
+	p := New(os.Stdout)
+	p.std = true
+	return p
+}()
+
+// Default returns the Printer behind the package-level functions.
+func Default() *Printer {
+	return std
+}
+
+// settings are a Printer's output settings; see Printer.settings.
+type settings struct {
+	colors, terminal, oneLine, diffCounts, summaryOnly bool
+}
+
+// settings returns p's settings: its fields, or the package-level variables
+// for the default Printer.
+func (p *Printer) settings() settings {
+	if p.std {
+		return settings{ColorsEnabled, Terminal, OneLine, DiffCounts, SummaryOnly}
+	}
+	return settings{p.Colors, p.Terminal, p.OneLine, p.DiffCounts, p.SummaryOnly}
+}
+
+// SetOutput redirects the default Printer's output to w and returns the
+// previous destination.
+func SetOutput(w io.Writer) io.Writer {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	prev := std.out
+	std.out = w
+	return prev
+}
 
 func isTerminal() bool {
 	fi, err := os.Stdout.Stat()
@@ -29,13 +137,62 @@ func isTerminal() bool {
 	return (fi.Mode() & os.ModeCharDevice) != 0
 }
 
-func c(color, s string) string {
-	if !ColorsEnabled {
+// printf writes to p's output, clearing and redrawing any active progress
+// line so it never interleaves with regular output.
+func (p *Printer) printf(format string, args ...interface{}) {
+	p.writeOut([]byte(fmt.Sprintf(format, args...)))
+}
+
+// writeOut writes b to p's output, and the transcript if any, under p's
+// output lock.
+func (p *Printer) writeOut(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearProgressLocked()
+	p.out.Write(b)
+	if p.transcript != nil {
+		p.transcript.Write(ansiEscape.ReplaceAll(b, nil))
+	}
+	p.drawProgressLocked()
+}
+
+func (p *Printer) c(color, s string) string {
+	if !p.settings().colors {
 		return s
 	}
 	return color + s + ansiReset
 }
 
+// rc colours s like c, except in recaps written to a non-terminal.
+func (p *Printer) rc(color, s string) string {
+	if !p.settings().terminal {
+		return s
+	}
+	return p.c(color, s)
+}
+
+// recapTitle returns a recap title line: bold with a * fill on a terminal,
+// the bare title otherwise.
+func (p *Printer) recapTitle(title string) string {
+	if !p.settings().terminal {
+		return title
+	}
+	return p.c(ansiBold, title+" ") + banner("*", title+" ")
+}
+
+// hostColumn returns the width of the host column in a recap: 24 on a
+// terminal, otherwise the longest host name.
+func (p *Printer) hostColumn(hosts []string) int {
+	if p.settings().terminal {
+		return 24
+	}
+	w := 0
+	for _, h := range hosts {
+		w = max(w, len(h))
+	}
+	return w
+}
+
 func pad(s string, width int) string {
 	if len(s) >= width {
 		return s
@@ -51,121 +208,418 @@ type HostSummary struct {
 	Failed  int
 	Skipped int
 	Ignored int
+	// Unreachable counts tasks that could not connect to the host and
+	// were not counted as failed (see tasks.RunOptions.IgnoreUnreachable).
+	Unreachable int
+	// Diffs counts the files a diff was shown for, i.e. that differ from
+	// the target under --diff; see DiffCounts.
+	Diffs int
+}
+
+// oneLine formats a single-line host result.
+func oneLine(host, status string, rc int, output string) string {
+	first := ""
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			first = line
+			break
+		}
+	}
+	line := fmt.Sprintf("%s | %s | rc=%d", host, status, rc)
+	if first != "" {
+		line += " | " + first
+	}
+	return line
+}
+
+// Truncate shortens s to at most max bytes, cut on a rune boundary, and
+// appends a "... (truncated, M more bytes)" line. max <= 0 means no limit.
+func Truncate(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	head := s[:cut]
+	if !strings.HasSuffix(head, "\n") {
+		head += "\n"
+	}
+	return head + fmt.Sprintf("... (truncated, %d more bytes)\n", len(s)-cut)
+}
+
+// errExitStatus returns the exit status carried by err, or 1.
+func errExitStatus(err error) int {
+	var status interface{ ExitStatus() int }
+	if errors.As(err, &status) {
+		return status.ExitStatus()
+	}
+	var code interface{ ExitCode() int }
+	if errors.As(err, &code) {
+		return code.ExitCode()
+	}
+	return 1
+}
+
+func errText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
 }
 
 // PlayHeader prints the PLAY banner.
 func PlayHeader(name string) {
-	sep := strings.Repeat("*", max(0, 72-len(name)-8))
-	fmt.Printf("\n%s [%s] %s\n", c(ansiBold+ansiBlue, "PLAY"), c(ansiBold, name), sep)
+	std.stdout.PlayHeader(name)
 }
 
 // TaskHeader prints the TASK banner.
 func TaskHeader(name string) {
-	sep := strings.Repeat("-", max(0, 72-len(name)-8))
-	fmt.Printf("\n%s [%s] %s\n", c(ansiBold, "TASK"), name, sep)
+	std.stdout.TaskHeader(name)
 }
 
 // HandlerHeader prints the HANDLER banner.
 func HandlerHeader(name string) {
-	sep := strings.Repeat("-", max(0, 72-len(name)-11))
-	fmt.Printf("\n%s [%s] %s\n", c(ansiBold, "HANDLER"), name, sep)
+	std.stdout.HandlerHeader(name)
 }
 
 // HostHeader prints a host separator line.
 func HostHeader(host string) {
-	fmt.Printf("\n%s\n", c(ansiCyan, "  HOST ["+host+"]"))
+	std.stdout.HostHeader(host)
 }
 
 // OK prints an ok result line and optional output.
 func OK(host, output string) {
-	fmt.Printf("  %s: [%s]\n", c(ansiGreen, "ok"), host)
-	if strings.TrimSpace(output) != "" {
-		Output("stdout", output)
-	}
+	std.stdout.OK(host, output)
 }
 
 // Changed prints a changed result line and optional output.
 func Changed(host, output string) {
-	fmt.Printf("  %s: [%s]\n", c(ansiYellow, "changed"), host)
-	if strings.TrimSpace(output) != "" {
-		Output("stdout", output)
-	}
+	std.stdout.Changed(host, output)
 }
 
 // Failed prints a failed result line.
 func Failed(host string, err error) {
-	msg := ""
-	if err != nil {
-		msg = err.Error()
-	}
-	fmt.Printf("  %s: [%s]\n", c(ansiRed, "FAILED"), host)
-	if msg != "" {
-		fmt.Printf("  %s\n", strings.TrimSpace(msg))
-	}
+	std.stdout.Failed(host, err)
+}
+
+// Unreachable prints an unreachable result line.
+func Unreachable(host string, err error) {
+	std.stdout.Unreachable(host, err)
 }
 
 // Ignored prints an ignored-error result line.
 func Ignored(host string, err error) {
-	msg := ""
-	if err != nil {
-		msg = err.Error()
-	}
-	fmt.Printf("  %s: [%s] (ignored)\n", c(ansiYellow, "failed"), host)
-	if msg != "" {
-		fmt.Printf("  %s\n", strings.TrimSpace(msg))
-	}
+	std.stdout.Ignored(host, err)
+}
+
+// Debug prints the ok line of a debug task followed by its message.
+func Debug(host, msg string) {
+	std.stdout.Debug(host, msg)
 }
 
 // Skipped prints a skipped result line.
 func Skipped(host string) {
-	fmt.Printf("  %s: [%s]\n", c(ansiCyan, "skipping"), host)
+	std.stdout.Skipped(host)
+}
+
+// SkippedItem prints a skipped loop item: when did not hold for item.
+func SkippedItem(host string, item interface{}) {
+	std.stdout.SkippedItem(host, item)
 }
 
 // DryRun prints a dry-run line for a command or copy.
 func DryRun(msg string) {
-	fmt.Printf("  %s %s\n", c(ansiCyan, "[dry-run]"), msg)
+	std.stdout.DryRun(msg)
+}
+
+// Copied prints a note that a local copy wrote src to dest.
+func Copied(src, dest string) {
+	std.stdout.Copied(src, dest)
 }
 
 // Output prints captured command output with a label.
 func Output(label, output string) {
-	if strings.TrimSpace(output) == "" {
-		return
-	}
-	fmt.Printf("  %s:\n", c(ansiBold, label))
-	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
-		fmt.Printf("    %s\n", line)
-	}
+	std.stdout.Output(label, output)
 }
 
 // RegisterNote prints a note that a result was registered, with its value.
 func RegisterNote(varName, value string) {
-	if strings.TrimSpace(value) != "" {
-		fmt.Printf("  %s => %s: %s\n", c(ansiBlue, "registered"), varName, strings.TrimSpace(value))
-	} else {
-		fmt.Printf("  %s => %s\n", c(ansiBlue, "registered"), varName)
+	std.stdout.RegisterNote(varName, value)
+}
+
+// Diff prints a unified diff, colouring added and removed lines.
+func Diff(text string) {
+	std.stdout.Diff(text)
+}
+
+// Drift prints a drift result line for a file that differs from the desired state.
+func Drift(host, path string) {
+	std.stdout.Drift(host, path)
+}
+
+// Retry prints a note that a failed task is being retried.
+func Retry(attempt, retries int) {
+	std.stdout.Retry(attempt, retries)
+}
+
+// Notice prints a run-level message, such as a warning, that belongs to no
+// host's task output. SummaryOnly does not hide it.
+func (p *Printer) Notice(format string, args ...interface{}) {
+	p.printf(format+"\n", args...)
+}
+
+// Notice is Printer.Notice on the default Printer.
+func Notice(format string, args ...interface{}) {
+	std.Notice(format, args...)
+}
+
+// DriftSummary prints how many hosts differ from the desired state.
+func (p *Printer) DriftSummary(drifted, total int) {
+	if drifted == 0 {
+		p.printf("%s\n\n", p.rc(ansiGreen, fmt.Sprintf("No drift: 0 of %d hosts differ from the playbook", total)))
+		return
 	}
+	p.printf("%s\n\n", p.rc(ansiYellow, fmt.Sprintf("%d hosts in drift (of %d)", drifted, total)))
 }
 
-// Recap prints the final PLAY RECAP table.
-func Recap(summaries []HostSummary) {
-	fmt.Printf("\n%s%s\n", c(ansiBold, "PLAY RECAP "), strings.Repeat("*", 62))
+// DriftSummary is Printer.DriftSummary on the default Printer.
+func DriftSummary(drifted, total int) {
+	std.DriftSummary(drifted, total)
+}
+
+// Recap prints the final PLAY RECAP table. On a terminal the host column is
+// 24 wide and each count 4; otherwise columns fit their widest value and
+// the last one is not padded. An unreachable column follows failed when any
+// host was unreachable, and a diff column follows changed under DiffCounts.
+func (p *Printer) Recap(summaries []HostSummary) {
+	p.printf("\n%s\n", p.recapTitle("PLAY RECAP"))
+	set := p.settings()
+	hosts := make([]string, len(summaries))
+	anyUnreachable := false
+	for i, s := range summaries {
+		hosts[i] = s.Host
+		anyUnreachable = anyUnreachable || s.Unreachable > 0
+	}
+	hostWidth := p.hostColumn(hosts)
+	widths := [7]int{4, 4, 4, 4, 4, 4, 4}
+	if !set.terminal {
+		widths = [7]int{}
+		for _, s := range summaries {
+			for i, n := range [5]int{s.OK, s.Changed, s.Failed, s.Skipped, s.Unreachable} {
+				widths[i] = max(widths[i], len(fmt.Sprint(n)))
+			}
+			widths[6] = max(widths[6], len(fmt.Sprint(s.Diffs)))
+		}
+	}
 	for _, s := range summaries {
-		hostStr := pad(s.Host, 24)
-		if s.Failed > 0 {
-			hostStr = c(ansiRed, hostStr)
+		hostStr := pad(s.Host, hostWidth)
+		if s.Failed > 0 || s.Unreachable > 0 {
+			hostStr = p.rc(ansiRed, hostStr)
 		} else if s.Changed > 0 {
-			hostStr = c(ansiYellow, hostStr)
+			hostStr = p.rc(ansiYellow, hostStr)
 		} else {
-			hostStr = c(ansiGreen, hostStr)
+			hostStr = p.rc(ansiGreen, hostStr)
+		}
+		ok := p.rc(ansiGreen, fmt.Sprintf("ok=%-*d", widths[0], s.OK))
+		chg := p.rc(ansiYellow, fmt.Sprintf("changed=%-*d", widths[1], s.Changed))
+		if set.diffCounts {
+			chg += " " + p.rc(ansiYellow, fmt.Sprintf("diff=%-*d", widths[6], s.Diffs))
+		}
+		fail := p.rc(ansiRed, fmt.Sprintf("failed=%-*d", widths[2], s.Failed))
+		if anyUnreachable {
+			fail += " " + p.rc(ansiRed, fmt.Sprintf("unreachable=%-*d", widths[4], s.Unreachable))
+		}
+		skip := p.rc(ansiCyan, fmt.Sprintf("skipped=%-*d", widths[3], s.Skipped))
+		ign := p.rc(ansiYellow, fmt.Sprintf("ignored=%-*d", widths[5], s.Ignored))
+		p.printf("  %s : %s %s %s %s %s\n", hostStr, ok, chg, fail, skip, ign)
+	}
+	p.printf("\n")
+}
+
+// Recap is Printer.Recap on the default Printer.
+func Recap(summaries []HostSummary) {
+	std.Recap(summaries)
+}
+
+// CheckRecap prints, for a check-mode run, how many tasks would change on
+// each host (sorted by host) and the total. It returns the total so callers
+// can fail when anything would change.
+func (p *Printer) CheckRecap(summaries []HostSummary) int {
+	sorted := append([]HostSummary(nil), summaries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Host < sorted[j].Host })
+	hosts := make([]string, len(sorted))
+	for i, s := range sorted {
+		hosts[i] = s.Host
+	}
+	hostWidth := p.hostColumn(hosts)
+
+	p.printf("%s\n", p.recapTitle("CHECK RECAP"))
+	total, changing := 0, 0
+	for _, s := range sorted {
+		line := fmt.Sprintf("%d would change", s.Changed)
+		if s.Changed > 0 {
+			line = p.rc(ansiYellow, line)
+			total += s.Changed
+			changing++
+		} else {
+			line = p.rc(ansiGreen, line)
+		}
+		p.printf("  %s : %s\n", pad(s.Host, hostWidth), line)
+	}
+	summary := fmt.Sprintf("Total: %d would change on %d of %d hosts", total, changing, len(sorted))
+	if total > 0 {
+		p.printf("%s\n\n", p.rc(ansiYellow, summary))
+	} else {
+		p.printf("%s\n\n", p.rc(ansiGreen, summary))
+	}
+	return total
+}
+
+// CheckRecap is Printer.CheckRecap on the default Printer.
+func CheckRecap(summaries []HostSummary) int {
+	return std.CheckRecap(summaries)
+}
+
+// Failure is one failed task on one host, as listed by FailureReport.
+type Failure struct {
+	Host string
+	Task string
+	Err  error
+}
+
+// FailureReport prints every failure of a --keep-going run, in the order
+// given, followed by a total.
+func (p *Printer) FailureReport(failures []Failure) {
+	p.printf("%s\n", p.recapTitle("FAILURE REPORT"))
+	names := make([]string, len(failures))
+	hosts := make(map[string]bool)
+	for i, f := range failures {
+		names[i] = f.Host
+		hosts[f.Host] = true
+	}
+	hostWidth := p.hostColumn(names)
+	for _, f := range failures {
+		p.printf("  %s : %s : %s\n", pad(f.Host, hostWidth), f.Task, p.rc(ansiRed, oneLineError(f.Err)))
+	}
+	summary := fmt.Sprintf("Total: %d failed on %d hosts", len(failures), len(hosts))
+	if len(failures) > 0 {
+		p.printf("%s\n\n", p.rc(ansiRed, summary))
+	} else {
+		p.printf("%s\n\n", p.rc(ansiGreen, summary))
+	}
+}
+
+// FailureReport is Printer.FailureReport on the default Printer.
+func FailureReport(failures []Failure) {
+	std.FailureReport(failures)
+}
+
+// TaskTiming is the run time of one task name across hosts, as listed by
+// TaskProfile.
+type TaskTiming struct {
+	Task string
+	// Total is the time spent in the task summed over every run.
+	Total time.Duration
+	// Count is the number of times the task ran; Hosts the number of
+	// distinct hosts it ran on.
+	Count int
+	Hosts int
+}
+
+// Average returns the mean time the task took per host.
+func (t TaskTiming) Average() time.Duration {
+	if t.Hosts == 0 {
+		return 0
+	}
+	return t.Total / time.Duration(t.Hosts)
+}
+
+// TaskProfile prints the --profile-tasks table in the order given.
+func (p *Printer) TaskProfile(timings []TaskTiming) {
+	p.printf("%s\n", p.recapTitle("TASKS PROFILE"))
+	names := make([]string, len(timings))
+	for i, t := range timings {
+		names[i] = t.Task
+	}
+	nameWidth := p.hostColumn(names)
+	for _, t := range timings {
+		p.printf("  %s : total=%s avg/host=%s count=%d\n", pad(t.Task, nameWidth),
+			t.Total.Round(time.Millisecond), t.Average().Round(time.Millisecond), t.Count)
+	}
+	p.printf("\n")
+}
+
+// TaskProfile is Printer.TaskProfile on the default Printer.
+func TaskProfile(timings []TaskTiming) {
+	std.TaskProfile(timings)
+}
+
+// Ping statuses reported by PingResult.Status.
+const (
+	PingPong        = "pong"
+	PingUnreachable = "unreachable"
+	PingFailed      = "failed"
+)
+
+// PingResult is the outcome of a connectivity check on one host, as listed
+// by PingReport.
+type PingResult struct {
+	Host    string
+	Elapsed time.Duration
+	// Err is nil for a host that answered pong.
+	Err error
+	// Unreachable is set when no connection could be made, as opposed to a
+	// connection on which the check command failed.
+	Unreachable bool
+}
+
+// Status returns PingPong, PingUnreachable or PingFailed.
+func (r PingResult) Status() string {
+	switch {
+	case r.Err == nil:
+		return PingPong
+	case r.Unreachable:
+		return PingUnreachable
+	default:
+		return PingFailed
+	}
+}
+
+// PingReport prints one line per host in the order given, followed by the
+// number of reachable, unreachable and failed hosts.
+func (p *Printer) PingReport(results []PingResult) {
+	p.printf("%s\n", p.recapTitle("PING"))
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = r.Host
+	}
+	hostWidth := p.hostColumn(names)
+	counts := make(map[string]int)
+	for _, r := range results {
+		status := r.Status()
+		counts[status]++
+		line := fmt.Sprintf("%s %s", status, r.Elapsed.Round(time.Millisecond))
+		switch status {
+		case PingPong:
+			line = p.rc(ansiGreen, line)
+		default:
+			line = p.rc(ansiRed, line+" "+oneLineError(r.Err))
 		}
-		ok := c(ansiGreen, fmt.Sprintf("ok=%-4d", s.OK))
-		chg := c(ansiYellow, fmt.Sprintf("changed=%-4d", s.Changed))
-		fail := c(ansiRed, fmt.Sprintf("failed=%-4d", s.Failed))
-		skip := c(ansiCyan, fmt.Sprintf("skipped=%-4d", s.Skipped))
-		ign := c(ansiYellow, fmt.Sprintf("ignored=%-4d", s.Ignored))
-		fmt.Printf("  %s : %s %s %s %s %s\n", hostStr, ok, chg, fail, skip, ign)
-	}
-	fmt.Println()
+		p.printf("  %s : %s\n", pad(r.Host, hostWidth), line)
+	}
+	p.printf("reachable=%d unreachable=%d failed=%d\n\n", counts[PingPong], counts[PingUnreachable], counts[PingFailed])
+}
+
+// PingReport is Printer.PingReport on the default Printer.
+func PingReport(results []PingResult) {
+	std.PingReport(results)
+}
+
+// oneLineError flattens a multi-line error message onto one line.
+func oneLineError(err error) string {
+	return strings.Join(strings.Fields(errText(err)), " ")
 }
 
 func max(a, b int) int {
@@ -0,0 +1,266 @@
+package printer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type exitErr struct{ code int }
+
+func (e exitErr) Error() string   { return "process exited\nwith more detail" }
+func (e exitErr) ExitStatus() int { return e.code }
+
+// captureOutput runs fn with colours off and returns what it printed.
+func captureOutput(t *testing.T, oneLine bool, fn func()) string {
+	t.Helper()
+	var buf bytes.Buffer
+	prevOut, prevColors, prevOneLine, prevTerminal := std.out, ColorsEnabled, OneLine, Terminal
+	std.out, ColorsEnabled, OneLine, Terminal = &buf, false, oneLine, true
+	defer func() { std.out, ColorsEnabled, OneLine, Terminal = prevOut, prevColors, prevOneLine, prevTerminal }()
+	fn()
+	return buf.String()
+}
+
+func TestOneLine_OK(t *testing.T) {
+	got := captureOutput(t, true, func() {
+		TaskHeader("uptime")
+		HostHeader("web1")
+		OK("web1", "\n 10:00 up 3 days\nsecond line\n")
+	})
+	want := "web1 | SUCCESS | rc=0 | 10:00 up 3 days\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOneLine_Failed(t *testing.T) {
+	got := captureOutput(t, true, func() {
+		Failed("db1", exitErr{code: 127})
+	})
+	want := "db1 | FAILED | rc=127 | process exited\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got = captureOutput(t, true, func() {
+		Failed("db1", errors.New("dial tcp: connection refused"))
+	})
+	want = "db1 | FAILED | rc=1 | dial tcp: connection refused\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOneLine_EmptyOutput(t *testing.T) {
+	got := captureOutput(t, true, func() {
+		Changed("web2", "")
+	})
+	if want := "web2 | CHANGED | rc=0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		Debug("web1", "version: {\n  \"a\": 1\n}")
+	})
+	want := "  ok: [web1] =>\n    version: {\n      \"a\": 1\n    }\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := Truncate("short", 10); got != "short" {
+		t.Errorf("expected short output untouched, got %q", got)
+	}
+	if got := Truncate("exactly10!", 10); got != "exactly10!" {
+		t.Errorf("expected output at the limit untouched, got %q", got)
+	}
+	if got := Truncate("abcdefghijkl", 0); got != "abcdefghijkl" {
+		t.Errorf("expected no limit for 0, got %q", got)
+	}
+	if got, want := Truncate("abcdefghijkl", 5), "abcde\n... (truncated, 7 more bytes)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// "é" is two bytes; cutting inside it backs off to the rune boundary.
+	if got, want := Truncate("abcé-tail", 4), "abc\n... (truncated, 7 more bytes)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCheckRecap(t *testing.T) {
+	var total int
+	got := captureOutput(t, false, func() {
+		total = CheckRecap([]HostSummary{
+			{Host: "web2", OK: 4},
+			{Host: "web1", OK: 1, Changed: 3},
+			{Host: "db1", Changed: 1},
+		})
+	})
+	if total != 4 {
+		t.Errorf("expected a total of 4, got %d", total)
+	}
+	for _, want := range []string{
+		"  db1                      : 1 would change\n  web1                     : 3 would change\n  web2                     : 0 would change\n",
+		"Total: 4 would change on 2 of 3 hosts\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in %q", want, got)
+		}
+	}
+}
+
+func TestFailureReport(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		FailureReport([]Failure{
+			{Host: "db1", Task: "check disk", Err: errors.New("exit status 1\ndisk full")},
+			{Host: "web1", Task: "check disk", Err: errors.New("timeout")},
+			{Host: "web1", Task: "check ntp", Err: errors.New("exit status 2")},
+		})
+	})
+	for _, want := range []string{
+		"  db1                      : check disk : exit status 1 disk full\n",
+		"  web1                     : check disk : timeout\n  web1                     : check ntp : exit status 2\n",
+		"Total: 3 failed on 2 hosts\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in %q", want, got)
+		}
+	}
+}
+
+func TestRecap_TerminalVsRedirected(t *testing.T) {
+	prevWidth := OutputWidth
+	OutputWidth = 40
+	defer func() { OutputWidth = prevWidth }()
+	summaries := []HostSummary{
+		{Host: "web1.example.com", OK: 12, Changed: 3},
+		{Host: "db1", OK: 4, Failed: 1, Ignored: 2},
+	}
+	render := func(terminal bool) string {
+		return captureOutput(t, false, func() {
+			ColorsEnabled, Terminal = true, terminal
+			Recap(summaries)
+		})
+	}
+
+	tty := render(true)
+	if !strings.Contains(tty, "\033[") || !strings.Contains(tty, strings.Repeat("*", 40-len("PLAY RECAP "))) {
+		t.Errorf("expected colour and a * fill on a terminal, got %q", tty)
+	}
+
+	plain := render(false)
+	want := "\nPLAY RECAP\n" +
+		"  web1.example.com : ok=12 changed=3 failed=0 skipped=0 ignored=0\n" +
+		"  db1              : ok=4  changed=0 failed=1 skipped=0 ignored=2\n\n"
+	if plain != want {
+		t.Errorf("got %q, want %q", plain, want)
+	}
+	if strings.Contains(plain, "\033") {
+		t.Errorf("expected no ANSI codes when redirected, got %q", plain)
+	}
+	for _, line := range strings.Split(plain, "\n") {
+		if strings.HasSuffix(line, " ") {
+			t.Errorf("expected no trailing spaces, got %q", line)
+		}
+	}
+}
+
+func TestRecap_UnreachableColumn(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		Terminal = false
+		Recap([]HostSummary{
+			{Host: "web1", OK: 12, Changed: 3},
+			{Host: "web2", Unreachable: 1},
+		})
+	})
+	want := "\nPLAY RECAP\n" +
+		"  web1 : ok=12 changed=3 failed=0 unreachable=0 skipped=0 ignored=0\n" +
+		"  web2 : ok=0  changed=0 failed=0 unreachable=1 skipped=0 ignored=0\n\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRecap_DiffColumn(t *testing.T) {
+	summaries := []HostSummary{
+		{Host: "web1", OK: 3, Changed: 12, Diffs: 10},
+		{Host: "web2", OK: 4},
+	}
+	render := func(diffCounts bool) string {
+		return captureOutput(t, false, func() {
+			Terminal = false
+			prev := DiffCounts
+			DiffCounts = diffCounts
+			defer func() { DiffCounts = prev }()
+			Recap(summaries)
+		})
+	}
+
+	want := "\nPLAY RECAP\n" +
+		"  web1 : ok=3 changed=12 diff=10 failed=0 skipped=0 ignored=0\n" +
+		"  web2 : ok=4 changed=0  diff=0  failed=0 skipped=0 ignored=0\n\n"
+	if got := render(true); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := render(false); strings.Contains(got, "diff=") {
+		t.Errorf("expected no diff column outside diff mode, got %q", got)
+	}
+}
+
+func TestTaskProfile(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		Terminal = false
+		TaskProfile([]TaskTiming{
+			{Task: "install packages", Total: 8 * time.Second, Count: 2, Hosts: 2},
+			{Task: "restart", Total: 1500 * time.Millisecond, Count: 3, Hosts: 2},
+		})
+	})
+	want := "TASKS PROFILE\n" +
+		"  install packages : total=8s avg/host=4s count=2\n" +
+		"  restart          : total=1.5s avg/host=750ms count=3\n\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPingReport(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		Terminal = false
+		PingReport([]PingResult{
+			{Host: "web1", Elapsed: 12 * time.Millisecond},
+			{Host: "web2", Elapsed: 5 * time.Second, Err: errors.New("dial tcp: connection\nrefused"), Unreachable: true},
+			{Host: "db1", Elapsed: 20 * time.Millisecond, Err: errors.New("exit status 127")},
+		})
+	})
+	want := "PING\n" +
+		"  web1 : pong 12ms\n" +
+		"  web2 : unreachable 5s dial tcp: connection refused\n" +
+		"  db1  : failed 20ms exit status 127\n" +
+		"reachable=1 unreachable=1 failed=1\n\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNew_OwnOutputAndSettings(t *testing.T) {
+	var own bytes.Buffer
+	p := New(&own)
+	p.OneLine = true
+	got := captureOutput(t, false, func() {
+		p.NewHostWriter(false).OK("web1", "up")
+		OK("web2", "")
+		p.Recap([]HostSummary{{Host: "web1", OK: 1}})
+	})
+	if got != "  ok: [web2]\n" {
+		t.Errorf("expected only the default Printer's output on stdout, got %q", got)
+	}
+	want := "web1 | SUCCESS | rc=0 | up\n\nPLAY RECAP\n  web1 : ok=1 changed=0 failed=0 skipped=0 ignored=0\n\n"
+	if own.String() != want {
+		t.Errorf("got %q, want %q", own.String(), want)
+	}
+}
@@ -0,0 +1,138 @@
+package printer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ProgressEnabled allows the live progress line. It is only drawn when
+// colours are enabled too, i.e. stdout is a terminal and --no-color is unset.
+var ProgressEnabled = true
+
+// Progress tracks completed/total hosts and the task most recently started.
+type Progress struct {
+	mu        sync.Mutex
+	total     int
+	completed int
+	task      string
+}
+
+// NewProgress returns a tracker for total hosts.
+func NewProgress(total int) *Progress {
+	return &Progress{total: total}
+}
+
+// SetTask records the name of the task currently running.
+func (p *Progress) SetTask(name string) {
+	p.mu.Lock()
+	p.task = name
+	p.mu.Unlock()
+}
+
+// HostDone marks one host as completed. Calls beyond total are ignored.
+func (p *Progress) HostDone() {
+	p.mu.Lock()
+	if p.completed < p.total {
+		p.completed++
+	}
+	p.mu.Unlock()
+}
+
+// State returns the completed and total host counts and the current task.
+func (p *Progress) State() (completed, total int, task string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.completed, p.total, p.task
+}
+
+// Line renders the progress line without terminal control codes.
+func (p *Progress) Line() string {
+	completed, total, task := p.State()
+	line := fmt.Sprintf("[%d/%d hosts]", completed, total)
+	if task != "" {
+		line += " TASK [" + task + "]"
+	}
+	return line
+}
+
+// StartProgress begins drawing a progress line for total hosts on the
+// default Printer; see Printer.StartProgress.
+func StartProgress(total int) {
+	std.StartProgress(total)
+}
+
+// ProgressTask is Printer.ProgressTask on the default Printer.
+func ProgressTask(name string) {
+	std.ProgressTask(name)
+}
+
+// ProgressHostDone is Printer.ProgressHostDone on the default Printer.
+func ProgressHostDone() {
+	std.ProgressHostDone()
+}
+
+// StopProgress is Printer.StopProgress on the default Printer.
+func StopProgress() {
+	std.StopProgress()
+}
+
+// StartProgress begins drawing a progress line for total hosts. It is a no-op
+// when progress is disabled or p has colours off, e.g. stdout is not a
+// terminal.
+func (p *Printer) StartProgress(total int) {
+	if !ProgressEnabled || !p.settings().colors {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearProgressLocked()
+	p.active = NewProgress(total)
+	p.drawProgressLocked()
+}
+
+// ProgressTask updates the task shown on the progress line.
+func (p *Printer) ProgressTask(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == nil {
+		return
+	}
+	p.active.SetTask(name)
+	p.clearProgressLocked()
+	p.drawProgressLocked()
+}
+
+// ProgressHostDone advances the completed-host counter on the progress line.
+func (p *Printer) ProgressHostDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == nil {
+		return
+	}
+	p.active.HostDone()
+	p.clearProgressLocked()
+	p.drawProgressLocked()
+}
+
+// StopProgress clears the progress line; call it before printing the recap.
+func (p *Printer) StopProgress() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearProgressLocked()
+	p.active = nil
+}
+
+func (p *Printer) clearProgressLocked() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+func (p *Printer) drawProgressLocked() {
+	if p.active == nil {
+		return
+	}
+	fmt.Fprint(p.out, p.c(ansiBold, p.active.Line()))
+	p.drawn = true
+}
@@ -0,0 +1,56 @@
+package printer
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestProgress_Transitions(t *testing.T) {
+	p := NewProgress(3)
+	if done, total, _ := p.State(); done != 0 || total != 3 {
+		t.Fatalf("expected 0/3, got %d/%d", done, total)
+	}
+
+	p.SetTask("Install nginx")
+	p.HostDone()
+	if got := p.Line(); got != "[1/3 hosts] TASK [Install nginx]" {
+		t.Errorf("unexpected line: %q", got)
+	}
+
+	p.HostDone()
+	p.HostDone()
+	p.HostDone() // beyond total – ignored
+	if done, total, _ := p.State(); done != 3 || total != 3 {
+		t.Errorf("expected 3/3 after completion, got %d/%d", done, total)
+	}
+}
+
+func TestProgress_ConcurrentHostDone(t *testing.T) {
+	p := NewProgress(100)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.HostDone()
+		}()
+	}
+	wg.Wait()
+	if done, _, _ := p.State(); done != 100 {
+		t.Errorf("expected 100 completed, got %d", done)
+	}
+}
+
+func TestStartProgress_DisabledWithoutColors(t *testing.T) {
+	prev := ColorsEnabled
+	ColorsEnabled = false
+	defer func() { ColorsEnabled = prev }()
+
+	StartProgress(5)
+	defer StopProgress()
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	if std.active != nil {
+		t.Error("expected no active progress when colours are disabled")
+	}
+}
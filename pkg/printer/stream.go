@@ -0,0 +1,87 @@
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+// Stream prints a running command's output as it arrives, one line at a
+// time prefixed with the host ("  web1 | line"), so lines from hosts running
+// in parallel stay legible. It writes to its Printer's output as lines
+// complete, bypassing any buffered HostWriter, and prints nothing when
+// SummaryOnly is set. Like Truncate, it stops after max bytes (0 = no limit)
+// and reports how many more there were on Close.
+type Stream struct {
+	host string
+	p    *Printer
+	max  int
+	mu   sync.Mutex
+	// partial holds output after the last newline until the line completes.
+	partial []byte
+	// kept and dropped count the bytes printed and cut off under max.
+	kept, dropped int
+}
+
+// NewStream returns a Stream for host's output, cut off after max bytes.
+func NewStream(host string, max int) *Stream {
+	return std.NewStream(host, max)
+}
+
+// NewStream is the package-level NewStream for output to p.
+func (p *Printer) NewStream(host string, max int) *Stream {
+	return &Stream{host: host, p: p, max: max}
+}
+
+// Write prints every complete line in p; a trailing partial line is kept
+// until its newline arrives or Close is called.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(p)
+	if s.max > 0 && s.kept+len(p) > s.max {
+		cut := s.max - s.kept
+		for cut > 0 && !utf8.RuneStart(p[cut]) {
+			cut--
+		}
+		s.dropped += len(p) - cut
+		s.kept = s.max
+		p = p[:cut]
+	} else {
+		s.kept += len(p)
+	}
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.line(s.partial[:i])
+		s.partial = s.partial[i+1:]
+	}
+	return n, nil
+}
+
+// Close prints the last line if it did not end in a newline, then the
+// truncation marker if output was cut off.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.partial) > 0 {
+		s.line(s.partial)
+		s.partial = nil
+	}
+	if s.dropped > 0 {
+		s.line([]byte(fmt.Sprintf("... (truncated, %d more bytes)", s.dropped)))
+		s.dropped = 0
+	}
+	return nil
+}
+
+func (s *Stream) line(text []byte) {
+	if s.p.settings().summaryOnly {
+		return
+	}
+	s.p.printf("  %s | %s\n", s.p.c(ansiCyan, s.host), bytes.TrimRight(text, "\r"))
+}
@@ -0,0 +1,48 @@
+package printer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStream_PrintsCompleteLines(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		s := NewStream("web1", 0)
+		s.Write([]byte("first\nsec"))
+		if got := std.out.(fmt.Stringer).String(); got != "  web1 | first\n" {
+			t.Errorf("expected only the complete line before Close, got %q", got)
+		}
+		s.Write([]byte("ond\r\nthird"))
+		s.Close()
+	})
+	want := "  web1 | first\n  web1 | second\n  web1 | third\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStream_SummaryOnly(t *testing.T) {
+	SummaryOnly = true
+	defer func() { SummaryOnly = false }()
+	got := captureOutput(t, false, func() {
+		s := NewStream("web1", 0)
+		s.Write([]byte("hidden\n"))
+		s.Close()
+	})
+	if got != "" {
+		t.Errorf("expected no output, got %q", got)
+	}
+}
+
+func TestStream_MaxBytes(t *testing.T) {
+	got := captureOutput(t, false, func() {
+		s := NewStream("web1", 8)
+		s.Write([]byte("first\nsec"))
+		s.Write([]byte("ond\nthird\n"))
+		s.Close()
+	})
+	want := "  web1 | first\n  web1 | se\n  web1 | ... (truncated, 11 more bytes)\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
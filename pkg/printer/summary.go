@@ -0,0 +1,157 @@
+package printer
+
+import (
+	"sort"
+	"sync"
+)
+
+// Result statuses counted by HostSummary.Record and SummaryCollector.Record.
+const (
+	StatusOK          = "ok"
+	StatusChanged     = "changed"
+	StatusFailed      = "failed"
+	StatusSkipped     = "skipped"
+	StatusIgnored     = "ignored"
+	StatusUnreachable = "unreachable"
+)
+
+// Record counts one task result with status on s. Unknown statuses are not
+// counted.
+func (s *HostSummary) Record(status string) {
+	switch status {
+	case StatusOK:
+		s.OK++
+	case StatusChanged:
+		s.Changed++
+	case StatusFailed:
+		s.Failed++
+	case StatusSkipped:
+		s.Skipped++
+	case StatusIgnored:
+		s.Ignored++
+	case StatusUnreachable:
+		s.Unreachable++
+	}
+}
+
+// Add adds the counts of o to s; s keeps its Host.
+func (s *HostSummary) Add(o HostSummary) {
+	s.OK += o.OK
+	s.Changed += o.Changed
+	s.Failed += o.Failed
+	s.Skipped += o.Skipped
+	s.Ignored += o.Ignored
+	s.Unreachable += o.Unreachable
+	s.Diffs += o.Diffs
+}
+
+// Sub subtracts the counts of o, added earlier with Add, from s.
+func (s *HostSummary) Sub(o HostSummary) {
+	s.OK -= o.OK
+	s.Changed -= o.Changed
+	s.Failed -= o.Failed
+	s.Skipped -= o.Skipped
+	s.Ignored -= o.Ignored
+	s.Unreachable -= o.Unreachable
+	s.Diffs -= o.Diffs
+}
+
+// SummaryCollector accumulates HostSummaries for the recap from any number
+// of goroutines, e.g. parallel plays or hosts. The zero value is not usable;
+// see NewSummaryCollector.
+type SummaryCollector struct {
+	mu        sync.Mutex
+	summaries map[string]*HostSummary
+	rank      map[string]int
+}
+
+// NewSummaryCollector returns an empty collector whose Summaries lists the
+// hosts of order first, in that order, then any others sorted by name.
+func NewSummaryCollector(order []string) *SummaryCollector {
+	rank := make(map[string]int, len(order))
+	for _, host := range order {
+		if _, ok := rank[host]; !ok {
+			rank[host] = len(rank)
+		}
+	}
+	return &SummaryCollector{summaries: make(map[string]*HostSummary), rank: rank}
+}
+
+// entry returns host's summary, creating it; c.mu must be held.
+func (c *SummaryCollector) entry(host string) *HostSummary {
+	s, ok := c.summaries[host]
+	if !ok {
+		s = &HostSummary{Host: host}
+		c.summaries[host] = s
+	}
+	return s
+}
+
+// Record counts one task result with status for host.
+func (c *SummaryCollector) Record(host, status string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry(host).Record(status)
+}
+
+// Add adds the counts of sum to its host's summary.
+func (c *SummaryCollector) Add(sum HostSummary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry(sum.Host).Add(sum)
+}
+
+// Sub subtracts the counts of sum, added earlier, from its host's summary.
+func (c *SummaryCollector) Sub(sum HostSummary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry(sum.Host).Sub(sum)
+}
+
+// Update calls fn with host's summary, if it has one, under the lock.
+func (c *SummaryCollector) Update(host string, fn func(*HostSummary)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.summaries[host]; ok {
+		fn(s)
+	}
+}
+
+// Summary returns a copy of host's summary, empty when nothing was
+// recorded for it.
+func (c *SummaryCollector) Summary(host string) HostSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.summaries[host]; ok {
+		return *s
+	}
+	return HostSummary{Host: host}
+}
+
+// Summaries returns a copy of every host's summary, in the order given to
+// NewSummaryCollector, then by name.
+func (c *SummaryCollector) Summaries() []HostSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]HostSummary, 0, len(c.summaries))
+	for _, s := range c.summaries {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ri, rj := c.Rank(out[i].Host), c.Rank(out[j].Host)
+		if ri != rj {
+			return ri < rj
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
+
+// Rank is host's position in the order given to NewSummaryCollector; hosts
+// not in it share the last rank.
+func (c *SummaryCollector) Rank(host string) int {
+	if i, ok := c.rank[host]; ok {
+		return i
+	}
+	return len(c.rank)
+}
@@ -0,0 +1,94 @@
+package printer
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSummaryCollector_ConcurrentRecord(t *testing.T) {
+	const (
+		hosts   = 8
+		workers = 16
+		rounds  = 250
+	)
+	statuses := []string{StatusOK, StatusChanged, StatusFailed, StatusSkipped, StatusIgnored, StatusUnreachable}
+	c := NewSummaryCollector(nil)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				host := fmt.Sprintf("h%d", i%hosts)
+				c.Record(host, statuses[i%len(statuses)])
+				c.Add(HostSummary{Host: host, OK: 2, Diffs: 1})
+				c.Sub(HostSummary{Host: host, OK: 1})
+				c.Summaries()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each host gets every rounds/hosts-th round from each worker, i.e.
+	// rounds of index i with i%hosts fixed.
+	want := map[string]HostSummary{}
+	for i := 0; i < rounds; i++ {
+		host := fmt.Sprintf("h%d", i%hosts)
+		s := want[host]
+		s.Host = host
+		for w := 0; w < workers; w++ {
+			s.Record(statuses[i%len(statuses)])
+			s.OK++
+			s.Diffs++
+		}
+		want[host] = s
+	}
+	got := c.Summaries()
+	if len(got) != hosts {
+		t.Fatalf("expected %d hosts, got %d", hosts, len(got))
+	}
+	total := HostSummary{}
+	for _, s := range got {
+		if s != want[s.Host] {
+			t.Errorf("%s: expected %+v, got %+v", s.Host, want[s.Host], s)
+		}
+		total.Add(s)
+	}
+	recorded := total.OK + total.Changed + total.Failed + total.Skipped + total.Ignored + total.Unreachable
+	if adds := workers * rounds; recorded != 2*adds || total.Diffs != adds {
+		t.Errorf("expected %d results and %d diffs in total, got %d and %d", 2*adds, adds, recorded, total.Diffs)
+	}
+}
+
+func TestSummaryCollector_Order(t *testing.T) {
+	c := NewSummaryCollector([]string{"web2", "web1", "web2"})
+	for _, host := range []string{"zeta", "web1", "alpha", "web2"} {
+		c.Record(host, StatusOK)
+	}
+	var hosts []string
+	for _, s := range c.Summaries() {
+		hosts = append(hosts, s.Host)
+	}
+	if want := []string{"web2", "web1", "alpha", "zeta"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("expected %v, got %v", want, hosts)
+	}
+}
+
+func TestSummaryCollector_UpdateAndSummary(t *testing.T) {
+	c := NewSummaryCollector(nil)
+	c.Record("web1", StatusFailed)
+	c.Update("web1", func(s *HostSummary) {
+		s.Ignored += s.Failed
+		s.Failed = 0
+	})
+	c.Update("web2", func(s *HostSummary) { s.Failed++ })
+	if got := c.Summary("web1"); got != (HostSummary{Host: "web1", Ignored: 1}) {
+		t.Errorf("expected the failure turned ignored, got %+v", got)
+	}
+	if got := c.Summary("web2"); got != (HostSummary{Host: "web2"}) || len(c.Summaries()) != 1 {
+		t.Errorf("expected no summary for a host never recorded, got %+v", got)
+	}
+}
@@ -0,0 +1,27 @@
+package printer
+
+import (
+	"io"
+	"regexp"
+)
+
+// ansiEscape matches ANSI escape sequences such as colour codes.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// SetTranscript tees all of the default Printer's output to w as well; see
+// Printer.SetTranscript.
+func SetTranscript(w io.Writer) io.Writer {
+	return std.SetTranscript(w)
+}
+
+// SetTranscript tees all of p's output to w as well, with ANSI escape
+// sequences removed and without the progress line, so w gets a plain copy
+// of what was printed. It returns the previous transcript writer; nil
+// stops the copy.
+func (p *Printer) SetTranscript(w io.Writer) io.Writer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev := p.transcript
+	p.transcript = w
+	return prev
+}
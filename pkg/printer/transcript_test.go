@@ -0,0 +1,51 @@
+package printer
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSetTranscript_PlainCopyOfOutput(t *testing.T) {
+	var screen, file bytes.Buffer
+	prevOut, prevColors, prevTerminal, prevProgress := std.out, ColorsEnabled, Terminal, ProgressEnabled
+	std.out, ColorsEnabled, Terminal, ProgressEnabled = &screen, true, true, true
+	prevTranscript := SetTranscript(&file)
+	defer func() {
+		std.out, ColorsEnabled, Terminal, ProgressEnabled = prevOut, prevColors, prevTerminal, prevProgress
+		SetTranscript(prevTranscript)
+	}()
+
+	StartProgress(2)
+	ProgressTask("deploy")
+	TaskHeader("deploy")
+	w := NewHostWriter(true)
+	w.Changed("web1", "released v2")
+	w.Failed("web2", errors.New("exit status 1"))
+	w.Flush()
+	ProgressHostDone()
+	ProgressHostDone()
+	StopProgress()
+	Recap([]HostSummary{{Host: "web1", Changed: 1}, {Host: "web2", Failed: 1}})
+
+	got := file.String()
+	if strings.Contains(got, "\x1b") {
+		t.Errorf("expected no ANSI codes in the transcript, got %q", got)
+	}
+	if strings.Contains(got, "hosts]") {
+		t.Errorf("expected no progress line in the transcript, got %q", got)
+	}
+	// The screen is the transcript plus colours and the progress line.
+	shown := ansiEscape.ReplaceAllString(screen.String(), "")
+	shown = regexp.MustCompile(`\[\d+/\d+ hosts\][^\r]*\r`).ReplaceAllString(shown, "")
+	if got != shown {
+		t.Errorf("transcript differs from what was printed:\ngot  %q\nwant %q", got, shown)
+	}
+	for _, want := range []string{"TASK [deploy]", "changed: [web1]", "FAILED: [web2]", "PLAY RECAP"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in the transcript %q", want, got)
+		}
+	}
+}
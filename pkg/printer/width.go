@@ -0,0 +1,41 @@
+package printer
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// DefaultWidth is the banner width used when the terminal width is unknown
+// or stdout is not a terminal.
+const DefaultWidth = 72
+
+// OutputWidth overrides the detected terminal width when greater than zero.
+var OutputWidth int
+
+// terminalWidth reports the width of the terminal on stdout, or 0.
+var terminalWidth = func() int {
+	w, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 0
+	}
+	return w
+}
+
+// width returns the number of columns banners should fill.
+func width() int {
+	if OutputWidth > 0 {
+		return OutputWidth
+	}
+	if w := terminalWidth(); w > 0 {
+		return w
+	}
+	return DefaultWidth
+}
+
+// banner returns a fill of ch long enough that a line starting with prefix
+// spans the output width.
+func banner(ch, prefix string) string {
+	return strings.Repeat(ch, max(0, width()-len(prefix)))
+}
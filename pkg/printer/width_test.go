@@ -0,0 +1,56 @@
+package printer
+
+import (
+	"strings"
+	"testing"
+)
+
+func withWidth(t *testing.T, configured, detected int) {
+	t.Helper()
+	prevConfigured, prevDetect := OutputWidth, terminalWidth
+	OutputWidth = configured
+	terminalWidth = func() int { return detected }
+	t.Cleanup(func() { OutputWidth, terminalWidth = prevConfigured, prevDetect })
+}
+
+func TestWidth_FallbackWhenUnknown(t *testing.T) {
+	withWidth(t, 0, 0)
+	got := captureOutput(t, false, func() { PlayHeader("web") })
+	if want := "\nPLAY [web] " + strings.Repeat("*", 61) + "\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWidth_DetectedTerminal(t *testing.T) {
+	withWidth(t, 0, 120)
+	got := captureOutput(t, false, func() { TaskHeader("install") })
+	if n := len(strings.TrimSpace(got)); n != 120 {
+		t.Errorf("expected a 120 column banner, got %d: %q", n, got)
+	}
+}
+
+func TestWidth_Configured(t *testing.T) {
+	for _, w := range []int{40, 100} {
+		withWidth(t, w, 200)
+		for name, print := range map[string]func(){
+			"play":    func() { PlayHeader("deploy") },
+			"task":    func() { TaskHeader("deploy") },
+			"handler": func() { HandlerHeader("restart") },
+			"recap":   func() { Recap(nil) },
+		} {
+			got := strings.TrimSpace(captureOutput(t, false, print))
+			if len(got) != w {
+				t.Errorf("%s banner at width %d: got %d columns: %q", name, w, len(got), got)
+			}
+		}
+	}
+}
+
+func TestWidth_LongNameNeverNegative(t *testing.T) {
+	withWidth(t, 20, 0)
+	name := strings.Repeat("x", 30)
+	got := captureOutput(t, false, func() { TaskHeader(name) })
+	if want := "\nTASK [" + name + "] \n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
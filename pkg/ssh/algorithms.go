@@ -0,0 +1,52 @@
+package ssh
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// CheckAlgorithms reports the first name in ciphers, keyExchanges or macs
+// that golang.org/x/crypto/ssh does not implement, listing the supported
+// names of that kind. Algorithms it marks insecure are accepted when named
+// explicitly.
+func CheckAlgorithms(ciphers, keyExchanges, macs []string) error {
+	supported, insecure := cryptossh.SupportedAlgorithms(), cryptossh.InsecureAlgorithms()
+	for _, kind := range []struct {
+		name              string
+		names, ok, legacy []string
+	}{
+		{"cipher", ciphers, supported.Ciphers, insecure.Ciphers},
+		{"key exchange", keyExchanges, supported.KeyExchanges, insecure.KeyExchanges},
+		{"MAC", macs, supported.MACs, insecure.MACs},
+	} {
+		for _, name := range kind.names {
+			if !slices.Contains(kind.ok, name) && !slices.Contains(kind.legacy, name) {
+				return fmt.Errorf("unsupported SSH %s %q; supported: %s", kind.name, name, strings.Join(kind.ok, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// algorithms returns the cipher, key exchange and MAC settings for cfg; see
+// Config.Ciphers.
+func algorithms(cfg Config) (cryptossh.Config, error) {
+	if err := CheckAlgorithms(cfg.Ciphers, cfg.KeyExchanges, cfg.MACs); err != nil {
+		return cryptossh.Config{}, err
+	}
+	supported := cryptossh.SupportedAlgorithms()
+	or := func(names, fallback []string) []string {
+		if len(names) > 0 {
+			return names
+		}
+		return fallback
+	}
+	return cryptossh.Config{
+		Ciphers:      or(cfg.Ciphers, supported.Ciphers),
+		KeyExchanges: or(cfg.KeyExchanges, supported.KeyExchanges),
+		MACs:         or(cfg.MACs, supported.MACs),
+	}, nil
+}
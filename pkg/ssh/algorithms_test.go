@@ -0,0 +1,80 @@
+package ssh
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+func TestClientConfig_RestrictedAlgorithms(t *testing.T) {
+	cfg := Config{
+		HostKeyChecking: HostKeyInsecure,
+		User:            "deploy",
+		Password:        "x",
+		Ciphers:         []string{cryptossh.CipherAES256GCM, cryptossh.CipherAES256CTR},
+		KeyExchanges:    []string{cryptossh.KeyExchangeECDHP384},
+		MACs:            []string{cryptossh.HMACSHA512},
+	}
+	cc, err := clientConfig(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cc.Ciphers, cfg.Ciphers) || !slices.Equal(cc.KeyExchanges, cfg.KeyExchanges) || !slices.Equal(cc.MACs, cfg.MACs) {
+		t.Errorf("expected the configured algorithms, got %v %v %v", cc.Ciphers, cc.KeyExchanges, cc.MACs)
+	}
+}
+
+func TestClientConfig_DefaultAlgorithmsAreSecure(t *testing.T) {
+	cc, err := clientConfig(Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.Ciphers) == 0 || len(cc.KeyExchanges) == 0 || len(cc.MACs) == 0 {
+		t.Fatalf("expected explicit defaults, got %v %v %v", cc.Ciphers, cc.KeyExchanges, cc.MACs)
+	}
+	insecure := cryptossh.InsecureAlgorithms()
+	for _, name := range slices.Concat(cc.Ciphers, cc.KeyExchanges, cc.MACs) {
+		if slices.Contains(slices.Concat(insecure.Ciphers, insecure.KeyExchanges, insecure.MACs), name) {
+			t.Errorf("expected no insecure algorithm by default, got %s", name)
+		}
+	}
+}
+
+func TestCheckAlgorithms_Unknown(t *testing.T) {
+	err := CheckAlgorithms([]string{cryptossh.CipherAES128GCM, "aes512-ctr"}, nil, nil)
+	if err == nil {
+		t.Fatal("expected an unknown cipher to be rejected")
+	}
+	for _, want := range []string{`unsupported SSH cipher "aes512-ctr"`, cryptossh.CipherChaCha20Poly1305} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+	if err := CheckAlgorithms(nil, nil, []string{"hmac-md5"}); err == nil || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("expected an unknown MAC to be rejected, got %v", err)
+	}
+	if err := CheckAlgorithms(nil, []string{cryptossh.InsecureKeyExchangeDH14SHA1}, nil); err != nil {
+		t.Errorf("expected an explicitly named legacy key exchange to be accepted, got %v", err)
+	}
+
+	_, err = RunCommandOutput("127.0.0.1", "true", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "x", Port: 1, KeyExchanges: []string{"kex-nope"}})
+	if err == nil || !strings.Contains(err.Error(), `unsupported SSH key exchange "kex-nope"`) {
+		t.Errorf("expected connecting with an unknown algorithm to fail clearly, got %v", err)
+	}
+}
+
+func TestRunCommandOutput_RestrictedAlgorithms(t *testing.T) {
+	port := startPasswordServer(t, "deploy", "pw")
+	out, err := RunCommandOutput("127.0.0.1", "uptime", Config{
+		HostKeyChecking: HostKeyInsecure,
+		User:            "deploy", Password: "pw", Port: port,
+		Ciphers:      []string{cryptossh.CipherAES256GCM},
+		KeyExchanges: []string{cryptossh.KeyExchangeCurve25519},
+		MACs:         []string{cryptossh.HMACSHA256ETM},
+	})
+	if err != nil || out != "ran: uptime" {
+		t.Errorf("expected a restricted client to connect, got %q, %v", out, err)
+	}
+}
@@ -0,0 +1,180 @@
+package ssh
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+
+	"for/pkg/logger"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// Connection setup stages reported by Config.Debug when a connection fails.
+const (
+	StageConfig    = "config"
+	StageDial      = "dial"
+	StageHandshake = "handshake"
+	StageAuth      = "auth"
+)
+
+// connTrace records how one connection was set up, for Config.Debug, and
+// logs it through logger.L at debug level. Credentials are never recorded:
+// auth methods appear by name and host keys by fingerprint only. A nil
+// *connTrace records nothing.
+type connTrace struct {
+	addr  string
+	stage string
+
+	mu            sync.Mutex
+	attempted     []string
+	hostKey       string
+	serverVersion string
+}
+
+// attempt records that the client tried auth method.
+func (t *connTrace) attempt(method string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range t.attempted {
+		if m == method {
+			return
+		}
+	}
+	t.attempted = append(t.attempted, method)
+}
+
+// hostKeyCallback wraps cb to record the key the server presented.
+func (t *connTrace) hostKeyCallback(cb cryptossh.HostKeyCallback) cryptossh.HostKeyCallback {
+	if t == nil {
+		return cb
+	}
+	return func(hostname string, remote net.Addr, key cryptossh.PublicKey) error {
+		t.mu.Lock()
+		t.hostKey = key.Type() + " " + cryptossh.FingerprintSHA256(key)
+		t.mu.Unlock()
+		return cb(hostname, remote, key)
+	}
+}
+
+// dial logs the connection about to be made.
+func (t *connTrace) dial(host, addr string, cfg Config, clientCfg *cryptossh.ClientConfig) {
+	if t == nil {
+		return
+	}
+	t.addr = addr
+	hostKeyChecking := cfg.HostKeyChecking
+	if hostKeyChecking == "" {
+		hostKeyChecking = HostKeyStrict
+	}
+	logger.L.Debug("ssh dial",
+		"host", host,
+		"addr", addr,
+		"user", cfg.User,
+		"jump_host", cfg.JumpHost,
+		"key_path", cfg.KeyPath,
+		"auth_methods", authMethodNames(cfg, len(clientCfg.Auth)),
+		"host_key_checking", hostKeyChecking,
+		"key_exchanges", clientCfg.KeyExchanges,
+		"ciphers", clientCfg.Ciphers,
+		"macs", clientCfg.MACs,
+	)
+}
+
+// wrap returns conn recording the server's version line as it is read.
+func (t *connTrace) wrap(conn net.Conn) net.Conn {
+	if t == nil {
+		return conn
+	}
+	return &versionConn{Conn: conn, trace: t}
+}
+
+// finish logs the negotiated connection, or the stage that failed and why.
+func (t *connTrace) finish(client *cryptossh.Client, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		algs := client.Conn.(cryptossh.AlgorithmsConnMetadata).Algorithms()
+		logger.L.Debug("ssh connected",
+			"addr", t.addr,
+			"server_version", string(client.ServerVersion()),
+			"client_version", string(client.ClientVersion()),
+			"kex", algs.KeyExchange,
+			"host_key", t.hostKey,
+			"cipher", algs.Write.Cipher,
+			"mac", algs.Write.MAC,
+			"auth_attempted", t.attempted,
+		)
+		return
+	}
+	stage := t.stage
+	if stage == StageHandshake && strings.Contains(err.Error(), "unable to authenticate") {
+		stage = StageAuth
+	}
+	logger.L.Debug("ssh connection failed",
+		"addr", t.addr,
+		"stage", stage,
+		"error", err.Error(),
+		"server_version", t.serverVersion,
+		"host_key", t.hostKey,
+		"auth_attempted", t.attempted,
+	)
+}
+
+// authMethodNames names the n auth methods clientConfig offers for cfg, in
+// order.
+func authMethodNames(cfg Config, n int) []string {
+	var names []string
+	if cfg.KeyPath != "" {
+		names = append(names, "publickey")
+	}
+	if cfg.Password != "" {
+		names = append(names, "password")
+	}
+	if len(names) < n {
+		names = append(names, "keyboard-interactive")
+	}
+	return names
+}
+
+// versionConn is a net.Conn that hands the server's "SSH-" version line,
+// sent before the key exchange, to its trace.
+type versionConn struct {
+	net.Conn
+	trace *connTrace
+	buf   []byte
+	done  bool
+}
+
+func (c *versionConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		// Servers may send other lines before the version line.
+		for !c.done {
+			i := bytes.IndexByte(c.buf, '\n')
+			if i < 0 {
+				c.done = len(c.buf) > 4096
+				break
+			}
+			line := strings.TrimRight(string(c.buf[:i]), "\r")
+			c.buf = c.buf[i+1:]
+			if strings.HasPrefix(line, "SSH-") {
+				c.trace.mu.Lock()
+				c.trace.serverVersion = line
+				c.trace.mu.Unlock()
+				c.done = true
+			}
+		}
+		if c.done {
+			c.buf = nil
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,156 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"for/pkg/logger"
+)
+
+// captureLog points logger.L at a JSON handler for the test and returns a
+// function decoding the records logged so far.
+func captureLog(t *testing.T) func() []map[string]interface{} {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := logger.L
+	logger.L = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() { logger.L = prev })
+	return func() []map[string]interface{} {
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("decoding %q: %v", line, err)
+			}
+			records = append(records, rec)
+		}
+		return records
+	}
+}
+
+// record returns the record with msg, failing the test when there is none.
+func record(t *testing.T, records []map[string]interface{}, msg string) map[string]interface{} {
+	t.Helper()
+	for _, rec := range records {
+		if rec["msg"] == msg {
+			return rec
+		}
+	}
+	t.Fatalf("no %q record in %v", msg, records)
+	return nil
+}
+
+func TestDebug_FailedAuth(t *testing.T) {
+	const password = "hunter2-secret"
+	port := startPasswordServer(t, "deploy", password)
+	records := captureLog(t)
+
+	_, err := RunCommandOutput("127.0.0.1", "uptime", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "wrong-" + password, Port: port, Debug: true})
+	if err == nil {
+		t.Fatal("expected the wrong password to fail")
+	}
+
+	recs := records()
+	dial := record(t, recs, "ssh dial")
+	if dial["addr"] != net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) || dial["user"] != "deploy" {
+		t.Errorf("unexpected dial record %v", dial)
+	}
+	if methods, _ := dial["auth_methods"].([]interface{}); len(methods) == 0 || methods[0] != "password" {
+		t.Errorf("expected password among the offered auth methods, got %v", dial["auth_methods"])
+	}
+	failed := record(t, recs, "ssh connection failed")
+	if failed["stage"] != StageAuth {
+		t.Errorf("expected stage %q, got %v", StageAuth, failed["stage"])
+	}
+	if v, _ := failed["server_version"].(string); !strings.HasPrefix(v, "SSH-2.0-") {
+		t.Errorf("expected the server version, got %q", v)
+	}
+	if k, _ := failed["host_key"].(string); !strings.HasPrefix(k, "ssh-ed25519 SHA256:") {
+		t.Errorf("expected the host key fingerprint, got %q", k)
+	}
+	if attempted, _ := failed["auth_attempted"].([]interface{}); len(attempted) == 0 || attempted[0] != "password" {
+		t.Errorf("expected the password attempt, got %v", failed["auth_attempted"])
+	}
+	for _, rec := range recs {
+		data, _ := json.Marshal(rec)
+		if strings.Contains(string(data), password) {
+			t.Errorf("password leaked into %s", data)
+		}
+	}
+}
+
+func TestDebug_FailureStages(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	// A server that sends a version line and hangs up fails the handshake.
+	bogus, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bogus.Close() })
+	go func() {
+		for {
+			conn, err := bogus.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("SSH-2.0-Bogus_1.0\r\n"))
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		port    int
+		stage   string
+		version string
+	}{
+		{closedPort, StageDial, ""},
+		{bogus.Addr().(*net.TCPAddr).Port, StageHandshake, "SSH-2.0-Bogus_1.0"},
+	}
+	for _, tt := range tests {
+		records := captureLog(t)
+		if _, err := RunCommandOutput("127.0.0.1", "uptime", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "x", Port: tt.port, Debug: true}); err == nil {
+			t.Fatalf("%s: expected the connection to fail", tt.stage)
+		}
+		failed := record(t, records(), "ssh connection failed")
+		if failed["stage"] != tt.stage || failed["server_version"] != tt.version {
+			t.Errorf("expected stage %q and server version %q, got %v", tt.stage, tt.version, failed)
+		}
+	}
+}
+
+func TestDebug_Connected(t *testing.T) {
+	port := startPasswordServer(t, "deploy", "pw")
+	records := captureLog(t)
+
+	if _, err := RunCommandOutput("127.0.0.1", "uptime", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "pw", Port: port, Debug: true}); err != nil {
+		t.Fatal(err)
+	}
+	ok := record(t, records(), "ssh connected")
+	for _, field := range []string{"server_version", "client_version", "kex", "host_key", "cipher"} {
+		if v, _ := ok[field].(string); v == "" {
+			t.Errorf("expected %s in %v", field, ok)
+		}
+	}
+
+	records = captureLog(t)
+	if _, err := RunCommandOutput("127.0.0.1", "uptime", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "pw", Port: port}); err != nil {
+		t.Fatal(err)
+	}
+	if recs := records(); len(recs) != 0 {
+		t.Errorf("expected no records without Debug, got %v", recs)
+	}
+}
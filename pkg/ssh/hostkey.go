@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes for Config.HostKeyChecking.
+const (
+	// HostKeyStrict rejects hosts whose key is not in known_hosts.
+	HostKeyStrict = "strict"
+	// HostKeyAsk prompts on a terminal for unknown hosts and records accepted keys.
+	HostKeyAsk = "ask"
+	// HostKeyInsecure accepts any host key without checking it. It must be
+	// asked for explicitly; never use it where hosts can be impersonated.
+	HostKeyInsecure = "insecure"
+)
+
+// defaultKnownHostsFile is ~/.ssh/known_hosts, used by HostKeyStrict and
+// HostKeyAsk when Config.KnownHostsFile is empty.
+func defaultKnownHostsFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("locating known_hosts: %w", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// promptMu serialises host key prompts across concurrent connections.
+var promptMu sync.Mutex
+
+// NewPromptingHostKeyCallback returns a callback that accepts hosts already in
+// knownHostsFile, rejects changed keys, and asks about unknown hosts. When
+// interactive is false unknown hosts are rejected (fail closed). Accepted keys
+// are appended to knownHostsFile, which is created if missing.
+func NewPromptingHostKeyCallback(knownHostsFile string, in io.Reader, out io.Writer, interactive bool) (cryptossh.HostKeyCallback, error) {
+	if err := ensureFile(knownHostsFile); err != nil {
+		return nil, fmt.Errorf("preparing known_hosts %q: %w", knownHostsFile, err)
+	}
+	reader := bufio.NewReader(in)
+
+	return func(hostname string, remote net.Addr, key cryptossh.PublicKey) error {
+		promptMu.Lock()
+		defer promptMu.Unlock()
+
+		// Re-read on every call so keys accepted for other hosts are seen.
+		check, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return fmt.Errorf("loading known_hosts %q: %w", knownHostsFile, err)
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			// Known, unexpected error, or a changed key – never prompt for those.
+			return err
+		}
+
+		fingerprint := cryptossh.FingerprintSHA256(key)
+		if !interactive {
+			return fmt.Errorf("host key for %s is unknown (%s %s) and no terminal is available to confirm it",
+				hostname, key.Type(), fingerprint)
+		}
+
+		fmt.Fprintf(out, "The authenticity of host '%s' can't be established.\n", hostname)
+		fmt.Fprintf(out, "%s key fingerprint is %s.\n", key.Type(), fingerprint)
+		fmt.Fprint(out, "Are you sure you want to continue connecting (yes/no)? ")
+		answer, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "yes" {
+			return fmt.Errorf("host key for %s rejected by user", hostname)
+		}
+		return appendKnownHost(knownHostsFile, hostname, key)
+	}, nil
+}
+
+func appendKnownHost(file, hostname string, key cryptossh.PublicKey) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("recording host key: %w", err)
+	}
+	defer f.Close()
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("recording host key: %w", err)
+	}
+	return nil
+}
+
+func ensureFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// stdinIsTerminal reports whether prompts can be answered interactively.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return (fi.Mode() & os.ModeCharDevice) != 0
+}
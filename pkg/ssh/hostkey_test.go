@@ -0,0 +1,137 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) cryptossh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	key, err := cryptossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("converting key: %v", err)
+	}
+	return key
+}
+
+var testAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+
+func TestPromptingCallback_KnownHostAccepted(t *testing.T) {
+	key := newHostKey(t)
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("web1:22")}, key)
+	os.WriteFile(file, []byte(line+"\n"), 0o600)
+
+	var out bytes.Buffer
+	cb, err := NewPromptingHostKeyCallback(file, strings.NewReader(""), &out, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cb("web1:22", testAddr, key); err != nil {
+		t.Errorf("expected known host to be accepted, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no prompt for known host, got %q", out.String())
+	}
+}
+
+func TestPromptingCallback_UnknownHostNonTTYRejected(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	cb, err := NewPromptingHostKeyCallback(file, strings.NewReader("yes\n"), &bytes.Buffer{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cb("web1:22", testAddr, newHostKey(t)); err == nil {
+		t.Error("expected unknown host to be rejected without a terminal")
+	}
+	if data, _ := os.ReadFile(file); len(data) != 0 {
+		t.Errorf("expected known_hosts to stay empty, got %q", data)
+	}
+}
+
+func TestPromptingCallback_AcceptAppendsKey(t *testing.T) {
+	key := newHostKey(t)
+	file := filepath.Join(t.TempDir(), "known_hosts")
+
+	var out bytes.Buffer
+	cb, err := NewPromptingHostKeyCallback(file, strings.NewReader("yes\n"), &out, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cb("web1:22", testAddr, key); err != nil {
+		t.Fatalf("expected accepted host, got %v", err)
+	}
+	if !strings.Contains(out.String(), cryptossh.FingerprintSHA256(key)) {
+		t.Errorf("expected prompt to show fingerprint, got %q", out.String())
+	}
+
+	// A second, non-interactive callback must now trust the recorded key.
+	strict, err := NewPromptingHostKeyCallback(file, strings.NewReader(""), &bytes.Buffer{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := strict("web1:22", testAddr, key); err != nil {
+		t.Errorf("expected recorded key to be trusted, got %v", err)
+	}
+}
+
+func TestPromptingCallback_DeclineAndChangedKey(t *testing.T) {
+	key := newHostKey(t)
+	file := filepath.Join(t.TempDir(), "known_hosts")
+
+	cb, _ := NewPromptingHostKeyCallback(file, strings.NewReader("no\n"), &bytes.Buffer{}, true)
+	if err := cb("web1:22", testAddr, key); err == nil {
+		t.Error("expected declined host to be rejected")
+	}
+
+	line := knownhosts.Line([]string{knownhosts.Normalize("web1:22")}, key)
+	os.WriteFile(file, []byte(line+"\n"), 0o600)
+	var out bytes.Buffer
+	cb, _ = NewPromptingHostKeyCallback(file, strings.NewReader("yes\n"), &out, true)
+	if err := cb("web1:22", testAddr, newHostKey(t)); err == nil {
+		t.Error("expected changed host key to be rejected")
+	}
+	if out.Len() != 0 {
+		t.Error("expected no prompt for a changed host key")
+	}
+}
+
+func TestClientConfig_StrictWithoutKnownHostsFailsClosed(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	for _, cfg := range []Config{
+		{User: "deploy", Password: "x"},
+		{User: "deploy", Password: "x", HostKeyChecking: HostKeyStrict, KnownHostsFile: filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := clientConfig(cfg, nil); err == nil || !strings.Contains(err.Error(), "known_hosts") {
+			t.Errorf("%+v: expected a missing known_hosts file to be an error, got %v", cfg, err)
+		}
+	}
+	if _, err := clientConfig(Config{User: "deploy", Password: "x", HostKeyChecking: HostKeyInsecure}, nil); err != nil {
+		t.Errorf("expected insecure checking to need no known_hosts file, got %v", err)
+	}
+}
+
+func TestRunCommandOutput_UnknownHostKeyRejected(t *testing.T) {
+	port := startPasswordServer(t, "deploy", "pw")
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := RunCommandOutput("127.0.0.1", "id", Config{User: "deploy", Password: "pw", Port: port, KnownHostsFile: file})
+	if err == nil || !strings.Contains(err.Error(), "knownhosts: key is unknown") {
+		t.Errorf("expected a host missing from known_hosts to be rejected, got %v", err)
+	}
+}
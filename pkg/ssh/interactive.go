@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// NewKeyboardInteractiveChallenge returns a handler for keyboard-interactive
+// authentication (PAM, MFA). Prompts that ask for a password are answered
+// with password; any other prompt is shown on out and answered from in when
+// interactive is true. Without a terminal, hidden prompts fall back to
+// password and anything else fails. Hidden answers are read without echo when
+// in is a terminal.
+func NewKeyboardInteractiveChallenge(password string, in io.Reader, out io.Writer, interactive bool) cryptossh.KeyboardInteractiveChallenge {
+	reader := bufio.NewReader(in)
+
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		if len(questions) == 0 {
+			return answers, nil
+		}
+
+		promptMu.Lock()
+		defer promptMu.Unlock()
+
+		shownInstruction := false
+		for i, q := range questions {
+			hidden := !echos[i]
+			switch {
+			case password != "" && strings.Contains(strings.ToLower(q), "password"):
+				answers[i] = password
+			case interactive:
+				if !shownInstruction && instruction != "" {
+					fmt.Fprintln(out, instruction)
+					shownInstruction = true
+				}
+				fmt.Fprint(out, q)
+				answer, err := readAnswer(reader, in, hidden)
+				if hidden {
+					fmt.Fprintln(out)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("reading answer to %q: %w", strings.TrimSpace(q), err)
+				}
+				answers[i] = answer
+			case password != "" && hidden:
+				answers[i] = password
+			default:
+				return nil, fmt.Errorf("keyboard-interactive prompt %q needs a terminal", strings.TrimSpace(q))
+			}
+		}
+		return answers, nil
+	}
+}
+
+// readAnswer reads one line, without echo when hidden and in is a terminal.
+func readAnswer(reader *bufio.Reader, in io.Reader, hidden bool) (string, error) {
+	if f, ok := in.(*os.File); ok && hidden && term.IsTerminal(int(f.Fd())) {
+		b, err := term.ReadPassword(int(f.Fd()))
+		return string(b), err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
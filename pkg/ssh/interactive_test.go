@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// startKeyboardInteractiveServer runs a server that only allows
+// keyboard-interactive auth, asking the hidden questions in one round and
+// expecting the matching answers.
+func startKeyboardInteractiveServer(t *testing.T, questions, want []string) int {
+	t.Helper()
+	return startTestServer(t, &cryptossh.ServerConfig{
+		KeyboardInteractiveCallback: func(c cryptossh.ConnMetadata, challenge cryptossh.KeyboardInteractiveChallenge) (*cryptossh.Permissions, error) {
+			answers, err := challenge("", "MFA required", questions, make([]bool, len(questions)))
+			if err != nil {
+				return nil, err
+			}
+			if strings.Join(answers, "\n") != strings.Join(want, "\n") {
+				return nil, cryptossh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	})
+}
+
+func TestKeyboardInteractive_AnswersChallenge(t *testing.T) {
+	const password = "hunter2-secret"
+	port := startKeyboardInteractiveServer(t, []string{"Password: ", "Verification code: "}, []string{password, "123456"})
+
+	var out bytes.Buffer
+	challenge := NewKeyboardInteractiveChallenge(password, strings.NewReader("123456\n"), &out, true)
+	cfg := &cryptossh.ClientConfig{
+		User:            "deploy",
+		Auth:            []cryptossh.AuthMethod{cryptossh.KeyboardInteractive(challenge)},
+		HostKeyCallback: cryptossh.InsecureIgnoreHostKey(),
+	}
+	client, err := cryptossh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), cfg)
+	if err != nil {
+		t.Fatalf("expected keyboard-interactive auth to succeed, got %v", err)
+	}
+	client.Close()
+
+	prompts := out.String()
+	if !strings.Contains(prompts, "MFA required") || !strings.Contains(prompts, "Verification code: ") {
+		t.Errorf("expected the code prompt to be shown, got %q", prompts)
+	}
+	if strings.Contains(prompts, "Password") || strings.Contains(prompts, password) {
+		t.Errorf("password prompt should be answered silently, got %q", prompts)
+	}
+}
+
+func TestPool_KeyboardInteractiveFromPassword(t *testing.T) {
+	port := startKeyboardInteractiveServer(t, []string{"Password: "}, []string{"hunter2"})
+	pool := NewPool()
+	defer pool.Close()
+
+	out, err := pool.RunCommandOutput("127.0.0.1", "id", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "hunter2", Port: port})
+	if err != nil || out != "ran: id" {
+		t.Errorf("expected password to answer the challenge, got %q, %v", out, err)
+	}
+}
+
+func TestKeyboardInteractive_PasswordOnlyWithoutTerminal(t *testing.T) {
+	challenge := NewKeyboardInteractiveChallenge("pw", strings.NewReader(""), &bytes.Buffer{}, false)
+
+	answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+	if err != nil || len(answers) != 1 || answers[0] != "pw" {
+		t.Errorf("expected password answer, got %v, %v", answers, err)
+	}
+	if _, err := challenge("", "", []string{"Username: "}, []bool{true}); err == nil {
+		t.Error("expected a visible prompt without a terminal to fail")
+	}
+}
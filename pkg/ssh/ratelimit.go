@@ -0,0 +1,54 @@
+package ssh
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter paces new connections to a fixed number per second, however
+// many goroutines dial at once: a token bucket holding a single token, so
+// dials are spread evenly rather than sent in bursts. It limits how often
+// connections are started, not how many are open. A nil *RateLimiter never
+// waits.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// NewRateLimiter returns a limiter allowing perSecond new connections per
+// second, or nil (no limit) when perSecond is not positive.
+func NewRateLimiter(perSecond int) *RateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// Wait blocks until the next connection may be started, or until ctx is
+// done, in which case it returns ctx's error.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
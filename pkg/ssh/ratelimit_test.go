@@ -0,0 +1,98 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter_NoLimit(t *testing.T) {
+	l := NewRateLimiter(0)
+	if l != nil {
+		t.Fatalf("expected no limiter for a rate of 0, got %+v", l)
+	}
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("expected a nil limiter never to wait, took %v", d)
+	}
+}
+
+func TestRateLimiter_WaitStopsWhenCancelled(t *testing.T) {
+	l := NewRateLimiter(1)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected Wait to return when the context is done, took %v", d)
+	}
+}
+
+func TestConnect_ConnectRatePacesDials(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var (
+		mu      sync.Mutex
+		accepts []time.Time
+	)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepts = append(accepts, time.Now())
+			mu.Unlock()
+			conn.Close()
+		}
+	}()
+
+	// Six hosts dial at once; at five per second the last may only start a
+	// second after the first.
+	const dials = 6
+	cfg := Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "x", Port: ln.Addr().(*net.TCPAddr).Port, ConnectLimiter: NewRateLimiter(5)}
+	var wg sync.WaitGroup
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := connect(context.Background(), "127.0.0.1", cfg); err == nil {
+				t.Error("expected the handshake with a closed connection to fail")
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(accepts) != dials {
+		t.Fatalf("expected %d dials, got %d", dials, len(accepts))
+	}
+	sort.Slice(accepts, func(i, j int) bool { return accepts[i].Before(accepts[j]) })
+	for i := 1; i < dials; i++ {
+		if gap := accepts[i].Sub(accepts[i-1]); gap < 150*time.Millisecond {
+			t.Errorf("expected dials about 200ms apart, dial %d came %v after the previous one", i+1, gap)
+		}
+	}
+	if span := accepts[dials-1].Sub(accepts[0]); span < 900*time.Millisecond || span > 2*time.Second {
+		t.Errorf("expected %d dials to take about a second, took %v", dials, span)
+	}
+}
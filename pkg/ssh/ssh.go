@@ -1,10 +1,18 @@
 package ssh
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 
+	"for/pkg/utils"
 	cryptossh "golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
@@ -15,74 +23,229 @@ type Config struct {
 	KeyPath        string
 	Password       string
 	Port           int
+	// HostName is the address to connect to when it differs from the
+	// inventory name (ansible_host).
+	HostName string
 	// JumpHost is an optional bastion host in host:port form.
 	JumpHost string
-	// KnownHostsFile enables proper host-key verification.
-	// When empty, InsecureIgnoreHostKey is used (not recommended for production).
+	// KnownHostsFile holds the accepted host keys; it defaults to
+	// ~/.ssh/known_hosts.
 	KnownHostsFile string
+	// HostKeyChecking is HostKeyStrict (default), which rejects hosts whose
+	// key is not in KnownHostsFile and fails when the file cannot be read,
+	// HostKeyAsk, which prompts for unknown hosts on a terminal, or
+	// HostKeyInsecure, which checks nothing.
+	HostKeyChecking string
+	// Ciphers, KeyExchanges and MACs restrict the algorithms offered to the
+	// server, in order of preference; see CheckAlgorithms. Each defaults to
+	// every algorithm of its kind in golang.org/x/crypto/ssh's
+	// SupportedAlgorithms, which leaves out SHA-1 key exchanges, CBC and RC4
+	// ciphers and truncated MACs.
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
+	// Debug logs how each new connection is set up through logger.L at
+	// debug level: the dial target, auth methods offered and attempted,
+	// negotiated algorithms and server version, or the stage (StageDial,
+	// StageHandshake, StageAuth) that failed. Credentials are never logged.
+	Debug bool
+	// ConnectLimiter, when set, paces the dials of new connections; share
+	// one across hosts to cap the connection rate of a whole run.
+	ConnectLimiter *RateLimiter
+}
+
+// ErrUnreachable matches every *UnreachableError with errors.Is.
+var ErrUnreachable = errors.New("host unreachable")
+
+// ErrAuth matches, with errors.Is, an *UnreachableError for a server that
+// was reached but accepted none of the offered credentials.
+var ErrAuth = errors.New("authentication failed")
+
+// UnreachableError reports that no connection to Host could be set up: it
+// could not be dialled, or the handshake or authentication failed. A
+// command that runs and fails is not unreachable.
+type UnreachableError struct {
+	Host string
+	Err  error
+	// Auth reports that the server rejected every authentication method.
+	Auth bool
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("%s unreachable: %v", e.Host, e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrUnreachable, or ErrAuth when Auth is set.
+func (e *UnreachableError) Is(target error) bool {
+	return target == ErrUnreachable || (target == ErrAuth && e.Auth)
+}
+
+// IsUnreachable reports whether err comes from a failed connection rather
+// than from the command that was run.
+func IsUnreachable(err error) bool {
+	var u *UnreachableError
+	return errors.As(err, &u)
 }
 
 // ---------------------------------------------------------------------------
 // Internal client factory
 // ---------------------------------------------------------------------------
 
-func newClient(host string, cfg Config) (*cryptossh.Client, error) {
-	var authMethods []cryptossh.AuthMethod
+// connect is newClient with its errors wrapped in an *UnreachableError.
+func connect(ctx context.Context, host string, cfg Config) (*cryptossh.Client, error) {
+	client, err := newClient(ctx, host, cfg)
+	if err != nil {
+		// golang.org/x/crypto/ssh has no error type for a rejected login.
+		auth := strings.Contains(err.Error(), "unable to authenticate")
+		return nil, &UnreachableError{Host: host, Err: err, Auth: auth}
+	}
+	return client, nil
+}
 
-	if cfg.KeyPath != "" {
-		key, err := os.ReadFile(cfg.KeyPath)
+func newClient(ctx context.Context, host string, cfg Config) (client *cryptossh.Client, err error) {
+	var trace *connTrace
+	if cfg.Debug {
+		trace = &connTrace{stage: StageConfig}
+		defer func() { trace.finish(client, err) }()
+	}
+	clientCfg, err := clientConfig(cfg, trace)
+	if err != nil {
+		return nil, err
+	}
+
+	name := host
+	if cfg.HostName != "" {
+		host = cfg.HostName
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+	trace.dial(name, addr, cfg, clientCfg)
+	if trace != nil {
+		trace.stage = StageDial
+	}
+
+	var (
+		jumpClient *cryptossh.Client
+		conn       net.Conn
+	)
+	if err := cfg.ConnectLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	if cfg.JumpHost != "" {
+		jumpClient, err = cryptossh.Dial("tcp", cfg.JumpHost, clientCfg)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("dial jump host %s: %w", cfg.JumpHost, err)
 		}
-		signer, err := cryptossh.ParsePrivateKey(key)
+		conn, err = jumpClient.Dial("tcp", addr)
 		if err != nil {
-			return nil, err
+			jumpClient.Close()
+			return nil, fmt.Errorf("dial via jump host to %s: %w", addr, err)
 		}
-		authMethods = append(authMethods, cryptossh.PublicKeys(signer))
+	} else if conn, err = net.Dial("tcp", addr); err != nil {
+		return nil, err
 	}
 
-	if cfg.Password != "" {
-		authMethods = append(authMethods, cryptossh.Password(cfg.Password))
+	if trace != nil {
+		trace.stage = StageHandshake
 	}
+	ncc, chans, reqs, err := cryptossh.NewClientConn(trace.wrap(conn), addr, clientCfg)
+	if err != nil {
+		if jumpClient != nil {
+			jumpClient.Close()
+		}
+		return nil, err
+	}
+	return cryptossh.NewClient(ncc, chans, reqs), nil
+}
 
-	var hostKeyCallback cryptossh.HostKeyCallback
-	if cfg.KnownHostsFile != "" {
-		cb, err := knownhosts.New(cfg.KnownHostsFile)
-		if err != nil {
-			return nil, fmt.Errorf("loading known_hosts %q: %w", cfg.KnownHostsFile, err)
+// clientConfig builds the authentication, host key and algorithm settings
+// for cfg. Auth attempts and the server's host key are recorded in trace,
+// which may be nil.
+func clientConfig(cfg Config, trace *connTrace) (*cryptossh.ClientConfig, error) {
+	var authMethods []cryptossh.AuthMethod
+
+	if cfg.KeyPath != "" {
+		signer, err := loadSigner(cfg.KeyPath)
+		switch {
+		case err == nil:
+			authMethods = append(authMethods, cryptossh.PublicKeysCallback(func() ([]cryptossh.Signer, error) {
+				trace.attempt("publickey")
+				return []cryptossh.Signer{signer}, nil
+			}))
+		case cfg.Password == "":
+			return nil, err
 		}
-		hostKeyCallback = cb
-	} else {
-		hostKeyCallback = cryptossh.InsecureIgnoreHostKey() // #nosec G106 – set known_hosts_file in config
+		// An unusable key falls back to password authentication.
 	}
 
-	clientCfg := &cryptossh.ClientConfig{
-		User:            cfg.User,
-		Auth:            authMethods,
-		HostKeyCallback: hostKeyCallback,
+	// Password is tried after the key; it is never included in errors.
+	if cfg.Password != "" {
+		authMethods = append(authMethods, cryptossh.PasswordCallback(func() (string, error) {
+			trace.attempt("password")
+			return cfg.Password, nil
+		}))
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, cfg.Port)
+	// Keyboard-interactive comes last, answered from the password or, on a
+	// terminal, by the operator.
+	if interactive := stdinIsTerminal(); cfg.Password != "" || interactive {
+		challenge := NewKeyboardInteractiveChallenge(cfg.Password, os.Stdin, os.Stderr, interactive)
+		authMethods = append(authMethods, cryptossh.KeyboardInteractive(
+			func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				trace.attempt("keyboard-interactive")
+				return challenge(name, instruction, questions, echos)
+			}))
+	}
 
-	if cfg.JumpHost != "" {
-		jumpClient, err := cryptossh.Dial("tcp", cfg.JumpHost, clientCfg)
-		if err != nil {
-			return nil, fmt.Errorf("dial jump host %s: %w", cfg.JumpHost, err)
+	var hostKeyCallback cryptossh.HostKeyCallback
+	file := cfg.KnownHostsFile
+	if file == "" && cfg.HostKeyChecking != HostKeyInsecure {
+		var err error
+		if file, err = defaultKnownHostsFile(); err != nil {
+			return nil, err
 		}
-		conn, err := jumpClient.Dial("tcp", addr)
+	}
+	switch cfg.HostKeyChecking {
+	case HostKeyInsecure:
+		hostKeyCallback = cryptossh.InsecureIgnoreHostKey() // #nosec G106 – explicitly requested
+	case HostKeyAsk:
+		cb, err := NewPromptingHostKeyCallback(file, os.Stdin, os.Stderr, stdinIsTerminal())
 		if err != nil {
-			jumpClient.Close()
-			return nil, fmt.Errorf("dial via jump host to %s: %w", addr, err)
+			return nil, err
 		}
-		ncc, chans, reqs, err := cryptossh.NewClientConn(conn, addr, clientCfg)
+		hostKeyCallback = cb
+	default:
+		cb, err := knownhosts.New(file)
 		if err != nil {
-			jumpClient.Close()
-			return nil, err
+			return nil, fmt.Errorf("loading known_hosts %q (set known_hosts_file, or host_key_checking: insecure to skip host key checks): %w", file, err)
 		}
-		return cryptossh.NewClient(ncc, chans, reqs), nil
+		hostKeyCallback = cb
 	}
 
-	return cryptossh.Dial("tcp", addr, clientCfg)
+	algos, err := algorithms(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptossh.ClientConfig{
+		Config:          algos,
+		User:            cfg.User,
+		Auth:            authMethods,
+		HostKeyCallback: trace.hostKeyCallback(hostKeyCallback),
+	}, nil
+}
+
+// loadSigner reads and parses the private key at path.
+func loadSigner(path string) (cryptossh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := cryptossh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key %s: %w", path, err)
+	}
+	return signer, nil
 }
 
 // ---------------------------------------------------------------------------
@@ -107,7 +270,8 @@ func (p *Pool) key(host string, cfg Config) string {
 
 // session returns a new SSH session from a pooled (or freshly created) client.
 // The returned cleanup function must be called (defer) to close the session.
-func (p *Pool) session(host string, cfg Config) (*cryptossh.Session, func(), error) {
+// ctx only bounds the wait for a new connection; see Config.ConnectLimiter.
+func (p *Pool) session(ctx context.Context, host string, cfg Config) (*cryptossh.Session, func(), error) {
 	k := p.key(host, cfg)
 
 	p.mu.Lock()
@@ -125,7 +289,7 @@ func (p *Pool) session(host string, cfg Config) (*cryptossh.Session, func(), err
 		p.mu.Unlock()
 	}
 
-	client, err := newClient(host, cfg)
+	client, err := connect(ctx, host, cfg)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -143,13 +307,81 @@ func (p *Pool) session(host string, cfg Config) (*cryptossh.Session, func(), err
 // RunCommandOutput runs a command on the remote host using a pooled connection and
 // returns the combined stdout+stderr output.
 func (p *Pool) RunCommandOutput(host, command string, cfg Config) (string, error) {
-	sess, cleanup, err := p.session(host, cfg)
+	return p.RunCommandOutputContext(context.Background(), host, command, cfg)
+}
+
+// RunCommandOutputContext is RunCommandOutput with cancellation: when ctx is
+// done the session is closed and ctx's error returned.
+func (p *Pool) RunCommandOutputContext(ctx context.Context, host, command string, cfg Config) (string, error) {
+	return p.RunCommandInput(ctx, host, command, "", cfg)
+}
+
+// RunCommandInput is RunCommandOutputContext with input written to the
+// command's stdin, e.g. a sudo password.
+func (p *Pool) RunCommandInput(ctx context.Context, host, command, input string, cfg Config) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	sess, cleanup, err := p.session(ctx, host, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	return combinedOutput(ctx, sess, command, input)
+}
+
+// RunCommandStream is RunCommandOutputContext that also writes stdout and
+// stderr to w as they arrive; the combined output is still returned.
+func (p *Pool) RunCommandStream(ctx context.Context, host, command string, w io.Writer, cfg Config) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	sess, cleanup, err := p.session(ctx, host, cfg)
 	if err != nil {
 		return "", err
 	}
 	defer cleanup()
-	out, err := sess.CombinedOutput(command)
-	return string(out), err
+	return streamOutput(ctx, sess, command, "", w)
+}
+
+// combinedOutput runs command on sess with input as its stdin, closing the
+// session if ctx is done first.
+func combinedOutput(ctx context.Context, sess *cryptossh.Session, command, input string) (string, error) {
+	return streamOutput(ctx, sess, command, input, nil)
+}
+
+// streamOutput is combinedOutput that also copies the output to w, when not
+// nil, as it arrives.
+func streamOutput(ctx context.Context, sess *cryptossh.Session, command, input string, w io.Writer) (string, error) {
+	if input != "" {
+		sess.Stdin = strings.NewReader(input)
+	}
+	var buf bytes.Buffer
+	out := &syncWriter{w: &buf}
+	if w != nil {
+		out.w = io.MultiWriter(&buf, w)
+	}
+	sess.Stdout = out
+	sess.Stderr = out
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	err := sess.Run(command)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return buf.String(), ctxErr
+	}
+	return buf.String(), err
+}
+
+// syncWriter serialises the writes of a session's stdout and stderr copiers.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
 }
 
 // RunScript uploads and executes a local script file via a pooled connection.
@@ -167,7 +399,7 @@ func (p *Pool) CopyFile(host, src, dest string, cfg Config) error {
 	if err != nil {
 		return fmt.Errorf("reading local file %s: %w", src, err)
 	}
-	sess, cleanup, err := p.session(host, cfg)
+	sess, cleanup, err := p.session(context.Background(), host, cfg)
 	if err != nil {
 		return err
 	}
@@ -177,7 +409,7 @@ func (p *Pool) CopyFile(host, src, dest string, cfg Config) error {
 	if err != nil {
 		return err
 	}
-	if err := sess.Start(fmt.Sprintf("cat > %q", dest)); err != nil {
+	if err := sess.Start("cat > "+utils.ShellQuote(dest)); err != nil {
 		return fmt.Errorf("starting copy to %s:%s: %w", host, dest, err)
 	}
 	if _, err := stdin.Write(data); err != nil {
@@ -203,7 +435,41 @@ func (p *Pool) Close() {
 
 // RunCommandOutput executes a command on the remote host and returns combined output.
 func RunCommandOutput(host, command string, cfg Config) (string, error) {
-	client, err := newClient(host, cfg)
+	return RunCommandOutputContext(context.Background(), host, command, cfg)
+}
+
+// RunCommandOutputContext is RunCommandOutput with cancellation; see
+// Pool.RunCommandOutputContext.
+func RunCommandOutputContext(ctx context.Context, host, command string, cfg Config) (string, error) {
+	return RunCommandInput(ctx, host, command, "", cfg)
+}
+
+// RunCommandInput is the non-pooled form of Pool.RunCommandInput.
+func RunCommandInput(ctx context.Context, host, command, input string, cfg Config) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	client, err := connect(ctx, host, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	return combinedOutput(ctx, session, command, input)
+}
+
+// RunCommandStream is the non-pooled form of Pool.RunCommandStream.
+func RunCommandStream(ctx context.Context, host, command string, w io.Writer, cfg Config) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	client, err := connect(ctx, host, cfg)
 	if err != nil {
 		return "", err
 	}
@@ -215,8 +481,7 @@ func RunCommandOutput(host, command string, cfg Config) (string, error) {
 	}
 	defer session.Close()
 
-	out, err := session.CombinedOutput(command)
-	return string(out), err
+	return streamOutput(ctx, session, command, "", w)
 }
 
 // RunCommand executes a shell command on the remote host via SSH and prints output.
@@ -250,7 +515,7 @@ func CopyFile(host, src, dest string, cfg Config) error {
 		return fmt.Errorf("reading local file %s: %w", src, err)
 	}
 
-	client, err := newClient(host, cfg)
+	client, err := connect(context.Background(), host, cfg)
 	if err != nil {
 		return err
 	}
@@ -266,7 +531,7 @@ func CopyFile(host, src, dest string, cfg Config) error {
 	if err != nil {
 		return err
 	}
-	if err := session.Start(fmt.Sprintf("cat > %q", dest)); err != nil {
+	if err := session.Start("cat > "+utils.ShellQuote(dest)); err != nil {
 		return fmt.Errorf("starting copy to %s:%s: %w", host, dest, err)
 	}
 	if _, err := stdin.Write(data); err != nil {
@@ -0,0 +1,217 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// startPasswordServer runs an SSH server on localhost that accepts only
+// user/password and answers every exec request with "ran: <command>", except
+// "hang", which never completes. It returns the port.
+func startPasswordServer(t *testing.T, user, password string) int {
+	t.Helper()
+	return startTestServer(t, &cryptossh.ServerConfig{
+		PasswordCallback: func(c cryptossh.ConnMetadata, pw []byte) (*cryptossh.Permissions, error) {
+			if c.User() == user && string(pw) == password {
+				return nil, nil
+			}
+			return nil, cryptossh.ErrNoAuth
+		},
+	})
+}
+
+// startTestServer runs an SSH server with cfg (a host key is added) on
+// localhost that answers every exec request with "ran: <command>". It returns
+// the port. "hang" never completes.
+func startTestServer(t *testing.T, cfg *cryptossh.ServerConfig) int {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating host key: %v", err)
+	}
+	hostKey, err := cryptossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("building host key: %v", err)
+	}
+	cfg.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, cfg)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func serveConn(conn net.Conn, cfg *cryptossh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := cryptossh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go cryptossh.DiscardRequests(reqs)
+	for newCh := range chans {
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range chReqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				command := string(req.Payload[4:])
+				req.Reply(true, nil)
+				if command == "hang" {
+					// Never answer; wait for the client to close the channel.
+					for range chReqs {
+					}
+					return
+				}
+				ch.Write([]byte("ran: " + command))
+				status := make([]byte, 4)
+				binary.BigEndian.PutUint32(status, 0)
+				ch.SendRequest("exit-status", false, status)
+				return
+			}
+		}()
+	}
+}
+
+func TestPool_PasswordAuth(t *testing.T) {
+	const password = "hunter2-secret"
+	port := startPasswordServer(t, "deploy", password)
+	pool := NewPool()
+	defer pool.Close()
+
+	out, err := pool.RunCommandOutput("127.0.0.1", "uptime", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: password, Port: port})
+	if err != nil {
+		t.Fatalf("expected password auth to succeed, got %v", err)
+	}
+	if out != "ran: uptime" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if strings.Contains(out, password) {
+		t.Error("password leaked into command output")
+	}
+
+	_, err = RunCommandOutput("127.0.0.1", "uptime", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "wrong-" + password, Port: port})
+	if err == nil {
+		t.Fatal("expected wrong password to fail")
+	}
+	if strings.Contains(err.Error(), password) {
+		t.Errorf("password leaked into error %q", err)
+	}
+	if !IsUnreachable(err) {
+		t.Errorf("expected a failed login to be unreachable, got %v", err)
+	}
+	if !errors.Is(err, ErrAuth) || !errors.Is(err, ErrUnreachable) {
+		t.Errorf("expected a failed login to match ErrAuth and ErrUnreachable, got %v", err)
+	}
+}
+
+func TestRunCommandOutput_Unreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	_, err = RunCommandOutput("127.0.0.1", "true", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "x", Port: port})
+	var u *UnreachableError
+	if !errors.As(err, &u) || u.Host != "127.0.0.1" {
+		t.Fatalf("expected an *UnreachableError for a closed port, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "127.0.0.1 unreachable: ") {
+		t.Errorf("expected the host in the error, got %q", err)
+	}
+	if !errors.Is(err, ErrUnreachable) || errors.Is(err, ErrAuth) {
+		t.Errorf("expected a closed port to be unreachable but not an auth failure, got %v", err)
+	}
+}
+
+func TestPool_KeyThenPasswordFallback(t *testing.T) {
+	const password = "hunter2-secret"
+	port := startPasswordServer(t, "deploy", password)
+
+	// A key the server does not accept is tried first, then the password.
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := cryptossh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600)
+
+	cases := map[string]string{
+		"rejected key": keyFile,
+		"missing key":  filepath.Join(t.TempDir(), "missing"),
+	}
+	for name, key := range cases {
+		out, err := RunCommandOutput("127.0.0.1", "id", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", KeyPath: key, Password: password, Port: port})
+		if err != nil || out != "ran: id" {
+			t.Errorf("%s: expected password fallback, got %q, %v", name, out, err)
+		}
+	}
+
+	if _, err := RunCommandOutput("127.0.0.1", "id", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", KeyPath: cases["missing key"], Port: port}); err == nil {
+		t.Error("expected a missing key without a password to fail")
+	}
+}
+
+func TestPool_RunCommandOutputContextCancels(t *testing.T) {
+	port := startPasswordServer(t, "deploy", "pw")
+	pool := NewPool()
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.RunCommandOutputContext(ctx, "127.0.0.1", "hang", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "pw", Port: port})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("command was not aborted when the context expired")
+	}
+}
+
+func TestRunCommandOutput_HostNameAlias(t *testing.T) {
+	port := startPasswordServer(t, "deploy", "pw")
+	out, err := RunCommandOutput("web1.invalid", "id", Config{HostKeyChecking: HostKeyInsecure, User: "deploy", Password: "pw", Port: port, HostName: "127.0.0.1"})
+	if err != nil || out != "ran: id" {
+		t.Errorf("expected connection to the HostName alias, got %q, %v", out, err)
+	}
+}
@@ -0,0 +1,141 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"for/pkg/utils"
+)
+
+// becomePrompt is passed to sudo -p so the password prompt can be told apart
+// from command output and removed from it.
+const becomePrompt = "[for-become-password]"
+
+// Become methods, set with become_method or RunOptions.BecomeMethod.
+const (
+	BecomeSudo = "sudo"
+	// BecomeDoas runs commands through OpenBSD's doas, which cannot be given
+	// a password on stdin, so it must be allowed with nopass.
+	BecomeDoas = "doas"
+)
+
+// redacted replaces the become password wherever it appears in output.
+const redacted = "********"
+
+// Become errors, returned wrapped in a *BecomeError.
+var (
+	// ErrBecomePasswordRequired means sudo wanted a password but none was
+	// configured (see --become-password-file).
+	ErrBecomePasswordRequired = errors.New("a sudo password is required")
+	// ErrBecomeIncorrectPassword means sudo rejected the configured password.
+	ErrBecomeIncorrectPassword = errors.New("incorrect sudo password")
+)
+
+// BecomeError reports that privilege escalation failed on a host, as opposed
+// to the command itself failing.
+type BecomeError struct {
+	Host string
+	Err  error
+}
+
+func (e *BecomeError) Error() string {
+	return fmt.Sprintf("become failed on %s: %v", e.Host, e.Err)
+}
+
+func (e *BecomeError) Unwrap() error { return e.Err }
+
+// InputRunner is implemented by connectors that can write to a command's
+// stdin, which become needs to pass the sudo password.
+type InputRunner interface {
+	RunCommandInput(command, input string) (string, error)
+}
+
+// becomeSettings is how a task escalates: whether it does, as whom (root
+// when empty) and with which method (BecomeSudo when empty).
+type becomeSettings struct {
+	enabled bool
+	user    string
+	method  string
+}
+
+// becomeFor resolves task's become settings. Each of become, become_user
+// and become_method set on the task wins over opts, which holds the play's
+// settings over the --become/config defaults (see runPlay).
+func becomeFor(task Task, opts RunOptions) becomeSettings {
+	b := becomeSettings{enabled: opts.Become, user: opts.BecomeUser, method: opts.BecomeMethod}
+	if task.Become != nil {
+		b.enabled = *task.Become
+	}
+	if task.BecomeUser != "" {
+		b.user = task.BecomeUser
+	}
+	if task.BecomeMethod != "" {
+		b.method = task.BecomeMethod
+	}
+	if b.method == "" {
+		b.method = BecomeSudo
+	}
+	return b
+}
+
+// ValidBecomeMethod reports whether method is empty or a known become method.
+func ValidBecomeMethod(method string) bool {
+	return method == "" || method == BecomeSudo || method == BecomeDoas
+}
+
+// becomeCommand wraps command in b's method. With a password sudo reads it
+// from stdin (-S) after printing becomePrompt; without one it must not
+// prompt (-n). doas is always run with -n.
+func becomeCommand(command string, b becomeSettings, withPassword bool) string {
+	cmd := b.method + " -n"
+	if withPassword {
+		cmd = b.method + " -S -p " + utils.ShellQuote(becomePrompt)
+	}
+	if b.user != "" {
+		cmd += " -u " + utils.ShellQuote(b.user)
+	}
+	return cmd + " sh -c " + utils.ShellQuote(command)
+}
+
+// runBecome runs command under b's method on conn. sudo's refusals are
+// returned as a *BecomeError, and the password and prompt are removed from
+// the output.
+func runBecome(conn Connector, host, command, password string, b becomeSettings) (string, error) {
+	var (
+		output string
+		err    error
+	)
+	switch {
+	case !ValidBecomeMethod(b.method):
+		return "", &BecomeError{Host: host, Err: fmt.Errorf("unknown become method %q (want %q or %q)", b.method, BecomeSudo, BecomeDoas)}
+	case password == "" || b.method == BecomeDoas:
+		output, err = conn.RunCommand(becomeCommand(command, b, false))
+	default:
+		runner, ok := conn.(InputRunner)
+		if !ok {
+			return "", &BecomeError{Host: host, Err: errors.New("the connection cannot pass a sudo password")}
+		}
+		output, err = runner.RunCommandInput(becomeCommand(command, b, true), password+"\n")
+	}
+	output = scrubBecome(output, password)
+	if err == nil {
+		return output, nil
+	}
+	switch {
+	case strings.Contains(output, "incorrect password") || strings.Contains(output, "Sorry, try again"):
+		return output, &BecomeError{Host: host, Err: ErrBecomeIncorrectPassword}
+	case strings.Contains(output, "a password is required") || strings.Contains(output, "a terminal is required"):
+		return output, &BecomeError{Host: host, Err: ErrBecomePasswordRequired}
+	}
+	return output, err
+}
+
+// scrubBecome removes sudo prompts and any echo of password from output.
+func scrubBecome(output, password string) string {
+	output = strings.ReplaceAll(output, becomePrompt, "")
+	if password != "" {
+		output = strings.ReplaceAll(output, password, redacted)
+	}
+	return output
+}
@@ -0,0 +1,206 @@
+package tasks
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+	"for/pkg/utils"
+)
+
+// fakeSudo puts a sudo stand-in on PATH that accepts only password "right".
+// Like sudo -S it prints the -p prompt, reads the password from stdin and
+// complains on failure; it also echoes wrong passwords to check redaction.
+func fakeSudo(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+prompt="Password: "
+nonint=0
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-S) shift ;;
+	-n) nonint=1; shift ;;
+	-p) prompt="$2"; shift 2 ;;
+	-u) shift 2 ;;
+	*) break ;;
+	esac
+done
+if [ $nonint = 1 ]; then
+	echo "sudo: a password is required" >&2
+	exit 1
+fi
+printf '%s' "$prompt" >&2
+read -r pw
+if [ "$pw" != "right" ]; then
+	echo "got $pw" >&2
+	echo "Sorry, try again." >&2
+	echo "sudo: 1 incorrect password attempt" >&2
+	exit 1
+fi
+exec "$@"
+`
+	if err := os.WriteFile(filepath.Join(dir, "sudo"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func runBecomeTask(password string) (TaskResult, error) {
+	task := Task{Name: "whoami", Command: "echo as root", Become: boolPtr(true)}
+	opts := RunOptions{Connection: ConnectionLocal, BecomePassword: password}
+	return runOnce(inventory.Host{Address: "ctrl"}, task, opts, nil)
+}
+
+func TestBecome_CorrectPassword(t *testing.T) {
+	fakeSudo(t)
+	res, err := runBecomeTask("right")
+	if err != nil {
+		t.Fatalf("unexpected error: %v (output %q)", err, res.Output)
+	}
+	if res.Output != "as root\n" {
+		t.Errorf("expected command output without the prompt, got %q", res.Output)
+	}
+}
+
+func TestBecome_WrongPassword(t *testing.T) {
+	fakeSudo(t)
+	res, err := runBecomeTask("hunter2")
+	var becomeErr *BecomeError
+	if !errors.As(err, &becomeErr) || !errors.Is(err, ErrBecomeIncorrectPassword) {
+		t.Fatalf("expected incorrect password BecomeError, got %v", err)
+	}
+	if strings.Contains(res.Output, "hunter2") || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("password leaked: output %q, error %q", res.Output, err)
+	}
+	if !strings.Contains(res.Output, "got "+redacted) {
+		t.Errorf("expected the echoed password to be redacted, got %q", res.Output)
+	}
+}
+
+func TestBecome_MissingPassword(t *testing.T) {
+	fakeSudo(t)
+	_, err := runBecomeTask("")
+	if !errors.Is(err, ErrBecomePasswordRequired) {
+		t.Fatalf("expected password required error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "become failed on ctrl") {
+		t.Errorf("expected the host in the error, got %q", err)
+	}
+}
+
+func TestAskedPasswords_ReachAuthAndBecome(t *testing.T) {
+	fakeSudo(t)
+	in := strings.NewReader("ssh-secret\nright\n")
+	var prompts strings.Builder
+	sshPassword, err := utils.PromptSecret(in, &prompts, "SSH password: ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	becomePassword, err := utils.PromptSecret(in, &prompts, "BECOME password: ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := RunOptions{Connection: ConnectionLocal, SSHPassword: sshPassword, BecomePassword: becomePassword}
+
+	for _, host := range []string{"web1", "web2"} {
+		if got := sshConfigFor(inventory.Host{Address: host}, opts).Password; got != "ssh-secret" {
+			t.Errorf("expected the asked SSH password for %s, got %q", host, got)
+		}
+		task := Task{Name: "whoami", Command: "echo as root", Become: boolPtr(true)}
+		res, err := runOnce(inventory.Host{Address: host}, task, opts, nil)
+		if err != nil || strings.TrimSpace(res.Output) != "as root" {
+			t.Errorf("expected the asked become password to reach sudo on %s, got %q, %v", host, res.Output, err)
+		}
+	}
+	if strings.Contains(prompts.String(), "secret") || strings.Contains(prompts.String(), "right") {
+		t.Errorf("expected the passwords never to be echoed, got %q", prompts.String())
+	}
+}
+
+func TestBecomeCommand(t *testing.T) {
+	tests := []struct {
+		b            becomeSettings
+		withPassword bool
+		want         string
+	}{
+		{becomeSettings{method: BecomeSudo}, false, "sudo -n sh -c 'id'"},
+		{becomeSettings{method: BecomeSudo, user: "postgres"}, true, "sudo -S -p '" + becomePrompt + "' -u 'postgres' sh -c 'id'"},
+		{becomeSettings{method: BecomeDoas, user: "www"}, false, "doas -n -u 'www' sh -c 'id'"},
+	}
+	for _, tt := range tests {
+		if got := becomeCommand("id", tt.b, tt.withPassword); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRunPlaybook_GlobalBecome(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: default
+  command: whoami
+- name: opted out
+  command: id
+  become: false
+- name: as postgres
+  command: psql
+  become_user: postgres
+`)
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(_, command string) (string, error) {
+		mu.Lock()
+		ran = append(ran, command)
+		mu.Unlock()
+		return "", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+
+	t.Run("cli default", func(t *testing.T) {
+		ran = nil
+		pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+		if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Become: true, BecomeUser: "deploy"}); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"sudo -n -u 'deploy' sh -c 'whoami'", "id", "sudo -n -u 'postgres' sh -c 'psql'"}
+		if !reflect.DeepEqual(ran, want) {
+			t.Errorf("got %q, want %q", ran, want)
+		}
+	})
+
+	t.Run("play overrides default", func(t *testing.T) {
+		ran = nil
+		pb := Playbook{{Name: "p", Hosts: "web", Become: boolPtr(false), BecomeMethod: BecomeDoas, Services: []Service{{ServiceName: "app"}}}}
+		if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Become: true}); err != nil {
+			t.Fatal(err)
+		}
+		// become_user alone does not turn become on.
+		if want := []string{"whoami", "id", "psql"}; !reflect.DeepEqual(ran, want) {
+			t.Errorf("got %q, want %q", ran, want)
+		}
+	})
+}
+
+func TestLoadTasks_BecomeMethod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.yaml")
+	if err := os.WriteFile(path, []byte("- hosts: web\n  become_method: su\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTasks(path); err == nil || !strings.Contains(err.Error(), `"su"`) {
+		t.Errorf("expected an unknown become_method error, got %v", err)
+	}
+}
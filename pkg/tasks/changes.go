@@ -0,0 +1,67 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// changeCache remembers a hash of each command's output per host between
+// runs. With change detection enabled, a command task without changed_when
+// is reported changed only when its output differs from the previous run
+// (or it has never run on that host); identical output reports ok.
+//
+// Entries are keyed by the rendered command, so with_items iterations and
+// templated commands are tracked separately. Only hashes are stored, never
+// the output itself.
+type changeCache struct {
+	mu   sync.Mutex
+	path string
+	// hosts maps host -> rendered command -> output hash.
+	hosts map[string]map[string]string
+}
+
+// loadChangeCache reads the cache at path; a missing file yields an empty cache.
+func loadChangeCache(path string) (*changeCache, error) {
+	c := &changeCache{path: path, hosts: make(map[string]map[string]string)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.hosts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// changed records output for command on host and reports whether it differs
+// from the previously recorded output.
+func (c *changeCache) changed(host, command, output string) bool {
+	sum := sha256.Sum256([]byte(output))
+	hash := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts[host] == nil {
+		c.hosts[host] = make(map[string]string)
+	}
+	prev, seen := c.hosts[host][command]
+	c.hosts[host][command] = hash
+	return !seen || prev != hash
+}
+
+// save writes the cache back to its file.
+func (c *changeCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c.hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,53 @@
+package tasks
+
+import (
+	"path/filepath"
+	"testing"
+
+	"for/pkg/inventory"
+)
+
+// runWithChangeCache runs tasks on host with change detection backed by path,
+// saving the cache afterwards like RunPlaybook does.
+func runWithChangeCache(t *testing.T, path string, host inventory.Host, tasks []Task) int {
+	t.Helper()
+	changes, err := loadChangeCache(path)
+	if err != nil {
+		t.Fatalf("loading change cache: %v", err)
+	}
+	sum := runHostTasks(host, tasks, nil, RunOptions{changes: changes}, map[string]interface{}{})
+	if err := changes.save(); err != nil {
+		t.Fatalf("saving change cache: %v", err)
+	}
+	return sum.Changed
+}
+
+func TestChangeCache_FirstRunChangedRepeatOK(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.changes.json")
+	stubConnection(t, ConnectionSSH, "installed 1.4.2")
+	tasks := []Task{{Name: "install", Command: "install app"}}
+	host := inventory.Host{Address: "w1"}
+
+	if got := runWithChangeCache(t, path, host, tasks); got != 1 {
+		t.Errorf("first run: expected changed, got changed=%d", got)
+	}
+	if got := runWithChangeCache(t, path, host, tasks); got != 0 {
+		t.Errorf("identical repeat: expected ok, got changed=%d", got)
+	}
+	if got := runWithChangeCache(t, path, inventory.Host{Address: "w2"}, tasks); got != 1 {
+		t.Errorf("other host: expected changed, got changed=%d", got)
+	}
+}
+
+func TestChangeCache_DifferentOutputChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.changes.json")
+	tasks := []Task{{Name: "install", Command: "install app"}}
+	host := inventory.Host{Address: "w1"}
+
+	stubConnection(t, ConnectionSSH, "installed 1.4.2")
+	runWithChangeCache(t, path, host, tasks)
+	stubConnection(t, ConnectionSSH, "installed 1.5.0")
+	if got := runWithChangeCache(t, path, host, tasks); got != 1 {
+		t.Errorf("expected changed output to report changed, got changed=%d", got)
+	}
+}
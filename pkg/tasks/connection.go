@@ -0,0 +1,385 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+	"for/pkg/ssh"
+	"for/pkg/utils"
+	"for/pkg/winrm"
+)
+
+// Connection types selectable via the connection field on plays, hosts and tasks.
+const (
+	ConnectionSSH    = "ssh"
+	ConnectionLocal  = "local"
+	ConnectionDocker = "docker"
+	ConnectionWinRM  = "winrm"
+)
+
+// Connector executes commands and copies files on a single target.
+type Connector interface {
+	// RunCommand runs a command (or a local script path) and returns combined output.
+	RunCommand(command string) (string, error)
+	// CopyFile copies a local file to dest on the target.
+	CopyFile(src, dest string) error
+}
+
+// ValidatingCopier is implemented by connectors that can check a copied file
+// with a command before it replaces dest (see CopyTask.Validate).
+type ValidatingCopier interface {
+	CopyFileValidated(src, dest, validate string) error
+}
+
+// StreamRunner is implemented by connectors that can pass a command's
+// output to w as it arrives, for RunOptions.Stream. The combined output is
+// still returned.
+type StreamRunner interface {
+	RunCommandStream(command string, w io.Writer) (string, error)
+}
+
+// ArgvRunner is implemented by connectors that can run a command module's
+// argv without a shell. Other connectors get the argv quoted into one
+// command line (see utils.ShellJoin), which their shell splits back.
+type ArgvRunner interface {
+	RunArgv(argv []string) (string, error)
+}
+
+// connectorFactory builds a Connector for one host.
+type connectorFactory func(host inventory.Host, opts RunOptions) Connector
+
+// connectors maps a connection type to its factory.
+var connectors = map[string]connectorFactory{
+	ConnectionLocal: func(_ inventory.Host, opts RunOptions) Connector {
+		return localConnector{ctx: opts.context(), out: opts.hostOutput()}
+	},
+	ConnectionSSH: func(host inventory.Host, opts RunOptions) Connector {
+		if opts.SSHMux {
+			return sshMuxConnector{host: host, cfg: sshConfigFor(host, opts), ctx: opts.context(), tmp: remoteTmpFor(host, opts)}
+		}
+		return sshConnector{host: host, cfg: sshConfigFor(host, opts), pool: opts.SSHPool, ctx: opts.context(), tmp: remoteTmpFor(host, opts)}
+	},
+	ConnectionDocker: func(host inventory.Host, opts RunOptions) Connector {
+		return dockerConnector{container: host.DialAddress(), ctx: opts.context()}
+	},
+	ConnectionWinRM: func(host inventory.Host, opts RunOptions) Connector {
+		shell := opts.WinRMShell
+		if v, ok := host.Var("winrm_shell"); ok {
+			shell = v
+		}
+		return winrmConnector{client: newWinRMClient(host.DialAddress(), winrmConfigFor(host, opts)), shell: shell}
+	},
+}
+
+// resolveConnection picks the connection type for a task on a host.
+// Precedence: task > host var > play/run default > "ssh".
+func resolveConnection(task Task, host inventory.Host, opts RunOptions) string {
+	if task.Connection != "" {
+		return task.Connection
+	}
+	if v, ok := host.Var("ansible_connection"); ok && v != "" {
+		return v
+	}
+	if v, ok := host.Var("connection"); ok && v != "" {
+		return v
+	}
+	if opts.Connection != "" {
+		return opts.Connection
+	}
+	if opts.RunLocally {
+		return ConnectionLocal
+	}
+	return ConnectionSSH
+}
+
+// connectorFor returns the Connector that should run task on host.
+func connectorFor(task Task, host inventory.Host, opts RunOptions) (Connector, error) {
+	name := resolveConnection(task, host, opts)
+	factory, ok := connectors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown connection type %q", name)
+	}
+	return factory(host, opts), nil
+}
+
+// ---------------------------------------------------------------------------
+// Local connection
+// ---------------------------------------------------------------------------
+
+type localConnector struct {
+	ctx context.Context
+	// out reports copies, with the rest of the host's output.
+	out *printer.HostWriter
+}
+
+func (c localConnector) RunCommand(command string) (string, error) {
+	if utils.IsScript(command) {
+		return runLocalScriptOutput(c.ctx, command)
+	}
+	return runLocalCommandOutput(c.ctx, command)
+}
+
+func (c localConnector) RunArgv(argv []string) (string, error) {
+	out, err := localCommand(c.ctx, argv[0], argv[1:]...).CombinedOutput()
+	return string(out), err
+}
+
+func (c localConnector) RunCommandInput(command, input string) (string, error) {
+	cmd := localCommand(c.ctx, "sh", "-c", command)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func (c localConnector) RunCommandStream(command string, w io.Writer) (string, error) {
+	cmd := localCommand(c.ctx, "sh", "-c", command)
+	if utils.IsScript(command) {
+		cmd = localCommand(c.ctx, "sh", command)
+	}
+	var buf bytes.Buffer
+	out := io.MultiWriter(&buf, w)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	return buf.String(), err
+}
+
+func (c localConnector) CopyFile(src, dest string) error {
+	if err := copyLocal(src, dest); err != nil {
+		return err
+	}
+	c.out.Copied(src, dest)
+	return nil
+}
+
+func (c localConnector) CopyFileValidated(src, dest, validate string) error {
+	if err := copyLocalValidated(c.ctx, src, dest, validate); err != nil {
+		return err
+	}
+	c.out.Copied(src, dest)
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// SSH connection
+// ---------------------------------------------------------------------------
+
+// sshConnector stages scripts and copied files under tmp (see remoteTmpFor).
+type sshConnector struct {
+	host inventory.Host
+	cfg  ssh.Config
+	pool *ssh.Pool
+	ctx  context.Context
+	tmp  string
+}
+
+func (c sshConnector) RunCommand(command string) (string, error) {
+	if utils.IsScript(command) {
+		return runStagedScript(c, c.host.Address, c.tmp, command)
+	}
+	if c.pool != nil {
+		return c.pool.RunCommandOutputContext(c.ctx, c.host.Address, command, c.cfg)
+	}
+	return ssh.RunCommandOutputContext(c.ctx, c.host.Address, command, c.cfg)
+}
+
+func (c sshConnector) RunCommandInput(command, input string) (string, error) {
+	if c.pool != nil {
+		return c.pool.RunCommandInput(c.ctx, c.host.Address, command, input, c.cfg)
+	}
+	return ssh.RunCommandInput(c.ctx, c.host.Address, command, input, c.cfg)
+}
+
+func (c sshConnector) RunCommandStream(command string, w io.Writer) (string, error) {
+	if utils.IsScript(command) {
+		return runStagedScript(sshStream{c, w}, c.host.Address, c.tmp, command)
+	}
+	return c.stream(command, w)
+}
+
+// stream runs command as is, copying its output to w.
+func (c sshConnector) stream(command string, w io.Writer) (string, error) {
+	if c.pool != nil {
+		return c.pool.RunCommandStream(c.ctx, c.host.Address, command, w, c.cfg)
+	}
+	return ssh.RunCommandStream(c.ctx, c.host.Address, command, w, c.cfg)
+}
+
+// sshStream is an sshConnector whose commands stream their output to w, so a
+// staged script's output streams too.
+type sshStream struct {
+	sshConnector
+	w io.Writer
+}
+
+func (s sshStream) RunCommand(command string) (string, error) {
+	return s.stream(command, s.w)
+}
+
+func (c sshConnector) CopyFile(src, dest string) error {
+	return copyStaged(c, c.host.Address, c.tmp, src, dest, "")
+}
+
+func (c sshConnector) CopyFileValidated(src, dest, validate string) error {
+	return copyStaged(c, c.host.Address, c.tmp, src, dest, validate)
+}
+
+// upload copies src to exactly dest, without staging.
+func (c sshConnector) upload(src, dest string) error {
+	if c.pool != nil {
+		return c.pool.CopyFile(c.host.Address, src, dest, c.cfg)
+	}
+	return ssh.CopyFile(c.host.Address, src, dest, c.cfg)
+}
+
+// ---------------------------------------------------------------------------
+// Docker connection
+// ---------------------------------------------------------------------------
+
+// dockerRun invokes the docker CLI, killed when ctx is done, and returns
+// its combined output. Replaced in tests to capture the generated arguments.
+var dockerRun = func(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	return string(out), err
+}
+
+// dockerConnector runs commands inside a container named by the host's
+// dial address: its ansible_host, else its inventory address.
+type dockerConnector struct {
+	container string
+	ctx       context.Context
+}
+
+func (c dockerConnector) RunCommand(command string) (string, error) {
+	if utils.IsScript(command) {
+		script, err := os.ReadFile(command)
+		if err != nil {
+			return "", err
+		}
+		command = string(script)
+	}
+	return dockerRun(c.ctx, "exec", c.container, "sh", "-c", command)
+}
+
+func (c dockerConnector) CopyFile(src, dest string) error {
+	out, err := dockerRun(c.ctx, "cp", src, c.container+":"+dest)
+	if err != nil {
+		return fmt.Errorf("docker cp %s -> %s:%s: %w\n%s", src, c.container, dest, err, out)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// WinRM connection
+// ---------------------------------------------------------------------------
+
+// winrmRunner is the subset of *winrm.Client used by winrmConnector.
+type winrmRunner interface {
+	Run(command string) (stdout, stderr string, exitCode int, err error)
+}
+
+// newWinRMClient is replaced in tests with a mock runner.
+var newWinRMClient = func(host string, cfg winrm.Config) winrmRunner {
+	return winrm.NewClient(host, cfg)
+}
+
+func winrmConfigFor(host inventory.Host, opts RunOptions) winrm.Config {
+	cfg := winrm.Config{
+		User:     opts.WinRMUser,
+		Password: opts.WinRMPassword,
+		Port:     opts.WinRMPort,
+		HTTPS:    opts.WinRMHTTPS,
+		Insecure: opts.WinRMInsecure,
+	}
+	if v, ok := host.Var("winrm_user"); ok {
+		cfg.User = v
+	}
+	if v, ok := host.Var("winrm_port"); ok {
+		var p int
+		if _, err := fmt.Sscan(v, &p); err == nil {
+			cfg.Port = p
+		}
+	}
+	return cfg
+}
+
+// winrmConnector runs commands through PowerShell (default) or cmd.exe.
+type winrmConnector struct {
+	client winrmRunner
+	shell  string
+}
+
+// winrmMaxCommand is the longest command line the cmd shell that runs
+// WinRM commands accepts.
+const winrmMaxCommand = 8191
+
+// winrmCopyScript is the PowerShell run for each chunk of a copy: the base64
+// chunk, the escaped destination path and the file mode.
+const winrmCopyScript = "$b=[Convert]::FromBase64String('%s');$f=[IO.File]::Open('%s','%s');$f.Write($b,0,$b.Length);$f.Close()"
+
+// winrmCopyChunk returns how many base64 characters of a file fit in one
+// copy command for the escaped path: winrm.Powershell encodes the script as
+// UTF-16LE and then base64, so the command line is about 8/3 as long as the
+// script and the script may use at most 3/8 of winrmMaxCommand, about 3000
+// characters. The chunk is a multiple of 4 so that each decodes on its own.
+func winrmCopyChunk(path string) int {
+	prefix := len(winrm.Powershell(""))
+	script := (winrmMaxCommand - prefix) / 4 * 3 / 2
+	overhead := len(fmt.Sprintf(winrmCopyScript, "", path, "Append"))
+	return (script - overhead) / 4 * 4
+}
+
+func (c winrmConnector) RunCommand(command string) (string, error) {
+	if utils.IsScript(command) {
+		script, err := os.ReadFile(command)
+		if err != nil {
+			return "", err
+		}
+		command = string(script)
+	}
+	if c.shell != "cmd" {
+		command = winrm.Powershell(command)
+	}
+	stdout, stderr, code, err := c.client.Run(command)
+	if err == nil && code != 0 {
+		err = &winrm.ExitError{Code: code, Stderr: stderr}
+	}
+	return stdout + stderr, err
+}
+
+func (c winrmConnector) CopyFile(src, dest string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("reading local file %s: %w", src, err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	path := strings.ReplaceAll(dest, "'", "''")
+	chunk := winrmCopyChunk(path)
+	if chunk <= 0 {
+		return fmt.Errorf("winrm copy to %s: destination path too long", dest)
+	}
+	mode := "Create"
+	for start := 0; start == 0 || start < len(encoded); start += chunk {
+		end := start + chunk
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		script := fmt.Sprintf(winrmCopyScript, encoded[start:end], path, mode)
+		if _, _, code, err := c.client.Run(winrm.Powershell(script)); err != nil || code != 0 {
+			if err == nil {
+				err = &winrm.ExitError{Code: code}
+			}
+			return fmt.Errorf("winrm copy to %s: %w", dest, err)
+		}
+		mode = "Append"
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+	"for/pkg/winrm"
+)
+
+// recordingConnector records every command it is asked to run.
+type recordingConnector struct {
+	mu       *sync.Mutex
+	commands *[]string
+	output   string
+}
+
+func (r recordingConnector) RunCommand(command string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.commands = append(*r.commands, command)
+	return r.output, nil
+}
+
+func (r recordingConnector) CopyFile(src, dest string) error {
+	_, err := r.RunCommand("copy " + src + " " + dest)
+	return err
+}
+
+// stubConnection replaces the factory for name with a recording connector for
+// the duration of the test and returns the slice of recorded commands.
+func stubConnection(t *testing.T, name, output string) *[]string {
+	t.Helper()
+	var (
+		mu       sync.Mutex
+		commands []string
+	)
+	prev, had := connectors[name]
+	connectors[name] = func(inventory.Host, RunOptions) Connector {
+		return recordingConnector{mu: &mu, commands: &commands, output: output}
+	}
+	t.Cleanup(func() {
+		if had {
+			connectors[name] = prev
+		} else {
+			delete(connectors, name)
+		}
+	})
+	return &commands
+}
+
+func TestResolveConnection_Precedence(t *testing.T) {
+	host := inventory.Host{Address: "web1", Vars: map[string]interface{}{"connection": "local"}}
+
+	if got := resolveConnection(Task{}, inventory.Host{Address: "web1"}, RunOptions{}); got != ConnectionSSH {
+		t.Errorf("expected default %q, got %q", ConnectionSSH, got)
+	}
+	if got := resolveConnection(Task{}, inventory.Host{Address: "web1"}, RunOptions{RunLocally: true}); got != ConnectionLocal {
+		t.Errorf("expected RunLocally to select %q, got %q", ConnectionLocal, got)
+	}
+	if got := resolveConnection(Task{}, host, RunOptions{Connection: ConnectionSSH}); got != ConnectionLocal {
+		t.Errorf("expected host var to override play default, got %q", got)
+	}
+	if got := resolveConnection(Task{Connection: ConnectionSSH}, host, RunOptions{}); got != ConnectionSSH {
+		t.Errorf("expected task connection to override host var, got %q", got)
+	}
+}
+
+func TestConnectorFor_UnknownType(t *testing.T) {
+	_, err := connectorFor(Task{Connection: "carrier-pigeon"}, inventory.Host{Address: "web1"}, RunOptions{})
+	if err == nil {
+		t.Error("expected error for unknown connection type")
+	}
+}
+
+func TestRunHostTasks_MixedLocalAndRemote(t *testing.T) {
+	local := stubConnection(t, ConnectionLocal, "local-out")
+	remote := stubConnection(t, ConnectionSSH, "remote-out")
+
+	localHost := inventory.Host{Address: "ctrl", Vars: map[string]interface{}{"connection": "local"}}
+	remoteHost := inventory.Host{Address: "web1", Vars: map[string]interface{}{}}
+	tasks := []Task{{Name: "hello", Command: "echo {{.inventory_name}}"}}
+
+	for _, h := range []inventory.Host{localHost, remoteHost} {
+		vars := map[string]interface{}{"inventory_name": h.Address}
+		sum := runHostTasks(h, tasks, nil, RunOptions{}, vars)
+		if sum.Failed != 0 {
+			t.Fatalf("host %s: unexpected failure", h.Address)
+		}
+	}
+
+	if len(*local) != 1 || (*local)[0] != "echo ctrl" {
+		t.Errorf("expected local connector to run 'echo ctrl', got %v", *local)
+	}
+	if len(*remote) != 1 || (*remote)[0] != "echo web1" {
+		t.Errorf("expected ssh connector to run 'echo web1', got %v", *remote)
+	}
+}
+
+func TestDockerConnector_GeneratesExecAndCp(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "run")
+	var calls [][]string
+	prev := dockerRun
+	dockerRun = func(c context.Context, args ...string) (string, error) {
+		if c.Value(ctxKey{}) != "run" {
+			t.Errorf("expected docker %v to get the run's context", args)
+		}
+		calls = append(calls, args)
+		return "", nil
+	}
+	t.Cleanup(func() { dockerRun = prev })
+
+	host := inventory.Host{Address: "app-1", Vars: map[string]interface{}{"connection": "docker"}}
+	tasks := []Task{
+		{Name: "run", Command: "echo {{.msg}}"},
+		{Name: "upload", Copy: &CopyTask{Src: "files/app.conf", Dest: "/etc/app.conf"}},
+	}
+	sum := runHostTasks(host, tasks, nil, RunOptions{Context: ctx}, map[string]interface{}{"msg": "hi"})
+	if sum.Failed != 0 {
+		t.Fatalf("unexpected failures: %+v", sum)
+	}
+
+	want := [][]string{
+		{"exec", "app-1", "sh", "-c", "echo hi"},
+		{"cp", "files/app.conf", "app-1:/etc/app.conf"},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("expected %d docker calls, got %v", len(want), calls)
+	}
+	for i := range want {
+		if strings.Join(calls[i], " ") != strings.Join(want[i], " ") {
+			t.Errorf("call %d: expected %v, got %v", i, want[i], calls[i])
+		}
+	}
+}
+
+func TestDockerConnector_NonZeroExitFails(t *testing.T) {
+	prev := dockerRun
+	dockerRun = func(_ context.Context, args ...string) (string, error) {
+		return "boom", errors.New("exit status 2")
+	}
+	t.Cleanup(func() { dockerRun = prev })
+
+	host := inventory.Host{Address: "app-1", Vars: map[string]interface{}{"connection": "docker"}}
+	sum := runHostTasks(host, []Task{{Name: "fail", Command: "false"}}, nil, RunOptions{}, map[string]interface{}{})
+	if sum.Failed != 1 {
+		t.Errorf("expected 1 failed task, got %+v", sum)
+	}
+}
+
+// mockWinRM records commands and returns a fixed result.
+type mockWinRM struct {
+	commands []string
+	stdout   string
+	stderr   string
+	code     int
+}
+
+func (m *mockWinRM) Run(command string) (string, string, int, error) {
+	m.commands = append(m.commands, command)
+	return m.stdout, m.stderr, m.code, nil
+}
+
+func stubWinRM(t *testing.T, m *mockWinRM) {
+	t.Helper()
+	prev := newWinRMClient
+	newWinRMClient = func(string, winrm.Config) winrmRunner { return m }
+	t.Cleanup(func() { newWinRMClient = prev })
+}
+
+func TestWinRMConnector_RunsThroughPowershell(t *testing.T) {
+	m := &mockWinRM{stdout: "ok\r\n"}
+	stubWinRM(t, m)
+
+	host := inventory.Host{Address: "win1", Vars: map[string]interface{}{"connection": "winrm"}}
+	res, err := runOnce(host, Task{Command: "Get-Service {{.svc}}"}, RunOptions{}, map[string]interface{}{"svc": "W32Time"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Output != "ok\r\n" {
+		t.Errorf("expected stdout to be returned, got %q", res.Output)
+	}
+	if len(m.commands) != 1 || m.commands[0] != winrm.Powershell("Get-Service W32Time") {
+		t.Errorf("expected encoded PowerShell command, got %v", m.commands)
+	}
+}
+
+func TestWinRMConnector_CmdShell(t *testing.T) {
+	m := &mockWinRM{}
+	stubWinRM(t, m)
+
+	host := inventory.Host{Address: "win1", Vars: map[string]interface{}{"connection": "winrm", "winrm_shell": "cmd"}}
+	if _, err := runOnce(host, Task{Command: "dir C:\\"}, RunOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.commands) != 1 || m.commands[0] != "dir C:\\" {
+		t.Errorf("expected raw cmd.exe command, got %v", m.commands)
+	}
+}
+
+func TestWinRMConnector_ExitCodePropagates(t *testing.T) {
+	m := &mockWinRM{stdout: "partial", stderr: "access denied", code: 5}
+	stubWinRM(t, m)
+
+	host := inventory.Host{Address: "win1", Vars: map[string]interface{}{"connection": "winrm"}}
+	res, err := runOnce(host, Task{Command: "Stop-Computer"}, RunOptions{}, nil)
+	if err == nil {
+		t.Fatal("expected error for non-zero exit code")
+	}
+	if !res.Failed || res.RC != 5 {
+		t.Errorf("expected failed result with RC=5, got %+v", res)
+	}
+	if res.Output != "partialaccess denied" {
+		t.Errorf("expected combined stdout+stderr, got %q", res.Output)
+	}
+}
+
+func TestWinRMConnector_CopyFileFitsCommandLine(t *testing.T) {
+	m := &mockWinRM{}
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	src := filepath.Join(t.TempDir(), "app.zip")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dest := `C:\Program Files\App's data\app.zip`
+	if err := (winrmConnector{client: m}).CopyFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.commands) < 3 {
+		t.Fatalf("expected the file to be split over several commands, got %d", len(m.commands))
+	}
+
+	var encoded strings.Builder
+	for i, command := range m.commands {
+		if len(command) > winrmMaxCommand {
+			t.Errorf("command %d is %d characters, over the %d limit", i+1, len(command), winrmMaxCommand)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(command, winrm.Powershell("")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := make([]uint16, len(raw)/2)
+		for j := range u {
+			u[j] = binary.LittleEndian.Uint16(raw[j*2:])
+		}
+		script := string(utf16.Decode(u))
+		mode := "'Append')"
+		if i == 0 {
+			mode = "'Create')"
+		}
+		if !strings.Contains(script, `'C:\Program Files\App''s data\app.zip',`+mode) {
+			t.Errorf("command %d: expected the escaped path opened with %s, got %q", i+1, mode, script)
+		}
+		chunk := strings.TrimPrefix(script, "$b=[Convert]::FromBase64String('")
+		encoded.WriteString(chunk[:strings.Index(chunk, "'")])
+	}
+	got, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("expected the chunks to reassemble the file, got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestSSHConfigFor_HostVarsOverrideDefaults(t *testing.T) {
+	opts := RunOptions{SSHUser: "root", SSHPort: 22, SSHKeyPath: "/keys/default"}
+
+	cfg := sshConfigFor(inventory.Host{Address: "web1"}, opts)
+	if cfg.User != "root" || cfg.Port != 22 || cfg.KeyPath != "/keys/default" || cfg.HostName != "" {
+		t.Errorf("expected global defaults, got %+v", cfg)
+	}
+
+	host := inventory.Host{Address: "web1", Vars: map[string]interface{}{
+		"ansible_user":                 "deploy",
+		"ssh_port":                     "2222",
+		"ansible_ssh_private_key_file": "/keys/web",
+		"ansible_host":                 "10.0.0.5",
+	}}
+	cfg = sshConfigFor(host, opts)
+	if cfg.User != "deploy" || cfg.Port != 2222 || cfg.KeyPath != "/keys/web" || cfg.HostName != "10.0.0.5" {
+		t.Errorf("expected host vars to override defaults, got %+v", cfg)
+	}
+}
+
+func TestSSHConfigFor_SharesConnectLimiter(t *testing.T) {
+	opts := RunOptions{}
+	opts.limitConnects()
+	if cfg := sshConfigFor(inventory.Host{Address: "web1"}, opts); cfg.ConnectLimiter != nil {
+		t.Errorf("expected no limiter without ConnectRate, got %+v", cfg.ConnectLimiter)
+	}
+
+	opts = RunOptions{ConnectRate: 5}
+	opts.limitConnects()
+	web1 := sshConfigFor(inventory.Host{Address: "web1"}, opts)
+	web2 := sshConfigFor(inventory.Host{Address: "web2"}, opts)
+	if web1.ConnectLimiter == nil || web1.ConnectLimiter != web2.ConnectLimiter {
+		t.Errorf("expected every host to share one limiter, got %p and %p", web1.ConnectLimiter, web2.ConnectLimiter)
+	}
+}
+
+func TestRunPlaybook_AnsibleHostAlias(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: whoami\n  command: 'echo {{ .inventory_hostname }}'\n")
+	m := &mockWinRM{}
+	var dialed []string
+	prev := newWinRMClient
+	newWinRMClient = func(host string, _ winrm.Config) winrmRunner {
+		dialed = append(dialed, host)
+		return m
+	}
+	t.Cleanup(func() { newWinRMClient = prev })
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	host := inventory.Host{Address: "web1", Vars: map[string]interface{}{"connection": "winrm", "ansible_host": "10.0.0.5"}}
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {host}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialed) == 0 || dialed[0] != "10.0.0.5" {
+		t.Errorf("expected to dial 10.0.0.5, got %v", dialed)
+	}
+	if len(m.commands) != 1 || m.commands[0] != winrm.Powershell("echo web1") {
+		t.Errorf("expected inventory_hostname to render as web1, got %v", m.commands)
+	}
+	if !strings.Contains(out.String(), "web1") || strings.Contains(out.String(), "10.0.0.5") {
+		t.Errorf("expected output to report web1 only, got:\n%s", out.String())
+	}
+
+	conn, err := connectorFor(Task{}, inventory.Host{Address: "web1", Vars: map[string]interface{}{"ansible_host": "10.0.0.5"}}, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := conn.(sshConnector); c.host.Address != "web1" || c.cfg.HostName != "10.0.0.5" {
+		t.Errorf("expected ssh to dial 10.0.0.5 for web1, got %s -> %s", c.host.Address, c.cfg.HostName)
+	}
+
+	conn, err = connectorFor(Task{}, inventory.Host{Address: "web1", Vars: map[string]interface{}{"connection": "docker", "ansible_host": "app-1"}}, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := conn.(dockerConnector); c.container != "app-1" {
+		t.Errorf("expected docker to exec in app-1 for web1, got %s", c.container)
+	}
+}
+
+func TestPlayHosts_GroupVarsApplyToConnection(t *testing.T) {
+	inv := &inventory.Inventory{
+		Hosts: map[string][]inventory.Host{"web": {
+			{Address: "web1", Vars: map[string]interface{}{}},
+			{Address: "web2", Vars: map[string]interface{}{"ansible_user": "admin"}},
+		}},
+		GroupVars: map[string]map[string]interface{}{"web": {"ansible_user": "deploy", "ansible_port": "2200"}},
+	}
+	hosts, _, ok := playHosts(Play{Hosts: "web"}, inv, RunOptions{})
+	if !ok || len(hosts) != 2 {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+	opts := RunOptions{SSHUser: "root", SSHPort: 22}
+	if cfg := sshConfigFor(hosts[0], opts); cfg.User != "deploy" || cfg.Port != 2200 {
+		t.Errorf("expected group vars to apply, got %+v", cfg)
+	}
+	if cfg := sshConfigFor(hosts[1], opts); cfg.User != "admin" || cfg.Port != 2200 {
+		t.Errorf("expected host var to beat group var, got %+v", cfg)
+	}
+	if _, ok := inv.Hosts["web"][0].Vars["ansible_user"]; ok {
+		t.Error("inventory hosts must not be modified")
+	}
+}
+
+// onWrite calls fn with everything written so far after every write.
+type onWrite struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	fn  func(string)
+}
+
+func (w *onWrite) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	w.fn(w.buf.String())
+	return len(p), nil
+}
+
+func TestExecuteTask_StreamsOutputIncrementally(t *testing.T) {
+	release := filepath.Join(t.TempDir(), "release")
+	released := false
+	w := &onWrite{fn: func(got string) {
+		// The command waits for this file after its first line, so it
+		// only finishes if that line is printed while it runs.
+		if !released && strings.Contains(got, "  localhost | first\n") {
+			released = true
+			os.WriteFile(release, nil, 0o644)
+		}
+	}}
+	prevOut := printer.SetOutput(w)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	command := "echo first; while [ ! -f " + release + " ]; do sleep 0.01; done; echo second"
+	res, err := executeTask(Task{Name: "deploy", Shell: command}, inventory.Host{Address: "localhost"},
+		RunOptions{RunLocally: true, Stream: true, Context: ctx}, nil)
+	if err != nil {
+		t.Fatalf("expected the command to finish once its first line was streamed: %v", err)
+	}
+	if res.Output != "first\nsecond\n" || !res.Streamed {
+		t.Errorf("expected the full output to be kept, got %+v", res)
+	}
+	if got := w.buf.String(); got != "  localhost | first\n  localhost | second\n" {
+		t.Errorf("unexpected streamed output %q", got)
+	}
+}
@@ -0,0 +1,60 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes of the for command, so scripts and CI can tell setup
+// mistakes from failures on hosts. ExitStatus maps a run's error to one.
+const (
+	// ExitOK: the run succeeded on every host.
+	ExitOK = 0
+	// ExitFailed: tasks failed on some of the hosts, or the run failed in
+	// another way once started (e.g. its pre-run hook).
+	ExitFailed = 1
+	// ExitChanges: --diff-only found drift or --check found pending changes.
+	ExitChanges = 2
+	// ExitUnreachable: nothing failed but hosts were unreachable, under
+	// --ignore-unreachable without --ok-on-unreachable.
+	ExitUnreachable = 3
+	// ExitAllFailed: every host the run targeted failed.
+	ExitAllFailed = 4
+	// ExitSyntax: the playbook or a service does not load, or
+	// --syntax-check found errors.
+	ExitSyntax = 5
+	// ExitConfig: the config, inventory, vault password or a secret file
+	// could not be loaded.
+	ExitConfig = 6
+	// ExitUsage: invalid flags or arguments (sysexits' EX_USAGE).
+	ExitUsage = 64
+	// ExitTimedOut: --run-timeout expired.
+	ExitTimedOut = 124
+)
+
+// ErrAllHostsFailed matches, with errors.Is, the error RunPlaybook and the
+// ad hoc functions return when tasks failed on every host they targeted.
+// It also matches ErrTaskFailed.
+var ErrAllHostsFailed = fmt.Errorf("all hosts failed: %w", ErrTaskFailed)
+
+// ExitStatus is the status the for command exits with after a run that
+// returned err.
+func ExitStatus(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrServiceLoad):
+		return ExitSyntax
+	case errors.Is(err, ErrDriftDetected), errors.Is(err, ErrWouldChange):
+		return ExitChanges
+	case errors.Is(err, ErrRunTimedOut):
+		return ExitTimedOut
+	case errors.Is(err, ErrAllHostsFailed):
+		return ExitAllFailed
+	case errors.Is(err, ErrTaskFailed):
+		return ExitFailed
+	case errors.Is(err, ErrHostsUnreachable):
+		return ExitUnreachable
+	}
+	return ExitFailed
+}
@@ -0,0 +1,105 @@
+package tasks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Template filters registered in templateFuncs. A piped value is passed as
+// the last argument, so {{ .x | default "foo" }} calls filterDefault("foo", x).
+
+// filterDefault returns def when v is missing, nil, an empty string or an
+// empty list or map, and v otherwise.
+func filterDefault(def, v interface{}) interface{} {
+	if isEmptyValue(v) {
+		return def
+	}
+	return v
+}
+
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// filterString renders v for the string filters; a missing value is "".
+func filterString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func filterToJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("to_json: %w", err)
+	}
+	return string(data), nil
+}
+
+func filterFromJSON(v interface{}) (interface{}, error) {
+	var out interface{}
+	if err := json.Unmarshal([]byte(filterString(v)), &out); err != nil {
+		return nil, fmt.Errorf("from_json: %w", err)
+	}
+	return out, nil
+}
+
+func filterUpper(v interface{}) string { return strings.ToUpper(filterString(v)) }
+
+func filterLower(v interface{}) string { return strings.ToLower(filterString(v)) }
+
+func filterTrim(v interface{}) string { return strings.TrimSpace(filterString(v)) }
+
+// filterJoin joins the elements of list, a list of any values, with sep. A
+// single value is returned as is.
+func filterJoin(sep string, list interface{}) string {
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return filterString(list)
+	}
+	parts := make([]string, rv.Len())
+	for i := range parts {
+		parts[i] = filterString(rv.Index(i).Interface())
+	}
+	return strings.Join(parts, sep)
+}
+
+func filterB64Encode(v interface{}) string {
+	return base64.StdEncoding.EncodeToString([]byte(filterString(v)))
+}
+
+func filterB64Decode(v interface{}) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(filterString(v)))
+	if err != nil {
+		return "", fmt.Errorf("b64decode: %w", err)
+	}
+	return string(data), nil
+}
+
+// filterRegexReplace replaces every match of pattern in v with repl, which
+// may refer to groups as $1 or ${name}.
+func filterRegexReplace(pattern, repl string, v interface{}) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("regex_replace: %w", err)
+	}
+	return re.ReplaceAllString(filterString(v), repl), nil
+}
@@ -0,0 +1,75 @@
+package tasks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandVars_Filters(t *testing.T) {
+	vars := map[string]interface{}{
+		"name":   "Web App",
+		"empty":  "",
+		"port":   8080,
+		"list":   []interface{}{"a", 1, true},
+		"hosts":  []string{"w1", "w2"},
+		"nested": map[string]interface{}{"k": "v"},
+		"json":   `{"version": "1.2", "tags": ["x"]}`,
+		"padded": "  ok \n",
+		"b64":    "aGVsbG8=",
+	}
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{`{{ .missing | default "foo" }}`, "foo"},
+		{`{{ .empty | default "foo" }}`, "foo"},
+		{`{{ .name | default "foo" }}`, "Web App"},
+		{`{{ .port | default 22 }}`, "8080"},
+		{`{{ .none | default .port }}`, "8080"},
+		{`{{ .list | to_json }}`, `["a",1,true]`},
+		{`{{ .nested | to_json }}`, `{"k":"v"}`},
+		{`{{ .name | to_json }}`, `"Web App"`},
+		{`{{ (.json | from_json).version }}`, "1.2"},
+		{`{{ range (.json | from_json).tags }}{{ . }}{{ end }}`, "x"},
+		{`{{ .name | upper }}`, "WEB APP"},
+		{`{{ .name | lower }}`, "web app"},
+		{`[{{ .padded | trim }}]`, "[ok]"},
+		{`{{ .hosts | join "," }}`, "w1,w2"},
+		{`{{ .list | join " " }}`, "a 1 true"},
+		{`{{ .name | join "," }}`, "Web App"},
+		{`{{ .name | b64encode }}`, "V2ViIEFwcA=="},
+		{`{{ .b64 | b64decode }}`, "hello"},
+		{`{{ .name | regex_replace "[^A-Za-z]+" "-" | lower }}`, "web-app"},
+		{`{{ .name | regex_replace "(\\w+) (\\w+)" "$2 $1" }}`, "App Web"},
+		{`{{ .missing | upper }}`, ""},
+	}
+	for _, tt := range tests {
+		got, err := expandVars(tt.tmpl, vars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.tmpl, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestExpandVars_FilterErrors(t *testing.T) {
+	vars := map[string]interface{}{"s": "not json"}
+	for _, tmpl := range []string{
+		`{{ .s | from_json }}`,
+		`{{ .s | b64decode }}`,
+		`{{ .s | regex_replace "(" "" }}`,
+	} {
+		_, err := expandVars(tmpl, vars)
+		if err == nil {
+			t.Errorf("%s: expected an error", tmpl)
+			continue
+		}
+		name := strings.Fields(strings.TrimPrefix(tmpl, "{{ .s | "))[0]
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: expected the filter named in %q", tmpl, err)
+		}
+	}
+}
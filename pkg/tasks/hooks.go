@@ -0,0 +1,91 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"for/pkg/printer"
+)
+
+// ErrPreRunHookFailed matches, with errors.Is, the error a run returns when
+// RunOptions.PreRunHook fails; no host is contacted.
+var ErrPreRunHookFailed = errors.New("pre-run hook failed")
+
+// Environment variables describing the run, set for PreRunHook and
+// PostRunHook on top of the controller's environment. The counts and exit
+// status are only set for PostRunHook.
+const (
+	EnvPlaybook    = "FOR_PLAYBOOK"
+	EnvGroup       = "FOR_GROUP"
+	EnvHostCount   = "FOR_HOST_COUNT"
+	EnvDryRun      = "FOR_DRY_RUN"
+	EnvOK          = "FOR_OK"
+	EnvChanged     = "FOR_CHANGED"
+	EnvFailed      = "FOR_FAILED"
+	EnvSkipped     = "FOR_SKIPPED"
+	EnvUnreachable = "FOR_UNREACHABLE"
+	EnvExitStatus  = "FOR_EXIT_STATUS"
+)
+
+// hookEnv returns the variables shared by both hooks of a run over hosts
+// hosts of group (empty for playbook runs).
+func hookEnv(opts RunOptions, group string, hosts int) []string {
+	return []string{
+		EnvPlaybook + "=" + opts.PlaybookFile,
+		EnvGroup + "=" + group,
+		EnvHostCount + "=" + strconv.Itoa(hosts),
+		EnvDryRun + "=" + strconv.FormatBool(opts.DryRun),
+	}
+}
+
+// runPreRunHook runs opts.PreRunHook, if any, on the controller. Its
+// failure is an ErrPreRunHookFailed error carrying the hook's output.
+func runPreRunHook(opts RunOptions, group string, hosts int) error {
+	if opts.PreRunHook == "" {
+		return nil
+	}
+	output, err := runHook(opts.context(), opts.PreRunHook, hookEnv(opts, group, hosts))
+	if err != nil {
+		return fmt.Errorf("%w: %v: %s", ErrPreRunHookFailed, err, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// runPostRunHook runs opts.PostRunHook, if any, on the controller once the
+// run has ended with result and err, even when it failed or timed out. A
+// failing post-run hook is reported but does not change the run's outcome.
+func runPostRunHook(opts RunOptions, group string, result Result, err error) {
+	if opts.PostRunHook == "" {
+		return
+	}
+	var total printer.HostSummary
+	for _, s := range result.Hosts {
+		total.Add(s)
+	}
+	env := append(hookEnv(opts, group, len(result.Hosts)),
+		EnvOK+"="+strconv.Itoa(total.OK),
+		EnvChanged+"="+strconv.Itoa(total.Changed),
+		EnvFailed+"="+strconv.Itoa(total.Failed),
+		EnvSkipped+"="+strconv.Itoa(total.Skipped),
+		EnvUnreachable+"="+strconv.Itoa(total.Unreachable),
+		EnvExitStatus+"="+strconv.Itoa(ExitStatus(err)),
+	)
+	// The run's context may be done already, e.g. after RunTimeout.
+	if output, err := runHook(context.Background(), opts.PostRunHook, env); err != nil {
+		opts.console().Notice("Warning: post-run hook failed: %v: %s", err, strings.TrimSpace(output))
+	}
+}
+
+// runHook runs command with sh -c, adding env to the controller's
+// environment, and returns its combined output.
+func runHook(ctx context.Context, command string, env []string) (string, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
@@ -0,0 +1,112 @@
+package tasks
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"for/pkg/inventory"
+	"for/pkg/utils"
+)
+
+// hookCommand returns a hook writing its FOR_* environment to file.
+func hookCommand(file string) string {
+	return "env | grep '^FOR_' | sort > " + utils.ShellQuote(file)
+}
+
+// readHookEnv returns the variables a hookCommand wrote to file.
+func readHookEnv(t *testing.T, file string) map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("expected the hook to run: %v", err)
+	}
+	env := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		name, value, _ := strings.Cut(line, "=")
+		env[name] = value
+	}
+	return env
+}
+
+func TestRunPlaybook_RunHooks(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	stubSSH(t, func(host, command string) (string, error) {
+		if host == "w2" {
+			return "", errors.New("exit status 1")
+		}
+		return "done", nil
+	})
+	pre, post := filepath.Join(dir, "pre.env"), filepath.Join(dir, "post.env")
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	opts := RunOptions{ServicesPath: dir, PlaybookFile: "site.yaml", PreRunHook: hookCommand(pre), PostRunHook: hookCommand(post)}
+	if err := RunPlaybook(pb, inv, opts); !errors.Is(err, ErrTaskFailed) {
+		t.Fatalf("expected ErrTaskFailed, got %v", err)
+	}
+
+	want := map[string]string{EnvPlaybook: "site.yaml", EnvGroup: "", EnvHostCount: "2", EnvDryRun: "false"}
+	if got := readHookEnv(t, pre); !maps.Equal(got, want) {
+		t.Errorf("unexpected pre-run hook env %v, want %v", got, want)
+	}
+	want[EnvOK] = "0"
+	want[EnvChanged] = "1"
+	want[EnvFailed] = "1"
+	want[EnvSkipped] = "0"
+	want[EnvUnreachable] = "0"
+	want[EnvExitStatus] = "1"
+	if got := readHookEnv(t, post); !maps.Equal(got, want) {
+		t.Errorf("unexpected post-run hook env %v, want %v", got, want)
+	}
+}
+
+func TestRunPlaybook_FailingPreRunHookAborts(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, host)
+		return "", nil
+	})
+	post := filepath.Join(dir, "post.env")
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	opts := RunOptions{ServicesPath: dir, PreRunHook: "echo change window closed; exit 3", PostRunHook: hookCommand(post)}
+	err := RunPlaybook(pb, inv, opts)
+	if !errors.Is(err, ErrPreRunHookFailed) || !strings.Contains(err.Error(), "change window closed") {
+		t.Fatalf("expected ErrPreRunHookFailed with the hook's output, got %v", err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("expected no host to be contacted, got %v", ran)
+	}
+	if _, err := os.Stat(post); !os.IsNotExist(err) {
+		t.Errorf("expected no post-run hook after an aborted run, got %v", err)
+	}
+}
+
+func TestRunAdHoc_RunHooks(t *testing.T) {
+	dir := t.TempDir()
+	stubSSH(t, func(host, command string) (string, error) { return "up", nil })
+	post := filepath.Join(dir, "post.env")
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}}}}
+	if err := RunAdHocCommand(inv, "web", "uptime", RunOptions{PostRunHook: hookCommand(post)}); err != nil {
+		t.Fatal(err)
+	}
+	env := readHookEnv(t, post)
+	if env[EnvGroup] != "web" || env[EnvHostCount] != "2" || env[EnvOK] != "2" || env[EnvExitStatus] != "0" {
+		t.Errorf("unexpected post-run hook env %v", env)
+	}
+}
@@ -0,0 +1,241 @@
+package tasks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"for/pkg/facts"
+	"for/pkg/inventory"
+)
+
+// Finding is a problem reported by SyntaxCheck. Errors are malformed
+// templates that would fail at run time; warnings are references to names
+// that are not known to be defined.
+type Finding struct {
+	// Where locates the template, e.g. `play "web" / service "nginx" / task "Install" command`.
+	Where   string
+	Message string
+	Error   bool
+}
+
+func (f Finding) String() string {
+	level := "WARNING"
+	if f.Error {
+		level = "ERROR"
+	}
+	return fmt.Sprintf("%s: %s: %s", level, f.Where, f.Message)
+}
+
+// SyntaxCheck loads every service of playbook and parses each templated field
+// (play when, task vars, command, when, changed_when, set_fact, debug, assert,
+// fail and handler commands). Malformed templates are errors. A reference
+// {{ .name }} is a warning unless name is a play var, an inventory var of the
+// play's group or one of its hosts, a fact, the loop variable item, one of
+// the task's own vars, or registered/set by an earlier task of the play.
+// Names reached only dynamically (e.g. through index) are not checked. inv
+// may be nil, in which case inventory vars are unknown.
+func SyntaxCheck(playbook Playbook, inv *inventory.Inventory, servicesPath string) ([]Finding, error) {
+	var findings []Finding
+	for i, play := range playbook {
+		known := map[string]bool{VarHostVars: true, VarGroups: true}
+		for _, name := range facts.Names() {
+			known[name] = true
+		}
+		for name := range play.Vars {
+			known[name] = true
+		}
+		if inv != nil {
+			for name := range inv.GroupVars[play.Hosts] {
+				known[name] = true
+			}
+			for _, h := range inv.Hosts[play.Hosts] {
+				for name := range h.Vars {
+					known[name] = true
+				}
+			}
+		}
+
+		playWhere := fmt.Sprintf("play %d", i+1)
+		if play.Name != "" {
+			playWhere = fmt.Sprintf("play %q", play.Name)
+		}
+		for _, cond := range play.When {
+			findings = append(findings, lintTemplate(playWhere+" when", cond, known)...)
+		}
+		for _, service := range play.Services {
+			serviceTasks, err := loadService(servicesPath, service)
+			if err != nil {
+				return nil, fmt.Errorf("loading service [%s]: %w", service.ServiceName, err)
+			}
+			for j, task := range serviceTasks {
+				name := task.Name
+				if name == "" {
+					name = fmt.Sprintf("#%d", j+1)
+				}
+				where := fmt.Sprintf("%s / service %q / task %q", playWhere, service.ServiceName, name)
+				findings = append(findings, lintTask(where, task, known)...)
+				if task.Register != "" {
+					known[task.Register] = true
+				}
+				for fact := range task.SetFact {
+					known[fact] = true
+				}
+			}
+		}
+		for _, h := range play.Handlers {
+			where := fmt.Sprintf("%s / handler %q command", playWhere, h.Name)
+			findings = append(findings, lintTemplate(where, h.Command+h.Shell, known)...)
+		}
+	}
+	return findings, nil
+}
+
+// lintTask checks the templated fields of one task against known names.
+func lintTask(where string, task Task, known map[string]bool) []Finding {
+	var out []Finding
+	check := func(field, text string, names map[string]bool) {
+		out = append(out, lintTemplate(where+" "+field, text, names)...)
+	}
+	scope := known
+	if len(task.Vars) > 0 {
+		names := make([]string, 0, len(task.Vars))
+		for name := range task.Vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if text, ok := task.Vars[name].(string); ok {
+				check("vars."+name, text, known)
+			}
+			scope = withName(scope, name)
+		}
+	}
+	if len(task.WithItems) > 0 {
+		scope = withName(scope, "item")
+	}
+	check("command", task.Command, scope)
+	check("shell", task.Shell, scope)
+	for _, cond := range task.When {
+		check("when", cond, scope)
+	}
+	check("changed_when", task.ChangedWhen, withName(scope, "output"))
+	fields := make([]string, 0, len(task.SetFact))
+	for name := range task.SetFact {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	for _, name := range fields {
+		check("set_fact."+name, task.SetFact[name], scope)
+	}
+	if task.Debug != nil {
+		check("debug.msg", task.Debug.Msg, scope)
+		if v := task.Debug.Var; v != "" && !scope[v] {
+			out = append(out, Finding{Where: where + " debug.var", Message: undefinedMessage(v)})
+		}
+	}
+	if task.Assert != nil {
+		for _, cond := range task.Assert.That {
+			check("assert.that", cond, scope)
+		}
+		check("assert.fail_msg", task.Assert.FailMsg, scope)
+		check("assert.success_msg", task.Assert.SuccessMsg, scope)
+	}
+	if task.Fail != nil {
+		check("fail.msg", task.Fail.Msg, scope)
+	}
+	return out
+}
+
+// lintTemplate parses text as a task template and reports a parse error, or
+// a warning for each top-level field reference that is not in known.
+func lintTemplate(where, text string, known map[string]bool) []Finding {
+	if !strings.Contains(text, "{{") {
+		return nil
+	}
+	tmpl, err := template.New("").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		msg := strings.TrimPrefix(err.Error(), "template: :")
+		return []Finding{{Where: where, Message: "malformed template: line " + msg, Error: true}}
+	}
+	var out []Finding
+	seen := make(map[string]bool)
+	walkFields(tmpl.Tree.Root, func(name string) {
+		if known[name] || seen[name] {
+			return
+		}
+		seen[name] = true
+		out = append(out, Finding{Where: where, Message: undefinedMessage(name)})
+	})
+	return out
+}
+
+func undefinedMessage(name string) string {
+	return fmt.Sprintf("%q is not a play or inventory var, fact, or earlier register/set_fact", name)
+}
+
+// walkFields calls fn with the first identifier of every .field reference
+// in the tree rooted at node. References inside range and with blocks are
+// relative to another value and skipped, as are values piped into default,
+// which may be undefined.
+func walkFields(node parse.Node, fn func(string)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkFields(c, fn)
+		}
+	case *parse.ActionNode:
+		walkFields(n.Pipe, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		start := 0
+		for i, cmd := range n.Cmds {
+			if i > 0 && isFunc(cmd, "default") {
+				start = i
+			}
+		}
+		for _, cmd := range n.Cmds[start:] {
+			walkFields(cmd, fn)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkFields(arg, fn)
+		}
+	case *parse.FieldNode:
+		fn(n.Ident[0])
+	case *parse.IfNode:
+		walkFields(n.Pipe, fn)
+		walkFields(n.List, fn)
+		walkFields(n.ElseList, fn)
+	case *parse.RangeNode:
+		walkFields(n.Pipe, fn)
+	case *parse.WithNode:
+		walkFields(n.Pipe, fn)
+	}
+}
+
+// isFunc reports whether cmd calls the template function name.
+func isFunc(cmd *parse.CommandNode, name string) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	id, ok := cmd.Args[0].(*parse.IdentifierNode)
+	return ok && id.Ident == name
+}
+
+// withName returns a copy of names that also contains name.
+func withName(names map[string]bool, name string) map[string]bool {
+	out := make(map[string]bool, len(names)+1)
+	for k := range names {
+		out[k] = true
+	}
+	out[name] = true
+	return out
+}
@@ -0,0 +1,118 @@
+package tasks
+
+import (
+	"strings"
+	"testing"
+
+	"for/pkg/inventory"
+)
+
+func TestSyntaxCheck_Clean(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: version
+  command: cat /opt/app/VERSION
+  register: current
+- name: deploy
+  command: "deploy {{ .app_version }} on {{ .os }} as {{ .deploy_user }}"
+  when: '{{ ne .current .app_version }}'
+- name: packages
+  command: "apt-get install -y {{ .item | quote }}"
+  with_items: [nginx, curl]
+- name: port
+  set_fact:
+    port: "{{ .base_port }}"
+- name: show
+  debug:
+    var: port
+`)
+	inv := &inventory.Inventory{
+		Hosts:     map[string][]inventory.Host{"web": {{Address: "w1", Vars: map[string]interface{}{"deploy_user": "app"}}}},
+		GroupVars: map[string]map[string]interface{}{"web": {"base_port": "8080"}},
+	}
+	pb := Playbook{{Name: "deploy", Hosts: "web", Vars: map[string]interface{}{"app_version": "1.2"}, Services: []Service{{ServiceName: "app"}}}}
+	findings, err := SyntaxCheck(pb, inv, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("expected no findings, got %v", findings)
+	}
+}
+
+func TestSyntaxCheck_MalformedTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: \"deploy {{ .version \"\n")
+	pb := Playbook{{Name: "deploy", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	findings, err := SyntaxCheck(pb, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || !findings[0].Error {
+		t.Fatalf("expected one error, got %v", findings)
+	}
+	want := `ERROR: play "deploy" / service "app" / task "deploy" command: malformed template: line 1:`
+	if got := findings[0].String(); !strings.HasPrefix(got, want) {
+		t.Errorf("expected %q to start with %q", got, want)
+	}
+}
+
+func TestSyntaxCheck_UndefinedVar(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: deploy
+  command: "deploy {{ .verison }}"
+  register: result
+- name: report
+  when: '{{ .result }}'
+  command: "echo {{ .verison }} {{ .undefined_later }} {{ .optional | default .fallback | upper }}"
+- name: later
+  set_fact:
+    undefined_later: x
+`)
+	pb := Playbook{{Name: "deploy", Hosts: "web", Vars: map[string]interface{}{"version": "1.2"}, Services: []Service{{ServiceName: "app"}}}}
+	findings, err := SyntaxCheck(pb, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range findings {
+		if f.Error {
+			t.Errorf("expected only warnings, got %v", f)
+		}
+		got = append(got, f.Where+": "+f.Message[:strings.Index(f.Message, " ")])
+	}
+	want := []string{
+		`play "deploy" / service "app" / task "deploy" command: "verison"`,
+		`play "deploy" / service "app" / task "report" command: "verison"`,
+		`play "deploy" / service "app" / task "report" command: "undefined_later"`,
+		`play "deploy" / service "app" / task "report" command: "fallback"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got findings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSyntaxCheck_TaskVars(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: probe
+  vars:
+    url: "http://{{ .inventory_host }}:{{ .port }}"
+    retries: 3
+  command: "curl --retry {{ .retries }} {{ .url }}"
+- name: later
+  command: "echo {{ .url }}"
+`)
+	pb := Playbook{{Name: "deploy", Hosts: "web", Vars: map[string]interface{}{"port": 80}, Services: []Service{{ServiceName: "app"}}}}
+	findings, err := SyntaxCheck(pb, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %v", findings)
+	}
+	if !strings.Contains(findings[0].Where, `task "probe" vars.url`) || !strings.Contains(findings[0].Message, `"inventory_host"`) {
+		t.Errorf("expected the task var's own template to be checked, got %v", findings[0])
+	}
+	if !strings.Contains(findings[1].Where, `task "later" command`) || !strings.Contains(findings[1].Message, `"url"`) {
+		t.Errorf("expected the task var to be unknown to later tasks, got %v", findings[1])
+	}
+}
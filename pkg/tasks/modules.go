@@ -0,0 +1,151 @@
+package tasks
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"for/pkg/utils"
+)
+
+// Modules a task can run, each named by the task key holding its
+// parameters. A task naming none runs its command.
+const (
+	// ModuleCommand runs its command without a shell: the command is split
+	// into argv (see utils.SplitArgs), so pipes, redirects and $VARS are
+	// passed literally.
+	ModuleCommand = "command"
+	// ModuleShell runs its command with sh -c.
+	ModuleShell   = "shell"
+	ModuleCopy    = "copy"
+	ModuleSetFact = "set_fact"
+	ModuleDebug   = "debug"
+	ModuleAssert  = "assert"
+	ModuleFail    = "fail"
+	ModulePing    = "ping"
+	ModuleMeta    = "meta"
+)
+
+// taskModules lists the module keys in the order Module checks them.
+var taskModules = []string{ModuleMeta, ModuleSetFact, ModuleDebug, ModuleAssert, ModuleFail, ModulePing, ModuleCopy, ModuleShell, ModuleCommand}
+
+// CommandArgs are the args of the command and shell modules: cmd is the
+// command, as an alternative to the command: and shell: shorthands.
+type CommandArgs struct {
+	Cmd string `yaml:"cmd"`
+}
+
+// Module returns the module task runs. When a task sets several module
+// keys the first of meta, set_fact, debug, assert, fail, ping, copy and
+// shell wins; otherwise it runs its command.
+func (t Task) Module() string {
+	switch {
+	case t.Meta != "":
+		return ModuleMeta
+	case t.SetFact != nil:
+		return ModuleSetFact
+	case t.Debug != nil:
+		return ModuleDebug
+	case t.Assert != nil:
+		return ModuleAssert
+	case t.Fail != nil:
+		return ModuleFail
+	case t.Ping:
+		return ModulePing
+	case t.Copy != nil:
+		return ModuleCopy
+	case t.Shell != "":
+		return ModuleShell
+	}
+	return ModuleCommand
+}
+
+// applyArgs merges the Args of each task decoded from file into tasks into
+// the parameters of the module the task names, e.g.
+//
+//	# tasks file
+//	- name: Upload config
+//	  copy:
+//	    dest: /etc/app.conf
+//	  args:
+//	    src: files/app.conf
+//
+// Keys written under the module win over args. A task with args must name
+// exactly one module; ping and meta take no args. root is the task list the
+// tasks were decoded from, which tells which modules each task names.
+func applyArgs(file string, root *yaml.Node, tasks []Task) error {
+	if root == nil {
+		return nil
+	}
+	for i, n := range root.Content {
+		if tasks[i].Args.Kind == 0 {
+			continue
+		}
+		n = utils.Resolve(n)
+		args := utils.Resolve(&tasks[i].Args)
+		var named []string
+		for _, m := range taskModules {
+			if mappingValue(n, m) != nil {
+				named = append(named, m)
+			}
+		}
+		switch {
+		case len(named) == 0:
+			return utils.NodeError(file, args, "task %d has args but names no module", i+1)
+		case len(named) > 1:
+			return utils.NodeError(file, args, "task %d has args for several modules (%s); name exactly one", i+1, strings.Join(named, ", "))
+		}
+		module := utils.Resolve(mappingValue(n, named[0]))
+		if module.Kind == yaml.ScalarNode && module.Tag == "!!null" {
+			module = nil
+		}
+
+		t := &tasks[i]
+		var err error
+		switch named[0] {
+		case ModuleCommand:
+			var c CommandArgs
+			if err = utils.DecodeNode(file, args, &c); err == nil && t.Command == "" {
+				t.Command = c.Cmd
+			}
+		case ModuleShell:
+			var c CommandArgs
+			if err = utils.DecodeNode(file, args, &c); err == nil && t.Shell == "" {
+				t.Shell = c.Cmd
+			}
+		case ModuleCopy:
+			t.Copy = &CopyTask{}
+			err = mergeArgs(file, args, module, t.Copy)
+		case ModuleSetFact:
+			t.SetFact = map[string]string{}
+			err = mergeArgs(file, args, module, &t.SetFact)
+		case ModuleDebug:
+			t.Debug = &DebugTask{}
+			err = mergeArgs(file, args, module, t.Debug)
+		case ModuleAssert:
+			t.Assert = &AssertTask{}
+			err = mergeArgs(file, args, module, t.Assert)
+		case ModuleFail:
+			t.Fail = &FailTask{}
+			err = mergeArgs(file, args, module, t.Fail)
+		default:
+			return utils.NodeError(file, args, "task %d: the %s module takes no args", i+1, named[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeArgs decodes args into out, then module, if set, over it so the
+// keys written under the module win.
+func mergeArgs(file string, args, module *yaml.Node, out interface{}) error {
+	if err := utils.DecodeNode(file, args, out); err != nil {
+		return err
+	}
+	if module == nil {
+		return nil
+	}
+	return module.Decode(out)
+}
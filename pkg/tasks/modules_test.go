@@ -0,0 +1,139 @@
+package tasks
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"for/pkg/inventory"
+)
+
+const moduleArgsTasks = `- name: shorthand
+  command: uptime
+- name: command args
+  command:
+  args:
+    cmd: df -h
+- name: upload
+  copy:
+    dest: /etc/app.conf
+  args:
+    src: files/app.conf
+    dest: /ignored
+- name: say
+  debug:
+  args:
+    msg: "hello {{ .inventory_hostname }}"
+- name: shell args
+  shell:
+  args:
+    cmd: df -h | tail -1
+`
+
+func TestLoadServiceTasks_ModuleArgs(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", moduleArgsTasks)
+	tasks, err := LoadServiceTasks(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var modules []string
+	for _, task := range tasks {
+		modules = append(modules, task.Module())
+	}
+	if got := strings.Join(modules, ","); got != "command,command,copy,debug,shell" {
+		t.Errorf("unexpected modules %q", got)
+	}
+	if tasks[0].Command != "uptime" || tasks[1].Command != "df -h" {
+		t.Errorf("expected the shorthand and cmd arg as commands, got %q and %q", tasks[0].Command, tasks[1].Command)
+	}
+	if c := tasks[2].Copy; c == nil || c.Src != "files/app.conf" || c.Dest != "/etc/app.conf" {
+		t.Errorf("expected src from args and dest from the module, got %+v", c)
+	}
+	if d := tasks[3].Debug; d == nil || d.Msg != "hello {{ .inventory_hostname }}" {
+		t.Errorf("expected msg from args, got %+v", d)
+	}
+	if tasks[4].Shell != "df -h | tail -1" {
+		t.Errorf("expected the cmd arg as the shell command, got %q", tasks[4].Shell)
+	}
+}
+
+func TestLoadServiceTasks_ModuleArgsErrors(t *testing.T) {
+	tests := []struct {
+		tasks string
+		want  string
+	}{
+		{"- name: x\n  args:\n    cmd: true\n", ":3:5: task 1 has args but names no module"},
+		{"- name: x\n  command: true\n  debug:\n  args:\n    msg: hi\n", ":5:5: task 1 has args for several modules (debug, command); name exactly one"},
+		{"- name: x\n  copy:\n  args:\n    source: a\n", ":4:5: field source not found in type tasks.CopyTask"},
+		{"- name: x\n  ping: true\n  args:\n    count: 1\n", ":4:5: task 1: the ping module takes no args"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeService(t, dir, "app", tt.tasks)
+		_, err := LoadServiceTasks(dir, "app")
+		want := filepath.Join(dir, "app", "tasks", "main.yaml") + tt.want
+		if err == nil || err.Error() != want {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+}
+
+func TestRunHostTasks_ModuleDispatch(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", moduleArgsTasks)
+	tasks, err := LoadServiceTasks(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := stubConnection(t, ConnectionSSH, "")
+	vars := map[string]interface{}{VarInventoryHostname: "w1"}
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{}, vars)
+	want := "uptime,df -h,copy files/app.conf /etc/app.conf,df -h | tail -1"
+	if got := strings.Join(*commands, ","); got != want {
+		t.Errorf("expected %q to reach the host, got %q", want, got)
+	}
+	if sum.Changed != 4 || sum.OK != 1 || sum.Failed != 0 {
+		t.Errorf("expected 4 changed and the debug task ok, got %+v", sum)
+	}
+}
+
+func TestRunOnce_PipeUnderShellNotCommand(t *testing.T) {
+	host := inventory.Host{Address: "localhost"}
+	opts := RunOptions{RunLocally: true}
+	vars := map[string]interface{}{"word": "hello"}
+
+	res, err := runOnce(host, Task{Shell: "echo {{ .word }} | tr a-z A-Z"}, opts, vars)
+	if err != nil || res.Output != "HELLO\n" {
+		t.Errorf("expected the shell to run the pipe, got %q, %v", res.Output, err)
+	}
+	res, err = runOnce(host, Task{Command: "echo {{ .word }} | tr a-z A-Z"}, opts, vars)
+	if err != nil || res.Output != "hello | tr a-z A-Z\n" {
+		t.Errorf("expected the pipe passed to echo literally, got %q, %v", res.Output, err)
+	}
+	res, err = runOnce(host, Task{Command: "echo $HOME '*' \"a  b\""}, opts, nil)
+	if err != nil || res.Output != "$HOME * a  b\n" {
+		t.Errorf("expected no expansion and quotes honoured, got %q, %v", res.Output, err)
+	}
+}
+
+func TestRunOnce_CommandQuotedForRemoteShell(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	host := inventory.Host{Address: "w1"}
+	if _, err := runOnce(host, Task{Command: "grep -c 'a b' /var/log/*.log | sort > out"}, RunOptions{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runOnce(host, Task{Shell: "grep -c 'a b' /var/log/*.log | sort > out"}, RunOptions{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`grep -c 'a b' '/var/log/*.log' '|' sort '>' out`,
+		`grep -c 'a b' /var/log/*.log | sort > out`,
+	}
+	if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %q, got %q", want, *commands)
+	}
+	if _, err := runOnce(host, Task{Command: "echo 'unterminated"}, RunOptions{}, nil); err == nil || !strings.Contains(err.Error(), "unterminated quote") {
+		t.Errorf("expected an unterminated quote error, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package tasks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+	"for/pkg/ssh"
+)
+
+// PingCommand is run by ping tasks and PingHosts; a reachable host answers
+// with PingReply.
+const (
+	PingCommand = "echo pong"
+	PingReply   = "pong"
+)
+
+// ping runs PingCommand on conn. The result is never changed.
+func ping(conn Connector) (TaskResult, error) {
+	out, err := conn.RunCommand(PingCommand)
+	if err != nil {
+		return TaskResult{Failed: true, RC: exitCode(err), Output: out}, err
+	}
+	if reply := strings.TrimSpace(out); reply != PingReply {
+		return TaskResult{Failed: true, RC: 1, Output: out}, fmt.Errorf("unexpected ping reply %q", reply)
+	}
+	return TaskResult{Output: PingReply}, nil
+}
+
+// PingHosts checks every host of group, after Limit and Slice, with a ping
+// task on up to Forks hosts at a time. Results are sorted by host and tell
+// unreachable hosts (see ssh.UnreachableError) apart from hosts where the
+// check command failed. Nothing on the hosts is changed.
+func PingHosts(inv *inventory.Inventory, group string, opts RunOptions) ([]printer.PingResult, error) {
+	hosts, ok := inv.Hosts[group]
+	if !ok {
+		return nil, fmt.Errorf("no hosts found for group: %s", group)
+	}
+	hosts = selectHosts(hosts, opts)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts in group %s matched the limit or slice", group)
+	}
+	if opts.Forks <= 0 {
+		opts.Forks = 5
+	}
+	opts.limitConnects()
+
+	results := make([]printer.PingResult, len(hosts))
+	sem := make(chan struct{}, opts.Forks)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, h inventory.Host) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			conn, err := connectorFor(Task{Ping: true}, h, opts)
+			if err == nil {
+				_, err = ping(conn)
+			}
+			results[i] = printer.PingResult{Host: h.Address, Elapsed: time.Since(start), Err: err, Unreachable: ssh.IsUnreachable(err)}
+		}(i, host)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Host < results[j].Host })
+	return results, nil
+}
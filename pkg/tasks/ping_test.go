@@ -0,0 +1,90 @@
+package tasks
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+	"for/pkg/ssh"
+)
+
+// stubPing makes SSH hosts in down unreachable and hosts in broken fail the
+// check command; every other host answers pong. It returns the commands run.
+func stubPing(t *testing.T, down, broken []string) *[]string {
+	t.Helper()
+	var (
+		mu       sync.Mutex
+		commands []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		commands = append(commands, command)
+		mu.Unlock()
+		for _, h := range down {
+			if h == host {
+				return "", &ssh.UnreachableError{Host: h, Err: errors.New("connection refused")}
+			}
+		}
+		for _, h := range broken {
+			if h == host {
+				return "sh: echo: not found", exitStatusErr(127)
+			}
+		}
+		return "pong\n", nil
+	})
+	return &commands
+}
+
+func TestPingHosts_ReachableAndUnreachable(t *testing.T) {
+	commands := stubPing(t, []string{"web2"}, []string{"web3"})
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "web3"}, {Address: "web2"}, {Address: "web1"}, {Address: "web4"}},
+	}}
+
+	results, err := PingHosts(inv, "web", RunOptions{Forks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"web1": printer.PingPong, "web2": printer.PingUnreachable, "web3": printer.PingFailed, "web4": printer.PingPong}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results, got %+v", len(want), results)
+	}
+	counts := make(map[string]int)
+	for i, r := range results {
+		if i > 0 && results[i-1].Host > r.Host {
+			t.Errorf("expected results sorted by host, got %+v", results)
+		}
+		if r.Status() != want[r.Host] {
+			t.Errorf("%s: expected %s, got %s (%v)", r.Host, want[r.Host], r.Status(), r.Err)
+		}
+		counts[r.Status()]++
+	}
+	if counts[printer.PingPong] != 2 || counts[printer.PingUnreachable] != 1 || counts[printer.PingFailed] != 1 {
+		t.Errorf("expected 2 reachable, 1 unreachable and 1 failed, got %v", counts)
+	}
+	for _, c := range *commands {
+		if c != PingCommand {
+			t.Errorf("expected only %q to run, got %q", PingCommand, *commands)
+		}
+	}
+
+	if _, err := PingHosts(inv, "db", RunOptions{}); err == nil {
+		t.Error("expected an error for an unknown group")
+	}
+}
+
+func TestRunOnce_PingRunsInDryRun(t *testing.T) {
+	stubPing(t, []string{"down"}, nil)
+	task := Task{Name: "ping", Ping: true}
+
+	res, err := runOnce(inventory.Host{Address: "up"}, task, RunOptions{DryRun: true}, nil)
+	if err != nil || res.Output != PingReply || res.Changed || res.Failed {
+		t.Errorf("expected an unchanged pong, got %+v, %v", res, err)
+	}
+	res, err = runOnce(inventory.Host{Address: "down"}, task, RunOptions{}, nil)
+	if !ssh.IsUnreachable(err) || !res.Failed {
+		t.Errorf("expected an unreachable failure, got %+v, %v", res, err)
+	}
+}
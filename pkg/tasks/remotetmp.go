@@ -0,0 +1,124 @@
+package tasks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"for/pkg/inventory"
+	"for/pkg/utils"
+)
+
+// DefaultRemoteTmp is the directory under which scripts and copied files
+// are staged on SSH hosts when remote_tmp is not set.
+const DefaultRemoteTmp = "/tmp"
+
+// RemoteTmpError reports that a host's staging directory cannot be used.
+type RemoteTmpError struct {
+	Host string
+	Dir  string
+	// Reason says what is wrong, e.g. "is not writable".
+	Reason string
+	Err    error
+}
+
+func (e *RemoteTmpError) Error() string {
+	return fmt.Sprintf("staging directory %s on %s %s (%v); set remote_tmp in the config or as a host var to a writable directory that allows executing files, e.g. remote_tmp=/var/tmp",
+		e.Dir, e.Host, e.Reason, e.Err)
+}
+
+func (e *RemoteTmpError) Unwrap() error { return e.Err }
+
+// remoteShell is a target files can be staged on: it runs shell commands and
+// uploads files to an exact path.
+type remoteShell interface {
+	RunCommand(command string) (string, error)
+	upload(src, dest string) error
+}
+
+// remoteTmpFor returns the staging parent for host: its remote_tmp host var,
+// then RunOptions.RemoteTmp, then DefaultRemoteTmp.
+func remoteTmpFor(host inventory.Host, opts RunOptions) string {
+	if v, _ := host.Var("remote_tmp"); v != "" {
+		return v
+	}
+	if opts.RemoteTmp != "" {
+		return opts.RemoteTmp
+	}
+	return DefaultRemoteTmp
+}
+
+// stage creates a private, randomly named directory under base on target
+// and returns it with a function that removes it again.
+func stage(target remoteShell, host, base string) (string, func(), error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	dir := path.Join(base, ".for-"+hex.EncodeToString(b))
+	q := utils.ShellQuote(dir)
+	if out, err := target.RunCommand("mkdir -p -m 700 " + q + " && test -w " + q); err != nil {
+		return "", nil, &RemoteTmpError{Host: host, Dir: dir, Reason: "cannot be created or is not writable", Err: withOutput(err, out)}
+	}
+	return dir, func() { target.RunCommand("rm -rf " + q) }, nil
+}
+
+// copyStaged uploads src into a staging directory and moves it to dest, so
+// a failed upload never leaves a partial dest. A non-empty validate command
+// (see CopyTask.Validate) must succeed on the staged file first. The
+// staging directory is removed whether or not the copy succeeds.
+func copyStaged(target remoteShell, host, base, src, dest, validate string) error {
+	dir, cleanup, err := stage(target, host, base)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	staged := path.Join(dir, filepath.Base(src))
+	if err := target.upload(src, staged); err != nil {
+		return err
+	}
+	if validate != "" {
+		command := validateCommand(validate, staged)
+		if out, err := target.RunCommand(command); err != nil {
+			return validateError(command, dest, err, out)
+		}
+	}
+	if out, err := target.RunCommand("mv -f " + utils.ShellQuote(staged) + " " + utils.ShellQuote(dest)); err != nil {
+		return fmt.Errorf("moving %s to %s: %w", staged, dest, withOutput(err, out))
+	}
+	return nil
+}
+
+// runStagedScript uploads the local script into a staging directory and
+// executes it there, so its shebang picks the interpreter. The staging
+// directory is removed afterwards, also when the script fails. A script
+// that cannot be executed because the directory is mounted noexec is
+// reported as a *RemoteTmpError.
+func runStagedScript(target remoteShell, host, base, script string) (string, error) {
+	dir, cleanup, err := stage(target, host, base)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	staged := path.Join(dir, filepath.Base(script))
+	if err := target.upload(script, staged); err != nil {
+		return "", err
+	}
+	q := utils.ShellQuote(staged)
+	out, err := target.RunCommand("chmod 700 " + q + " && " + q)
+	if err != nil && exitCode(err) == 126 && strings.Contains(out, "Permission denied") {
+		return out, &RemoteTmpError{Host: host, Dir: dir, Reason: "does not allow executing files (mounted noexec?)", Err: err}
+	}
+	return out, err
+}
+
+// withOutput appends a failed command's output to its error.
+func withOutput(err error, out string) error {
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"for/pkg/inventory"
+)
+
+type exitStatusErr int
+
+func (e exitStatusErr) Error() string   { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitStatusErr) ExitStatus() int { return int(e) }
+
+// fakeShell records commands and uploads; run decides each command's result.
+type fakeShell struct {
+	commands []string
+	uploads  []string
+	run      func(command string) (string, error)
+}
+
+func (f *fakeShell) RunCommand(command string) (string, error) {
+	f.commands = append(f.commands, command)
+	if f.run != nil {
+		return f.run(command)
+	}
+	return "", nil
+}
+
+func (f *fakeShell) upload(src, dest string) error {
+	f.uploads = append(f.uploads, src+" -> "+dest)
+	return nil
+}
+
+// stagedDir returns the staging directory created by the first command.
+func (f *fakeShell) stagedDir(t *testing.T) string {
+	t.Helper()
+	if len(f.commands) == 0 || !strings.HasPrefix(f.commands[0], "mkdir -p -m 700 '") {
+		t.Fatalf("expected a staging mkdir first, got %q", f.commands)
+	}
+	return strings.SplitN(strings.TrimPrefix(f.commands[0], "mkdir -p -m 700 '"), "'", 2)[0]
+}
+
+func TestRemoteTmpFor(t *testing.T) {
+	if got := remoteTmpFor(inventory.Host{}, RunOptions{}); got != DefaultRemoteTmp {
+		t.Errorf("expected the default, got %q", got)
+	}
+	if got := remoteTmpFor(inventory.Host{}, RunOptions{RemoteTmp: "/var/tmp"}); got != "/var/tmp" {
+		t.Errorf("expected the configured directory, got %q", got)
+	}
+	host := inventory.Host{Vars: map[string]interface{}{"remote_tmp": "/home/deploy/tmp"}}
+	if got := remoteTmpFor(host, RunOptions{RemoteTmp: "/var/tmp"}); got != "/home/deploy/tmp" {
+		t.Errorf("expected the host var to win, got %q", got)
+	}
+}
+
+func TestCopyStaged_UsesAndRemovesStagingDir(t *testing.T) {
+	f := &fakeShell{}
+	if err := copyStaged(f, "web1", "/var/tmp", "files/app.conf", "/etc/app.conf", ""); err != nil {
+		t.Fatal(err)
+	}
+	dir := f.stagedDir(t)
+	if !strings.HasPrefix(dir, "/var/tmp/.for-") {
+		t.Errorf("expected staging under /var/tmp, got %q", dir)
+	}
+	if len(f.uploads) != 1 || f.uploads[0] != "files/app.conf -> "+dir+"/app.conf" {
+		t.Errorf("expected the file to be uploaded into the staging dir, got %q", f.uploads)
+	}
+	want := []string{
+		"mv -f '" + dir + "/app.conf' '/etc/app.conf'",
+		"rm -rf '" + dir + "'",
+	}
+	if got := f.commands[1:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected move then cleanup, got %q", got)
+	}
+}
+
+func TestRunStagedScript_CleansUpOnFailure(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "deploy.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\nexit 3\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeShell{run: func(command string) (string, error) {
+		if strings.HasPrefix(command, "chmod 700 ") {
+			return "boom", exitStatusErr(3)
+		}
+		return "", nil
+	}}
+	out, err := runStagedScript(f, "web1", DefaultRemoteTmp, script)
+	if err == nil || exitCode(err) != 3 || out != "boom" {
+		t.Fatalf("expected the script's failure, got %q, %v", out, err)
+	}
+	var tmpErr *RemoteTmpError
+	if errors.As(err, &tmpErr) {
+		t.Errorf("expected an ordinary script failure, got %v", err)
+	}
+	dir := f.stagedDir(t)
+	if !strings.HasPrefix(dir, "/tmp/.for-") {
+		t.Errorf("expected staging under /tmp, got %q", dir)
+	}
+	if f.uploads[0] != script+" -> "+dir+"/deploy.sh" {
+		t.Errorf("expected the script to be staged, got %q", f.uploads)
+	}
+	if last := f.commands[len(f.commands)-1]; last != "rm -rf '"+dir+"'" {
+		t.Errorf("expected cleanup after a failed script, got %q", f.commands)
+	}
+}
+
+func TestRunStagedScript_Noexec(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "deploy.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeShell{run: func(command string) (string, error) {
+		if strings.HasPrefix(command, "chmod 700 ") {
+			return "sh: 1: /tmp/.for-x/deploy.sh: Permission denied\n", exitStatusErr(126)
+		}
+		return "", nil
+	}}
+	_, err := runStagedScript(f, "web1", DefaultRemoteTmp, script)
+	var tmpErr *RemoteTmpError
+	if !errors.As(err, &tmpErr) || tmpErr.Host != "web1" {
+		t.Fatalf("expected a RemoteTmpError, got %v", err)
+	}
+	for _, want := range []string{"does not allow executing files", "set remote_tmp"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err.Error())
+		}
+	}
+	if last := f.commands[len(f.commands)-1]; !strings.HasPrefix(last, "rm -rf ") {
+		t.Errorf("expected cleanup after a noexec failure, got %q", f.commands)
+	}
+}
+
+func TestStage_Unwritable(t *testing.T) {
+	f := &fakeShell{run: func(string) (string, error) {
+		return "mkdir: cannot create directory '/ro/.for-1': Read-only file system", exitStatusErr(1)
+	}}
+	err := copyStaged(f, "web1", "/ro", "a", "/etc/a", "")
+	var tmpErr *RemoteTmpError
+	if !errors.As(err, &tmpErr) || !strings.Contains(err.Error(), "Read-only file system") || !strings.Contains(err.Error(), "not writable") {
+		t.Fatalf("expected a clear unwritable error, got %v", err)
+	}
+	if len(f.uploads) != 0 || len(f.commands) != 1 {
+		t.Errorf("expected nothing to be uploaded, got %q %q", f.uploads, f.commands)
+	}
+}
+
+func TestCopyStaged_Validate(t *testing.T) {
+	f := &fakeShell{run: func(command string) (string, error) {
+		if strings.HasPrefix(command, "nginx -t -c ") {
+			return "nginx: [emerg] unexpected \"}\"", exitStatusErr(1)
+		}
+		return "", nil
+	}}
+	err := copyStaged(f, "web1", "/tmp", "nginx.conf", "/etc/nginx/nginx.conf", "nginx -t -c %s")
+	if err == nil || !strings.Contains(err.Error(), "validation failed, /etc/nginx/nginx.conf left unchanged") || !strings.Contains(err.Error(), "[emerg]") {
+		t.Fatalf("expected a validation failure, got %v", err)
+	}
+	dir := f.stagedDir(t)
+	want := []string{
+		"nginx -t -c '" + dir + "/nginx.conf'",
+		"rm -rf '" + dir + "'",
+	}
+	if got := f.commands[1:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected validation then cleanup without a move, got %q", got)
+	}
+}
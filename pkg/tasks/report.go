@@ -0,0 +1,192 @@
+package tasks
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PlayReport is one play of a Result: its tasks in the order they first
+// ran on any host. Tasks are told apart by their position in the play, so
+// unnamed or same-named tasks get an entry each.
+type PlayReport struct {
+	Name  string       `json:"name" yaml:"name"`
+	Tasks []TaskReport `json:"tasks" yaml:"tasks"`
+}
+
+// TaskReport is one task (or handler) of a play with its result on each
+// host it ran on, in recap order.
+type TaskReport struct {
+	Name  string           `json:"name" yaml:"name"`
+	Hosts []HostTaskReport `json:"hosts" yaml:"hosts"`
+
+	// key is the task's stateKey, which tells unnamed and same-named
+	// tasks apart.
+	key string
+}
+
+// HostTaskReport is one task's result on one host. Stdout holds the
+// command's combined stdout and stderr, as connectors return them.
+type HostTaskReport struct {
+	Host string `json:"host" yaml:"host"`
+	// Status is StatusOK, StatusChanged, StatusFailed or StatusSkipped.
+	Status  string `json:"status" yaml:"status"`
+	Changed bool   `json:"changed" yaml:"changed"`
+	// Ignored marks a failure of a task with ignore_errors.
+	Ignored bool   `json:"ignored,omitempty" yaml:"ignored,omitempty"`
+	RC      int    `json:"rc" yaml:"rc"`
+	Stdout  string `json:"stdout" yaml:"stdout"`
+	Error   string `json:"error,omitempty" yaml:"error,omitempty"`
+	// Duration is the task's run time in seconds.
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// HostStats is a host's PLAY RECAP line in a serialized Result.
+type HostStats struct {
+	Host    string `json:"host" yaml:"host"`
+	OK      int    `json:"ok" yaml:"ok"`
+	Changed int    `json:"changed" yaml:"changed"`
+	Failed  int    `json:"failed" yaml:"failed"`
+	Skipped int    `json:"skipped" yaml:"skipped"`
+	Ignored int    `json:"ignored" yaml:"ignored"`
+	// Unreachable is set under RunOptions.IgnoreUnreachable.
+	Unreachable int `json:"unreachable" yaml:"unreachable"`
+}
+
+// resultDocument is the serialized form of a Result.
+type resultDocument struct {
+	Plays  []PlayReport `json:"plays" yaml:"plays"`
+	Stats  []HostStats  `json:"stats" yaml:"stats"`
+	Failed bool         `json:"failed" yaml:"failed"`
+}
+
+func (r Result) document() resultDocument {
+	doc := resultDocument{Plays: r.Plays, Stats: make([]HostStats, 0, len(r.Hosts)), Failed: r.Failed}
+	if doc.Plays == nil {
+		doc.Plays = []PlayReport{}
+	}
+	for _, h := range r.Hosts {
+		doc.Stats = append(doc.Stats, HostStats{Host: h.Host, OK: h.OK, Changed: h.Changed, Failed: h.Failed, Skipped: h.Skipped, Ignored: h.Ignored, Unreachable: h.Unreachable})
+	}
+	return doc
+}
+
+// MarshalJSON encodes r as {"plays": [...], "stats": [...], "failed": bool};
+// see PlayReport and HostStats. Failures are part of the task results.
+func (r Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.document())
+}
+
+// MarshalYAML encodes r with the same schema as MarshalJSON.
+func (r Result) MarshalYAML() (interface{}, error) {
+	return r.document(), nil
+}
+
+// writeResultFile writes r to path as YAML when path ends in .yaml or .yml
+// and as indented JSON otherwise.
+func writeResultFile(path string, r Result) error {
+	var (
+		data []byte
+		err  error
+	)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(r)
+	default:
+		data, err = json.MarshalIndent(r, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// runReport collects task results by play and task for Result.Plays; safe
+// for concurrent use. A nil *runReport ignores them.
+type runReport struct {
+	mu    sync.Mutex
+	plays []PlayReport
+}
+
+// add records res of task on host in play.
+func (r *runReport) add(play, host string, task Task, res TaskResult, err error, d time.Duration) {
+	if r == nil {
+		return
+	}
+	entry := HostTaskReport{
+		Host:     host,
+		Status:   taskStatus(res, err),
+		Changed:  res.Changed,
+		Ignored:  err != nil && task.IgnoreErrors,
+		RC:       res.RC,
+		Stdout:   res.Output,
+		Duration: d.Seconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.play(play)
+	key := task.stateKey()
+	t := -1
+	for i := range p.Tasks {
+		if p.Tasks[i].key == key {
+			t = i
+			break
+		}
+	}
+	if t < 0 {
+		p.Tasks = append(p.Tasks, TaskReport{Name: task.Name, key: key})
+		t = len(p.Tasks) - 1
+	}
+	p.Tasks[t].Hosts = append(p.Tasks[t].Hosts, entry)
+}
+
+// play returns the report of the play named name, adding it if needed.
+// Callers hold r.mu.
+func (r *runReport) play(name string) *PlayReport {
+	for i := range r.plays {
+		if r.plays[i].Name == name {
+			return &r.plays[i]
+		}
+	}
+	r.plays = append(r.plays, PlayReport{Name: name})
+	return &r.plays[len(r.plays)-1]
+}
+
+// list returns the plays with each task's hosts sorted by rank.
+func (r *runReport) list(rank func(host string) int) []PlayReport {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]PlayReport, len(r.plays))
+	for i, p := range r.plays {
+		out[i] = PlayReport{Name: p.Name, Tasks: make([]TaskReport, len(p.Tasks))}
+		for j, t := range p.Tasks {
+			hosts := append([]HostTaskReport(nil), t.Hosts...)
+			sort.SliceStable(hosts, func(a, b int) bool { return rank(hosts[a].Host) < rank(hosts[b].Host) })
+			out[i].Tasks[j] = TaskReport{Name: t.Name, Hosts: hosts}
+		}
+	}
+	return out
+}
+
+// newRunReport returns a report with a play entry for every play in
+// playbook, so plays keep playbook order even when they run in parallel.
+func newRunReport(playbook Playbook) *runReport {
+	r := &runReport{}
+	for _, play := range playbook {
+		r.play(play.Name)
+	}
+	return r
+}
@@ -0,0 +1,135 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+)
+
+func TestRunPlaybook_ResultFile(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n- name: check\n  command: check\n  ignore_errors: true\n  notify: restart\n")
+	stubSSH(t, func(host, command string) (string, error) {
+		if host == "w2" && command == "check" {
+			return "bad\n", exitStatusErr(3)
+		}
+		return command + " on " + host + "\n", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w2"}, {Address: "w1"}}}}
+	pb := Playbook{
+		{
+			Name: "deploy", Hosts: "web", Services: []Service{{ServiceName: "app"}},
+			Handlers: []Handler{{Name: "restart", Command: "restart"}},
+		},
+		{Name: "unused", Hosts: "web", Tags: []string{"never"}},
+	}
+	want := resultDocument{
+		Plays: []PlayReport{
+			{Name: "deploy", Tasks: []TaskReport{
+				{Name: "deploy", Hosts: []HostTaskReport{
+					{Host: "w2", Status: StatusChanged, Changed: true, Stdout: "deploy on w2\n"},
+					{Host: "w1", Status: StatusChanged, Changed: true, Stdout: "deploy on w1\n"},
+				}},
+				{Name: "check", Hosts: []HostTaskReport{
+					{Host: "w2", Status: StatusFailed, Ignored: true, RC: 3, Stdout: "bad\n", Error: "exit status 3"},
+					{Host: "w1", Status: StatusChanged, Changed: true, Stdout: "check on w1\n"},
+				}},
+				{Name: "restart", Hosts: []HostTaskReport{
+					{Host: "w1", Status: StatusChanged, Changed: true, Stdout: "restart on w1\n"},
+				}},
+			}},
+			{Name: "unused", Tasks: []TaskReport{}},
+		},
+		Stats: []HostStats{
+			{Host: "w2", Changed: 1, Ignored: 1},
+			{Host: "w1", Changed: 3},
+		},
+	}
+
+	for _, name := range []string{"result.json", "result.yaml"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, ResultFile: path, Tags: []string{"all"}, SkipTags: []string{"never"}}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got resultDocument
+		if name == "result.json" {
+			err = json.Unmarshal(data, &got)
+		} else {
+			err = yaml.Unmarshal(data, &got)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, p := range got.Plays {
+			for _, task := range p.Tasks {
+				for i := range task.Hosts {
+					if task.Hosts[i].Duration < 0 {
+						t.Errorf("%s: negative duration %+v", name, task.Hosts[i])
+					}
+					task.Hosts[i].Duration = 0
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got\n%+v\nwant\n%+v", name, got, want)
+		}
+	}
+}
+
+func TestResult_MarshalJSONEmpty(t *testing.T) {
+	data, err := json.Marshal(Result{Failures: []printer.Failure{{Host: "w1", Task: "x", Err: errors.New("boom")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != `{"plays":[],"stats":[],"failed":false}` {
+		t.Errorf("unexpected document %s", got)
+	}
+}
+
+func TestRunPlaybook_ReportKeepsUnnamedTasksApart(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- command: a\n- command: b\n- name: same\n  command: c\n- name: same\n  command: d\n")
+	stubConnection(t, ConnectionSSH, "")
+	captureRunOutput(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "site", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	res, err := runPlaybook(pb, inv, RunOptions{ServicesPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := res.Plays[0].Tasks
+	if len(tasks) != 4 {
+		t.Fatalf("expected an entry per task, got %+v", tasks)
+	}
+	for i, name := range []string{"", "", "same", "same"} {
+		if tasks[i].Name != name || len(tasks[i].Hosts) != 1 {
+			t.Errorf("task %d: expected %q with one host, got %+v", i+1, name, tasks[i])
+		}
+	}
+
+	res, err = runAdHoc(inv, "web", []string{"uptime", "df -h"}, true, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks := res.Plays[0].Tasks; len(tasks) != 2 {
+		t.Errorf("expected an entry per ad hoc command, got %+v", tasks)
+	}
+}
@@ -0,0 +1,68 @@
+package tasks
+
+import (
+	"context"
+	"io"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+)
+
+// Result is the outcome of a run started through a Runner.
+type Result struct {
+	// Hosts holds one summary per host, in recap order.
+	Hosts []printer.HostSummary
+	// Failures lists every task failure, sorted by host.
+	Failures []printer.Failure
+	// Failed reports that a task failed on at least one host.
+	Failed bool
+	// Plays holds every task's result on every host, by play and task.
+	Plays []PlayReport
+}
+
+// Runner runs playbooks and ad hoc commands for programs embedding this
+// package. Options carries everything a CLI run would set: SSH settings,
+// Forks, DryRun for check mode, OnTaskResult and so on. The output a CLI
+// run prints goes to Printer, or when it is nil to Output, without colours
+// or the progress line, and is discarded when both are nil.
+//
+// Each Runner prints through its own Printer, so several may run at once.
+type Runner struct {
+	Inventory *inventory.Inventory
+	Options   RunOptions
+	Output    io.Writer
+	// Printer, when set, prints the run with its own settings, e.g.
+	// printer.Default() for the console as the for command does.
+	Printer *printer.Printer
+}
+
+// RunPlaybook runs playbook against r.Inventory until it finishes or ctx is
+// done. The error is nil or one of the errors RunPlaybook returns, e.g. one
+// matching ErrTaskFailed; the Result is filled in either way.
+func (r *Runner) RunPlaybook(ctx context.Context, playbook Playbook) (Result, error) {
+	return runPlaybook(playbook, r.Inventory, r.options(ctx))
+}
+
+// RunAdHoc runs command, as is, on every host in group, like
+// RunAdHocCommand.
+func (r *Runner) RunAdHoc(ctx context.Context, group, command string) (Result, error) {
+	return runAdHoc(r.Inventory, group, []string{command}, false, r.options(ctx))
+}
+
+// RunAdHocCommands runs commands in order on every host in group, expanding
+// each as a template, like RunAdHocCommands.
+func (r *Runner) RunAdHocCommands(ctx context.Context, group string, commands []string) (Result, error) {
+	return runAdHoc(r.Inventory, group, commands, true, r.options(ctx))
+}
+
+func (r *Runner) options(ctx context.Context) RunOptions {
+	opts := r.Options
+	opts.Context = ctx
+	opts.printer = r.Printer
+	if opts.printer == nil {
+		opts.printer = printer.New(r.Output)
+		opts.printer.DiffCounts = opts.Diff || opts.DriftCheck
+		opts.printer.SummaryOnly = opts.SummaryOnly
+	}
+	return opts
+}
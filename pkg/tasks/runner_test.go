@@ -0,0 +1,181 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+)
+
+// stubConnector replaces the connector for the connection type name with
+// run for the test.
+func stubConnector(t *testing.T, name string, run func(host, command string) (string, error)) {
+	t.Helper()
+	prev := connectors[name]
+	connectors[name] = func(host inventory.Host, _ RunOptions) Connector {
+		return funcConnector(func(command string) (string, error) { return run(host.Address, command) })
+	}
+	t.Cleanup(func() { connectors[name] = prev })
+}
+
+// stubSSH replaces the SSH connector with run for the test.
+func stubSSH(t *testing.T, run func(host, command string) (string, error)) {
+	t.Helper()
+	stubConnector(t, ConnectionSSH, run)
+}
+
+func TestRunner_RunPlaybook(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n- name: migrate\n  command: migrate\n")
+	stubSSH(t, func(host, command string) (string, error) {
+		if host == "w2" && command == "migrate" {
+			return "", errors.New("migration failed")
+		}
+		return "done", nil
+	})
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	var out bytes.Buffer
+	r := &Runner{
+		Inventory: &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}}}},
+		Options: RunOptions{
+			ServicesPath: dir,
+			Forks:        2,
+			OnTaskResult: func(host, task string, res TaskResult, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, host+":"+task+":"+res.Output)
+			},
+		},
+		Output: &out,
+	}
+	stdout := &bytes.Buffer{}
+	prevOut := printer.SetOutput(stdout)
+	defer printer.SetOutput(prevOut)
+
+	res, err := r.RunPlaybook(context.Background(), Playbook{{Name: "deploy", Hosts: "web", Services: []Service{{ServiceName: "app"}}}})
+	if !errors.Is(err, ErrTaskFailed) {
+		t.Fatalf("expected ErrTaskFailed, got %v", err)
+	}
+	want := []printer.HostSummary{
+		{Host: "w1", Changed: 2},
+		{Host: "w2", Changed: 1, Failed: 1},
+	}
+	if !reflect.DeepEqual(res.Hosts, want) || !res.Failed {
+		t.Errorf("got %+v, want hosts %+v", res, want)
+	}
+	if len(res.Failures) != 1 || res.Failures[0].Host != "w2" || res.Failures[0].Task != "migrate" {
+		t.Errorf("expected the failure in the result, got %+v", res.Failures)
+	}
+	if len(events) != 4 {
+		t.Errorf("expected a callback per task and host, got %q", events)
+	}
+	if got := out.String(); !strings.Contains(got, "TASK [deploy]") || !strings.Contains(got, "PLAY RECAP") || strings.Contains(got, "\033[") {
+		t.Errorf("expected the run's plain output in the writer, got:\n%s", got)
+	}
+	if stdout.Len() != 0 || printer.SetOutput(stdout) != stdout {
+		t.Error("expected the printer output to be left alone outside the run")
+	}
+}
+
+func TestRunner_RunAdHoc(t *testing.T) {
+	stubSSH(t, func(host, command string) (string, error) {
+		return host + " up", nil
+	})
+	var out bytes.Buffer
+	r := &Runner{
+		Inventory: &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w2"}, {Address: "w1"}}}},
+		Output:    &out,
+	}
+	res, err := r.RunAdHoc(context.Background(), "web", "uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []printer.HostSummary{{Host: "w2", OK: 1}, {Host: "w1", OK: 1}}
+	if !reflect.DeepEqual(res.Hosts, want) || res.Failed || len(res.Failures) != 0 {
+		t.Errorf("got %+v, want hosts %+v", res, want)
+	}
+	if !strings.Contains(out.String(), "w1 up") {
+		t.Errorf("expected command output in the writer, got %q", out.String())
+	}
+	if _, err := r.RunAdHoc(context.Background(), "db", "uptime"); err == nil {
+		t.Error("expected an unknown group to fail")
+	}
+}
+
+func TestRunner_LocalCopyReportsToOutput(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app.conf")
+	dest := filepath.Join(dir, "app.conf.live")
+	if err := os.WriteFile(src, []byte("port=80\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeService(t, dir, "app", "- name: config\n  copy:\n    src: "+src+"\n    dest: "+dest+"\n")
+	stdout := captureRunOutput(t)
+
+	var out bytes.Buffer
+	r := &Runner{Options: RunOptions{ServicesPath: dir, RunLocally: true}, Output: &out}
+	if _, err := r.RunPlaybook(context.Background(), Playbook{{Name: "local", Services: []Service{{ServiceName: "app"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Copied "+src+" -> "+dest) {
+		t.Errorf("expected the copy reported in the run's output, got:\n%s", out.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected nothing on the default printer, got:\n%s", stdout.String())
+	}
+
+	out.Reset()
+	r = &Runner{Inventory: LocalInventory(), Options: RunOptions{RunLocally: true}, Output: &out}
+	if _, err := r.RunAdHoc(context.Background(), LocalGroup, "echo local"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "local") || stdout.Len() != 0 {
+		t.Errorf("expected local ad hoc output in the writer only, got %q and %q", out.String(), stdout.String())
+	}
+}
+
+func TestRunner_ConcurrentRunnersKeepOutputApart(t *testing.T) {
+	stubSSH(t, func(host, command string) (string, error) {
+		return host + " up", nil
+	})
+	runners := make([]*Runner, 2)
+	outs := make([]bytes.Buffer, 2)
+	for i, host := range []string{"a1", "b1"} {
+		runners[i] = &Runner{
+			Inventory: &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: host}}}},
+			Output:    &outs[i],
+		}
+	}
+	var wg sync.WaitGroup
+	for _, r := range runners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if _, err := r.RunAdHoc(context.Background(), "web", "uptime"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, own := range []string{"a1", "b1"} {
+		other := []string{"b1", "a1"}[i]
+		got := outs[i].String()
+		if strings.Count(got, own+" up") != 20 || strings.Contains(got, other) {
+			t.Errorf("expected only %s's 20 runs in its writer, got:\n%s", own, got)
+		}
+	}
+}
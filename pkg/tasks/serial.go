@@ -0,0 +1,117 @@
+package tasks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+)
+
+// BatchSizes is a play's serial: value, one batch size or a list of them.
+// Each size is a host count ("2") or a share of the play's hosts ("30%").
+type BatchSizes []string
+
+// UnmarshalYAML accepts a single size as well as a list of sizes.
+func (b *BatchSizes) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		*b = BatchSizes{n.Value}
+	case yaml.SequenceNode:
+		sizes := make(BatchSizes, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: serial entries must be numbers or percentages", item.Line)
+			}
+			sizes = append(sizes, item.Value)
+		}
+		*b = sizes
+	default:
+		return fmt.Errorf("line %d: serial must be a number, a percentage or a list of them", n.Line)
+	}
+	return nil
+}
+
+// batchSize resolves one serial entry against total hosts. Percentages
+// round down but never below one host.
+func batchSize(size string, total int) (int, error) {
+	s := strings.TrimSpace(size)
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.Atoi(strings.TrimSpace(pct))
+		if err != nil || p < 1 || p > 100 {
+			return 0, fmt.Errorf("invalid serial percentage %q (want 1%%-100%%)", size)
+		}
+		return max(total*p/100, 1), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid serial %q (want a positive number or a percentage)", size)
+	}
+	return n, nil
+}
+
+// batchSizes splits total hosts into batches following serial, repeating
+// its last entry until every host is covered; [1, "50%", "100%"] over ten
+// hosts gives 1, 5 and 4. An empty serial is one batch of all hosts.
+func batchSizes(serial BatchSizes, total int) ([]int, error) {
+	if len(serial) == 0 {
+		return []int{total}, nil
+	}
+	var sizes []int
+	for i, left := 0, total; left > 0; i++ {
+		n, err := batchSize(serial[min(i, len(serial)-1)], total)
+		if err != nil {
+			return nil, err
+		}
+		n = min(n, left)
+		sizes = append(sizes, n)
+		left -= n
+	}
+	return sizes, nil
+}
+
+// batchFailed reports whether a batch of size hosts, failed of which
+// failed, should abort the run: when more than maxFailPercentage percent of
+// it failed or, with no percentage set, when all of it did.
+func batchFailed(failed, size, maxFailPercentage int) bool {
+	if failed == 0 {
+		return false
+	}
+	if maxFailPercentage <= 0 {
+		return failed == size
+	}
+	return failed*100 > maxFailPercentage*size
+}
+
+// runHealthCheck runs play.HealthCheck, if any, on the controller after
+// batch has finished the play. The command is rendered with the play's
+// and its group's vars plus batch_hosts, the batch's addresses. It is
+// shown but not run in dry-run and render-only mode.
+func runHealthCheck(play Play, batch []inventory.Host, groupVars map[string]interface{}, opts RunOptions, out *printer.HostWriter) error {
+	if play.HealthCheck == "" || opts.context().Err() != nil {
+		return nil
+	}
+	out.TaskHeader("health check")
+	vars := mergeVars(play.Vars, groupVars)
+	vars[VarBatchHosts] = addresses(batch)
+	command, err := expandVars(play.HealthCheck, vars)
+	if err != nil {
+		out.Failed("localhost", err)
+		return err
+	}
+	if opts.DryRun || opts.RenderOnly {
+		out.DryRun("health check: " + command)
+		return nil
+	}
+	output, err := connectors[ConnectionLocal](inventory.Host{Address: "localhost"}, opts).RunCommand(command)
+	if err != nil {
+		out.Failed("localhost", err)
+		out.Output("output", output)
+		return err
+	}
+	out.OK("localhost", output)
+	return nil
+}
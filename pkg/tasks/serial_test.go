@@ -0,0 +1,240 @@
+package tasks
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"for/pkg/inventory"
+)
+
+func TestBatchSizes_Ramp(t *testing.T) {
+	ramp := BatchSizes{"1", "50%", "100%"}
+	tests := []struct {
+		total int
+		want  []int
+	}{
+		{1, []int{1}},
+		{2, []int{1, 1}},
+		{4, []int{1, 2, 1}},
+		{10, []int{1, 5, 4}},
+		{20, []int{1, 10, 9}},
+	}
+	for _, tt := range tests {
+		got, err := batchSizes(ramp, tt.total)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d hosts: got batches %v, want %v", tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestBatchSizes(t *testing.T) {
+	tests := []struct {
+		serial BatchSizes
+		total  int
+		want   []int
+	}{
+		{nil, 5, []int{5}},
+		{BatchSizes{"2"}, 5, []int{2, 2, 1}},
+		{BatchSizes{"30%"}, 10, []int{3, 3, 3, 1}},
+		{BatchSizes{"10%"}, 3, []int{1, 1, 1}},
+		{BatchSizes{"1", "3"}, 8, []int{1, 3, 3, 1}},
+		{BatchSizes{"2"}, 0, nil},
+	}
+	for _, tt := range tests {
+		got, err := batchSizes(tt.serial, tt.total)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("serial %v over %d hosts: got %v, want %v", tt.serial, tt.total, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"0", "-1", "x", "0%", "150%"} {
+		if _, err := batchSizes(BatchSizes{bad}, 4); err == nil {
+			t.Errorf("expected serial %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLoadPlaybook_Serial(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "site.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("- hosts: web\n  serial: [1, \"50%\", 100%]\n  max_fail_percentage: 20\n- hosts: db\n  serial: 2\n")
+	pb, err := LoadTasks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (BatchSizes{"1", "50%", "100%"}); !reflect.DeepEqual(pb[0].Serial, want) || pb[0].MaxFailPercentage != 20 {
+		t.Errorf("got serial %v, max_fail_percentage %d", pb[0].Serial, pb[0].MaxFailPercentage)
+	}
+	if want := (BatchSizes{"2"}); !reflect.DeepEqual(pb[1].Serial, want) {
+		t.Errorf("expected a single serial to load as one batch size, got %v", pb[1].Serial)
+	}
+
+	write("- hosts: web\n  serial: [1, 200%]\n")
+	if _, err := LoadTasks(path); err == nil || !strings.Contains(err.Error(), ":2:") || !strings.Contains(err.Error(), "200%") {
+		t.Errorf("expected a positioned serial error, got %v", err)
+	}
+}
+
+// recordHostOrder stubs SSH to record "host:command" for every command run.
+func recordHostOrder(t *testing.T, fail func(host, command string) bool) *[]string {
+	t.Helper()
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		order = append(order, host+":"+command)
+		mu.Unlock()
+		if fail != nil && fail(host, command) {
+			return "", errors.New("boom")
+		}
+		return "ok", nil
+	})
+	captureRunOutput(t)
+	return &order
+}
+
+func TestRunPlaybook_SerialRamp(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "a", "- name: a\n  command: a\n")
+	writeService(t, dir, "b", "- name: b\n  command: b\n")
+	order := recordHostOrder(t, nil)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "h1"}, {Address: "h2"}, {Address: "h3"}, {Address: "h4"}},
+	}}
+	pb := Playbook{{Name: "rolling", Hosts: "web", Serial: BatchSizes{"1", "50%", "100%"}, Services: []Service{{ServiceName: "a"}, {ServiceName: "b"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Forks: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Batches of 1, 2 and 1 hosts, each finishing both services before the
+	// next starts.
+	want := []string{"h1:a", "h1:b", "h2:a", "h3:a", "h2:b", "h3:b", "h4:a", "h4:b"}
+	if !reflect.DeepEqual(*order, want) {
+		t.Errorf("got %v, want %v", *order, want)
+	}
+}
+
+func TestRunPlaybook_SerialAbortsOnFailedBatch(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: a\n  command: a\n")
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "h1"}, {Address: "h2"}, {Address: "h3"}, {Address: "h4"}, {Address: "h5"}},
+	}}
+
+	t.Run("whole batch failed", func(t *testing.T) {
+		order := recordHostOrder(t, func(host, _ string) bool { return host == "h1" })
+		pb := Playbook{
+			{Name: "rolling", Hosts: "web", Serial: BatchSizes{"1", "100%"}, Services: []Service{{ServiceName: "app"}}},
+			{Name: "later", Hosts: "web", Services: []Service{{ServiceName: "app"}}},
+		}
+		if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir}); !errors.Is(err, ErrTaskFailed) {
+			t.Fatalf("expected ErrTaskFailed, got %v", err)
+		}
+		if want := []string{"h1:a"}; !reflect.DeepEqual(*order, want) {
+			t.Errorf("expected the run to stop after the first batch, got %v", *order)
+		}
+	})
+
+	t.Run("max_fail_percentage", func(t *testing.T) {
+		// One of two hosts (50%) is within 50%; one of one host in the
+		// next batch is not.
+		order := recordHostOrder(t, func(host, _ string) bool { return host == "h2" || host == "h3" })
+		pb := Playbook{{Name: "rolling", Hosts: "web", Serial: BatchSizes{"2", "1"}, MaxFailPercentage: 50, Services: []Service{{ServiceName: "app"}}}}
+		if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Forks: 1}); !errors.Is(err, ErrTaskFailed) {
+			t.Fatalf("expected ErrTaskFailed, got %v", err)
+		}
+		if want := []string{"h1:a", "h2:a", "h3:a"}; !reflect.DeepEqual(*order, want) {
+			t.Errorf("got %v, want %v", *order, want)
+		}
+	})
+
+	t.Run("partial failure continues", func(t *testing.T) {
+		order := recordHostOrder(t, func(host, _ string) bool { return host == "h1" })
+		pb := Playbook{{Name: "rolling", Hosts: "web", Serial: BatchSizes{"2"}, Services: []Service{{ServiceName: "app"}}}}
+		RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Forks: 1})
+		if len(*order) != 5 {
+			t.Errorf("expected every host to run, got %v", *order)
+		}
+	})
+}
+
+// stubHealthCheck replaces the local connector with one recording each
+// command and failing those fail picks.
+func stubHealthCheck(t *testing.T, fail func(command string) bool) *[]string {
+	t.Helper()
+	var checks []string
+	stubConnector(t, ConnectionLocal, func(_, command string) (string, error) {
+		checks = append(checks, command)
+		if fail != nil && fail(command) {
+			return "503\n", exitStatusErr(1)
+		}
+		return "200\n", nil
+	})
+	return &checks
+}
+
+func TestRunPlaybook_HealthCheckAfterEachBatch(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: a\n  command: a\n")
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "h1"}, {Address: "h2"}, {Address: "h3"}, {Address: "h4"}},
+	}}
+	play := Play{
+		Name: "rolling", Hosts: "web", Serial: BatchSizes{"1", "50%", "100%"},
+		Vars:        map[string]interface{}{"lb": "lb1"},
+		HealthCheck: "check {{ .lb }}{{ range .batch_hosts }} {{ . }}{{ end }}",
+		Services:    []Service{{ServiceName: "app"}},
+	}
+
+	t.Run("passing", func(t *testing.T) {
+		order := recordHostOrder(t, nil)
+		checks := stubHealthCheck(t, nil)
+		if err := RunPlaybook(Playbook{play}, inv, RunOptions{ServicesPath: dir, Forks: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"check lb1 h1", "check lb1 h2 h3", "check lb1 h4"}; !reflect.DeepEqual(*checks, want) {
+			t.Errorf("got checks %q, want %q", *checks, want)
+		}
+		if len(*order) != 4 {
+			t.Errorf("expected every host to run, got %v", *order)
+		}
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		order := recordHostOrder(t, nil)
+		checks := stubHealthCheck(t, func(command string) bool { return strings.Contains(command, "h2") })
+		later := Play{Name: "later", Hosts: "web", Services: []Service{{ServiceName: "app"}}}
+		res, err := runPlaybook(Playbook{play, later}, inv, RunOptions{ServicesPath: dir, Forks: 1})
+		if !errors.Is(err, ErrTaskFailed) {
+			t.Fatalf("expected ErrTaskFailed, got %v", err)
+		}
+		if want := []string{"check lb1 h1", "check lb1 h2 h3"}; !reflect.DeepEqual(*checks, want) {
+			t.Errorf("got checks %q, want %q", *checks, want)
+		}
+		if want := []string{"h1:a", "h2:a", "h3:a"}; !reflect.DeepEqual(*order, want) {
+			t.Errorf("expected the rollout to stop before h4, got %v", *order)
+		}
+		if len(res.Failures) != 1 || res.Failures[0].Task != "health check" {
+			t.Errorf("expected the health check in the failures, got %+v", res.Failures)
+		}
+	})
+}
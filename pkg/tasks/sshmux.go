@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"for/pkg/inventory"
+	"for/pkg/ssh"
+	"for/pkg/utils"
+)
+
+// sshMuxPersist is how long an idle control master stays up after the last
+// command, so the next for invocation can reuse it.
+const sshMuxPersist = "10m"
+
+// sshMuxDir returns the directory holding the control sockets, private to
+// the current user.
+var sshMuxDir = func() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("for-ssh-%d", os.Getuid()))
+}
+
+// sshMuxRun invokes the system ssh client with args, feeding it stdin when
+// not nil, and returns its combined output. Replaced in tests to capture the
+// generated arguments.
+var sshMuxRun = func(ctx context.Context, args []string, stdin io.Reader) (string, error) {
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = stdin
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// sshMuxArgs returns the ssh arguments that run command on host through a
+// control master shared with other for processes (ControlMaster=auto),
+// translating cfg's settings to their OpenSSH options. Passwords cannot be
+// passed to the system client, so only keys and the agent authenticate.
+func sshMuxArgs(host string, cfg ssh.Config, controlDir, command string) []string {
+	args := []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPersist=" + sshMuxPersist,
+		"-o", "ControlPath=" + filepath.Join(controlDir, "%C"),
+	}
+	if cfg.HostKeyChecking == ssh.HostKeyAsk {
+		args = append(args, "-o", "StrictHostKeyChecking=ask")
+	} else {
+		args = append(args, "-o", "BatchMode=yes")
+	}
+	switch cfg.HostKeyChecking {
+	case ssh.HostKeyInsecure:
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	case ssh.HostKeyAsk:
+	default:
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+	}
+	if cfg.KnownHostsFile != "" && cfg.HostKeyChecking != ssh.HostKeyInsecure {
+		args = append(args, "-o", "UserKnownHostsFile="+cfg.KnownHostsFile)
+	}
+	if cfg.User != "" {
+		args = append(args, "-l", cfg.User)
+	}
+	if cfg.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(cfg.Port))
+	}
+	if cfg.KeyPath != "" {
+		args = append(args, "-i", cfg.KeyPath)
+	}
+	if cfg.JumpHost != "" {
+		args = append(args, "-J", cfg.JumpHost)
+	}
+	if len(cfg.Ciphers) > 0 {
+		args = append(args, "-o", "Ciphers="+strings.Join(cfg.Ciphers, ","))
+	}
+	if len(cfg.KeyExchanges) > 0 {
+		args = append(args, "-o", "KexAlgorithms="+strings.Join(cfg.KeyExchanges, ","))
+	}
+	if len(cfg.MACs) > 0 {
+		args = append(args, "-o", "MACs="+strings.Join(cfg.MACs, ","))
+	}
+	if cfg.HostName != "" {
+		host = cfg.HostName
+	}
+	return append(args, "--", host, command)
+}
+
+// sshMuxConnector runs commands with the system ssh client over a
+// persistent control socket per host; see RunOptions.SSHMux.
+type sshMuxConnector struct {
+	host inventory.Host
+	cfg  ssh.Config
+	ctx  context.Context
+	tmp  string
+}
+
+func (c sshMuxConnector) RunCommand(command string) (string, error) {
+	if utils.IsScript(command) {
+		return runStagedScript(c, c.host.Address, c.tmp, command)
+	}
+	return c.run(command, nil)
+}
+
+func (c sshMuxConnector) RunCommandInput(command, input string) (string, error) {
+	return c.run(command, strings.NewReader(input))
+}
+
+func (c sshMuxConnector) CopyFile(src, dest string) error {
+	return copyStaged(c, c.host.Address, c.tmp, src, dest, "")
+}
+
+func (c sshMuxConnector) CopyFileValidated(src, dest, validate string) error {
+	return copyStaged(c, c.host.Address, c.tmp, src, dest, validate)
+}
+
+// upload copies src to exactly dest by piping it to cat on the host.
+func (c sshMuxConnector) upload(src, dest string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("reading local file %s: %w", src, err)
+	}
+	defer f.Close()
+	if out, err := c.run("cat > "+utils.ShellQuote(dest), f); err != nil {
+		return fmt.Errorf("copying %s to %s: %w\n%s", src, dest, err, out)
+	}
+	return nil
+}
+
+// run runs command on the host with stdin. ssh exits with 255 when it
+// cannot connect or authenticate, which is reported as unreachable.
+func (c sshMuxConnector) run(command string, stdin io.Reader) (string, error) {
+	dir := sshMuxDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("creating ssh control socket directory: %w", err)
+	}
+	out, err := sshMuxRun(c.ctx, sshMuxArgs(c.host.Address, c.cfg, dir, command), stdin)
+	if err != nil && exitCode(err) == 255 {
+		return out, &ssh.UnreachableError{Host: c.host.Address, Err: fmt.Errorf("%w: %s", err, strings.TrimSpace(out))}
+	}
+	return out, err
+}
@@ -0,0 +1,138 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"for/pkg/inventory"
+	"for/pkg/ssh"
+)
+
+// stubSSHMux replaces the system ssh client and control socket directory;
+// run decides each invocation's result. It returns the arguments of every
+// invocation.
+func stubSSHMux(t *testing.T, run func(args []string) (string, error)) *[][]string {
+	t.Helper()
+	var calls [][]string
+	prevRun, prevDir := sshMuxRun, sshMuxDir
+	dir := t.TempDir()
+	sshMuxRun = func(_ context.Context, args []string, _ io.Reader) (string, error) {
+		calls = append(calls, args)
+		return run(args)
+	}
+	sshMuxDir = func() string { return dir }
+	t.Cleanup(func() { sshMuxRun, sshMuxDir = prevRun, prevDir })
+	return &calls
+}
+
+func TestSSHMuxArgs(t *testing.T) {
+	cfg := ssh.Config{
+		User:           "deploy",
+		Port:           2222,
+		KeyPath:        "/keys/id_ed25519",
+		JumpHost:       "bastion:22",
+		KnownHostsFile: "/etc/for/known_hosts",
+		HostName:       "10.0.0.5",
+		Ciphers:        []string{"aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com"},
+		KeyExchanges:   []string{"curve25519-sha256"},
+		MACs:           []string{"hmac-sha2-256-etm@openssh.com"},
+	}
+	got := sshMuxArgs("web1", cfg, "/tmp/for-ssh-1000", "uptime")
+	want := []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPersist=10m",
+		"-o", "ControlPath=/tmp/for-ssh-1000/%C",
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=/etc/for/known_hosts",
+		"-l", "deploy",
+		"-p", "2222",
+		"-i", "/keys/id_ed25519",
+		"-J", "bastion:22",
+		"-o", "Ciphers=aes256-gcm@openssh.com,chacha20-poly1305@openssh.com",
+		"-o", "KexAlgorithms=curve25519-sha256",
+		"-o", "MACs=hmac-sha2-256-etm@openssh.com",
+		"--", "10.0.0.5", "uptime",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected\n%q\ngot\n%q", want, got)
+	}
+}
+
+func TestSSHMuxArgs_HostKeyChecking(t *testing.T) {
+	got := strings.Join(sshMuxArgs("web1", ssh.Config{}, "/run", "true"), " ")
+	if !strings.Contains(got, "StrictHostKeyChecking=yes") || strings.Contains(got, "UserKnownHostsFile") || !strings.Contains(got, "BatchMode=yes") {
+		t.Errorf("expected strict checking against ssh's own known hosts by default, got %q", got)
+	}
+	if !strings.HasSuffix(got, "-- web1 true") {
+		t.Errorf("expected the inventory name as the target, got %q", got)
+	}
+
+	got = strings.Join(sshMuxArgs("web1", ssh.Config{HostKeyChecking: ssh.HostKeyInsecure, KnownHostsFile: "/etc/kh"}, "/run", "true"), " ")
+	if !strings.Contains(got, "StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null") || strings.Contains(got, "/etc/kh") {
+		t.Errorf("expected host keys unchecked only when insecure is asked for, got %q", got)
+	}
+
+	got = strings.Join(sshMuxArgs("web1", ssh.Config{HostKeyChecking: ssh.HostKeyAsk}, "/run", "true"), " ")
+	if !strings.Contains(got, "StrictHostKeyChecking=ask") || strings.Contains(got, "BatchMode") || strings.Contains(got, "/dev/null") {
+		t.Errorf("expected ssh to prompt for unknown host keys, got %q", got)
+	}
+}
+
+func TestConnectorFor_SSHMuxOnlyWhenEnabled(t *testing.T) {
+	calls := stubSSHMux(t, func([]string) (string, error) { return "up 3 days", nil })
+	host := inventory.Host{Address: "web1", Vars: map[string]interface{}{"ansible_user": "ops"}}
+
+	conn, err := connectorFor(Task{}, host, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.(sshConnector); !ok {
+		t.Errorf("expected the native client without SSHMux, got %T", conn)
+	}
+
+	conn, err = connectorFor(Task{}, host, RunOptions{SSHMux: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := conn.RunCommand("uptime")
+	if err != nil || out != "up 3 days" {
+		t.Fatalf("expected the command's output, got %q, %v", out, err)
+	}
+	if len(*calls) != 1 {
+		t.Fatalf("expected one ssh invocation, got %q", *calls)
+	}
+	args := strings.Join((*calls)[0], " ")
+	if !strings.Contains(args, "ControlMaster=auto") || !strings.Contains(args, "-l ops") || !strings.HasSuffix(args, "-- web1 uptime") {
+		t.Errorf("expected a multiplexed ssh to web1 as ops, got %q", args)
+	}
+	if want := "ControlPath=" + filepath.Join(sshMuxDir(), "%C"); !strings.Contains(args, want) {
+		t.Errorf("expected %q in %q", want, args)
+	}
+}
+
+func TestSSHMuxConnector_ExitStatuses(t *testing.T) {
+	code := 0
+	stubSSHMux(t, func([]string) (string, error) {
+		if code == 0 {
+			return "", nil
+		}
+		return "ssh: connect to host web1 port 22: Connection refused", exitStatusErr(code)
+	})
+	conn, _ := connectorFor(Task{}, inventory.Host{Address: "web1"}, RunOptions{SSHMux: true})
+
+	code = 3
+	if _, err := conn.RunCommand("false"); err == nil || ssh.IsUnreachable(err) {
+		t.Errorf("expected a plain command failure, got %v", err)
+	}
+	code = 255
+	_, err := conn.RunCommand("true")
+	if !errors.Is(err, ssh.ErrUnreachable) || !strings.Contains(err.Error(), "Connection refused") {
+		t.Errorf("expected exit 255 to be unreachable, got %v", err)
+	}
+}
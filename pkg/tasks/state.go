@@ -0,0 +1,96 @@
+package tasks
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Task statuses recorded in a state file.
+const (
+	StatusOK      = "ok"
+	StatusChanged = "changed"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// runState remembers the status each task last finished with on each host,
+// so a ChangedOnly run can skip the tasks that were ok. Tasks are identified
+// by play, service, position and name (see taskKey); an ignored error is
+// recorded as failed.
+type runState struct {
+	mu   sync.Mutex
+	path string
+	// hosts maps host -> task key -> status.
+	hosts map[string]map[string]string
+}
+
+// loadRunState reads the state at path; a missing file yields an empty state.
+func loadRunState(path string) (*runState, error) {
+	s := &runState{path: path, hosts: make(map[string]map[string]string)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.hosts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// status returns the recorded status of task on host, or "" if there is none.
+func (s *runState) status(host, task string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hosts[host][task]
+}
+
+// set records the status of task on host.
+func (s *runState) set(host, task, status string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts[host] == nil {
+		s.hosts[host] = make(map[string]string)
+	}
+	s.hosts[host][task] = status
+}
+
+// save writes the state back to its file.
+func (s *runState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(s.hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, append(data, '\n'), 0o644)
+}
+
+// taskStatus maps a task's result to the status recorded for it.
+func taskStatus(res TaskResult, err error) string {
+	switch {
+	case err != nil:
+		return StatusFailed
+	case res.Skipped:
+		return StatusSkipped
+	case res.Changed:
+		return StatusChanged
+	default:
+		return StatusOK
+	}
+}
+
+// alwaysRuns reports whether task only sets or checks vars, so ChangedOnly
+// must not skip it: later tasks may depend on it.
+func alwaysRuns(task Task) bool {
+	return task.SetFact != nil || task.Debug != nil || task.Assert != nil || task.Fail != nil
+}
@@ -0,0 +1,95 @@
+package tasks
+
+import (
+	"path/filepath"
+	"testing"
+
+	"for/pkg/inventory"
+)
+
+func TestRunPlaybook_ChangedOnlySkipsPreviouslyOK(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: check
+  command: check
+  changed_when: "false"
+- name: deploy
+  command: deploy
+- name: migrate
+  command: migrate
+- name: remember
+  set_fact:
+    release: "1"
+`)
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "site", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	statePath := filepath.Join(dir, "site.state.json")
+
+	var first []string
+	stubSSH(t, func(_, command string) (string, error) {
+		first = append(first, command)
+		if command == "migrate" {
+			return "", exitStatusErr(1)
+		}
+		return "done", nil
+	})
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, StateFile: statePath, Forks: 1}); err == nil {
+		t.Fatal("expected the failed migrate to fail the run")
+	}
+	if len(first) != 3 {
+		t.Fatalf("first run: expected every command to run, got %q", first)
+	}
+	state, err := loadRunState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		taskKey(0, "app", 0, "check"):    StatusOK,
+		taskKey(0, "app", 1, "deploy"):   StatusChanged,
+		taskKey(0, "app", 2, "migrate"):  StatusFailed,
+		taskKey(0, "app", 3, "remember"): StatusOK,
+	}
+	for task, status := range want {
+		if got := state.status("w1", task); got != status {
+			t.Errorf("first run: expected %s recorded as %s, got %q", task, status, got)
+		}
+	}
+
+	ran := stubConnection(t, ConnectionSSH, "done")
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, StateFile: statePath, ChangedOnly: true, Forks: 1}); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if got := *ran; len(got) != 2 || got[0] != "deploy" || got[1] != "migrate" {
+		t.Errorf("second run: expected only deploy and migrate to run, got %q", got)
+	}
+	if state, _ = loadRunState(statePath); state.status("w1", taskKey(0, "app", 0, "check")) != StatusOK || state.status("w1", taskKey(0, "app", 2, "migrate")) != StatusChanged {
+		t.Errorf("second run: expected check to stay ok and migrate to be recorded changed, got %v", state.hosts)
+	}
+}
+
+func TestRunPlaybook_ChangedOnlyTellsUnnamedTasksApart(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- command: check
+  changed_when: "false"
+- command: deploy
+- name: same
+  command: a
+  changed_when: "false"
+- name: same
+  command: b
+`)
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "site", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	opts := RunOptions{ServicesPath: dir, StateFile: filepath.Join(dir, "site.state.json"), ChangedOnly: true, Forks: 1}
+
+	stubConnection(t, ConnectionSSH, "done")
+	if err := RunPlaybook(pb, inv, opts); err != nil {
+		t.Fatal(err)
+	}
+	ran := stubConnection(t, ConnectionSSH, "done")
+	if err := RunPlaybook(pb, inv, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := *ran; len(got) != 2 || got[0] != "deploy" || got[1] != "b" {
+		t.Errorf("expected the changed tasks to run again, got %q", got)
+	}
+}
@@ -3,15 +3,22 @@ package tasks
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
+	"for/pkg/diff"
 	"for/pkg/facts"
 	"for/pkg/inventory"
 	"for/pkg/printer"
@@ -36,38 +43,211 @@ type Play struct {
 	Handlers []Handler              `yaml:"handlers"`
 	Vars     map[string]interface{} `yaml:"vars"`
 	Tags     []string               `yaml:"tags"`
+	// Connection is the default connection type for the play ("ssh" or "local").
+	Connection string `yaml:"connection"`
+	// Become runs the play's commands through sudo, overriding
+	// RunOptions.Become either way; BecomeUser and BecomeMethod likewise
+	// override RunOptions.BecomeUser and BecomeMethod.
+	Become       *bool  `yaml:"become"`
+	BecomeUser   string `yaml:"become_user"`
+	BecomeMethod string `yaml:"become_method"`
+	// Strategy is StrategyLinear (default) or StrategyFree.
+	Strategy string `yaml:"strategy"`
+	// Forks caps how many of the play's hosts run at once; the tightest of
+	// this, the group's forks var and RunOptions.Forks applies (see
+	// playForks).
+	Forks int `yaml:"forks"`
+	// Serial runs the play's hosts in batches, each through the whole play
+	// before the next starts; see batchSizes.
+	Serial BatchSizes `yaml:"serial"`
+	// MaxFailPercentage aborts the run once more than this percentage of
+	// a batch fails. When unset, a serial play aborts only when a whole
+	// batch fails.
+	MaxFailPercentage int `yaml:"max_fail_percentage"`
+	// HealthCheck is a command run on the controller after each batch; if
+	// it fails, the remaining batches and plays are skipped. See
+	// runHealthCheck.
+	HealthCheck string `yaml:"health_check"`
+	// RetriesPerHost re-runs the whole play on the hosts that failed it, up
+	// to this many times, waiting RetryDelay (a duration such as "10s")
+	// before each retry. They override RunOptions.RetriesPerHost and
+	// RetryDelay when set.
+	RetriesPerHost int    `yaml:"retries_per_host"`
+	RetryDelay     string `yaml:"retry_delay"`
+	// GatherSubset limits the facts gathered for the play to these subsets
+	// (see facts.Select), e.g. ["min"] or ["!hardware"].
+	GatherSubset []string `yaml:"gather_subset"`
+	// When skips the whole play on each host where one of its conditions
+	// does not hold, evaluated after facts are gathered. Task-level when
+	// conditions apply on top of it.
+	When Conditions `yaml:"when"`
 }
 
+// Play strategies.
+const (
+	// StrategyLinear runs one service at a time; all hosts finish a service
+	// before any host starts the next.
+	StrategyLinear = "linear"
+	// StrategyFree lets every host run through all services independently.
+	StrategyFree = "free"
+)
+
+// Meta actions for the meta field of a task.
+const (
+	// MetaFlushHandlers runs the handlers notified so far on the host.
+	MetaFlushHandlers = "flush_handlers"
+	// MetaClearHostErrors lets a host halted by a failure resume and turns
+	// its failures so far into ignored errors.
+	MetaClearHostErrors = "clear_host_errors"
+)
+
 type Service struct {
 	ServiceName string `yaml:"service"`
+	// Tags apply to every task of the service (and select/skip it as a unit).
+	Tags []string `yaml:"tags"`
+	// TasksFrom selects the entrypoint file in services/<name>/tasks/
+	// (default main.yaml). Dependencies always load their main.yaml.
+	TasksFrom string `yaml:"tasks_from"`
 }
 
-// Handler is a task that runs only when notified by another task.
+// Handler is a task that runs only when notified by another task, either
+// by name or by one of the topics it listens to.
 type Handler struct {
-	Name    string `yaml:"name"`
-	Command string `yaml:"command"`
+	Name    string   `yaml:"name"`
+	Command string   `yaml:"command"`
+	Shell   string   `yaml:"shell"`
+	Listen  []string `yaml:"listen"`
+}
+
+// notifiedBy reports whether notified names h or one of its topics.
+func (h Handler) notifiedBy(notified map[string]bool) bool {
+	if notified[h.Name] {
+		return true
+	}
+	for _, topic := range h.Listen {
+		if notified[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+// DebugTask prints a templated message or the value of a variable.
+type DebugTask struct {
+	Msg string `yaml:"msg"`
+	Var string `yaml:"var"`
+	// Verbosity hides the task unless RunOptions.Verbosity is at least this.
+	Verbosity int `yaml:"verbosity"`
+}
+
+// AssertTask fails unless every That condition holds. Conditions use the
+// same syntax as when; the messages are templated.
+type AssertTask struct {
+	That       []string `yaml:"that"`
+	FailMsg    string   `yaml:"fail_msg"`
+	SuccessMsg string   `yaml:"success_msg"`
+}
+
+// FailTask fails the host with a templated message; guard it with when.
+type FailTask struct {
+	Msg string `yaml:"msg"`
 }
 
 // CopyTask describes a local to remote file copy.
 type CopyTask struct {
 	Src  string `yaml:"src"`
 	Dest string `yaml:"dest"`
+	// Validate is a templated command run against the staged copy, with %s
+	// standing for its path (e.g. "nginx -t -c %s"). Dest is only replaced
+	// when it succeeds.
+	Validate string `yaml:"validate"`
+	// Backup copies an existing Dest that is about to change to
+	// <dest>.<timestamp>.bak on the target first; the task's output (and
+	// registered value) is the backup path. An unchanged Dest is left alone
+	// and the task reports ok.
+	Backup bool `yaml:"backup"`
 }
 
 type Task struct {
-	Name         string        `yaml:"name"`
+	Name string `yaml:"name"`
+	// Command runs without a shell (see ModuleCommand); Shell runs with
+	// sh -c.
 	Command      string        `yaml:"command"`
+	Shell        string        `yaml:"shell"`
 	Copy         *CopyTask     `yaml:"copy"`
 	IgnoreErrors bool          `yaml:"ignore_errors"`
 	Tags         []string      `yaml:"tags"`
 	Notify       string        `yaml:"notify"`
-	When         string        `yaml:"when"`
+	When         Conditions    `yaml:"when"`
 	WithItems    []interface{} `yaml:"with_items"`
 	Timeout      string        `yaml:"timeout"`
 	Retries      int           `yaml:"retries"`
 	Delay        string        `yaml:"delay"`
 	Register     string        `yaml:"register"`
 	ChangedWhen  string        `yaml:"changed_when"`
+	Connection   string        `yaml:"connection"`
+	// Become runs the command through sudo (see runBecome); set either way
+	// it overrides the play and RunOptions. BecomeUser and BecomeMethod
+	// override theirs when set (see becomeFor).
+	Become       *bool  `yaml:"become"`
+	BecomeUser   string `yaml:"become_user"`
+	BecomeMethod string `yaml:"become_method"`
+	// MaxOutputBytes overrides RunOptions.MaxOutputBytes for this task;
+	// negative means no limit.
+	MaxOutputBytes int `yaml:"max_output_bytes"`
+	// SetFact maps variable names to templated values that are rendered
+	// against the host's vars and set for the rest of the run.
+	SetFact map[string]string `yaml:"set_fact"`
+	Debug   *DebugTask        `yaml:"debug"`
+	Assert  *AssertTask       `yaml:"assert"`
+	Fail    *FailTask         `yaml:"fail"`
+	// Meta is a runner control action (MetaFlushHandlers or
+	// MetaClearHostErrors) instead of work on the target.
+	Meta string `yaml:"meta"`
+	// Vars are set for this task only, over every other var, and dropped
+	// afterwards. String values are templates rendered against the vars the
+	// task would otherwise see.
+	Vars map[string]interface{} `yaml:"vars"`
+	// Ping checks that the target can be reached and runs commands (see
+	// PingCommand). It changes nothing and also runs in dry-run mode.
+	Ping bool `yaml:"ping"`
+	// Throttle caps how many hosts run this task at the same time,
+	// independently of forks; 0 means no cap.
+	Throttle int `yaml:"throttle"`
+	// Args are parameters for the module the task names, kept as written
+	// and merged into the module when the task file is loaded (see
+	// applyArgs).
+	Args yaml.Node `yaml:"args"`
+
+	// key identifies the task by its position in the playbook (see
+	// taskKey), as names may be missing or repeated; empty for tasks that
+	// are not part of a play's services, such as handlers.
+	key string
+}
+
+// taskKey identifies the index-th task (from 0) of service in the
+// play-th play (from 0). The name is part of it so that a task moved or
+// replaced in its service is not taken for the one that was there before.
+func taskKey(play int, service string, index int, name string) string {
+	return fmt.Sprintf("%d/%s/%d/%s", play+1, service, index+1, name)
+}
+
+// stateKey is the key of task in the run state: its position when known,
+// its name otherwise.
+func (t Task) stateKey() string {
+	if t.key != "" {
+		return t.key
+	}
+	return t.Name
+}
+
+// outputLimit is how many bytes of t's output are printed: its
+// MaxOutputBytes, else opts'.
+func (t Task) outputLimit(opts RunOptions) int {
+	if t.MaxOutputBytes != 0 {
+		return t.MaxOutputBytes
+	}
+	return opts.MaxOutputBytes
 }
 
 // TaskResult captures the outcome of a single task execution.
@@ -75,9 +255,45 @@ type TaskResult struct {
 	Output  string
 	Changed bool
 	Failed  bool
+	Skipped bool
 	RC      int
+	// Facts holds the variables set by a set_fact task.
+	Facts map[string]interface{}
+	// Streamed reports that Output was already printed as it arrived (see
+	// RunOptions.Stream), so the result line omits it.
+	Streamed bool
+	// Diffs counts the files the task printed a diff for; see
+	// printer.HostSummary.Diffs.
+	Diffs int
 }
 
+// ErrDriftDetected is returned by RunPlaybook in drift-check mode when at least
+// one host differs from the desired state.
+var ErrDriftDetected = errors.New("drift detected")
+
+// ErrWouldChange is returned by RunPlaybook in check (dry-run) mode when at
+// least one task would change a host.
+var ErrWouldChange = errors.New("changes pending")
+
+// ErrTaskFailed matches, with errors.Is, the error RunPlaybook and the ad hoc
+// runners return when a task failed on at least one host. Failures are
+// reported per host as they happen; see RunOptions.KeepGoing for a list.
+var ErrTaskFailed = errors.New("task failed")
+
+// ErrHostsUnreachable matches, with errors.Is, the error RunPlaybook and
+// the ad hoc runners return under RunOptions.IgnoreUnreachable when no task
+// failed but some host could not be reached, unless OkOnUnreachable is set.
+var ErrHostsUnreachable = errors.New("hosts unreachable")
+
+// ErrRunTimedOut is returned by RunPlaybook and the ad hoc runners when
+// RunTimeout expires before the run finishes; the recap covers the work
+// done until then.
+var ErrRunTimedOut = errors.New("run timed out")
+
+// ErrServiceLoad matches, with errors.Is, the error RunPlaybook returns when
+// a service of a play did not load. The play's other services still run.
+var ErrServiceLoad = errors.New("service did not load")
+
 // ServiceMeta declares role/service dependencies.
 type ServiceMeta struct {
 	Dependencies []string `yaml:"dependencies"`
@@ -91,30 +307,396 @@ type RunOptions struct {
 	SSHPort        int
 	JumpHost       string
 	KnownHostsFile string
-	ServicesPath   string
-	RunLocally     bool
-	DryRun         bool
-	FailFast       bool
-	Forks          int
-	Tags           []string
-	SkipTags       []string
-	SSHPool        *ssh.Pool
-	GatherFacts    bool
+	// HostKeyChecking is passed through to ssh.Config.
+	HostKeyChecking string
+	// SSHCiphers, SSHKeyExchanges and SSHMACs are passed through to
+	// ssh.Config's Ciphers, KeyExchanges and MACs.
+	SSHCiphers      []string
+	SSHKeyExchanges []string
+	SSHMACs         []string
+	ServicesPath    string
+	RunLocally      bool
+	DryRun          bool
+	FailFast        bool
+	Forks           int
+	Tags            []string
+	SkipTags        []string
+	SSHPool         *ssh.Pool
+	// SSHMux runs ssh connections through the system ssh client with
+	// OpenSSH connection multiplexing (ControlMaster=auto and a
+	// ControlPersist), so separate for invocations reuse one connection per
+	// host. SSHPool is not used then, and the SSH password is ignored.
+	SSHMux bool
+	// ConnectRate caps how many new SSH connections the built-in client
+	// starts per second across all hosts, independent of Forks, which caps
+	// how many hosts are worked on at once. Zero means no limit.
+	ConnectRate int
+	GatherFacts bool
+	// Connection is the default connection type; empty means "ssh"
+	// (or "local" when RunLocally is set).
+	Connection string
+	// WinRM settings used by hosts with connection "winrm".
+	WinRMUser     string
+	WinRMPassword string
+	WinRMPort     int
+	WinRMHTTPS    bool
+	WinRMInsecure bool
+	// WinRMShell selects "powershell" (default) or "cmd".
+	WinRMShell string
+	// Limit restricts execution to these host addresses (see inventory.ParseLimit).
+	Limit []string
+	// Slice runs only one chunk of each play's hosts after Limit is applied
+	// (see inventory.SliceHosts).
+	Slice inventory.Slice
+	// RetryFile, when set, receives the failed host addresses after a playbook
+	// run; it is removed after a fully successful run.
+	RetryFile string
+	// DriftCheck compares file tasks against each host without changing
+	// anything; other tasks are skipped.
+	DriftCheck bool
+	// Diff makes copy tasks under DryRun compare against the target and print
+	// the diff of what would change.
+	Diff bool
+	// Secrets are redacted from printed diffs, e.g. values decrypted from
+	// the vault. BecomePassword is always redacted.
+	Secrets []string
+	// ParallelPlays runs plays on disjoint hosts concurrently; plays that
+	// share hosts still run in playbook order.
+	ParallelPlays bool
+	// MaxOutputBytes truncates the output printed for a task (0 = no limit);
+	// registered values keep the full output.
+	MaxOutputBytes int
+	// Become runs every command task through sudo unless a play or task
+	// sets become: false. BecomeUser is the user to become (root when
+	// empty) and BecomeMethod BecomeSudo (default) or BecomeDoas.
+	Become       bool
+	BecomeUser   string
+	BecomeMethod string
+	// BecomePassword is fed to sudo on stdin and redacted from output.
+	BecomePassword string
+	// Verbosity is the level debug tasks are compared against.
+	Verbosity int
+	// ConnectionDebug logs how each SSH connection is set up (see
+	// ssh.Config.Debug).
+	ConnectionDebug bool
+	// Context cancels the run: no new tasks start once it is done and
+	// in-flight ssh and local commands are aborted. Nil means no cancellation.
+	Context context.Context
+	// RunTimeout caps the whole playbook or ad hoc run; see ErrRunTimedOut.
+	RunTimeout time.Duration
+	// FactTimeout caps how long gathering facts waits for each host; a
+	// host that takes longer gets the facts it sent so far, with a
+	// warning. Zero waits indefinitely.
+	FactTimeout time.Duration
+	// ChangeCacheFile enables output-based change detection: command tasks
+	// without changed_when report changed only when their output differs
+	// from the run recorded in this file (see changeCache).
+	ChangeCacheFile string
+	// RemoteTmp is the directory on SSH hosts under which scripts and copied
+	// files are staged (default DefaultRemoteTmp); the remote_tmp host var
+	// overrides it.
+	RemoteTmp string
+	// KeepGoing overrides FailFast: a failure never stops a host's remaining
+	// tasks or the run, and every failure is listed in a FAILURE REPORT
+	// printed after the recap.
+	KeepGoing bool
+	// ProfileTasks prints a TASKS PROFILE after the recap: each task name's
+	// total run time across hosts, average per host and count, slowest first.
+	ProfileTasks bool
+	// StateFile records the status each task finished with on each host
+	// (see runState). It is read at the start of the run and written at the
+	// end, except in dry-run and drift-check mode. The CLI only sets it
+	// under --changed-only.
+	StateFile string
+	// ChangedOnly skips tasks whose status in StateFile is ok, reporting
+	// them skipped; changed, failed, skipped and new tasks run. set_fact,
+	// debug, assert and fail tasks always run.
+	ChangedOnly bool
+	// RenderOnly prints each task's rendered command per host instead of
+	// running it (see renderTask). set_fact, debug, assert and fail tasks
+	// still run, as they only use vars; a template error fails the task but
+	// never stops the host. Nothing is written to the state, change cache or
+	// retry files.
+	RenderOnly bool
+	// OnTaskResult, when set, is called after every task, handler and ad
+	// hoc command with the host, task name, result and error. Hosts run
+	// concurrently, so it must be safe for concurrent use.
+	OnTaskResult func(host, task string, res TaskResult, err error)
+	// Stream prints the output of command and script tasks line by line as
+	// it arrives, prefixed with the host, instead of with the task's result
+	// (see printer.Stream). The full output is still registered. Tasks run
+	// with become, and docker and WinRM connections, are not streamed.
+	Stream bool
+	// SummaryOnly lists failures in a FAILURE REPORT after the recap when
+	// there are any, without changing when a run stops. Set it together
+	// with printer.SummaryOnly, which hides the per-task output those
+	// failures would otherwise be read from.
+	SummaryOnly bool
+
+	// ResultFile, when set, receives the run's Result at the end: YAML when
+	// it ends in .yaml or .yml, JSON otherwise (see Result.MarshalJSON). It
+	// is written in every mode, including dry-run.
+	ResultFile string
+	// RetriesPerHost re-runs each play on the hosts that failed it, up to
+	// this many times, waiting RetryDelay before each retry; a host that
+	// succeeds on a retry counts only that attempt in the recap. A play's
+	// retries_per_host and retry_delay override them.
+	RetriesPerHost int
+	RetryDelay     time.Duration
+	// IgnoreUnreachable counts a task that cannot connect to its host (see
+	// ssh.ErrUnreachable) as unreachable instead of failed: the host is
+	// dropped from the rest of the run while other hosts carry on, even
+	// under FailFast. The run still returns ErrHostsUnreachable unless
+	// OkOnUnreachable is set.
+	IgnoreUnreachable bool
+	OkOnUnreachable   bool
+	// PreRunHook and PostRunHook are shell commands run on the controller
+	// before a playbook or ad hoc run contacts any host and after it ends,
+	// with the run described in FOR_* environment variables (see hookEnv
+	// and runPostRunHook). A failing PreRunHook aborts the run with
+	// ErrPreRunHookFailed; a failing PostRunHook is only reported.
+	PreRunHook  string
+	PostRunHook string
+	// PlaybookFile is the path of the playbook being run, for the hooks.
+	PlaybookFile string
+	// AdHocChangedWhen and AdHocFailedWhen classify each ad hoc command's
+	// result: templates evaluated with output and rc, like a task's
+	// changed_when. When AdHocChangedWhen is set, a command reports changed
+	// instead of ok when it holds; when AdHocFailedWhen is set, it alone
+	// decides whether the command failed. A condition that fails to
+	// evaluate fails the command. Playbook runs ignore both.
+	AdHocChangedWhen string
+	AdHocFailedWhen  string
+
+	// printer receives the run's output; see console.
+	printer *printer.Printer
+	// out receives a host's output while its tasks run; see hostOutput.
+	out *printer.HostWriter
+	// results holds task results registered during the run, shared by all plays.
+	results *results
+	// facts holds the facts gathered for each host during the run.
+	facts *results
+	// invVars holds every inventory host's vars, built once per run by
+	// inventoryVars (nil when running locally); see hostVars.
+	invVars map[string]map[string]interface{}
+	// recap receives host summaries; clear_host_errors updates it.
+	recap *recap
+	// changes is the loaded ChangeCacheFile, if any.
+	changes *changeCache
+	// play is the name of the play running, for report.
+	play string
+	// report collects task results for Result.Plays.
+	report *runReport
+	// failures collects every failure for Result.Failures and the KeepGoing
+	// and SummaryOnly reports.
+	failures *failureLog
+	// loadErrors collects the services that did not load, for
+	// ErrServiceLoad.
+	loadErrors *errorLog
+	// profile collects task durations for ProfileTasks.
+	profile *taskProfile
+	// state is the loaded StateFile, if any.
+	state *runState
+	// throttles limits how many hosts run each task with a throttle.
+	throttles *throttles
+	// connectLimiter paces new SSH connections; see ConnectRate and
+	// limitConnects.
+	connectLimiter *ssh.RateLimiter
+}
+
+// limitConnects sets up the connection rate limiter for ConnectRate, shared
+// by every host of the run.
+func (o *RunOptions) limitConnects() {
+	if o.connectLimiter == nil {
+		o.connectLimiter = ssh.NewRateLimiter(o.ConnectRate)
+	}
+}
+
+// taskResult records a task that finished on host after d for Result.Plays
+// and passes it to OnTaskResult, if set.
+func (o RunOptions) taskResult(host string, task Task, res TaskResult, err error, d time.Duration) {
+	o.report.add(o.play, host, task, res, err, d)
+	if o.OnTaskResult != nil {
+		o.OnTaskResult(host, task.Name, res, err)
+	}
+}
+
+// context returns the run's context, never nil.
+func (o RunOptions) context() context.Context {
+	if o.Context != nil {
+		return o.Context
+	}
+	return context.Background()
+}
+
+// unreachable reports whether err should count a host as unreachable
+// rather than failed; see IgnoreUnreachable.
+func (o RunOptions) unreachable(err error) bool {
+	return o.IgnoreUnreachable && errors.Is(err, ssh.ErrUnreachable)
+}
+
+// unreachableErr returns the ErrHostsUnreachable error for a run whose rec
+// has unreachable hosts, or nil under OkOnUnreachable.
+func (o RunOptions) unreachableErr(rec *recap) error {
+	if n := rec.unreachableHosts(); n > 0 && !o.OkOnUnreachable {
+		return utils.Mark(fmt.Errorf("%d hosts unreachable", n), ErrHostsUnreachable)
+	}
+	return nil
+}
+
+// hostOutput returns the writer for per-host output, falling back to
+// unbuffered output to the console when none was assigned.
+func (o RunOptions) hostOutput() *printer.HostWriter {
+	if o.out != nil {
+		return o.out
+	}
+	return o.console().NewHostWriter(false)
+}
+
+// console returns the Printer the run's output goes to: the one a Runner
+// assigned, or the default Printer.
+func (o RunOptions) console() *printer.Printer {
+	if o.printer != nil {
+		return o.printer
+	}
+	return printer.Default()
 }
 
 // ---------------------------------------------------------------------------
 // Loaders
 // ---------------------------------------------------------------------------
 
+// LoadTasks loads a playbook file.
 func LoadTasks(file string) (Playbook, error) {
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
+	root, err := utils.ParseYAML(file, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePlaybook(file, root); err != nil {
+		return nil, err
+	}
 	var playbook Playbook
-	return playbook, yaml.Unmarshal(data, &playbook)
+	return playbook, utils.DecodeYAML(file, data, &playbook)
+}
+
+// validatePlaybook checks the shape of a parsed playbook so mistakes such as
+// a missing list dash are reported with their position rather than as a
+// Go type mismatch.
+func validatePlaybook(file string, root *yaml.Node) error {
+	if root == nil {
+		return nil
+	}
+	if root.Kind != yaml.SequenceNode {
+		return utils.NodeError(file, root, "playbook must be a list of plays, got %s", utils.NodeKind(root))
+	}
+	for i, play := range root.Content {
+		play = utils.Resolve(play)
+		if play.Kind != yaml.MappingNode {
+			return utils.NodeError(file, play, "play %d must be a mapping with hosts and services, got %s", i+1, utils.NodeKind(play))
+		}
+		if mappingValue(play, "hosts") == nil {
+			return utils.NodeError(file, play, "play %d is missing \"hosts\"", i+1)
+		}
+		if s := mappingValue(play, "strategy"); s != nil && s.Value != StrategyLinear && s.Value != StrategyFree {
+			return utils.NodeError(file, s, "play %d has unknown strategy %q (want %q or %q)", i+1, s.Value, StrategyLinear, StrategyFree)
+		}
+		if s := mappingValue(play, "serial"); s != nil {
+			var sizes BatchSizes
+			if err := s.Decode(&sizes); err != nil {
+				return utils.NodeError(file, s, "play %d has an invalid serial: it must be a number, a percentage or a list of them", i+1)
+			}
+			for _, size := range sizes {
+				if _, err := batchSize(size, 1); err != nil {
+					return utils.NodeError(file, s, "play %d has an %v", i+1, err)
+				}
+			}
+		}
+		if g := mappingValue(play, "gather_subset"); g != nil {
+			var subset []string
+			if err := g.Decode(&subset); err != nil {
+				return utils.NodeError(file, g, "play %d has an invalid gather_subset: it must be a list of subset names", i+1)
+			}
+			if _, err := facts.Select(subset); err != nil {
+				return utils.NodeError(file, g, "play %d has an %v", i+1, err)
+			}
+		}
+		if m := mappingValue(play, "become_method"); m != nil && !ValidBecomeMethod(m.Value) {
+			return utils.NodeError(file, m, "play %d has unknown become_method %q (want %q or %q)", i+1, m.Value, BecomeSudo, BecomeDoas)
+		}
+		services := utils.Resolve(mappingValue(play, "services"))
+		if services == nil {
+			continue
+		}
+		if services.Kind != yaml.SequenceNode {
+			return utils.NodeError(file, services, "services of play %d must be a list, got %s", i+1, utils.NodeKind(services))
+		}
+		for _, svc := range services.Content {
+			svc = utils.Resolve(svc)
+			if svc.Kind != yaml.MappingNode || mappingValue(svc, "service") == nil {
+				return utils.NodeError(file, svc, "each service of play %d must be a mapping with a \"service\" key, got %s", i+1, utils.NodeKind(svc))
+			}
+		}
+	}
+	return nil
+}
+
+// validateTaskList checks that a parsed service task file is a list of mappings.
+func validateTaskList(file string, root *yaml.Node) error {
+	if root == nil {
+		return nil
+	}
+	if root.Kind != yaml.SequenceNode {
+		return utils.NodeError(file, root, "task file must be a list of tasks, got %s", utils.NodeKind(root))
+	}
+	for i, task := range root.Content {
+		task = utils.Resolve(task)
+		if task.Kind != yaml.MappingNode {
+			return utils.NodeError(file, task, "task %d must be a mapping, got %s", i+1, utils.NodeKind(task))
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value node for key in mapping n, or nil. Keys
+// set in n win over those merged in with "<<" (a mapping, an alias to one
+// or a list of them), as when decoding.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	n = utils.Resolve(n)
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	var merges []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		switch n.Content[i].Value {
+		case key:
+			return n.Content[i+1]
+		case mergeKey:
+			merges = append(merges, n.Content[i+1])
+		}
+	}
+	for _, m := range merges {
+		m = utils.Resolve(m)
+		sources := []*yaml.Node{m}
+		if m.Kind == yaml.SequenceNode {
+			sources = m.Content
+		}
+		for _, src := range sources {
+			if v := mappingValue(src, key); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
 }
 
+// mergeKey is the YAML merge key: "<<: *defaults" copies the keys of the
+// anchored mapping into the one containing it.
+const mergeKey = "<<"
+
 // LoadServiceMeta loads meta/main.yaml for a service (role dependencies).
 func LoadServiceMeta(servicesPath, serviceName string) (*ServiceMeta, error) {
 	if servicesPath == "" {
@@ -129,29 +711,77 @@ func LoadServiceMeta(servicesPath, serviceName string) (*ServiceMeta, error) {
 		return nil, err
 	}
 	var meta ServiceMeta
-	return &meta, yaml.Unmarshal(data, &meta)
+	return &meta, utils.DecodeYAML(metaPath, data, &meta)
 }
 
 // LoadServiceTasks loads the task list for a named service.
 func LoadServiceTasks(servicesPath, serviceName string) ([]Task, error) {
+	return LoadServiceTasksFrom(servicesPath, serviceName, "")
+}
+
+// LoadServiceTasksFrom loads the tasks of a named service from the entrypoint
+// tasksFrom in services/<name>/tasks/. An empty tasksFrom means main.yaml; a
+// name without an extension tries .yaml, then .yml.
+func LoadServiceTasksFrom(servicesPath, serviceName, tasksFrom string) ([]Task, error) {
 	if servicesPath == "" {
 		servicesPath = DefaultServicesPath
 	}
-	serviceFilePath := filepath.Join(servicesPath, serviceName, "tasks", "main.yaml")
+	serviceFilePath, err := serviceTasksFile(servicesPath, serviceName, tasksFrom)
+	if err != nil {
+		return nil, err
+	}
 	data, err := os.ReadFile(serviceFilePath)
 	if err != nil {
 		return nil, err
 	}
+	root, err := utils.ParseYAML(serviceFilePath, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTaskList(serviceFilePath, root); err != nil {
+		return nil, err
+	}
 	var serviceTasks []Task
-	return serviceTasks, yaml.Unmarshal(data, &serviceTasks)
+	if err := utils.DecodeYAML(serviceFilePath, data, &serviceTasks); err != nil {
+		return nil, err
+	}
+	return serviceTasks, applyArgs(serviceFilePath, root, serviceTasks)
+}
+
+// serviceTasksFile resolves the entrypoint tasksFrom of a service to a path,
+// failing clearly when it names no file in the service's tasks directory.
+func serviceTasksFile(servicesPath, serviceName, tasksFrom string) (string, error) {
+	dir := filepath.Join(servicesPath, serviceName, "tasks")
+	if tasksFrom == "" {
+		return filepath.Join(dir, "main.yaml"), nil
+	}
+	if tasksFrom != filepath.Base(tasksFrom) || tasksFrom == "." || tasksFrom == ".." {
+		return "", fmt.Errorf("tasks_from %q must be a file name in %s", tasksFrom, dir)
+	}
+	candidates := []string{tasksFrom}
+	if filepath.Ext(tasksFrom) == "" {
+		candidates = []string{tasksFrom + ".yaml", tasksFrom + ".yml"}
+	}
+	for _, name := range candidates {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("service %q has no tasks_from entrypoint %q in %s", serviceName, tasksFrom, dir)
 }
 
 // LoadServiceTasksWithDeps loads tasks for a service and all its dependencies.
 func LoadServiceTasksWithDeps(servicesPath, serviceName string) ([]Task, error) {
-	return loadWithDeps(servicesPath, serviceName, map[string]bool{})
+	return loadWithDeps(servicesPath, serviceName, "", map[string]bool{})
 }
 
-func loadWithDeps(servicesPath, name string, visited map[string]bool) ([]Task, error) {
+// loadService loads a play's service entry, honouring its tasks_from.
+func loadService(servicesPath string, service Service) ([]Task, error) {
+	return loadWithDeps(servicesPath, service.ServiceName, service.TasksFrom, map[string]bool{})
+}
+
+func loadWithDeps(servicesPath, name, tasksFrom string, visited map[string]bool) ([]Task, error) {
 	if visited[name] {
 		return nil, nil
 	}
@@ -164,14 +794,14 @@ func loadWithDeps(servicesPath, name string, visited map[string]bool) ([]Task, e
 
 	var all []Task
 	for _, dep := range meta.Dependencies {
-		depTasks, err := loadWithDeps(servicesPath, dep, visited)
+		depTasks, err := loadWithDeps(servicesPath, dep, "", visited)
 		if err != nil {
 			return nil, fmt.Errorf("dependency %q: %w", dep, err)
 		}
 		all = append(all, depTasks...)
 	}
 
-	own, err := LoadServiceTasks(servicesPath, name)
+	own, err := LoadServiceTasksFrom(servicesPath, name, tasksFrom)
 	if err != nil {
 		return nil, err
 	}
@@ -182,20 +812,62 @@ func loadWithDeps(servicesPath, name string, visited map[string]bool) ([]Task, e
 // Tag helpers
 // ---------------------------------------------------------------------------
 
+// Special tag selectors accepted by --tags.
+const (
+	// TagAll selects every task (the default when no filter is given).
+	TagAll = "all"
+	// TagTagged selects only tasks that carry at least one tag.
+	TagTagged = "tagged"
+)
+
+// Special task tags.
+const (
+	// TagAlways runs the task whatever --tags selects.
+	TagAlways = "always"
+	// TagNever skips the task unless --tags names "never" or another of the
+	// task's own tags; "all" and "tagged" do not select it.
+	TagNever = "never"
+)
+
+// matchesTags reports whether a task with taskTags runs. Precedence, highest
+// first:
+//
+//  1. a tag in skipTags skips the task (this includes skipping "always");
+//  2. "always" runs the task;
+//  3. "never" skips the task unless filterTags names one of its tags;
+//  4. otherwise the task runs when filterTags is empty, contains "all",
+//     contains "tagged" and the task is tagged, or names one of its tags.
 func matchesTags(taskTags, filterTags, skipTags []string) bool {
-	for _, st := range skipTags {
-		for _, tt := range taskTags {
-			if st == tt {
-				return false
-			}
-		}
+	if hasAnyTag(taskTags, skipTags) {
+		return false
+	}
+	if hasAnyTag(taskTags, []string{TagAlways}) {
+		return true
+	}
+	if hasAnyTag(taskTags, []string{TagNever}) {
+		return hasAnyTag(taskTags, filterTags)
 	}
 	if len(filterTags) == 0 {
 		return true
 	}
 	for _, ft := range filterTags {
-		for _, tt := range taskTags {
-			if ft == tt {
+		switch ft {
+		case TagAll:
+			return true
+		case TagTagged:
+			if len(taskTags) > 0 {
+				return true
+			}
+		}
+	}
+	return hasAnyTag(taskTags, filterTags)
+}
+
+// hasAnyTag reports whether tags and want share an entry.
+func hasAnyTag(tags, want []string) bool {
+	for _, w := range want {
+		for _, t := range tags {
+			if w == t {
 				return true
 			}
 		}
@@ -203,15 +875,113 @@ func matchesTags(taskTags, filterTags, skipTags []string) bool {
 	return false
 }
 
+// selectsUnit reports whether a play or service with the given tags should be
+// loaded at all. Units hit by skipTags are skipped; tagged units must match the
+// filter. Untagged units are always loaded so their tasks can match on their
+// own tags.
+func selectsUnit(unitTags, filterTags, skipTags []string) bool {
+	if hasAnyTag(unitTags, skipTags) {
+		return false
+	}
+	if len(unitTags) == 0 {
+		return true
+	}
+	return matchesTags(unitTags, filterTags, nil)
+}
+
+// inheritTags returns copies of tasks whose tags also include the enclosing
+// play and service tags, so a task matches when either its own or an inherited
+// tag does.
+func inheritTags(tasks []Task, inherited ...[]string) []Task {
+	var extra []string
+	for _, tags := range inherited {
+		extra = append(extra, tags...)
+	}
+	if len(extra) == 0 {
+		return tasks
+	}
+	out := make([]Task, len(tasks))
+	for i, t := range tasks {
+		t.Tags = append(append([]string(nil), t.Tags...), extra...)
+		out[i] = t
+	}
+	return out
+}
+
+// PlayTags is the set of tags used by one play, as reported by --list-tags.
+type PlayTags struct {
+	Play string
+	Tags []string
+}
+
+// ListTags collects the sorted set of tags used by each play, including the
+// play's own tags and those of every task in its services and dependencies.
+func ListTags(playbook Playbook, servicesPath string) ([]PlayTags, error) {
+	var out []PlayTags
+	for _, play := range playbook {
+		seen := make(map[string]bool)
+		for _, t := range play.Tags {
+			seen[t] = true
+		}
+		for _, service := range play.Services {
+			for _, t := range service.Tags {
+				seen[t] = true
+			}
+			serviceTasks, err := loadService(servicesPath, service)
+			if err != nil {
+				return nil, fmt.Errorf("loading service [%s]: %w", service.ServiceName, err)
+			}
+			for _, task := range serviceTasks {
+				for _, t := range task.Tags {
+					seen[t] = true
+				}
+			}
+		}
+		tags := make([]string, 0, len(seen))
+		for t := range seen {
+			tags = append(tags, t)
+		}
+		sort.Strings(tags)
+		out = append(out, PlayTags{Play: play.Name, Tags: tags})
+	}
+	return out, nil
+}
+
 // ---------------------------------------------------------------------------
 // Template helpers
 // ---------------------------------------------------------------------------
 
+// templateFuncs are available in every templated field (see filters.go).
+//
+//	quote         – shell-quote a value: {{ .path | quote }}
+//	default       – fall back when missing or empty: {{ .port | default "22" }}
+//	to_json       – encode as JSON: {{ .list | to_json }}
+//	from_json     – decode JSON: {{ (.out | from_json).version }}
+//	upper, lower  – change case: {{ .env | upper }}
+//	trim          – strip surrounding whitespace: {{ .out | trim }}
+//	join          – join a list: {{ .hosts | join "," }}
+//	b64encode     – base64-encode: {{ .secret | b64encode }}
+//	b64decode     – base64-decode: {{ .blob | b64decode }}
+//	regex_replace – replace matches: {{ .name | regex_replace "[^a-z]" "-" }}
+var templateFuncs = template.FuncMap{
+	"quote":         utils.ShellQuote,
+	"default":       filterDefault,
+	"to_json":       filterToJSON,
+	"from_json":     filterFromJSON,
+	"upper":         filterUpper,
+	"lower":         filterLower,
+	"trim":          filterTrim,
+	"join":          filterJoin,
+	"b64encode":     filterB64Encode,
+	"b64decode":     filterB64Decode,
+	"regex_replace": filterRegexReplace,
+}
+
 func expandVars(s string, vars map[string]interface{}) (string, error) {
 	if len(vars) == 0 || s == "" {
 		return s, nil
 	}
-	tmpl, err := template.New("").Option("missingkey=zero").Parse(s)
+	tmpl, err := template.New("").Option("missingkey=zero").Funcs(templateFuncs).Parse(s)
 	if err != nil {
 		return s, err
 	}
@@ -232,14 +1002,6 @@ func mergeVars(maps ...map[string]interface{}) map[string]interface{} {
 	return out
 }
 
-func hostVarsToInterface(m map[string]string) map[string]interface{} {
-	out := make(map[string]interface{}, len(m))
-	for k, v := range m {
-		out[k] = v
-	}
-	return out
-}
-
 // evaluateCondition renders the when expression and returns true unless result is falsy.
 func evaluateCondition(when string, vars map[string]interface{}) (bool, error) {
 	if when == "" {
@@ -258,6 +1020,11 @@ func isTruthy(expr string, vars map[string]interface{}) bool {
 	if err != nil {
 		return false
 	}
+	return truthy(result)
+}
+
+// truthy reports whether an expanded condition holds.
+func truthy(result string) bool {
 	r := strings.TrimSpace(strings.ToLower(result))
 	return r != "" && r != "false" && r != "0" && r != "no"
 }
@@ -266,33 +1033,45 @@ func isTruthy(expr string, vars map[string]interface{}) bool {
 // SSH config builder
 // ---------------------------------------------------------------------------
 
+// sshConfigFor builds the SSH settings for host from the run defaults,
+// overridden by the host's vars (group vars already merged in, see
+// playHosts). Of each pair of var names the later one wins.
 func sshConfigFor(host inventory.Host, opts RunOptions) ssh.Config {
 	cfg := ssh.Config{
-		User:           opts.SSHUser,
-		KeyPath:        opts.SSHKeyPath,
-		Password:       opts.SSHPassword,
-		Port:           opts.SSHPort,
-		JumpHost:       opts.JumpHost,
-		KnownHostsFile: opts.KnownHostsFile,
-	}
-	if v, ok := host.Vars["ansible_user"]; ok {
-		cfg.User = v
+		User:            opts.SSHUser,
+		KeyPath:         opts.SSHKeyPath,
+		Password:        opts.SSHPassword,
+		Port:            opts.SSHPort,
+		JumpHost:        opts.JumpHost,
+		KnownHostsFile:  opts.KnownHostsFile,
+		HostKeyChecking: opts.HostKeyChecking,
+		Ciphers:         opts.SSHCiphers,
+		KeyExchanges:    opts.SSHKeyExchanges,
+		MACs:            opts.SSHMACs,
+		Debug:           opts.ConnectionDebug,
+		ConnectLimiter:  opts.connectLimiter,
 	}
-	if v, ok := host.Vars["ssh_user"]; ok {
-		cfg.User = v
+	for _, name := range []string{"ansible_user", "ssh_user"} {
+		if v, ok := host.Var(name); ok {
+			cfg.User = v
+		}
 	}
-	if v, ok := host.Vars["ansible_port"]; ok {
-		var p int
-		if _, err := fmt.Sscan(v, &p); err == nil {
-			cfg.Port = p
+	for _, name := range []string{"ansible_port", "ssh_port"} {
+		if v, ok := host.Var(name); ok {
+			var p int
+			if _, err := fmt.Sscan(v, &p); err == nil {
+				cfg.Port = p
+			}
 		}
 	}
-	if v, ok := host.Vars["ssh_port"]; ok {
-		var p int
-		if _, err := fmt.Sscan(v, &p); err == nil {
-			cfg.Port = p
+	for _, name := range []string{"ansible_ssh_private_key_file", "ssh_key_path"} {
+		if v, ok := host.Var(name); ok {
+			cfg.KeyPath = v
 		}
 	}
+	if v, ok := host.Var(inventory.VarAnsibleHost); ok {
+		cfg.HostName = v
+	}
 	return cfg
 }
 
@@ -301,127 +1080,433 @@ func sshConfigFor(host inventory.Host, opts RunOptions) ssh.Config {
 // ---------------------------------------------------------------------------
 
 func runOnce(host inventory.Host, task Task, opts RunOptions, vars map[string]interface{}) (TaskResult, error) {
-	cmd, err := expandVars(task.Command, vars)
+	module := task.Module()
+	switch module {
+	case ModuleSetFact:
+		return setFacts(task.SetFact, vars)
+	case ModuleDebug:
+		if task.Debug.Verbosity > opts.Verbosity {
+			return TaskResult{Skipped: true}, nil
+		}
+		msg, err := debugMessage(task.Debug, vars)
+		if err != nil {
+			return TaskResult{Failed: true}, err
+		}
+		return TaskResult{Output: msg}, nil
+	case ModuleAssert:
+		return checkAssert(task.Assert, vars)
+	case ModuleFail:
+		return failTask(task.Fail, vars)
+	}
+	if opts.RenderOnly {
+		return renderTask(task, host, opts, vars)
+	}
+	if module == ModulePing {
+		conn, err := connectorFor(task, host, opts)
+		if err != nil {
+			return TaskResult{Failed: true, RC: 1}, err
+		}
+		return ping(conn)
+	}
+
+	cmd, argv, err := commandLine(task, host, opts, vars)
 	if err != nil {
-		return TaskResult{Failed: true}, fmt.Errorf("template: %w", err)
+		return TaskResult{Failed: true, RC: 1}, err
 	}
 
 	if opts.DryRun {
+		if task.Copy != nil && opts.Diff {
+			conn, err := connectorFor(task, host, opts)
+			if err != nil {
+				return TaskResult{Failed: true, RC: 1}, err
+			}
+			return previewCopy(host, task, conn, opts)
+		}
 		if task.Copy != nil {
-			printer.DryRun(fmt.Sprintf("COPY %s -> %s:%s", task.Copy.Src, host.Address, task.Copy.Dest))
+			opts.hostOutput().DryRun(fmt.Sprintf("COPY %s -> %s:%s", task.Copy.Src, host.Address, task.Copy.Dest))
 		} else {
-			printer.DryRun(fmt.Sprintf("CMD %s", cmd))
+			opts.hostOutput().DryRun(fmt.Sprintf("CMD %s", cmd))
 		}
 		return TaskResult{}, nil
 	}
 
+	conn, err := connectorFor(task, host, opts)
+	if err != nil {
+		return TaskResult{Failed: true, RC: 1}, err
+	}
+
+	if opts.DriftCheck {
+		return checkDrift(host, task, conn, opts)
+	}
+
 	if task.Copy != nil {
-		if opts.RunLocally {
-			err = copyLocal(task.Copy.Src, task.Copy.Dest)
-		} else {
-			err = ssh.CopyFile(host.Address, task.Copy.Src, task.Copy.Dest, sshConfigFor(host, opts))
+		res := TaskResult{Changed: true}
+		if task.Copy.Backup {
+			backup, changed, err := backupDest(conn, task.Copy)
+			if err != nil {
+				return TaskResult{Failed: true, RC: 1}, err
+			}
+			if !changed {
+				return TaskResult{}, nil
+			}
+			res.Output = backup
 		}
-		if err != nil {
+		if err := copyFile(conn, task.Copy, vars); err != nil {
 			return TaskResult{Failed: true, RC: 1}, err
 		}
-		return TaskResult{Changed: true}, nil
+		return res, nil
 	}
 
 	var output string
-	if opts.RunLocally {
+	streamed := false
+	if become := becomeFor(task, opts); become.enabled {
 		if utils.IsScript(cmd) {
-			output, err = runLocalScriptOutput(cmd)
-		} else {
-			output, err = runLocalCommandOutput(cmd)
+			script, err := os.ReadFile(cmd)
+			if err != nil {
+				return TaskResult{Failed: true, RC: 1}, err
+			}
+			cmd = string(script)
 		}
+		output, err = runBecome(conn, host.Address, cmd, opts.BecomePassword, become)
+	} else if sr, ok := conn.(StreamRunner); ok && opts.Stream {
+		stream := opts.console().NewStream(host.Address, task.outputLimit(opts))
+		output, err = sr.RunCommandStream(cmd, stream)
+		stream.Close()
+		streamed = true
+	} else if ar, ok := conn.(ArgvRunner); ok && len(argv) > 0 {
+		output, err = ar.RunArgv(argv)
 	} else {
-		sshCfg := sshConfigFor(host, opts)
-		if opts.SSHPool != nil {
-			output, err = opts.SSHPool.RunCommandOutput(host.Address, cmd, sshCfg)
-		} else if utils.IsScript(cmd) {
-			output, err = runRemoteScript(host.Address, cmd, sshCfg)
-		} else {
-			output, err = ssh.RunCommandOutput(host.Address, cmd, sshCfg)
-		}
+		output, err = conn.RunCommand(cmd)
 	}
 
-	res := TaskResult{Output: output}
+	res := TaskResult{Output: output, Streamed: streamed}
 	if err != nil {
 		res.Failed = true
-		res.RC = 1
+		res.RC = exitCode(err)
 	}
 	if task.ChangedWhen != "" {
 		localVars := mergeVars(vars, map[string]interface{}{"output": output})
 		res.Changed = isTruthy(task.ChangedWhen, localVars)
+	} else if opts.changes != nil {
+		res.Changed = !res.Failed && opts.changes.changed(host.Address, cmd, output)
 	} else {
 		res.Changed = !res.Failed
 	}
 	return res, err
 }
 
-func runWithTimeout(timeout string, fn func() (TaskResult, error)) (TaskResult, error) {
-	d, err := time.ParseDuration(timeout)
+// commandLine renders the command task runs on host against vars. A shell
+// task's command is returned as is. A command task's is split into argv and
+// returned quoted so that any shell runs argv as is; a local script path,
+// and any command for WinRM hosts, whose shells do not split words like sh,
+// are left alone.
+func commandLine(task Task, host inventory.Host, opts RunOptions, vars map[string]interface{}) (string, []string, error) {
+	if task.Module() == ModuleShell {
+		cmd, err := expandVars(task.Shell, vars)
+		if err != nil {
+			return "", nil, fmt.Errorf("template: %w", err)
+		}
+		return cmd, nil, nil
+	}
+	cmd, err := expandVars(task.Command, vars)
 	if err != nil {
-		return TaskResult{Failed: true}, fmt.Errorf("invalid timeout %q: %w", timeout, err)
+		return "", nil, fmt.Errorf("template: %w", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), d)
-	defer cancel()
-	type pair struct {
-		r TaskResult
-		e error
+	if utils.IsScript(cmd) || resolveConnection(task, host, opts) == ConnectionWinRM {
+		return cmd, nil, nil
 	}
-	ch := make(chan pair, 1)
-	go func() {
-		r, e := fn()
-		ch <- pair{r, e}
-	}()
-	select {
-	case <-ctx.Done():
-		return TaskResult{Failed: true}, fmt.Errorf("timed out after %s", timeout)
-	case p := <-ch:
-		return p.r, p.e
+	argv, err := utils.SplitArgs(cmd)
+	if err != nil {
+		return "", nil, fmt.Errorf("command: %w", err)
 	}
+	return utils.ShellJoin(argv), argv, nil
 }
 
-func runWithRetry(retries int, delay string, fn func() (TaskResult, error)) (TaskResult, error) {
-	var d time.Duration
-	if delay != "" {
-		var err error
-		d, err = time.ParseDuration(delay)
-		if err != nil {
-			return TaskResult{Failed: true}, fmt.Errorf("invalid delay %q: %w", delay, err)
-		}
-	}
-	var (
-		res TaskResult
-		err error
-	)
-	for attempt := 0; attempt <= retries; attempt++ {
-		if attempt > 0 {
-			fmt.Printf("    retry %d/%d\n", attempt, retries)
-			if d > 0 {
-				time.Sleep(d)
+// renderTask prints what task would run with vars, without connecting to
+// the host: the rendered command, or for a copy task its paths and rendered
+// validate command.
+func renderTask(task Task, host inventory.Host, opts RunOptions, vars map[string]interface{}) (TaskResult, error) {
+	var text string
+	switch {
+	case task.Ping:
+		text = PingCommand
+	case task.Copy != nil:
+		text = fmt.Sprintf("COPY %s -> %s", task.Copy.Src, task.Copy.Dest)
+		if task.Copy.Validate != "" {
+			validate, err := expandVars(task.Copy.Validate, vars)
+			if err != nil {
+				return TaskResult{Failed: true, RC: 1}, fmt.Errorf("template: %w", err)
 			}
+			text += "\nVALIDATE " + validate
 		}
-		res, err = fn()
-		if err == nil {
-			return res, nil
+	default:
+		cmd, _, err := commandLine(task, host, opts, vars)
+		if err != nil {
+			return TaskResult{Failed: true, RC: 1}, err
 		}
+		text = cmd
 	}
-	return res, err
+	opts.hostOutput().Output("rendered", text)
+	return TaskResult{}, nil
 }
 
-// executeTask applies when/with_items/timeout/retry logic and delegates to runOnce.
-func executeTask(task Task, host inventory.Host, opts RunOptions, vars map[string]interface{}) (TaskResult, error) {
-	ok, err := evaluateCondition(task.When, vars)
-	if err != nil {
-		return TaskResult{Failed: true}, fmt.Errorf("when eval: %w", err)
-	}
-	if !ok {
-		return TaskResult{}, nil
+// setFacts renders each set_fact value against vars. Nothing runs on the
+// target, so facts are also set in dry-run and drift-check mode.
+func setFacts(exprs map[string]string, vars map[string]interface{}) (TaskResult, error) {
+	names := make([]string, 0, len(exprs))
+	for name := range exprs {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	run := func(loopVars map[string]interface{}) (TaskResult, error) {
+	res := TaskResult{Facts: make(map[string]interface{}, len(exprs))}
+	var lines []string
+	for _, name := range names {
+		value, err := expandVars(exprs[name], vars)
+		if err != nil {
+			return TaskResult{Failed: true}, fmt.Errorf("set_fact %s: %w", name, err)
+		}
+		res.Facts[name] = value
+		lines = append(lines, name+"="+value)
+	}
+	res.Output = strings.Join(lines, "\n")
+	return res, nil
+}
+
+// debugMessage renders a debug task's msg, or formats its var as
+// "name: value" with maps and lists printed as indented JSON.
+func debugMessage(d *DebugTask, vars map[string]interface{}) (string, error) {
+	if d.Var == "" {
+		msg, err := expandVars(d.Msg, vars)
+		if err != nil {
+			return "", fmt.Errorf("debug msg: %w", err)
+		}
+		return msg, nil
+	}
+	value, ok := vars[d.Var]
+	if !ok {
+		return d.Var + ": VARIABLE IS NOT DEFINED", nil
+	}
+	if k := reflect.ValueOf(value).Kind(); k == reflect.Map || k == reflect.Slice {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("debug var %s: %w", d.Var, err)
+		}
+		return d.Var + ": " + string(data), nil
+	}
+	return fmt.Sprintf("%s: %v", d.Var, value), nil
+}
+
+// checkAssert evaluates every condition of an assert task and fails with
+// fail_msg (or the first false condition) unless all of them hold.
+func checkAssert(a *AssertTask, vars map[string]interface{}) (TaskResult, error) {
+	for _, cond := range a.That {
+		ok, err := evaluateCondition(cond, vars)
+		if err != nil {
+			return TaskResult{Failed: true, RC: 1}, fmt.Errorf("assert: evaluating %q: %w", cond, err)
+		}
+		if ok {
+			continue
+		}
+		msg := "assertion failed: " + cond
+		if a.FailMsg != "" {
+			if msg, err = expandVars(a.FailMsg, vars); err != nil {
+				return TaskResult{Failed: true, RC: 1}, fmt.Errorf("assert fail_msg: %w", err)
+			}
+		}
+		return TaskResult{Failed: true, RC: 1}, errors.New(msg)
+	}
+	msg := "All assertions passed"
+	if a.SuccessMsg != "" {
+		var err error
+		if msg, err = expandVars(a.SuccessMsg, vars); err != nil {
+			return TaskResult{Failed: true, RC: 1}, fmt.Errorf("assert success_msg: %w", err)
+		}
+	}
+	return TaskResult{Output: msg}, nil
+}
+
+// failTask always fails, with the rendered msg as the error.
+func failTask(f *FailTask, vars map[string]interface{}) (TaskResult, error) {
+	if f.Msg == "" {
+		return TaskResult{Failed: true, RC: 1}, errors.New("failed as requested from task")
+	}
+	msg, err := expandVars(f.Msg, vars)
+	if err != nil {
+		return TaskResult{Failed: true, RC: 1}, fmt.Errorf("fail msg: %w", err)
+	}
+	return TaskResult{Failed: true, RC: 1}, errors.New(msg)
+}
+
+// checkDrift compares a file task's desired content with the target's current
+// content and reports a diff. Tasks that do not manage files are skipped.
+func checkDrift(host inventory.Host, task Task, conn Connector, opts RunOptions) (TaskResult, error) {
+	if task.Copy == nil {
+		return TaskResult{Skipped: true}, nil
+	}
+	d, err := copyDiff(host, task.Copy, conn, opts)
+	if err != nil {
+		return TaskResult{Failed: true, RC: 1}, err
+	}
+	if d == "" {
+		return TaskResult{}, nil
+	}
+	opts.hostOutput().Drift(host.Address, task.Copy.Dest)
+	opts.hostOutput().Diff(d)
+	return TaskResult{Changed: true, Diffs: 1}, nil
+}
+
+// previewCopy reports what a copy task would change under --dry-run --diff
+// without writing anything: changed with the diff when the target differs,
+// ok when it already matches.
+func previewCopy(host inventory.Host, task Task, conn Connector, opts RunOptions) (TaskResult, error) {
+	d, err := copyDiff(host, task.Copy, conn, opts)
+	if err != nil {
+		return TaskResult{Failed: true, RC: 1}, err
+	}
+	if d == "" {
+		return TaskResult{}, nil
+	}
+	opts.hostOutput().DryRun(fmt.Sprintf("COPY %s -> %s:%s would change", task.Copy.Src, host.Address, task.Copy.Dest))
+	opts.hostOutput().Diff(d)
+	return TaskResult{Changed: true, Diffs: 1}, nil
+}
+
+// copyDiff returns the unified diff from the target's current copy of c.Dest
+// (empty when missing) to c.Src, with opts' secrets redacted. It returns ""
+// when they match. A Dest that exists but cannot be read is an error rather
+// than a diff against nothing.
+func copyDiff(host inventory.Host, c *CopyTask, conn Connector, opts RunOptions) (string, error) {
+	desired, err := os.ReadFile(c.Src)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", c.Src, err)
+	}
+	current := ""
+	if out, err := conn.RunCommand("test -e " + utils.ShellQuote(c.Dest)); err == nil {
+		if current, err = readRemoteFile(conn, c.Dest); err != nil {
+			return "", fmt.Errorf("reading %s: %w", c.Dest, withOutput(err, current))
+		}
+	} else if !exitedWith(err, 1) {
+		return "", fmt.Errorf("checking %s: %w", c.Dest, withOutput(err, out))
+	}
+	d := diff.Unified(current, string(desired), host.Address+":"+c.Dest, c.Src)
+	return redactSecrets(d, append([]string{opts.BecomePassword}, opts.Secrets...)), nil
+}
+
+// redactSecrets replaces every non-empty secret in text.
+func redactSecrets(text string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, redacted)
+		}
+	}
+	return text
+}
+
+// readRemoteFile returns the content of path on the target.
+func readRemoteFile(conn Connector, path string) (string, error) {
+	return conn.RunCommand("cat " + utils.ShellQuote(path))
+}
+
+// exitedWith reports whether err is a command exiting with code, as opposed
+// to e.g. a lost connection.
+func exitedWith(err error, code int) bool {
+	var status interface{ ExitStatus() int }
+	if errors.As(err, &status) {
+		return status.ExitStatus() == code
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == code
+}
+
+// exitCode extracts the remote/local exit status from err, defaulting to 1.
+func exitCode(err error) int {
+	var status interface{ ExitStatus() int }
+	if errors.As(err, &status) {
+		return status.ExitStatus()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+func runWithTimeout(timeout string, fn func() (TaskResult, error)) (TaskResult, error) {
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return TaskResult{Failed: true}, fmt.Errorf("invalid timeout %q: %w", timeout, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	type pair struct {
+		r TaskResult
+		e error
+	}
+	ch := make(chan pair, 1)
+	go func() {
+		r, e := fn()
+		ch <- pair{r, e}
+	}()
+	select {
+	case <-ctx.Done():
+		return TaskResult{Failed: true}, fmt.Errorf("timed out after %s", timeout)
+	case p := <-ch:
+		return p.r, p.e
+	}
+}
+
+func runWithRetry(out *printer.HostWriter, retries int, delay string, fn func() (TaskResult, error)) (TaskResult, error) {
+	var d time.Duration
+	if delay != "" {
+		var err error
+		d, err = time.ParseDuration(delay)
+		if err != nil {
+			return TaskResult{Failed: true}, fmt.Errorf("invalid delay %q: %w", delay, err)
+		}
+	}
+	var (
+		res TaskResult
+		err error
+	)
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			out.Retry(attempt, retries)
+			if d > 0 {
+				time.Sleep(d)
+			}
+		}
+		res, err = fn()
+		if err == nil {
+			return res, nil
+		}
+	}
+	return res, err
+}
+
+// executeTask applies when/with_items/timeout/retry logic and delegates to
+// runOnce. A looping task checks when for each item, so conditions can
+// refer to .item; each skipped item is reported, and the task is skipped
+// when every item is.
+func executeTask(task Task, host inventory.Host, opts RunOptions, vars map[string]interface{}) (TaskResult, error) {
+	if len(task.Vars) > 0 {
+		taskVars, err := renderTaskVars(task.Vars, vars)
+		if err != nil {
+			return TaskResult{Failed: true}, err
+		}
+		vars = mergeVars(vars, taskVars)
+	}
+	if len(task.WithItems) == 0 {
+		ok, err := evaluateConditions(task.When, vars)
+		if err != nil {
+			return TaskResult{Failed: true}, fmt.Errorf("when eval: %w", err)
+		}
+		if !ok {
+			return TaskResult{Skipped: true}, nil
+		}
+	}
+
+	run := func(loopVars map[string]interface{}) (TaskResult, error) {
 		merged := mergeVars(vars, loopVars)
 		fn := func() (TaskResult, error) {
 			return runOnce(host, task, opts, merged)
@@ -433,16 +1518,28 @@ func executeTask(task Task, host inventory.Host, opts RunOptions, vars map[strin
 			}
 		}
 		if task.Retries > 0 {
-			return runWithRetry(task.Retries, task.Delay, fn)
+			return runWithRetry(opts.hostOutput(), task.Retries, task.Delay, fn)
 		}
 		return fn()
 	}
 
 	if len(task.WithItems) > 0 {
-		combined := TaskResult{}
+		combined := TaskResult{Skipped: true}
 		for _, item := range task.WithItems {
-			res, err := run(map[string]interface{}{"item": item})
+			loopVars := map[string]interface{}{"item": item}
+			ok, err := evaluateConditions(task.When, mergeVars(vars, loopVars))
+			if err != nil {
+				return TaskResult{Failed: true}, fmt.Errorf("when eval (item=%v): %w", item, err)
+			}
+			if !ok {
+				opts.hostOutput().SkippedItem(host.Address, item)
+				continue
+			}
+			combined.Skipped = false
+			res, err := run(loopVars)
 			combined.Output += res.Output
+			combined.Facts = mergeVars(combined.Facts, res.Facts)
+			combined.Diffs += res.Diffs
 			if res.Changed {
 				combined.Changed = true
 			}
@@ -458,6 +1555,64 @@ func executeTask(task Task, host inventory.Host, opts RunOptions, vars map[strin
 	return run(nil)
 }
 
+// renderTaskVars renders the string values of a task's vars against vars;
+// other values are used as they are.
+func renderTaskVars(taskVars, vars map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(taskVars))
+	for name, v := range taskVars {
+		if s, ok := v.(string); ok {
+			rendered, err := expandVars(s, vars)
+			if err != nil {
+				return nil, fmt.Errorf("vars %s: %w", name, err)
+			}
+			v = rendered
+		}
+		out[name] = v
+	}
+	return out, nil
+}
+
+// gatherFacts collects the facts in selected (nil for every fact) for all
+// hosts of a play, at most opts.Forks at a time. Local-connection hosts use
+// the control node's facts; every other host runs one batched command over
+// its connection, bounded by opts.FactTimeout.
+func gatherFacts(hosts []inventory.Host, selected map[string]bool, opts RunOptions) map[string]facts.Facts {
+	return facts.GatherAll(hosts, opts.Forks, func(h inventory.Host) facts.Facts {
+		if resolveConnection(Task{}, h, opts) == ConnectionLocal {
+			f := facts.GatherLocal()
+			f.Keep(selected)
+			f["inventory_hostname"] = h.Address
+			return f
+		}
+		if opts.FactTimeout <= 0 {
+			conn, err := connectorFor(Task{}, h, opts)
+			if err != nil {
+				return facts.Facts{"inventory_hostname": h.Address}
+			}
+			return facts.GatherSelected(h.Address, selected, conn.RunCommand)
+		}
+		// The connection shares the timeout, so a gather that runs over
+		// has its remote command stopped rather than left running.
+		ctx, cancel := context.WithTimeout(opts.context(), opts.FactTimeout)
+		defer cancel()
+		hostOpts := opts
+		hostOpts.Context = ctx
+		conn, err := connectorFor(Task{}, h, hostOpts)
+		if err != nil {
+			return facts.Facts{"inventory_hostname": h.Address}
+		}
+		run := func(command string, _ io.Writer) (string, error) { return conn.RunCommand(command) }
+		if sr, ok := conn.(StreamRunner); ok {
+			run = sr.RunCommandStream
+		}
+		f, ok := facts.GatherWithin(ctx, h.Address, selected, run)
+		if !ok {
+			opts.console().Notice("Warning: gathering facts from %s timed out after %s; continuing with the %d facts received", h.Address, opts.FactTimeout, len(f)-1)
+		}
+		return f
+	})
+}
+
 // ---------------------------------------------------------------------------
 // Per-host runner
 // ---------------------------------------------------------------------------
@@ -465,71 +1620,161 @@ func executeTask(task Task, host inventory.Host, opts RunOptions, vars map[strin
 func runHostTasks(host inventory.Host, serviceTasks []Task, handlers []Handler, opts RunOptions, vars map[string]interface{}) printer.HostSummary {
 	notified := make(map[string]bool)
 	summary := printer.HostSummary{Host: host.Address}
+	out := opts.hostOutput()
+	// halted is set when a task fails under fail-fast; the remaining tasks
+	// are skipped unless a clear_host_errors meta task resumes the host.
+	halted := false
+
+	flushHandlers := func() {
+		// Each handler runs at most once, in definition order, however
+		// many of its name and topics were notified.
+		for _, h := range handlers {
+			if !h.notifiedBy(notified) {
+				continue
+			}
+			out.HandlerHeader(h.Name)
+			hTask := Task{Name: h.Name, Command: h.Command, Shell: h.Shell}
+			start := time.Now()
+			res, err := executeTask(hTask, host, opts, vars)
+			opts.taskResult(host.Address, hTask, res, err, time.Since(start))
+			shown := printer.Truncate(res.Output, opts.MaxOutputBytes)
+			if res.Streamed {
+				shown = ""
+			}
+			if opts.unreachable(err) {
+				out.Unreachable(host.Address, err)
+				summary.Record(printer.StatusUnreachable)
+			} else if err != nil {
+				out.Failed(host.Address, err)
+				summary.Record(printer.StatusFailed)
+				opts.failures.add(host.Address, h.Name, err)
+			} else if res.Changed {
+				out.Changed(host.Address, shown)
+				summary.Record(printer.StatusChanged)
+				summary.Diffs += res.Diffs
+			} else {
+				out.OK(host.Address, shown)
+				summary.Record(printer.StatusOK)
+			}
+		}
+		notified = make(map[string]bool)
+	}
 
-	for _, task := range serviceTasks {
+	ctx := opts.context()
+	for i, task := range serviceTasks {
+		if ctx.Err() != nil {
+			return summary
+		}
+		if halted && task.Meta != MetaClearHostErrors {
+			continue
+		}
 		if !matchesTags(task.Tags, opts.Tags, opts.SkipTags) {
-			summary.Skipped++
+			summary.Record(printer.StatusSkipped)
+			continue
+		}
+
+		switch task.Meta {
+		case "":
+		case MetaFlushHandlers:
+			flushHandlers()
+			continue
+		case MetaClearHostErrors:
+			halted = false
+			summary.Ignored += summary.Failed
+			summary.Failed = 0
+			opts.recap.clearHost(host.Address)
+			opts.failures.clearHost(host.Address)
+			continue
+		default:
+			out.TaskHeader(task.Name)
+			err := fmt.Errorf("unknown meta action %q", task.Meta)
+			out.Failed(host.Address, err)
+			summary.Record(printer.StatusFailed)
+			opts.failures.add(host.Address, task.Name, err)
+			halted = opts.FailFast
 			continue
 		}
 
-		printer.TaskHeader(task.Name)
+		out.TaskHeader(task.Name)
+		opts.console().ProgressTask(task.Name)
+
+		if opts.ChangedOnly && !alwaysRuns(task) && opts.state.status(host.Address, task.stateKey()) == StatusOK {
+			out.Skipped(host.Address)
+			summary.Record(printer.StatusSkipped)
+			continue
+		}
 
+		if vars != nil {
+			// Other hosts' facts and results change as they run.
+			vars[VarHostVars] = hostVars(opts)
+		}
+		release, ok := opts.throttles.acquire(ctx, &serviceTasks[i])
+		if !ok {
+			return summary
+		}
+		start := time.Now()
 		res, err := executeTask(task, host, opts, vars)
+		release()
+		opts.profile.add(task.Name, host.Address, time.Since(start))
+		opts.taskResult(host.Address, task, res, err, time.Since(start))
+		shown := printer.Truncate(res.Output, task.outputLimit(opts))
 
 		if task.Register != "" && vars != nil {
 			vars[task.Register] = res.Output
-			printer.RegisterNote(task.Register, res.Output)
+			opts.results.set(host.Address, task.Register, res.Output)
+			out.RegisterNote(task.Register, shown)
+		}
+		if res.Streamed {
+			shown = ""
+		}
+		for name, value := range res.Facts {
+			if vars != nil {
+				vars[name] = value
+			}
+			opts.results.set(host.Address, name, value)
 		}
+		opts.state.set(host.Address, task.stateKey(), taskStatus(res, err))
 
 		switch {
+		case opts.unreachable(err):
+			out.Unreachable(host.Address, err)
+			summary.Record(printer.StatusUnreachable)
+			return summary
 		case err != nil:
 			if task.IgnoreErrors {
-				printer.Ignored(host.Address, err)
-				summary.Ignored++
+				out.Ignored(host.Address, err)
+				summary.Record(printer.StatusIgnored)
 			} else {
-				printer.Failed(host.Address, err)
-				summary.Failed++
-				if opts.FailFast {
-					return summary
-				}
+				out.Failed(host.Address, err)
+				summary.Record(printer.StatusFailed)
+				opts.failures.add(host.Address, task.Name, err)
+				halted = opts.FailFast
 			}
-		case !res.Changed && !res.Failed && task.When != "" && res.Output == "":
-			printer.Skipped(host.Address)
-			summary.Skipped++
+		case res.Skipped:
+			out.Skipped(host.Address)
+			summary.Record(printer.StatusSkipped)
 		case res.Changed:
-			printer.Changed(host.Address, res.Output)
-			summary.Changed++
+			out.Changed(host.Address, shown)
+			summary.Record(printer.StatusChanged)
+			summary.Diffs += res.Diffs
 			if task.Notify != "" {
 				notified[task.Notify] = true
 			}
+		case task.Debug != nil, task.Assert != nil:
+			out.Debug(host.Address, shown)
+			summary.Record(printer.StatusOK)
 		default:
-			printer.OK(host.Address, res.Output)
-			summary.OK++
+			out.OK(host.Address, shown)
+			summary.Record(printer.StatusOK)
 			if task.Notify != "" {
 				notified[task.Notify] = true
 			}
 		}
 	}
 
-	for _, h := range handlers {
-		if !notified[h.Name] {
-			continue
-		}
-		printer.HandlerHeader(h.Name)
-		hTask := Task{Name: h.Name, Command: h.Command}
-		res, err := executeTask(hTask, host, opts, vars)
-		if err != nil {
-			printer.Failed(host.Address, err)
-			summary.Failed++
-		} else if res.Changed {
-			printer.Changed(host.Address, res.Output)
-			summary.Changed++
-		} else {
-			printer.OK(host.Address, res.Output)
-			summary.OK++
-		}
+	if !halted && ctx.Err() == nil {
+		flushHandlers()
 	}
-
 	return summary
 }
 
@@ -539,6 +1784,12 @@ func runHostTasks(host inventory.Host, serviceTasks []Task, handlers []Handler,
 
 // RunPlaybook executes a full playbook and prints a PLAY RECAP.
 func RunPlaybook(playbook Playbook, inv *inventory.Inventory, opts RunOptions) error {
+	_, err := runPlaybook(playbook, inv, opts)
+	return err
+}
+
+// runPlaybook is RunPlaybook that also returns the run's Result.
+func runPlaybook(playbook Playbook, inv *inventory.Inventory, opts RunOptions) (result Result, err error) {
 	if opts.ServicesPath == "" {
 		opts.ServicesPath = DefaultServicesPath
 	}
@@ -546,12 +1797,39 @@ func RunPlaybook(playbook Playbook, inv *inventory.Inventory, opts RunOptions) e
 		opts.Forks = 5
 	}
 
-	overallFailed := false
-	var recapMu sync.Mutex
-	allSummaries := make(map[string]printer.HostSummary)
+	if opts.RunTimeout > 0 {
+		ctx, cancel := context.WithTimeout(opts.context(), opts.RunTimeout)
+		defer cancel()
+		opts.Context = ctx
+	}
+
+	if opts.KeepGoing {
+		opts.FailFast = false
+	}
+	opts.failures = &failureLog{}
+	opts.loadErrors = &errorLog{}
+	if opts.RenderOnly {
+		opts.FailFast = false
+	}
+	if opts.ProfileTasks {
+		opts.profile = newTaskProfile()
+	}
 
+	rec := newRecap(playbook, inv, opts)
+	if err := runPreRunHook(opts, "", len(rec.hosts)); err != nil {
+		return Result{}, err
+	}
+	defer func() { runPostRunHook(opts, "", result, err) }()
+	opts.report = newRunReport(playbook)
+	opts.results = newResults()
+	opts.facts = newResults()
+	opts.invVars = inventoryVars(inv)
+	opts.recap = rec
+	opts.throttles = newThrottles()
+
+	opts.limitConnects()
 	ownPool := false
-	if opts.SSHPool == nil && !opts.RunLocally {
+	if opts.SSHPool == nil && !opts.RunLocally && !opts.SSHMux {
 		opts.SSHPool = ssh.NewPool()
 		ownPool = true
 	}
@@ -559,182 +1837,1373 @@ func RunPlaybook(playbook Playbook, inv *inventory.Inventory, opts RunOptions) e
 		defer opts.SSHPool.Close()
 	}
 
-	for _, play := range playbook {
-		if !matchesTags(play.Tags, opts.Tags, opts.SkipTags) {
-			continue
+	if opts.ChangeCacheFile != "" && !opts.DryRun && !opts.DriftCheck && !opts.RenderOnly {
+		changes, err := loadChangeCache(opts.ChangeCacheFile)
+		if err != nil {
+			opts.console().Notice("Warning: could not read change cache, every command will report changed: %v", err)
+			changes = &changeCache{path: opts.ChangeCacheFile, hosts: make(map[string]map[string]string)}
 		}
+		opts.changes = changes
+	}
 
-		printer.PlayHeader(play.Name)
-
-		var hosts []inventory.Host
-		var groupVars map[string]interface{}
+	if opts.StateFile != "" {
+		state, err := loadRunState(opts.StateFile)
+		if err != nil {
+			opts.console().Notice("Warning: could not read state file, every task will run: %v", err)
+			state = &runState{path: opts.StateFile, hosts: make(map[string]map[string]string)}
+		}
+		opts.state = state
+	}
 
-		if opts.RunLocally {
-			hosts = []inventory.Host{{Address: "localhost"}}
-		} else {
-			var ok bool
-			hosts, ok = inv.Hosts[play.Hosts]
-			if !ok {
-				fmt.Printf("No hosts found for group: %s\n", play.Hosts)
-				continue
+	if opts.ParallelPlays {
+		runPlaysParallel(playbook, inv, opts, rec)
+	} else {
+		for i, play := range playbook {
+			runPlay(play, i, inv, opts, rec, opts.console().NewHostWriter(false))
+			if rec.stopped(opts.FailFast) || opts.context().Err() != nil {
+				break
 			}
-			groupVars = hostVarsToInterface(inv.GroupVars[play.Hosts])
 		}
+	}
 
-		var localFacts map[string]interface{}
-		if opts.GatherFacts && opts.RunLocally {
-			localFacts = map[string]interface{}(facts.GatherLocal())
-		}
+	summaries, overallFailed := rec.snapshot()
+	failures := opts.failures.list()
+	result = Result{Hosts: summaries, Failures: failures, Failed: overallFailed, Plays: opts.report.list(rec.rank)}
+	opts.console().Recap(summaries)
+	if opts.KeepGoing || (opts.SummaryOnly && len(failures) > 0) {
+		opts.console().FailureReport(failures)
+	}
+	if opts.ProfileTasks {
+		opts.console().TaskProfile(opts.profile.timings())
+	}
 
-		for _, service := range play.Services {
-			serviceTasks, err := LoadServiceTasksWithDeps(opts.ServicesPath, service.ServiceName)
-			if err != nil {
-				fmt.Printf("Error loading service [%s]: %v\n", service.ServiceName, err)
-				continue
+	drifted := 0
+	if opts.DriftCheck {
+		for _, s := range summaries {
+			if s.Changed > 0 {
+				drifted++
 			}
+		}
+		opts.console().DriftSummary(drifted, len(summaries))
+	}
+	wouldChange := 0
+	if opts.DryRun {
+		wouldChange = opts.console().CheckRecap(summaries)
+	}
 
-			sem := make(chan struct{}, opts.Forks)
-			var wg sync.WaitGroup
-
-			for _, host := range hosts {
-				host := host
-				wg.Add(1)
-				sem <- struct{}{}
-				go func(h inventory.Host) {
-					defer wg.Done()
-					defer func() { <-sem }()
-
-					printer.HostHeader(h.Address)
-
-					hostFacts := localFacts
-					if opts.GatherFacts && !opts.RunLocally {
-						sshCfg := sshConfigFor(h, opts)
-						hostFacts = map[string]interface{}(facts.GatherRemote(h, sshCfg))
-					}
+	if opts.changes != nil {
+		if err := opts.changes.save(); err != nil {
+			opts.console().Notice("Warning: could not update change cache: %v", err)
+		}
+	}
 
-					vars := mergeVars(play.Vars, groupVars, hostVarsToInterface(h.Vars), hostFacts)
-					sum := runHostTasks(h, serviceTasks, play.Handlers, opts, vars)
-
-					recapMu.Lock()
-					prev := allSummaries[h.Address]
-					prev.Host = h.Address
-					prev.OK += sum.OK
-					prev.Changed += sum.Changed
-					prev.Failed += sum.Failed
-					prev.Skipped += sum.Skipped
-					prev.Ignored += sum.Ignored
-					allSummaries[h.Address] = prev
-					if sum.Failed > 0 {
-						overallFailed = true
-					}
-					recapMu.Unlock()
-				}(host)
-			}
-			wg.Wait()
+	if opts.state != nil && !opts.DryRun && !opts.DriftCheck && !opts.RenderOnly {
+		if err := opts.state.save(); err != nil {
+			opts.console().Notice("Warning: could not update state file: %v", err)
+		}
+	}
 
-			if overallFailed && opts.FailFast {
-				break
+	if opts.RetryFile != "" && !opts.RenderOnly {
+		var failedHosts []string
+		for _, s := range summaries {
+			if s.Failed > 0 || s.Unreachable > 0 {
+				failedHosts = append(failedHosts, s.Host)
 			}
 		}
-
-		if overallFailed && opts.FailFast {
-			break
+		if err := writeRetryFile(opts.RetryFile, failedHosts); err != nil {
+			opts.console().Notice("Warning: could not update retry file: %v", err)
 		}
 	}
 
-	summaries := make([]printer.HostSummary, 0, len(allSummaries))
-	for _, s := range allSummaries {
-		summaries = append(summaries, s)
+	if opts.ResultFile != "" {
+		if err := writeResultFile(opts.ResultFile, result); err != nil {
+			opts.console().Notice("Warning: could not write result file: %v", err)
+		}
 	}
-	printer.Recap(summaries)
 
+	if err := opts.loadErrors.err(); err != nil {
+		return result, utils.Mark(err, ErrServiceLoad)
+	}
+	if opts.RunTimeout > 0 && errors.Is(opts.context().Err(), context.DeadlineExceeded) {
+		return result, ErrRunTimedOut
+	}
+	if overallFailed && rec.allFailed() {
+		return result, utils.Mark(errors.New("playbook failed on every host"), ErrAllHostsFailed)
+	}
 	if overallFailed {
-		return fmt.Errorf("playbook completed with errors")
+		return result, utils.Mark(errors.New("playbook completed with errors"), ErrTaskFailed)
 	}
-	return nil
-}
-
-// RunAdHocCommand runs a single command against all hosts in a group.
-func RunAdHocCommand(inv *inventory.Inventory, group, command string, opts RunOptions) error {
-	hosts, ok := inv.Hosts[group]
-	if !ok {
-		return fmt.Errorf("no hosts found for group: %s", group)
+	if err := opts.unreachableErr(rec); err != nil {
+		return result, err
 	}
-	if opts.Forks <= 0 {
-		opts.Forks = 5
+	if drifted > 0 {
+		return result, ErrDriftDetected
 	}
+	if wouldChange > 0 {
+		return result, ErrWouldChange
+	}
+	return result, nil
+}
 
-	task := Task{Name: "ad hoc", Command: command}
-	sem := make(chan struct{}, opts.Forks)
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	failed := false
+// recap accumulates per-host summaries across plays in a
+// printer.SummaryCollector, with the run's abort state; safe for concurrent
+// use.
+type recap struct {
+	*printer.SummaryCollector
+	// hosts are the hosts the run targets, in recap order.
+	hosts []string
+	mu    sync.Mutex
+	// aborted is set when a serial batch failed; see abort.
+	aborted bool
+}
 
-	for _, host := range hosts {
-		host := host
-		wg.Add(1)
-		sem <- struct{}{}
-		go func(h inventory.Host) {
-			defer wg.Done()
-			defer func() { <-sem }()
-			printer.TaskHeader("ad hoc: "+command)
-			printer.HostHeader(h.Address)
-			res, err := executeTask(task, h, opts, nil)
-			if err != nil {
-				printer.Failed(h.Address, err)
-				mu.Lock()
-				failed = true
-				mu.Unlock()
-			} else {
-				printer.OK(h.Address, res.Output)
+// newRecap returns a recap that lists hosts in the order the playbook first
+// targets them: play by play, each play's hosts in inventory definition
+// order. Hosts outside that order come last, sorted by name.
+func newRecap(playbook Playbook, inv *inventory.Inventory, opts RunOptions) *recap {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, ph := range ListPlayHosts(playbook, inv, opts) {
+		for _, h := range ph.Hosts {
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
 			}
-		}(host)
+		}
 	}
-	wg.Wait()
+	return newHostRecap(hosts)
+}
 
-	if failed {
-		return fmt.Errorf("ad hoc command failed on one or more hosts")
-	}
-	return nil
+// newHostRecap returns a recap that lists hosts in the given order.
+func newHostRecap(hosts []string) *recap {
+	return &recap{SummaryCollector: printer.NewSummaryCollector(hosts), hosts: hosts}
 }
 
-// RunLocalAdHocCommand runs a single command locally.
-func RunLocalAdHocCommand(command string) error {
-	printer.TaskHeader("local ad hoc: "+command)
-	task := Task{Name: "local ad hoc", Command: command}
-	h := inventory.Host{Address: "localhost"}
-	opts := RunOptions{RunLocally: true}
-	res, err := executeTask(task, h, opts, nil)
-	if err != nil {
-		printer.Failed("localhost", err)
-		return err
+func (r *recap) add(sum printer.HostSummary) {
+	r.Add(sum)
+}
+
+// discard subtracts sum, recorded earlier with add, from its host's
+// summary, for a host whose attempt at a play is being retried.
+func (r *recap) discard(sum printer.HostSummary) {
+	r.Sub(sum)
+}
+
+// clearHost turns the failures recorded for host into ignored errors so
+// fail-fast no longer aborts the run because of them. A nil *recap does
+// nothing.
+func (r *recap) clearHost(host string) {
+	if r == nil {
+		return
 	}
-	printer.OK("localhost", res.Output)
-	return nil
+	r.Update(host, func(sum *printer.HostSummary) {
+		sum.Ignored += sum.Failed
+		sum.Failed = 0
+	})
+}
+
+// anyFailed reports whether tasks failed on any host.
+func (r *recap) anyFailed() bool {
+	for _, s := range r.Summaries() {
+		if s.Failed > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allFailed reports whether tasks failed on every host the run targeted.
+// Hosts a fail-fast or serial abort kept from running have not failed.
+func (r *recap) allFailed() bool {
+	if len(r.hosts) == 0 {
+		return false
+	}
+	for _, host := range r.hosts {
+		if r.Summary(host).Failed == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// abort stops the run after a serial batch exceeded its play's failure
+// threshold: no further batches or plays start.
+func (r *recap) abort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aborted = true
+}
+
+func (r *recap) isAborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+// stopped reports whether no further plays or batches should start, because
+// the run was aborted or, under fail-fast, anything failed.
+func (r *recap) stopped(failFast bool) bool {
+	return r.isAborted() || (failFast && r.anyFailed())
+}
+
+// unreachable reports whether host was found unreachable (see
+// RunOptions.IgnoreUnreachable). A nil *recap reports false.
+func (r *recap) unreachable(host string) bool {
+	if r == nil {
+		return false
+	}
+	return r.Summary(host).Unreachable > 0
+}
+
+// unreachableHosts counts the hosts found unreachable.
+func (r *recap) unreachableHosts() int {
+	n := 0
+	for _, s := range r.Summaries() {
+		if s.Unreachable > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// rank is host's position in the recap; hosts not in order come last.
+func (r *recap) rank(host string) int {
+	return r.Rank(host)
+}
+
+// snapshot returns the summaries in host order (see newRecap) and whether
+// any host failed or the run was aborted.
+func (r *recap) snapshot() ([]printer.HostSummary, bool) {
+	summaries := r.Summaries()
+	failed := r.isAborted()
+	for _, s := range summaries {
+		failed = failed || s.Failed > 0
+	}
+	return summaries, failed
+}
+
+// errorLog collects errors; safe for concurrent use. A nil *errorLog
+// ignores them.
+type errorLog struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *errorLog) add(err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, err)
+}
+
+// err joins the collected errors, or returns nil when there are none.
+func (l *errorLog) err() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.Join(l.errs...)
+}
+
+// failureLog records task failures for the KeepGoing report; safe for
+// concurrent use. A nil *failureLog ignores failures.
+type failureLog struct {
+	mu       sync.Mutex
+	failures []printer.Failure
+}
+
+func (l *failureLog) add(host, task string, err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures = append(l.failures, printer.Failure{Host: host, Task: task, Err: err})
+}
+
+// clearHost drops the failures recorded for host, which clear_host_errors
+// has turned into ignored errors.
+func (l *failureLog) clearHost(host string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.failures[:0]
+	for _, f := range l.failures {
+		if f.Host != host {
+			kept = append(kept, f)
+		}
+	}
+	l.failures = kept
+}
+
+// mark returns a position in the log for dropSince.
+func (l *failureLog) mark() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.failures)
+}
+
+// dropSince drops the failures of host recorded after mark, those of an
+// attempt at a play that is being retried.
+func (l *failureLog) dropSince(host string, mark int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.failures[:mark]
+	for _, f := range l.failures[mark:] {
+		if f.Host != host {
+			kept = append(kept, f)
+		}
+	}
+	l.failures = kept
+}
+
+// list returns the failures sorted by host, in task order within a host.
+func (l *failureLog) list() []printer.Failure {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := append([]printer.Failure(nil), l.failures...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// taskProfile aggregates task durations by task name across hosts for
+// ProfileTasks; safe for concurrent use. A nil *taskProfile ignores them.
+type taskProfile struct {
+	mu     sync.Mutex
+	byTask map[string]*printer.TaskTiming
+	hosts  map[string]map[string]bool
+}
+
+func newTaskProfile() *taskProfile {
+	return &taskProfile{byTask: make(map[string]*printer.TaskTiming), hosts: make(map[string]map[string]bool)}
+}
+
+func (p *taskProfile) add(task, host string, d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.byTask[task]
+	if t == nil {
+		t = &printer.TaskTiming{Task: task}
+		p.byTask[task] = t
+		p.hosts[task] = make(map[string]bool)
+	}
+	t.Total += d
+	t.Count++
+	if !p.hosts[task][host] {
+		p.hosts[task][host] = true
+		t.Hosts++
+	}
+}
+
+// timings returns the aggregated timings, slowest total first and then by
+// task name.
+func (p *taskProfile) timings() []printer.TaskTiming {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]printer.TaskTiming, 0, len(p.byTask))
+	for _, t := range p.byTask {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Total != out[j].Total {
+			return out[i].Total > out[j].Total
+		}
+		return out[i].Task < out[j].Task
+	})
+	return out
+}
+
+// results stores registered task results per host for the whole run, so a
+// later play can read what an earlier one registered; safe for concurrent use.
+// A nil *results ignores writes and has no values.
+type results struct {
+	mu     sync.Mutex
+	byHost map[string]map[string]interface{}
+}
+
+func newResults() *results {
+	return &results{byHost: make(map[string]map[string]interface{})}
+}
+
+func (r *results) set(host, name string, value interface{}) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.byHost[host] == nil {
+		r.byHost[host] = make(map[string]interface{})
+	}
+	r.byHost[host][name] = value
+}
+
+// hosts returns the hosts that have values.
+func (r *results) hosts() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]string, 0, len(r.byHost))
+	for host := range r.byHost {
+		out = append(out, host)
+	}
+	return out
+}
+
+// forHost returns a copy of the values registered on host.
+func (r *results) forHost(host string) map[string]interface{} {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return mergeVars(r.byHost[host])
+}
+
+// Template variables describing the whole run rather than the current host.
+const (
+	// VarHostVars maps each host address to its inventory vars, gathered
+	// facts and registered results: {{ index .hostvars "web2" "os" }}.
+	VarHostVars = "hostvars"
+	// VarGroups maps each inventory group to its host addresses, in
+	// inventory order, plus GroupAll unless the inventory defines it:
+	// {{ range .groups.web }}{{ . }} {{ end }}.
+	VarGroups = "groups"
+	// VarInventoryHostname is the current host's inventory name, which
+	// differs from the dialled address when ansible_host is set.
+	VarInventoryHostname = "inventory_hostname"
+	// VarBatchHosts lists the addresses of the batch a play's health_check
+	// runs after: {{ range .batch_hosts }}{{ . }} {{ end }}.
+	VarBatchHosts = "batch_hosts"
+)
+
+// GroupAll is the groups entry listing every inventory host.
+const GroupAll = "all"
+
+// inventoryVars returns every host's inventory vars (host vars over group
+// vars, across all of its groups, as inventory.Describe merges them), keyed
+// by address. It is nil for a nil inv.
+func inventoryVars(inv *inventory.Inventory) map[string]map[string]interface{} {
+	if inv == nil {
+		return nil
+	}
+	byHost := make(map[string]map[string]interface{})
+	for _, info := range inv.Describe(allHosts(inv)) {
+		byHost[info.Host] = info.Vars
+	}
+	return byHost
+}
+
+// hostVars builds the hostvars template value: for every inventory host and
+// every host with facts or results so far, its inventory vars from
+// opts.invVars, overridden by its gathered facts and then its registered
+// results. The shared inventory vars are never modified.
+func hostVars(opts RunOptions) map[string]interface{} {
+	out := make(map[string]interface{}, len(opts.invVars))
+	for host, vars := range opts.invVars {
+		out[host] = vars
+	}
+	for _, store := range []*results{opts.facts, opts.results} {
+		for _, host := range store.hosts() {
+			vars, _ := out[host].(map[string]interface{})
+			out[host] = mergeVars(vars, store.forHost(host))
+		}
+	}
+	return out
+}
+
+// groupHosts builds the groups template value from inv.
+func groupHosts(inv *inventory.Inventory) map[string]interface{} {
+	out := make(map[string]interface{})
+	if inv == nil {
+		return out
+	}
+	for group, hosts := range inv.Hosts {
+		out[group] = addresses(hosts)
+	}
+	if _, ok := out[GroupAll]; !ok {
+		out[GroupAll] = addresses(allHosts(inv))
+	}
+	return out
+}
+
+// allHosts lists every host of inv once: group by group in name order, each
+// group's hosts in inventory order.
+func allHosts(inv *inventory.Inventory) []inventory.Host {
+	groups := make([]string, 0, len(inv.Hosts))
+	for group := range inv.Hosts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	var out []inventory.Host
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, h := range inv.Hosts[group] {
+			if !seen[h.Address] {
+				seen[h.Address] = true
+				out = append(out, h)
+			}
+		}
+	}
+	return out
+}
+
+func addresses(hosts []inventory.Host) []string {
+	out := make([]string, len(hosts))
+	for i, h := range hosts {
+		out[i] = h.Address
+	}
+	return out
+}
+
+// playHosts resolves the hosts and group vars a play targets. ok is false
+// (after printing why) when the play has nothing to run on.
+func playHosts(play Play, inv *inventory.Inventory, opts RunOptions) (hosts []inventory.Host, groupVars map[string]interface{}, ok bool) {
+	if opts.RunLocally {
+		return []inventory.Host{{Address: "localhost"}}, nil, true
+	}
+	hosts, ok = inv.Hosts[play.Hosts]
+	if !ok {
+		opts.console().Notice("No hosts found for group: %s", play.Hosts)
+		return nil, nil, false
+	}
+	hosts = selectHosts(hosts, opts)
+	if len(hosts) == 0 {
+		opts.console().Notice("No hosts matched the limit or slice for group: %s", play.Hosts)
+		return nil, nil, false
+	}
+	return withGroupVars(hosts, inv.GroupVars[play.Hosts]), mergeVars(inv.GroupVars[play.Hosts]), true
+}
+
+// playForks returns how many of play's hosts may run at once: the smallest
+// of opts.Forks, play.Forks and the forks var of the play's group, so a
+// cautious group (e.g. forks=1 for databases) is never run wider than it
+// allows. A forks var that is not a positive number is ignored with a
+// warning.
+func playForks(play Play, inv *inventory.Inventory, opts RunOptions) int {
+	forks := opts.Forks
+	limit := func(n int) {
+		if n > 0 && n < forks {
+			forks = n
+		}
+	}
+	limit(play.Forks)
+	if inv != nil && !opts.RunLocally {
+		if v, ok := inventory.StringVar(inv.GroupVars[play.Hosts], "forks"); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || n < 1 {
+				opts.console().Notice("Warning: ignoring forks=%q for group %s: not a positive number", v, play.Hosts)
+			} else {
+				limit(n)
+			}
+		}
+	}
+	return forks
+}
+
+// playRetries returns how often and after what delay runPlay re-runs play
+// on its failed hosts: the play's retries_per_host and retry_delay, else
+// opts.RetriesPerHost and RetryDelay. An invalid retry_delay is ignored with
+// a warning.
+func playRetries(play Play, opts RunOptions) (int, time.Duration) {
+	retries, delay := opts.RetriesPerHost, opts.RetryDelay
+	if play.RetriesPerHost > 0 {
+		retries = play.RetriesPerHost
+	}
+	if play.RetryDelay != "" {
+		d, err := time.ParseDuration(play.RetryDelay)
+		if err != nil {
+			opts.console().Notice("Warning: ignoring retry_delay %q of play [%s]: %v", play.RetryDelay, play.Name, err)
+		} else {
+			delay = d
+		}
+	}
+	return retries, delay
+}
+
+// sleepContext waits for d or until ctx is done, reporting whether the
+// full delay passed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// PlayHosts is the hosts one play targets, as reported by
+// --list-plays-with-hosts.
+type PlayHosts struct {
+	Play string
+	// Pattern is the play's hosts: value.
+	Pattern string
+	Hosts   []string
+}
+
+// String renders "PLAY [name] -> [h1, h2]", with a warning when the play
+// targets no hosts.
+func (p PlayHosts) String() string {
+	line := fmt.Sprintf("PLAY [%s] -> [%s]", p.Play, strings.Join(p.Hosts, ", "))
+	if len(p.Hosts) == 0 {
+		line += fmt.Sprintf(" WARNING: %q matches no hosts", p.Pattern)
+	}
+	return line
+}
+
+// ListPlayHosts resolves each play's hosts against inv after opts.Limit and
+// opts.Slice, the way a run would, without connecting to anything.
+func ListPlayHosts(playbook Playbook, inv *inventory.Inventory, opts RunOptions) []PlayHosts {
+	out := make([]PlayHosts, 0, len(playbook))
+	for _, play := range playbook {
+		ph := PlayHosts{Play: play.Name, Pattern: play.Hosts}
+		if opts.RunLocally {
+			ph.Hosts = []string{"localhost"}
+		} else if inv != nil {
+			for _, h := range selectHosts(inv.Hosts[play.Hosts], opts) {
+				ph.Hosts = append(ph.Hosts, h.Address)
+			}
+		}
+		out = append(out, ph)
+	}
+	return out
+}
+
+// ListHosts resolves each of patterns (a playbook's hosts: values or an ad
+// hoc group) against inv after opts.Limit and opts.Slice, the way a run
+// would, and describes every selected host once, in the order first
+// selected, for --list-hosts. A local run selects only localhost.
+func ListHosts(patterns []string, inv *inventory.Inventory, opts RunOptions) []inventory.HostInfo {
+	if opts.RunLocally {
+		return (&inventory.Inventory{}).Describe([]inventory.Host{{Address: "localhost"}})
+	}
+	if inv == nil {
+		return []inventory.HostInfo{}
+	}
+	var hosts []inventory.Host
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		for _, h := range selectHosts(inv.Hosts[pattern], opts) {
+			if !seen[h.Address] {
+				seen[h.Address] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return inv.Describe(hosts)
+}
+
+// selectHosts applies opts.Limit and then opts.Slice to hosts.
+func selectHosts(hosts []inventory.Host, opts RunOptions) []inventory.Host {
+	return inventory.SliceHosts(inventory.FilterHosts(hosts, opts.Limit), opts.Slice)
+}
+
+// withGroupVars returns copies of hosts whose vars also contain groupVars, so
+// group-level connection settings (ansible_user, connection, ...) apply to
+// every host. Host vars take precedence.
+func withGroupVars(hosts []inventory.Host, groupVars map[string]interface{}) []inventory.Host {
+	if len(groupVars) == 0 {
+		return hosts
+	}
+	out := make([]inventory.Host, len(hosts))
+	for i, h := range hosts {
+		vars := make(map[string]interface{}, len(groupVars)+len(h.Vars))
+		for k, v := range groupVars {
+			vars[k] = v
+		}
+		for k, v := range h.Vars {
+			vars[k] = v
+		}
+		out[i] = inventory.Host{Address: h.Address, Vars: vars}
+	}
+	return out
+}
+
+// runPlay runs every selected service of play, the index-th of the
+// playbook, on its hosts, writing the play's output to out and host results
+// to rec.
+func runPlay(play Play, index int, inv *inventory.Inventory, opts RunOptions, rec *recap, out *printer.HostWriter) {
+	if !selectsUnit(play.Tags, opts.Tags, opts.SkipTags) || opts.context().Err() != nil {
+		return
+	}
+
+	out.PlayHeader(play.Name)
+
+	playOpts := opts
+	playOpts.play = play.Name
+	if play.Connection != "" {
+		playOpts.Connection = play.Connection
+	}
+	if play.Become != nil {
+		playOpts.Become = *play.Become
+	}
+	if play.BecomeUser != "" {
+		playOpts.BecomeUser = play.BecomeUser
+	}
+	if play.BecomeMethod != "" {
+		playOpts.BecomeMethod = play.BecomeMethod
+	}
+
+	hosts, groupVars, ok := playHosts(play, inv, opts)
+	if !ok {
+		return
+	}
+	playOpts.Forks = playForks(play, inv, opts)
+
+	var hostFacts map[string]facts.Facts
+	if opts.GatherFacts {
+		selected, err := facts.Select(play.GatherSubset)
+		if err != nil {
+			opts.console().Notice("Error in play [%s]: %v", play.Name, err)
+			return
+		}
+		hostFacts = gatherFacts(hosts, selected, playOpts)
+		for host, f := range hostFacts {
+			for name, value := range f {
+				opts.facts.set(host, name, value)
+			}
+		}
+	}
+	groups := groupHosts(inv)
+
+	// hostVars returns the vars a task on h starts from. Registered results
+	// override play, group and host vars and facts, including those
+	// registered by earlier plays.
+	hostVars := func(h inventory.Host) map[string]interface{} {
+		vars := mergeVars(play.Vars, groupVars, h.Vars, hostFacts[h.Address], opts.results.forHost(h.Address))
+		vars[VarGroups] = groups
+		vars[VarInventoryHostname] = h.Address
+		return vars
+	}
+
+	// A play-level when skips the whole play on the hosts where it does not
+	// hold; each counts as one skipped task in the recap.
+	if len(play.When) > 0 {
+		var selected []inventory.Host
+		for _, h := range hosts {
+			ok, err := evaluateConditions(play.When, hostVars(h))
+			if err != nil {
+				out.Failed(h.Address, fmt.Errorf("evaluating the when of play [%s]: %w", play.Name, err))
+				rec.Record(h.Address, printer.StatusFailed)
+				opts.failures.add(h.Address, play.Name, err)
+				continue
+			}
+			if !ok {
+				out.Skipped(h.Address)
+				rec.Record(h.Address, printer.StatusSkipped)
+				continue
+			}
+			selected = append(selected, h)
+		}
+		hosts = selected
+		if len(hosts) == 0 {
+			return
+		}
+	}
+
+	sizes, err := batchSizes(play.Serial, len(hosts))
+	if err != nil {
+		opts.console().Notice("Error in play [%s]: %v", play.Name, err)
+		return
+	}
+
+	var services [][]Task
+	for _, service := range play.Services {
+		if !selectsUnit(service.Tags, opts.Tags, opts.SkipTags) {
+			continue
+		}
+		serviceTasks, err := loadService(opts.ServicesPath, service)
+		if err != nil {
+			opts.console().Notice("Error loading service [%s]: %v", service.ServiceName, err)
+			opts.loadErrors.add(fmt.Errorf("loading service %s: %w", service.ServiceName, err))
+			continue
+		}
+		for j := range serviceTasks {
+			serviceTasks[j].key = taskKey(index, service.ServiceName, j, serviceTasks[j].Name)
+		}
+		services = append(services, inheritTags(serviceTasks, play.Tags, service.Tags))
+	}
+
+	// failedHosts collects the hosts of the current batch that failed and
+	// attempts what each host's current attempt at the play added to rec.
+	var (
+		failedMu    sync.Mutex
+		failedHosts map[string]bool
+		attempts    map[string]printer.HostSummary
+	)
+
+	// runHost runs service task lists on one host, stopping early under
+	// fail-fast once anything has failed.
+	runHost := func(h inventory.Host, out *printer.HostWriter, services ...[]Task) {
+		hostOpts := playOpts
+		hostOpts.out = out
+		for _, serviceTasks := range services {
+			if rec.unreachable(h.Address) {
+				return
+			}
+			sum := runHostTasks(h, serviceTasks, play.Handlers, hostOpts, hostVars(h))
+			rec.add(sum)
+			failedMu.Lock()
+			a := attempts[h.Address]
+			a.Host = sum.Host
+			a.Add(sum)
+			attempts[h.Address] = a
+			if sum.Failed > 0 {
+				failedHosts[h.Address] = true
+			}
+			failedMu.Unlock()
+			if rec.anyFailed() && opts.FailFast {
+				return
+			}
+		}
+	}
+
+	// Buffer per host when hosts run concurrently so each host's output is
+	// printed as one contiguous block.
+	buffered := playOpts.Forks > 1 && len(hosts) > 1
+	// The progress line tracks a single play, so it is not shown while
+	// plays run in parallel.
+	showProgress := !opts.ParallelPlays
+
+	// forEachHost runs fn on every host, at most playOpts.Forks at a time.
+	forEachHost := func(hosts []inventory.Host, fn func(h inventory.Host, out *printer.HostWriter)) {
+		sem := make(chan struct{}, playOpts.Forks)
+		var wg sync.WaitGroup
+		if showProgress {
+			opts.console().StartProgress(len(hosts))
+		}
+		for _, host := range hosts {
+			if opts.context().Err() != nil {
+				break
+			}
+			host := host
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(h inventory.Host) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				hostOut := out.Nested(buffered)
+				defer hostOut.Flush()
+				hostOut.HostHeader(h.Address)
+				fn(h, hostOut)
+				if showProgress {
+					opts.console().ProgressHostDone()
+				}
+			}(host)
+		}
+		wg.Wait()
+		if showProgress {
+			opts.console().StopProgress()
+		}
+	}
+
+	// runBatch runs the whole play on batch.
+	runBatch := func(batch []inventory.Host) {
+		if play.Strategy == StrategyFree {
+			// Every host works through all services on its own; nobody
+			// waits for slower hosts between services.
+			forEachHost(batch, func(h inventory.Host, out *printer.HostWriter) {
+				runHost(h, out, services...)
+			})
+			return
+		}
+		for _, serviceTasks := range services {
+			forEachHost(batch, func(h inventory.Host, out *printer.HostWriter) {
+				runHost(h, out, serviceTasks)
+			})
+			if (rec.anyFailed() && opts.FailFast) || opts.context().Err() != nil {
+				return
+			}
+		}
+	}
+
+	retries, delay := playRetries(play, opts)
+	for _, size := range sizes {
+		batch := hosts[:size]
+		hosts = hosts[size:]
+		failedHosts = make(map[string]bool)
+		attempts = make(map[string]printer.HostSummary)
+		mark := opts.failures.mark()
+		runBatch(batch)
+		for attempt := 1; attempt <= retries && len(failedHosts) > 0; attempt++ {
+			var retry []inventory.Host
+			for _, h := range batch {
+				if failedHosts[h.Address] {
+					retry = append(retry, h)
+					rec.discard(attempts[h.Address])
+					opts.failures.dropSince(h.Address, mark)
+				}
+			}
+			opts.console().Notice("Retrying play [%s] on %d failed hosts (%d/%d)", play.Name, len(retry), attempt, retries)
+			if !sleepContext(opts.context(), delay) {
+				break
+			}
+			failedHosts = make(map[string]bool)
+			attempts = make(map[string]printer.HostSummary)
+			mark = opts.failures.mark()
+			runBatch(retry)
+		}
+		limited := len(play.Serial) > 0 || play.MaxFailPercentage > 0
+		if limited && batchFailed(len(failedHosts), len(batch), play.MaxFailPercentage) {
+			opts.console().Notice("Aborting: %d of %d hosts in a batch of play [%s] failed", len(failedHosts), len(batch), play.Name)
+			rec.abort()
+			return
+		}
+		if err := runHealthCheck(play, batch, groupVars, playOpts, out); err != nil {
+			opts.console().Notice("Aborting: health check of play [%s] failed after a batch of %d hosts: %v", play.Name, len(batch), err)
+			opts.failures.add("localhost", "health check", err)
+			rec.abort()
+			return
+		}
+		if rec.stopped(opts.FailFast) || opts.context().Err() != nil {
+			return
+		}
+	}
+}
+
+// runPlaysParallel runs plays concurrently. A play waits for every earlier
+// play whose hosts overlap its own, so plays sharing hosts keep playbook
+// order while plays on disjoint hosts run side by side. Each play's output
+// is printed as one block when it finishes.
+func runPlaysParallel(playbook Playbook, inv *inventory.Inventory, opts RunOptions, rec *recap) {
+	hostSets := make([]map[string]bool, len(playbook))
+	for i, play := range playbook {
+		hostSets[i] = make(map[string]bool)
+		if opts.RunLocally {
+			hostSets[i]["localhost"] = true
+			continue
+		}
+		for _, h := range selectHosts(inv.Hosts[play.Hosts], opts) {
+			hostSets[i][h.Address] = true
+		}
+	}
+
+	done := make([]chan struct{}, len(playbook))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for i, play := range playbook {
+		wg.Add(1)
+		go func(i int, play Play) {
+			defer wg.Done()
+			defer close(done[i])
+			for j := 0; j < i; j++ {
+				if overlaps(hostSets[i], hostSets[j]) {
+					<-done[j]
+				}
+			}
+			if rec.stopped(opts.FailFast) {
+				return
+			}
+			out := opts.console().NewHostWriter(true)
+			defer out.Flush()
+			runPlay(play, i, inv, opts, rec, out)
+		}(i, play)
+	}
+	wg.Wait()
+}
+
+func overlaps(a, b map[string]bool) bool {
+	for h := range a {
+		if b[h] {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRetryFile writes one failed host per line to path, sorted, or removes a
+// stale retry file when nothing failed.
+func writeRetryFile(path string, failedHosts []string) error {
+	if len(failedHosts) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	sort.Strings(failedHosts)
+	return os.WriteFile(path, []byte(strings.Join(failedHosts, "\n")+"\n"), 0o644)
+}
+
+// ParseAdHocCommands turns a -t argument into the commands to run: the
+// argument itself, or for "@file" one command per line of file (blank lines
+// and # comments are skipped, as in inventory files).
+func ParseAdHocCommands(arg string) ([]string, error) {
+	if !strings.HasPrefix(arg, "@") {
+		return []string{arg}, nil
+	}
+	file := strings.TrimPrefix(arg, "@")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading command file: %w", err)
+	}
+	var commands []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("command file %s has no commands", file)
+	}
+	return commands, nil
+}
+
+// RunAdHocCommand runs a single command against all hosts in a group.
+func RunAdHocCommand(inv *inventory.Inventory, group, command string, opts RunOptions) error {
+	_, err := runAdHoc(inv, group, []string{command}, false, opts)
+	return err
+}
+
+// RunAdHocCommands runs commands in order on each host in a group, each
+// reported as its own task. Commands are templates expanded with the
+// group's and host's inventory vars and inventory_hostname. A failed
+// command stops the host's remaining commands only under FailFast.
+func RunAdHocCommands(inv *inventory.Inventory, group string, commands []string, opts RunOptions) error {
+	_, err := runAdHoc(inv, group, commands, true, opts)
+	return err
+}
+
+func runAdHoc(inv *inventory.Inventory, group string, commands []string, templated bool, opts RunOptions) (result Result, err error) {
+	hosts, ok := inv.Hosts[group]
+	if !ok {
+		return Result{}, fmt.Errorf("no hosts found for group: %s", group)
+	}
+	hosts = selectHosts(hosts, opts)
+	if len(hosts) == 0 {
+		return Result{}, fmt.Errorf("no hosts in group %s matched the limit or slice", group)
+	}
+	for _, expr := range []string{opts.AdHocChangedWhen, opts.AdHocFailedWhen} {
+		if _, err := template.New("").Funcs(templateFuncs).Parse(expr); err != nil {
+			return Result{}, fmt.Errorf("invalid ad hoc condition %q: %w", expr, err)
+		}
+	}
+	if opts.Forks <= 0 {
+		opts.Forks = 5
+	}
+	if opts.RunTimeout > 0 {
+		ctx, cancel := context.WithTimeout(opts.context(), opts.RunTimeout)
+		defer cancel()
+		opts.Context = ctx
+	}
+	if err := runPreRunHook(opts, group, len(hosts)); err != nil {
+		return Result{}, err
+	}
+	defer func() { runPostRunHook(opts, group, result, err) }()
+
+	addresses := make([]string, len(hosts))
+	for i, h := range hosts {
+		addresses[i] = h.Address
+	}
+	rec := newHostRecap(addresses)
+	failures := &failureLog{}
+	opts.limitConnects()
+	opts.invVars = inventoryVars(inv)
+	opts.play = "ad hoc"
+	opts.report = &runReport{}
+	sem := make(chan struct{}, opts.Forks)
+	var wg sync.WaitGroup
+	buffered := opts.Forks > 1 && len(hosts) > 1
+	opts.console().StartProgress(len(hosts))
+
+	for _, host := range hosts {
+		host := host
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(h inventory.Host) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			out := opts.console().NewHostWriter(buffered)
+			defer out.Flush()
+
+			var vars map[string]interface{}
+			if templated {
+				vars = mergeVars(inv.GroupVars[group], h.Vars)
+				vars[VarInventoryHostname] = h.Address
+				vars[VarGroups] = groupHosts(inv)
+				vars[VarHostVars] = hostVars(opts)
+			}
+			hostOpts := opts
+			hostOpts.out = out
+			summary := printer.HostSummary{Host: h.Address}
+			defer func() { rec.add(summary) }()
+			for i, command := range commands {
+				if opts.context().Err() != nil {
+					break
+				}
+				out.TaskHeader("ad hoc: " + command)
+				out.HostHeader(h.Address)
+				task := Task{Name: "ad hoc", Shell: command, key: fmt.Sprintf("ad hoc/%d", i+1)}
+				start := time.Now()
+				res, err := executeTask(task, h, hostOpts, vars)
+				if !opts.unreachable(err) {
+					res, err = classifyAdHoc(res, err, vars, opts)
+				}
+				opts.taskResult(h.Address, task, res, err, time.Since(start))
+				if opts.unreachable(err) {
+					out.Unreachable(h.Address, err)
+					summary.Record(printer.StatusUnreachable)
+					break
+				}
+				if err != nil {
+					out.Failed(h.Address, err)
+					summary.Record(printer.StatusFailed)
+					failures.add(h.Address, command, err)
+					if opts.FailFast {
+						break
+					}
+					continue
+				}
+				shown := printer.Truncate(res.Output, opts.MaxOutputBytes)
+				if res.Streamed {
+					shown = ""
+				}
+				if res.Changed {
+					out.Changed(h.Address, shown)
+					summary.Record(printer.StatusChanged)
+					continue
+				}
+				out.OK(h.Address, shown)
+				summary.Record(printer.StatusOK)
+			}
+			opts.console().ProgressHostDone()
+		}(host)
+	}
+	wg.Wait()
+	opts.console().StopProgress()
+
+	summaries, failed := rec.snapshot()
+	result = Result{Hosts: summaries, Failures: failures.list(), Failed: failed, Plays: opts.report.list(rec.rank)}
+	if opts.ResultFile != "" {
+		if err := writeResultFile(opts.ResultFile, result); err != nil {
+			opts.console().Notice("Warning: could not write result file: %v", err)
+		}
+	}
+	if opts.RunTimeout > 0 && errors.Is(opts.context().Err(), context.DeadlineExceeded) {
+		return result, ErrRunTimedOut
+	}
+	if failed && rec.allFailed() {
+		return result, utils.Mark(errors.New("ad hoc command failed on every host"), ErrAllHostsFailed)
+	}
+	if failed {
+		return result, utils.Mark(errors.New("ad hoc command failed on one or more hosts"), ErrTaskFailed)
+	}
+	if err := opts.unreachableErr(rec); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// classifyAdHoc applies opts.AdHocChangedWhen and AdHocFailedWhen to the
+// result of an ad hoc command. Without AdHocChangedWhen a command is never
+// changed, so plain ad hoc runs report ok as before. A condition that fails
+// to evaluate, e.g. comparing an unset var, fails the command.
+func classifyAdHoc(res TaskResult, err error, vars map[string]interface{}, opts RunOptions) (TaskResult, error) {
+	localVars := mergeVars(vars, map[string]interface{}{"output": res.Output, "rc": res.RC})
+	res.Changed = false
+	if opts.AdHocFailedWhen != "" {
+		result, evalErr := expandVars(opts.AdHocFailedWhen, localVars)
+		if evalErr != nil {
+			res.Failed = true
+			return res, fmt.Errorf("evaluating --failed-when %q: %w", opts.AdHocFailedWhen, evalErr)
+		}
+		res.Failed = truthy(result)
+		switch {
+		case res.Failed && err == nil:
+			err = fmt.Errorf("--failed-when %q holds", opts.AdHocFailedWhen)
+		case !res.Failed:
+			err = nil
+		}
+	}
+	if !res.Failed && opts.AdHocChangedWhen != "" {
+		result, evalErr := expandVars(opts.AdHocChangedWhen, localVars)
+		if evalErr != nil {
+			res.Failed = true
+			return res, fmt.Errorf("evaluating --changed-when %q: %w", opts.AdHocChangedWhen, evalErr)
+		}
+		res.Changed = truthy(result)
+	}
+	return res, err
+}
+
+// RunLocalAdHocCommand runs a single command locally, as an ad hoc run on
+// localhost with opts, so RunTimeout, MaxOutputBytes, Stream and the other
+// run options apply as they do on remote hosts.
+func RunLocalAdHocCommand(command string, opts RunOptions) error {
+	opts.RunLocally = true
+	_, err := runAdHoc(LocalInventory(), LocalGroup, []string{command}, false, opts)
+	return err
+}
+
+// LocalGroup is the only group of LocalInventory.
+const LocalGroup = "localhost"
+
+// LocalInventory returns an inventory holding just localhost, for ad hoc
+// runs with RunOptions.RunLocally.
+func LocalInventory() *inventory.Inventory {
+	return &inventory.Inventory{Hosts: map[string][]inventory.Host{LocalGroup: {{Address: "localhost"}}}}
 }
 
 // ---------------------------------------------------------------------------
 // Local execution helpers
 // ---------------------------------------------------------------------------
 
-func runLocalCommandOutput(command string) (string, error) {
-	cmd := exec.Command("sh", "-c", command)
+// localWaitDelay bounds how long a cancelled local command's output is
+// waited for: a child of sh, e.g. sleep, keeps its pipes open after sh is
+// killed.
+const localWaitDelay = time.Second
+
+// localCommand is exec.CommandContext for a command run on the control
+// host, returning soon after ctx is done even if children outlive it.
+func localCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = localWaitDelay
+	return cmd
+}
+
+func runLocalCommandOutput(ctx context.Context, command string) (string, error) {
+	cmd := localCommand(ctx, "sh", "-c", command)
 	out, err := cmd.CombinedOutput()
 	return string(out), err
 }
 
-func runLocalScriptOutput(scriptPath string) (string, error) {
-	cmd := exec.Command("sh", scriptPath)
+func runLocalScriptOutput(ctx context.Context, scriptPath string) (string, error) {
+	cmd := localCommand(ctx, "sh", scriptPath)
 	out, err := cmd.CombinedOutput()
 	return string(out), err
 }
 
-func runRemoteScript(host, scriptPath string, cfg ssh.Config) (string, error) {
-	script, err := os.ReadFile(scriptPath)
+// copyFile runs a copy task on conn, validating the staged file first when
+// the task has a validate command.
+func copyFile(conn Connector, task *CopyTask, vars map[string]interface{}) error {
+	if task.Validate == "" {
+		return conn.CopyFile(task.Src, task.Dest)
+	}
+	validate, err := expandVars(task.Validate, vars)
+	if err != nil {
+		return fmt.Errorf("template: %w", err)
+	}
+	if !strings.Contains(validate, "%s") {
+		return fmt.Errorf("validate %q must contain %%s for the path of the file to check", validate)
+	}
+	copier, ok := conn.(ValidatingCopier)
+	if !ok {
+		return errors.New("validate is not supported by this connection")
+	}
+	return copier.CopyFileValidated(task.Src, task.Dest, validate)
+}
+
+// backupTime is the clock used to name backups; replaced in tests.
+var backupTime = time.Now
+
+// backupDest compares c.Dest on the target with c.Src. When they differ and
+// Dest exists, it is copied to <dest>.<timestamp>.bak, whose path is
+// returned. changed is false when Dest already matches Src. Only a missing
+// Dest goes without a backup; any other failure to read it is an error, so
+// the copy does not overwrite what it could not back up.
+func backupDest(conn Connector, c *CopyTask) (backup string, changed bool, err error) {
+	desired, err := os.ReadFile(c.Src)
+	if err != nil {
+		return "", false, fmt.Errorf("reading %s: %w", c.Src, err)
+	}
+	if out, err := conn.RunCommand("test -e " + utils.ShellQuote(c.Dest)); err != nil {
+		if exitedWith(err, 1) {
+			// Nothing to back up yet.
+			return "", true, nil
+		}
+		return "", false, fmt.Errorf("checking %s for a backup: %w", c.Dest, withOutput(err, out))
+	}
+	current, err := readRemoteFile(conn, c.Dest)
+	if err != nil {
+		return "", false, fmt.Errorf("reading %s for a backup: %w", c.Dest, withOutput(err, current))
+	}
+	if current == string(desired) {
+		return "", false, nil
+	}
+	backup = c.Dest + "." + backupTime().Format("20060102T150405") + ".bak"
+	if out, err := conn.RunCommand("cp -p " + utils.ShellQuote(c.Dest) + " " + utils.ShellQuote(backup)); err != nil {
+		return "", false, fmt.Errorf("backing up %s: %w", c.Dest, withOutput(err, out))
+	}
+	return backup, true, nil
+}
+
+// validateCommand substitutes the quoted path for %s in validate.
+func validateCommand(validate, path string) string {
+	return strings.ReplaceAll(validate, "%s", utils.ShellQuote(path))
+}
+
+// validateError reports a failed validate command; dest was not touched.
+func validateError(command, dest string, err error, out string) error {
+	return fmt.Errorf("validation failed, %s left unchanged: %s: %w", dest, command, withOutput(err, out))
+}
+
+// copyLocalValidated copies src to a temporary file next to dest, runs
+// validate against it and renames it over dest only if that succeeds.
+func copyLocalValidated(ctx context.Context, src, dest, validate string) error {
+	data, err := os.ReadFile(src)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("reading %s: %w", src, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".for-validate-*")
+	if err != nil {
+		return fmt.Errorf("staging %s: %w", dest, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(dest); err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("checking %s: %w", dest, err)
 	}
-	return ssh.RunCommandOutput(host, string(script), cfg)
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	command := validateCommand(validate, tmp.Name())
+	if out, err := runLocalCommandOutput(ctx, command); err != nil {
+		return validateError(command, dest, err, out)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("writing %s: %w", dest, err)
+	}
+	return nil
 }
 
 func copyLocal(src, dest string) error {
@@ -745,6 +3214,5 @@ func copyLocal(src, dest string) error {
 	if err := os.WriteFile(dest, data, 0o644); err != nil {
 		return fmt.Errorf("writing %s: %w", dest, err)
 	}
-	fmt.Printf("Copied %s -> %s\n", src, dest)
 	return nil
 }
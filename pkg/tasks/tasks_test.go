@@ -1,7 +1,21 @@
 package tasks
 
 import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"for/pkg/facts"
+	"for/pkg/inventory"
+	"for/pkg/printer"
+	"for/pkg/ssh"
 )
 
 func TestMatchesTags_NoFilter(t *testing.T) {
@@ -46,6 +60,63 @@ func TestMatchesTags_NoTagsWithFilter(t *testing.T) {
 	}
 }
 
+func TestMatchesTags_AllSelector(t *testing.T) {
+	if !matchesTags(nil, []string{TagAll}, nil) {
+		t.Error("expected 'all' to select an untagged task")
+	}
+	if !matchesTags([]string{"deploy"}, []string{TagAll}, nil) {
+		t.Error("expected 'all' to select a tagged task")
+	}
+	if matchesTags([]string{"deploy"}, []string{TagAll}, []string{"deploy"}) {
+		t.Error("expected skip-tags to still apply with 'all'")
+	}
+}
+
+func TestMatchesTags_TaggedSelector(t *testing.T) {
+	if !matchesTags([]string{"deploy"}, []string{TagTagged}, nil) {
+		t.Error("expected 'tagged' to select a tagged task")
+	}
+	if matchesTags(nil, []string{TagTagged}, nil) {
+		t.Error("expected 'tagged' to skip an untagged task")
+	}
+}
+
+func TestMatchesTags_Never(t *testing.T) {
+	if matchesTags([]string{TagNever}, nil, nil) {
+		t.Error("expected 'never' to be skipped with no filter")
+	}
+	if matchesTags([]string{TagNever, "reset"}, []string{TagAll}, nil) {
+		t.Error("expected 'all' not to select a 'never' task")
+	}
+	if matchesTags([]string{TagNever, "reset"}, []string{TagTagged}, nil) {
+		t.Error("expected 'tagged' not to select a 'never' task")
+	}
+	if !matchesTags([]string{TagNever, "reset"}, []string{TagNever}, nil) {
+		t.Error("expected '--tags never' to select a 'never' task")
+	}
+	if !matchesTags([]string{TagNever, "reset"}, []string{"reset"}, nil) {
+		t.Error("expected the task's own tag to select a 'never' task")
+	}
+	if matchesTags([]string{TagNever, "reset"}, []string{"reset"}, []string{"reset"}) {
+		t.Error("expected skip-tags to win over an explicit request")
+	}
+}
+
+func TestMatchesTags_Always(t *testing.T) {
+	if !matchesTags([]string{TagAlways}, []string{"deploy"}, nil) {
+		t.Error("expected 'always' to run despite a mismatched filter")
+	}
+	if !matchesTags([]string{TagAlways, TagNever}, nil, nil) {
+		t.Error("expected 'always' to take precedence over 'never'")
+	}
+	if matchesTags([]string{TagAlways}, []string{"deploy"}, []string{TagAlways}) {
+		t.Error("expected '--skip-tags always' to skip an 'always' task")
+	}
+	if matchesTags([]string{TagAlways, "setup"}, nil, []string{"setup"}) {
+		t.Error("expected skip-tags on another tag to skip an 'always' task")
+	}
+}
+
 func TestExpandVars_Basic(t *testing.T) {
 	result, err := expandVars("echo {{.version}}", map[string]interface{}{"version": "1.2.3"})
 	if err != nil {
@@ -76,6 +147,16 @@ func TestExpandVars_EmptyString(t *testing.T) {
 	}
 }
 
+func TestExpandVars_QuoteFunc(t *testing.T) {
+	result, err := expandVars("rm -f {{ .path | quote }}", map[string]interface{}{"path": "/tmp/a b; rm -rf /"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result != "rm -f '/tmp/a b; rm -rf /'" {
+		t.Errorf("expected quoted path, got %q", result)
+	}
+}
+
 func TestMergeVars(t *testing.T) {
 	a := map[string]interface{}{"x": "1", "y": "original"}
 	b := map[string]interface{}{"y": "override", "z": "3"}
@@ -90,3 +171,2186 @@ func TestMergeVars(t *testing.T) {
 		t.Errorf("expected z=3, got %v", merged["z"])
 	}
 }
+
+// writeService creates services/<name>/tasks/main.yaml under dir.
+func writeService(t *testing.T, dir, name, content string) {
+	t.Helper()
+	taskDir := filepath.Join(dir, name, "tasks")
+	if err := os.MkdirAll(taskDir, 0o755); err != nil {
+		t.Fatalf("creating service dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(taskDir, "main.yaml"), []byte(content), 0o644); err != nil {
+		t.Fatalf("writing service tasks: %v", err)
+	}
+}
+
+// stubFailingHosts routes ssh tasks to a connector that fails on the given hosts
+// and records which hosts ran anything.
+func stubFailingHosts(t *testing.T, failing ...string) *[]string {
+	t.Helper()
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	fail := make(map[string]bool)
+	for _, h := range failing {
+		fail[h] = true
+	}
+	stubSSH(t, func(host, _ string) (string, error) {
+		mu.Lock()
+		ran = append(ran, host)
+		mu.Unlock()
+		if fail[host] {
+			return "", errors.New("exit status 1")
+		}
+		return "ok", nil
+	})
+	return &ran
+}
+
+// funcConnector adapts a function to the Connector interface.
+type funcConnector func(command string) (string, error)
+
+func (f funcConnector) RunCommand(command string) (string, error) { return f(command) }
+func (f funcConnector) CopyFile(src, dest string) error {
+	_, err := f("copy " + src + " " + dest)
+	return err
+}
+
+func TestRunPlaybook_RecapInDefinitionOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	stubConnection(t, ConnectionSSH, "ok")
+	invPath := filepath.Join(dir, "hosts")
+	os.WriteFile(invPath, []byte("[web]\nweb-c\nweb-a\nweb-b\n\n[db]\ndb-2\nweb-a\ndb-1\n"), 0o644)
+	inv, err := inventory.LoadInventory(invPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb := Playbook{
+		{Name: "web", Hosts: "web", Services: []Service{{ServiceName: "app"}}},
+		{Name: "db", Hosts: "db", Services: []Service{{ServiceName: "app"}}},
+	}
+	prevTerminal := printer.Terminal
+	printer.Terminal = false
+	t.Cleanup(func() { printer.Terminal = prevTerminal })
+
+	want := []string{"web-c", "web-a", "web-b", "db-2", "db-1"}
+	for run := 0; run < 10; run++ {
+		var out bytes.Buffer
+		prevOut := printer.SetOutput(&out)
+		err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Forks: 5, ParallelPlays: run%2 == 1})
+		printer.SetOutput(prevOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recap := out.String()[strings.Index(out.String(), "PLAY RECAP"):]
+		var got []string
+		for _, line := range strings.Split(recap, "\n")[1:] {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				got = append(got, fields[0])
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("run %d: expected recap order %v, got %v", run, want, got)
+		}
+	}
+}
+
+func TestRunPlaybook_RenderOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: release name
+  set_fact:
+    release: "{{ .app }}-{{ .version }}"
+- name: deploy
+  command: deploy {{ .release }} --env {{ .env }}
+- name: broken
+  command: echo {{ .env
+- name: config
+  copy:
+    src: files/app.conf
+    dest: /etc/app.conf
+    validate: app --check {{ .env }} %s
+- name: only on prod
+  command: never
+  when: "{{ eq .env \"prod\" }}"
+`)
+	commands := stubConnection(t, ConnectionSSH, "ok")
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+	prevColors := printer.ColorsEnabled
+	printer.ColorsEnabled = false
+	t.Cleanup(func() { printer.ColorsEnabled = prevColors })
+
+	// Host vars win over group vars, which win over play vars.
+	inv := &inventory.Inventory{
+		Hosts:     map[string][]inventory.Host{"web": {{Address: "w1", Vars: map[string]interface{}{"env": "staging"}}}},
+		GroupVars: map[string]map[string]interface{}{"web": {"env": "prod", "version": "1.0"}},
+	}
+	pb := Playbook{{Name: "site", Hosts: "web", Vars: map[string]interface{}{"app": "shop", "version": "2.0"}, Services: []Service{{ServiceName: "app"}}}}
+	retry := filepath.Join(dir, "site.retry")
+	err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, RenderOnly: true, FailFast: true, RetryFile: retry, StateFile: filepath.Join(dir, "site.state.json")})
+	if err == nil {
+		t.Fatal("expected the template error to fail the run")
+	}
+	if len(*commands) != 0 {
+		t.Errorf("expected nothing to run, got %q", *commands)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"rendered:\n    deploy shop-1.0 --env staging\n",
+		"template: ",
+		"rendered:\n    COPY files/app.conf -> /etc/app.conf\n    VALIDATE app --check staging %s\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "never") {
+		t.Errorf("expected the when-skipped task not to be rendered:\n%s", got)
+	}
+	for _, file := range []string{retry, filepath.Join(dir, "site.state.json")} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be written, got %v", file, err)
+		}
+	}
+}
+
+func TestRunHostTasks_TaskVars(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "ok")
+	tasks := []Task{
+		{
+			Name:    "probe",
+			Command: "curl {{ .url }} --retry {{ .retries }}",
+			When:    Conditions{"{{ .enabled }}"},
+			Vars:    map[string]interface{}{"url": "http://{{ .host }}:8080", "retries": 3, "enabled": true, "env": "task"},
+		},
+		{Name: "later", Command: "echo {{ if .url }}{{ .url }}{{ else }}unset{{ end }} {{ .env }}"},
+		{Name: "gated", Command: "never", When: Conditions{"{{ if .enabled }}true{{ end }}"}},
+	}
+	vars := map[string]interface{}{"host": "w1.example", "env": "prod"}
+
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{}, vars)
+	want := []string{"curl http://w1.example:8080 --retry 3", "echo unset prod"}
+	if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %q, got %q", want, *commands)
+	}
+	if sum.Skipped != 1 {
+		t.Errorf("expected the task gated on another task's var to be skipped, got %+v", sum)
+	}
+	for _, name := range []string{"url", "retries", "enabled"} {
+		if _, ok := vars[name]; ok {
+			t.Errorf("expected task var %s to be dropped after the task, got %v", name, vars)
+		}
+	}
+	if vars["env"] != "prod" {
+		t.Errorf("expected the overridden var to be restored, got %v", vars["env"])
+	}
+}
+
+func TestRunPlaybook_WritesRetryFile(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	stubFailingHosts(t, "b", "c")
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "a"}, {Address: "c"}, {Address: "b"}},
+	}}
+	pb := Playbook{{Name: "deploy", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	retry := filepath.Join(dir, "site.retry")
+
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, RetryFile: retry}); err == nil {
+		t.Fatal("expected playbook error for failed hosts")
+	}
+	data, err := os.ReadFile(retry)
+	if err != nil {
+		t.Fatalf("reading retry file: %v", err)
+	}
+	if string(data) != "b\nc\n" {
+		t.Errorf("expected retry file to list b and c, got %q", data)
+	}
+}
+
+func TestRunPlaybook_SuccessRemovesRetryFile(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	stubFailingHosts(t)
+
+	retry := filepath.Join(dir, "site.retry")
+	if err := os.WriteFile(retry, []byte("stale\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "a"}}}}
+	pb := Playbook{{Name: "deploy", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, RetryFile: retry}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(retry); !os.IsNotExist(err) {
+		t.Error("expected stale retry file to be removed")
+	}
+}
+
+func TestRunPlaybook_LimitFromRetryFile(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	ran := stubFailingHosts(t)
+
+	retry := filepath.Join(dir, "site.retry")
+	if err := os.WriteFile(retry, []byte("b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	limit, err := inventory.ParseLimit("@" + retry)
+	if err != nil {
+		t.Fatalf("ParseLimit: %v", err)
+	}
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "a"}, {Address: "b"}, {Address: "c"}},
+	}}
+	pb := Playbook{{Name: "deploy", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Limit: limit}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*ran) != 1 || (*ran)[0] != "b" {
+		t.Errorf("expected only host b to run, got %v", *ran)
+	}
+}
+
+func TestListTags(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "nginx", "- name: install\n  command: apt-get install nginx\n  tags: [setup, nginx]\n- name: reload\n  command: nginx -s reload\n")
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n  tags: [deploy, setup]\n")
+
+	pb := Playbook{
+		{Name: "web", Tags: []string{"web"}, Services: []Service{{ServiceName: "nginx"}, {ServiceName: "app"}}},
+		{Name: "db", Services: []Service{{ServiceName: "app"}}},
+	}
+	got, err := ListTags(pb, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []PlayTags{
+		{Play: "web", Tags: []string{"deploy", "nginx", "setup", "web"}},
+		{Play: "db", Tags: []string{"deploy", "setup"}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d plays, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Play != want[i].Play || strings.Join(got[i].Tags, ",") != strings.Join(want[i].Tags, ",") {
+			t.Errorf("play %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestListPlayHosts(t *testing.T) {
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "w1"}, {Address: "w2"}, {Address: "w3"}},
+		"db":  {{Address: "d1"}},
+	}}
+	pb := Playbook{
+		{Name: "frontend", Hosts: "web"},
+		{Name: "database", Hosts: "db"},
+		{Name: "cache", Hosts: "redis"},
+	}
+
+	var got []string
+	for _, ph := range ListPlayHosts(pb, inv, RunOptions{}) {
+		got = append(got, ph.String())
+	}
+	want := []string{
+		"PLAY [frontend] -> [w1, w2, w3]",
+		"PLAY [database] -> [d1]",
+		`PLAY [cache] -> [] WARNING: "redis" matches no hosts`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	got = nil
+	for _, ph := range ListPlayHosts(pb, inv, RunOptions{Limit: []string{"w1", "w3"}, Slice: inventory.Slice{Index: 2, Count: 2}}) {
+		got = append(got, ph.String())
+	}
+	want = []string{
+		"PLAY [frontend] -> [w3]",
+		`PLAY [database] -> [] WARNING: "db" matches no hosts`,
+		`PLAY [cache] -> [] WARNING: "redis" matches no hosts`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("with limit and slice got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestListHosts(t *testing.T) {
+	inv := &inventory.Inventory{
+		Hosts: map[string][]inventory.Host{
+			"web":  {{Address: "w1", Vars: map[string]interface{}{"port": "8080"}}, {Address: "w2"}},
+			"db":   {{Address: "d1"}, {Address: "w2"}},
+			"prod": {{Address: "w1"}, {Address: "w2"}, {Address: "d1"}},
+		},
+		GroupVars: map[string]map[string]interface{}{"prod": {"env": "prod"}, "web": {"port": "80"}},
+		Children:  map[string][]string{"prod": {"web", "db"}},
+	}
+
+	got := ListHosts([]string{"web", "db", "cache"}, inv, RunOptions{Limit: []string{"w2", "d1"}})
+	want := []inventory.HostInfo{
+		{Host: "w2", Groups: []string{"db", "prod", "web"}, Vars: map[string]interface{}{"env": "prod", "port": "80"}},
+		{Host: "d1", Groups: []string{"db", "prod"}, Vars: map[string]interface{}{"env": "prod"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	got = ListHosts([]string{"web"}, inv, RunOptions{})
+	if len(got) != 2 || got[0].Host != "w1" || got[0].Vars["port"] != "8080" {
+		t.Errorf("expected host vars over group vars, got %+v", got)
+	}
+
+	got = ListHosts([]string{"web"}, nil, RunOptions{RunLocally: true})
+	if len(got) != 1 || got[0].Host != "localhost" || len(got[0].Groups) != 0 {
+		t.Errorf("expected only localhost for a local run, got %+v", got)
+	}
+}
+
+func TestRunPlaybook_PlayTagsSkipWholesale(t *testing.T) {
+	dir := t.TempDir()
+	ran := stubFailingHosts(t)
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "a"}}}}
+	// The service does not exist on disk: a skipped play must not try to load it.
+	pb := Playbook{{Name: "db", Hosts: "web", Tags: []string{"db"}, Services: []Service{{ServiceName: "missing"}}}}
+
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Tags: []string{"web"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*ran) != 0 {
+		t.Errorf("expected no tasks to run, got %v", *ran)
+	}
+}
+
+func TestRunPlaybook_ServiceTagsSkipWholesale(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy-app\n")
+	ran := stubFailingHosts(t)
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "a"}}}}
+	pb := Playbook{{Name: "site", Hosts: "web", Services: []Service{
+		{ServiceName: "missing", Tags: []string{"db"}},
+		{ServiceName: "app", Tags: []string{"deploy"}},
+	}}}
+
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Tags: []string{"deploy"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*ran) != 1 {
+		t.Errorf("expected only the deploy service task to run, got %v", *ran)
+	}
+}
+
+func TestInheritTags_TaskOrPlayMatch(t *testing.T) {
+	tasks := inheritTags([]Task{{Name: "untagged"}, {Name: "own", Tags: []string{"config"}}}, []string{"deploy"}, nil)
+
+	if !matchesTags(tasks[0].Tags, []string{"deploy"}, nil) {
+		t.Error("expected untagged task to match via inherited play tag")
+	}
+	if !matchesTags(tasks[1].Tags, []string{"config"}, nil) {
+		t.Error("expected task to match on its own tag")
+	}
+	if !matchesTags(tasks[1].Tags, []string{"deploy"}, nil) {
+		t.Error("expected tagged task to also match the inherited play tag")
+	}
+	if matchesTags(tasks[1].Tags, []string{"other"}, nil) {
+		t.Error("expected no match for an unrelated tag")
+	}
+}
+
+func TestCheckDrift_ChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "desired.conf")
+	dest := filepath.Join(dir, "live.conf")
+	os.WriteFile(src, []byte("port=8080\n"), 0o644)
+	os.WriteFile(dest, []byte("port=80\n"), 0o644)
+
+	task := Task{Name: "config", Copy: &CopyTask{Src: src, Dest: dest}}
+	res, err := runOnce(inventory.Host{Address: "localhost"}, task, RunOptions{RunLocally: true, DriftCheck: true}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.Changed {
+		t.Error("expected drift to be reported as changed")
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "port=80\n" {
+		t.Errorf("drift check must not modify the target, got %q", data)
+	}
+}
+
+func TestCheckDrift_MatchingFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "desired.conf")
+	dest := filepath.Join(dir, "live.conf")
+	os.WriteFile(src, []byte("port=8080\n"), 0o644)
+	os.WriteFile(dest, []byte("port=8080\n"), 0o644)
+
+	task := Task{Name: "config", Copy: &CopyTask{Src: src, Dest: dest}}
+	res, err := runOnce(inventory.Host{Address: "localhost"}, task, RunOptions{RunLocally: true, DriftCheck: true}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Changed {
+		t.Error("expected no drift for matching file")
+	}
+}
+
+func TestCheckDrift_UnreadableFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "desired.conf")
+	os.WriteFile(src, []byte("port=8080\n"), 0o644)
+
+	// A directory exists but cat cannot read it.
+	task := Task{Name: "config", Copy: &CopyTask{Src: src, Dest: dir}}
+	res, err := runOnce(inventory.Host{Address: "localhost"}, task, RunOptions{RunLocally: true, DriftCheck: true}, nil)
+	if err == nil || !res.Failed {
+		t.Fatalf("expected a read failure to fail the check, got %+v, %v", res, err)
+	}
+	if !strings.Contains(err.Error(), "reading "+dir) {
+		t.Errorf("expected the error to name the unread file, got %v", err)
+	}
+}
+
+func TestRunPlaybook_DriftCheckReturnsErrDrift(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "desired.conf")
+	dest := filepath.Join(dir, "live.conf")
+	os.WriteFile(src, []byte("a\n"), 0o644)
+	os.WriteFile(dest, []byte("b\n"), 0o644)
+	writeService(t, dir, "cfg", "- name: config\n  copy:\n    src: "+src+"\n    dest: "+dest+"\n- name: restart\n  shell: exit 1\n")
+
+	pb := Playbook{{Name: "drift", Services: []Service{{ServiceName: "cfg"}}}}
+	err := RunPlaybook(pb, nil, RunOptions{RunLocally: true, ServicesPath: dir, DriftCheck: true})
+	if !errors.Is(err, ErrDriftDetected) {
+		t.Errorf("expected ErrDriftDetected, got %v", err)
+	}
+}
+
+func TestLoadTasks_UnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playbook.yaml")
+	os.WriteFile(path, []byte("- name: web\n  hosts: web\n  servces:\n    - service: nginx\n"), 0o644)
+	_, err := LoadTasks(path)
+	if err == nil || !strings.Contains(err.Error(), "servces") || !strings.Contains(err.Error(), path) {
+		t.Errorf("expected unknown key error naming file and key, got %v", err)
+	}
+}
+
+func TestLoadTasks_MalformedShape(t *testing.T) {
+	cases := map[string]string{
+		"name: web\nhosts: web\n":                                      ":1:1: playbook must be a list of plays, got a mapping",
+		"- name: web\n  services:\n    - service: nginx\n":             ":1:3: play 1 is missing \"hosts\"",
+		"- hosts: web\n- just a string\n":                              ":2:3: play 2 must be a mapping",
+		"- hosts: web\n  services: nginx\n":                            ":2:13: services of play 1 must be a list, got the value \"nginx\"",
+		"- hosts: web\n  services:\n    - nginx\n":                     ":3:7: each service of play 1 must be a mapping",
+		"- hosts: web\n  strategy: fastest\n":                          ":2:13: play 1 has unknown strategy \"fastest\"",
+		"- hosts: web\n  gather_subset: [min, virtual]\n":              ":2:18: play 1 has an unknown fact subset \"virtual\"",
+		"- hosts: web\n  gather_subset: min\n":                         ":2:18: play 1 has an invalid gather_subset",
+		"- hosts: web\n  services:\n    - service: nginx\n   bad: 1\n": ":3: did not find expected key",
+	}
+	for content, want := range cases {
+		path := filepath.Join(t.TempDir(), "playbook.yaml")
+		os.WriteFile(path, []byte(content), 0o644)
+		_, err := LoadTasks(path)
+		if err == nil || !strings.Contains(err.Error(), path+want) {
+			t.Errorf("%q: expected error containing %q, got %v", content, path+want, err)
+		}
+	}
+}
+
+func TestLoadTasks_AnchorsAndMergeKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playbook.yaml")
+	os.WriteFile(path, []byte(`- &base
+  name: web
+  hosts: web
+  become: true
+  vars: &common
+    env: prod
+    region: eu
+  services: &stack
+    - service: nginx
+    - service: app
+      tags: [deploy]
+- <<: *base
+  name: canary
+  hosts: canary
+  vars:
+    <<: *common
+    env: canary
+- name: batch
+  hosts: workers
+  services: *stack
+`), 0o644)
+	pb, err := LoadTasks(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pb) != 3 {
+		t.Fatalf("expected 3 plays, got %d", len(pb))
+	}
+	canary := pb[1]
+	if canary.Name != "canary" || canary.Hosts != "canary" || canary.Become == nil || !*canary.Become {
+		t.Errorf("expected the canary play to override name and hosts and inherit become, got %+v", canary)
+	}
+	if canary.Vars["env"] != "canary" || canary.Vars["region"] != "eu" {
+		t.Errorf("expected merged vars with env overridden, got %v", canary.Vars)
+	}
+	if pb[0].Vars["env"] != "prod" {
+		t.Errorf("expected the anchored vars to be unchanged, got %v", pb[0].Vars)
+	}
+	for _, play := range pb {
+		if len(play.Services) != 2 || play.Services[0].ServiceName != "nginx" || play.Services[1].ServiceName != "app" || play.Services[1].Tags[0] != "deploy" {
+			t.Errorf("play %s: expected the shared service set, got %+v", play.Name, play.Services)
+		}
+	}
+
+	path = filepath.Join(t.TempDir(), "playbook.yaml")
+	os.WriteFile(path, []byte("- &base\n  hosts: web\n- <<: *base\n  servces: []\n"), 0o644)
+	if _, err := LoadTasks(path); err == nil || !strings.Contains(err.Error(), "servces") {
+		t.Errorf("expected unknown keys next to a merge key to be rejected, got %v", err)
+	}
+}
+
+func TestLoadServiceTasks_Anchors(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "web", `- &restart
+  name: restart nginx
+  command: systemctl restart nginx
+  retries: 2
+  tags: [restart]
+- <<: *restart
+  name: reload nginx
+  command: systemctl reload nginx
+- *restart
+`)
+	got, err := LoadServiceTasks(dir, "web")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 tasks, got %d", len(got))
+	}
+	if got[1].Name != "reload nginx" || got[1].Command != "systemctl reload nginx" || got[1].Retries != 2 || got[1].Tags[0] != "restart" {
+		t.Errorf("expected the merged task to inherit retries and tags, got %+v", got[1])
+	}
+	if got[2].Name != "restart nginx" || got[2].Command != "systemctl restart nginx" {
+		t.Errorf("expected the alias to repeat the anchored task, got %+v", got[2])
+	}
+}
+
+func TestLoadServiceTasks_MalformedShape(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "web", "name: not a list\ncommand: true\n")
+	_, err := LoadServiceTasks(dir, "web")
+	want := filepath.Join(dir, "web", "tasks", "main.yaml") + ":1:1: task file must be a list of tasks, got a mapping"
+	if err == nil || err.Error() != want {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+}
+
+func TestLoadServiceTasksFrom(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "web", "- name: main\n  command: main\n")
+	tasksDir := filepath.Join(dir, "web", "tasks")
+	os.WriteFile(filepath.Join(tasksDir, "install.yaml"), []byte("- name: install\n  command: apt-get install nginx\n"), 0o644)
+	os.WriteFile(filepath.Join(tasksDir, "configure.yml"), []byte("- name: configure\n  command: configure\n"), 0o644)
+
+	cases := map[string]string{"": "main", "install.yaml": "install", "install": "install", "configure": "configure"}
+	for from, want := range cases {
+		got, err := LoadServiceTasksFrom(dir, "web", from)
+		if err != nil {
+			t.Fatalf("tasks_from %q: %v", from, err)
+		}
+		if len(got) != 1 || got[0].Name != want {
+			t.Errorf("tasks_from %q: expected task %q, got %+v", from, want, got)
+		}
+	}
+}
+
+func TestLoadServiceTasksFrom_MissingEntrypoint(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "web", "- name: main\n  command: main\n")
+	_, err := LoadServiceTasksFrom(dir, "web", "deploy.yaml")
+	want := `service "web" has no tasks_from entrypoint "deploy.yaml" in ` + filepath.Join(dir, "web", "tasks")
+	if err == nil || err.Error() != want {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+	if _, err := LoadServiceTasksFrom(dir, "web", "../../etc/passwd"); err == nil || !strings.Contains(err.Error(), "must be a file name") {
+		t.Errorf("expected a path outside the tasks directory to be rejected, got %v", err)
+	}
+}
+
+func TestRunPlaybook_TasksFrom(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "base", "- name: base\n  command: base\n")
+	writeService(t, dir, "web", "- name: main\n  command: main\n")
+	os.MkdirAll(filepath.Join(dir, "web", "meta"), 0o755)
+	os.WriteFile(filepath.Join(dir, "web", "meta", "main.yaml"), []byte("dependencies: [base]\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "web", "tasks", "install.yaml"), []byte("- name: install\n  command: install\n"), 0o644)
+	var ran []string
+	stubSSH(t, func(_, command string) (string, error) {
+		ran = append(ran, command)
+		return "", nil
+	})
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "web", TasksFrom: "install"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ran, ","); got != "base,install" {
+		t.Errorf("expected the dependency's main.yaml and the install entrypoint, got %q", got)
+	}
+}
+
+// stubBlockingConnector routes ssh tasks to a connector whose commands are
+// "start NAME" (log and return), "wait NAME" (block until NAME started, or
+// fail after a timeout) and "log TEXT".
+func stubBlockingConnector(t *testing.T) *[]string {
+	t.Helper()
+	var (
+		mu      sync.Mutex
+		log     []string
+		started = make(map[string]chan struct{})
+	)
+	signal := func(name string) chan struct{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if started[name] == nil {
+			started[name] = make(chan struct{})
+		}
+		return started[name]
+	}
+	stubSSH(t, func(_, command string) (string, error) {
+		verb, arg, _ := strings.Cut(command, " ")
+		switch verb {
+		case "start":
+			close(signal(arg))
+		case "wait":
+			select {
+			case <-signal(arg):
+			case <-time.After(2 * time.Second):
+				return "", errors.New("timed out waiting for " + arg)
+			}
+		}
+		mu.Lock()
+		log = append(log, command)
+		mu.Unlock()
+		return "ok", nil
+	})
+	return &log
+}
+
+func TestRunPlaybook_ParallelPlaysDisjoint(t *testing.T) {
+	dir := t.TempDir()
+	// Each play waits for the other to start: only succeeds when concurrent.
+	writeService(t, dir, "web", "- name: web\n  command: start web\n- name: sync\n  command: wait db\n")
+	writeService(t, dir, "db", "- name: db\n  command: start db\n- name: sync\n  command: wait web\n")
+	stubBlockingConnector(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "w1"}},
+		"db":  {{Address: "d1"}},
+	}}
+	pb := Playbook{
+		{Name: "web", Hosts: "web", Services: []Service{{ServiceName: "web"}}},
+		{Name: "db", Hosts: "db", Services: []Service{{ServiceName: "db"}}},
+	}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, ParallelPlays: true}); err != nil {
+		t.Fatalf("expected disjoint plays to run concurrently, got %v", err)
+	}
+}
+
+func TestRunPlaybook_ParallelPlaysOverlapping(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "first", "- name: a\n  command: log first-a\n- name: b\n  command: log first-b\n")
+	writeService(t, dir, "second", "- name: a\n  command: log second-a\n")
+	log := stubBlockingConnector(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "shared"}, {Address: "w1"}},
+		"all": {{Address: "shared"}},
+	}}
+	pb := Playbook{
+		{Name: "first", Hosts: "web", Services: []Service{{ServiceName: "first"}}},
+		{Name: "second", Hosts: "all", Services: []Service{{ServiceName: "second"}}},
+	}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, ParallelPlays: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*log) != 5 || (*log)[4] != "log second-a" {
+		t.Errorf("expected overlapping play to run after the first, got %v", *log)
+	}
+}
+
+func TestRunPlaybook_FreeStrategyFastHostRunsAhead(t *testing.T) {
+	dir := t.TempDir()
+	// The slow host's first task blocks until the fast host has started its
+	// last one, which only happens when hosts don't sync between services.
+	writeService(t, dir, "one", "- name: one\n  command: \"{{ .one }}\"\n")
+	writeService(t, dir, "two", "- name: two\n  command: \"{{ .two }}\"\n")
+	log := stubBlockingConnector(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {
+			{Address: "slow", Vars: map[string]interface{}{"one": "wait fast-two", "two": "log slow-two"}},
+			{Address: "fast", Vars: map[string]interface{}{"one": "log fast-one", "two": "start fast-two"}},
+		},
+	}}
+	pb := Playbook{{Name: "free", Hosts: "web", Strategy: StrategyFree,
+		Services: []Service{{ServiceName: "one"}, {ServiceName: "two"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"log fast-one", "start fast-two", "wait fast-two", "log slow-two"}
+	if strings.Join(*log, ",") != strings.Join(want, ",") {
+		t.Errorf("expected fast host to finish before slow host's first task, got %v", *log)
+	}
+}
+
+func TestRunPlaybook_RegisterVisibleInLaterPlay(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "probe", "- name: probe\n  command: version\n  register: version\n")
+	writeService(t, dir, "use", "- name: use\n  command: \"use {{ .version }}\"\n")
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, host+": "+command)
+		return "v-" + host, nil
+	})
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "w1", Vars: map[string]interface{}{"version": "from-inventory"}}},
+	}}
+	pb := Playbook{
+		{Name: "probe", Hosts: "web", Services: []Service{{ServiceName: "probe"}}},
+		{Name: "other", Hosts: "web", Vars: map[string]interface{}{"version": "from-play"}},
+		{Name: "use", Hosts: "web", Vars: map[string]interface{}{"version": "from-play"}, Services: []Service{{ServiceName: "use"}}},
+	}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ran) != 2 || ran[1] != "w1: use v-w1" {
+		t.Errorf("expected later play to use the registered value, got %v", ran)
+	}
+}
+
+func TestRunHostTasks_SetFact(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "1.4.2")
+	tasks := []Task{
+		{Name: "probe", Command: "version", Register: "raw"},
+		{Name: "facts", SetFact: map[string]string{
+			"env":     "prod",
+			"app":     "{{ .name }}-svc",
+			"release": "v{{ .raw }}",
+		}},
+		{Name: "use", Command: "deploy {{ .app }} {{ .release }} {{ .env }}"},
+	}
+	vars := map[string]interface{}{"name": "shop"}
+	res := newResults()
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{results: res}, vars)
+	if sum.Failed != 0 || sum.OK != 1 || sum.Changed != 2 {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+	if len(*commands) != 2 || (*commands)[1] != "deploy shop-svc v1.4.2 prod" {
+		t.Errorf("expected facts in later task, got %v", *commands)
+	}
+	if got := res.forHost("w1")["release"]; got != "v1.4.2" {
+		t.Errorf("expected fact kept for later plays, got %v", got)
+	}
+}
+
+func TestDebugMessage_Msg(t *testing.T) {
+	got, err := debugMessage(&DebugTask{Msg: "deploying {{ .app }} to {{ .env }}"}, map[string]interface{}{"app": "shop", "env": "prod"})
+	if err != nil || got != "deploying shop to prod" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestDebugMessage_Var(t *testing.T) {
+	vars := map[string]interface{}{
+		"version": "1.4.2\n",
+		"ansible": facts.Facts{"os": "linux"},
+		"ports":   []interface{}{80, 443},
+	}
+	cases := map[string]string{
+		"version": "version: 1.4.2\n",
+		"ansible": "ansible: {\n  \"os\": \"linux\"\n}",
+		"ports":   "ports: [\n  80,\n  443\n]",
+		"missing": "missing: VARIABLE IS NOT DEFINED",
+	}
+	for name, want := range cases {
+		got, err := debugMessage(&DebugTask{Var: name}, vars)
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestRunHostTasks_DebugIsOKAndRespectsVerbosity(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "1.4.2")
+	tasks := []Task{
+		{Name: "probe", Command: "version", Register: "version"},
+		{Name: "show", Debug: &DebugTask{Var: "version"}},
+		{Name: "verbose", Debug: &DebugTask{Msg: "details", Verbosity: 2}},
+	}
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{}, map[string]interface{}{})
+	if sum.OK != 1 || sum.Changed != 1 || sum.Skipped != 1 || len(*commands) != 1 {
+		t.Errorf("expected debug to report ok without running anything, got %+v (%v)", sum, *commands)
+	}
+	sum = runHostTasks(inventory.Host{Address: "w1"}, tasks[2:], nil, RunOptions{Verbosity: 2}, map[string]interface{}{})
+	if sum.OK != 1 {
+		t.Errorf("expected verbose debug to run at verbosity 2, got %+v", sum)
+	}
+}
+
+func TestCheckAssert(t *testing.T) {
+	vars := map[string]interface{}{"os": "linux", "disk_ok": true, "free": "0"}
+
+	res, err := checkAssert(&AssertTask{That: []string{"{{ .disk_ok }}", `{{ eq .os "linux" }}`}, SuccessMsg: "{{ .os }} ready"}, vars)
+	if err != nil || res.Failed || res.Output != "linux ready" {
+		t.Errorf("expected all-true assert to pass, got %+v, %v", res, err)
+	}
+
+	res, err = checkAssert(&AssertTask{That: []string{"{{ .disk_ok }}", "{{ .free }}"}, FailMsg: "no space on {{ .os }} host"}, vars)
+	if err == nil || !res.Failed || err.Error() != "no space on linux host" {
+		t.Errorf("expected fail_msg, got %+v, %v", res, err)
+	}
+
+	_, err = checkAssert(&AssertTask{That: []string{"{{ .free"}}, vars)
+	if err == nil || !strings.Contains(err.Error(), `evaluating "{{ .free"`) {
+		t.Errorf("expected malformed condition error, got %v", err)
+	}
+}
+
+func TestRunHostTasks_FailedAssertHaltsHost(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	tasks := []Task{
+		{Name: "preflight", Assert: &AssertTask{That: []string{"{{ .ready }}"}}},
+		{Name: "deploy", Command: "deploy"},
+	}
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{FailFast: true}, map[string]interface{}{"ready": false})
+	if sum.Failed != 1 || len(*commands) != 0 {
+		t.Errorf("expected failed assert to stop the host, got %+v (%v)", sum, *commands)
+	}
+}
+
+func TestRunHostTasks_FailIsUnconditional(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	tasks := []Task{
+		{Name: "stop", Fail: &FailTask{Msg: "{{ .env }} is frozen"}},
+		{Name: "deploy", Command: "deploy"},
+	}
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{FailFast: true}, map[string]interface{}{"env": "prod"})
+	if sum.Failed != 1 || len(*commands) != 0 {
+		t.Errorf("expected fail to stop the host, got %+v (%v)", sum, *commands)
+	}
+	if _, err := failTask(tasks[0].Fail, map[string]interface{}{"env": "prod"}); err == nil || err.Error() != "prod is frozen" {
+		t.Errorf("expected rendered message, got %v", err)
+	}
+}
+
+func TestRunPlaybook_FailGuardedByWhen(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: guard\n  fail:\n    msg: \"{{ .role }} not allowed\"\n  when: '{{ eq .role \"db\" }}'\n- name: deploy\n  command: deploy\n")
+	ran := stubFailingHosts(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"all": {{Address: "web1", Vars: map[string]interface{}{"role": "web"}}, {Address: "db1", Vars: map[string]interface{}{"role": "db"}}},
+	}}
+	retry := filepath.Join(dir, "site.retry")
+	pb := Playbook{{Name: "deploy", Hosts: "all", Services: []Service{{ServiceName: "app"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, RetryFile: retry}); err == nil {
+		t.Fatal("expected playbook error from fail task")
+	}
+	if data, _ := os.ReadFile(retry); string(data) != "db1\n" {
+		t.Errorf("expected only db1 to fail, got %q", data)
+	}
+	if len(*ran) != 2 {
+		t.Errorf("expected deploy to run on both hosts without fail-fast, got %v", *ran)
+	}
+}
+
+func TestRunHostTasks_FlushHandlers(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	tasks := []Task{
+		{Name: "config", Command: "write config", Notify: "restart"},
+		{Name: "flush", Meta: MetaFlushHandlers},
+		{Name: "check", Command: "check"},
+	}
+	handlers := []Handler{{Name: "restart", Command: "restart"}}
+	runHostTasks(inventory.Host{Address: "w1"}, tasks, handlers, RunOptions{}, map[string]interface{}{})
+	want := "write config,restart,check"
+	if got := strings.Join(*commands, ","); got != want {
+		t.Errorf("expected handler to run at flush_handlers, got %q, want %q", got, want)
+	}
+}
+
+func TestRunHostTasks_HandlerListenTopic(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	tasks := []Task{{Name: "config", Command: "write config", Notify: "web config changed"}}
+	handlers := []Handler{
+		{Name: "restart nginx", Command: "restart nginx", Listen: []string{"web config changed"}},
+		{Name: "unrelated", Command: "unrelated", Listen: []string{"db changed"}},
+		{Name: "reload app", Command: "reload app", Listen: []string{"web config changed"}},
+	}
+	runHostTasks(inventory.Host{Address: "w1"}, tasks, handlers, RunOptions{}, map[string]interface{}{})
+	want := "write config,restart nginx,reload app"
+	if got := strings.Join(*commands, ","); got != want {
+		t.Errorf("expected both listening handlers in definition order, got %q, want %q", got, want)
+	}
+}
+
+func TestRunHostTasks_HandlerNotifiedByNameAndTopic(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	tasks := []Task{
+		{Name: "config", Command: "write config", Notify: "restart nginx"},
+		{Name: "certs", Command: "write certs", Notify: "web config changed"},
+	}
+	handlers := []Handler{{Name: "restart nginx", Command: "restart nginx", Listen: []string{"web config changed"}}}
+	runHostTasks(inventory.Host{Address: "w1"}, tasks, handlers, RunOptions{}, map[string]interface{}{})
+	want := "write config,write certs,restart nginx"
+	if got := strings.Join(*commands, ","); got != want {
+		t.Errorf("expected the handler to run once, got %q, want %q", got, want)
+	}
+}
+
+func TestRunPlaybook_ClearHostErrorsResumesHost(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "first", "- name: broken\n  command: broken\n- name: skipped\n  command: skipped\n- name: clear\n  meta: clear_host_errors\n- name: after\n  command: after\n")
+	writeService(t, dir, "second", "- name: next\n  command: next\n")
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(_, command string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, command)
+		if command == "broken" {
+			return "", errors.New("exit status 1")
+		}
+		return "ok", nil
+	})
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "first"}, {ServiceName: "second"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, FailFast: true}); err != nil {
+		t.Fatalf("expected cleared failure not to fail the run, got %v", err)
+	}
+	if got := strings.Join(ran, ","); got != "broken,after,next" {
+		t.Errorf("expected host to resume after clear_host_errors, got %q", got)
+	}
+}
+
+func TestRunPlaybook_KeepGoingReportsEveryFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "audit", "- name: check disk\n  command: disk\n- name: check ntp\n  command: ntp\n")
+	writeService(t, dir, "report", "- name: summary\n  command: summary\n")
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		ran = append(ran, host+":"+command)
+		mu.Unlock()
+		if command == "disk" || (command == "ntp" && host == "w2") {
+			return "", errors.New(command + " check failed")
+		}
+		return "ok", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	prevTerminal := printer.Terminal
+	printer.Terminal = false
+	t.Cleanup(func() { printer.Terminal = prevTerminal })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}}}}
+	pb := Playbook{
+		{Name: "audit", Hosts: "web", Services: []Service{{ServiceName: "audit"}}},
+		{Name: "report", Hosts: "web", Services: []Service{{ServiceName: "report"}}},
+	}
+	err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, FailFast: true, KeepGoing: true, Forks: 1})
+	if !errors.Is(err, ErrTaskFailed) {
+		t.Fatalf("expected the run to fail with ErrTaskFailed, got %v", err)
+	}
+	sort.Strings(ran)
+	want := "w1:disk,w1:ntp,w1:summary,w2:disk,w2:ntp,w2:summary"
+	if got := strings.Join(ran, ","); got != want {
+		t.Errorf("expected every task to run, got %q, want %q", got, want)
+	}
+	got := out.String()
+	recap := strings.Index(got, "PLAY RECAP")
+	report := strings.Index(got, "FAILURE REPORT")
+	if recap < 0 || report < recap {
+		t.Fatalf("expected the failure report after the recap, got:\n%s", got)
+	}
+	for _, line := range []string{
+		"  w1 : check disk : disk check failed\n",
+		"  w2 : check disk : disk check failed\n",
+		"  w2 : check ntp : ntp check failed\n",
+		"Total: 3 failed on 2 hosts",
+	} {
+		if !strings.Contains(got[report:], line) {
+			t.Errorf("expected %q in the failure report, got:\n%s", line, got[report:])
+		}
+	}
+}
+
+func TestRunPlaybook_SummaryOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "audit", "- name: check disk\n  command: disk\n- name: check ntp\n  command: ntp\n")
+	stubSSH(t, func(host, command string) (string, error) {
+		if command == "disk" && host == "w2" {
+			return "", errors.New("disk check failed")
+		}
+		return "all good", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+	prevTerminal := printer.Terminal
+	printer.Terminal = false
+	t.Cleanup(func() { printer.Terminal = prevTerminal })
+	printer.SummaryOnly = true
+	t.Cleanup(func() { printer.SummaryOnly = false })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}}}}
+	pb := Playbook{{Name: "audit", Hosts: "web", Services: []Service{{ServiceName: "audit"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, SummaryOnly: true, Forks: 2}); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	got := out.String()
+	for _, line := range []string{"PLAY [", "TASK [", "all good", "ok: [w1]"} {
+		if strings.Contains(got, line) {
+			t.Errorf("expected no %q in summary-only output, got:\n%s", line, got)
+		}
+	}
+	recap := strings.Index(got, "PLAY RECAP")
+	report := strings.Index(got, "FAILURE REPORT")
+	if recap < 0 || report < recap {
+		t.Fatalf("expected the recap followed by the failure report, got:\n%s", got)
+	}
+	if !strings.Contains(got[report:], "  w2 : check disk : disk check failed\n") {
+		t.Errorf("expected the failure to be listed, got:\n%s", got[report:])
+	}
+
+	out.Reset()
+	writeService(t, dir, "audit", "- name: check ntp\n  command: ntp\n")
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, SummaryOnly: true, Forks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); !strings.Contains(got, "PLAY RECAP") || strings.Contains(got, "FAILURE REPORT") {
+		t.Errorf("expected only the recap on success, got:\n%s", got)
+	}
+}
+
+func TestRunPlaybook_RunTimeoutAbortsWithRecap(t *testing.T) {
+	dir := t.TempDir()
+	var tasks strings.Builder
+	for i := 0; i < 20; i++ {
+		tasks.WriteString("- name: slow\n  command: sleep\n")
+	}
+	writeService(t, dir, "slow", tasks.String())
+	var (
+		mu  sync.Mutex
+		ran int
+	)
+	stubSSH(t, func(_, _ string) (string, error) {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		ran++
+		mu.Unlock()
+		return "ok", nil
+	})
+
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "slow", Hosts: "web", Services: []Service{{ServiceName: "slow"}}}}
+	start := time.Now()
+	err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, RunTimeout: 70 * time.Millisecond})
+	if !errors.Is(err, ErrRunTimedOut) {
+		t.Fatalf("expected ErrRunTimedOut, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("expected the run to abort promptly, took %s", elapsed)
+	}
+	if ran == 0 || ran >= 20 {
+		t.Errorf("expected a partial run, %d of 20 tasks ran", ran)
+	}
+	if !strings.Contains(out.String(), "PLAY RECAP") || !strings.Contains(out.String(), "w1") {
+		t.Errorf("expected a partial recap, got %q", out.String())
+	}
+}
+
+func TestRunPlaybook_MaxOutputBytes(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: long
+  command: long
+  register: out
+- name: short
+  command: short
+- name: unlimited
+  command: long
+  max_output_bytes: -1
+- name: reuse
+  command: "echo {{ .out }}"
+`)
+	long := strings.Repeat("x", 100)
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(_, command string) (string, error) {
+		mu.Lock()
+		ran = append(ran, command)
+		mu.Unlock()
+		switch command {
+		case "long":
+			return long, nil
+		case "short":
+			return "short", nil
+		}
+		return "done", nil
+	})
+
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, MaxOutputBytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if n := strings.Count(got, "... (truncated, 90 more bytes)"); n != 2 {
+		t.Errorf("expected the registered and printed output truncated, got %d markers in %q", n, got)
+	}
+	if !strings.Contains(got, long) {
+		t.Errorf("expected max_output_bytes: -1 to print the full output, got %q", got)
+	}
+	if !strings.Contains(got, "short") || strings.Count(got, "truncated") != 2 {
+		t.Errorf("expected short output untouched, got %q", got)
+	}
+	if last := ran[len(ran)-1]; last != "echo "+long {
+		t.Errorf("expected the registered value to keep the full output, got %q", last)
+	}
+}
+
+func TestRunPlaybook_CheckDiffPreviewsCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app.conf")
+	os.WriteFile(src, []byte("port=8080\npassword=s3cret\n"), 0o644)
+	writeService(t, dir, "cfg", "- name: config\n  copy:\n    src: "+src+"\n    dest: /etc/app.conf\n")
+
+	remote := map[string]string{
+		"stale":   "port=80\npassword=s3cret\n",
+		"current": "port=8080\npassword=s3cret\n",
+	}
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		ran = append(ran, command)
+		mu.Unlock()
+		return remote[host], nil
+	})
+
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "stale"}, {Address: "current"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "cfg"}}}}
+	opts := RunOptions{ServicesPath: dir, DryRun: true, Diff: true, Secrets: []string{"s3cret"}}
+	if err := RunPlaybook(pb, inv, opts); !errors.Is(err, ErrWouldChange) {
+		t.Fatalf("expected ErrWouldChange, got %v", err)
+	}
+
+	for _, command := range ran {
+		if strings.HasPrefix(command, "copy ") {
+			t.Errorf("expected no write under check mode, got %q", command)
+		}
+	}
+	got := out.String()
+	if !strings.Contains(got, "-port=80\n") || !strings.Contains(got, "+port=8080\n") {
+		t.Errorf("expected a diff for the differing host, got %q", got)
+	}
+	if !strings.Contains(got, "Total: 1 would change on 1 of 2 hosts") {
+		t.Errorf("expected the check recap to count the differing host, got %q", got)
+	}
+	if !strings.Contains(got, "changed: [stale]") || !strings.Contains(got, "ok: [current]") {
+		t.Errorf("expected changed for the differing host and ok for the matching one, got %q", got)
+	}
+	if strings.Contains(got, "s3cret") || !strings.Contains(got, "password="+redacted) {
+		t.Errorf("expected the secret redacted from the diff, got %q", got)
+	}
+}
+
+func TestRunPlaybook_DiffCountsInRecap(t *testing.T) {
+	dir := t.TempDir()
+	app := filepath.Join(dir, "app.conf")
+	workers := filepath.Join(dir, "workers.conf")
+	os.WriteFile(app, []byte("port=8080\n"), 0o644)
+	os.WriteFile(workers, []byte("workers=4\n"), 0o644)
+	writeService(t, dir, "cfg", "- name: app\n  copy:\n    src: "+app+"\n    dest: /etc/app.conf\n"+
+		"- name: workers\n  copy:\n    src: "+workers+"\n    dest: /etc/workers.conf\n")
+
+	remote := map[string]map[string]string{
+		"stale":   {"/etc/app.conf": "port=80\n", "/etc/workers.conf": "workers=2\n"},
+		"half":    {"/etc/app.conf": "port=8080\n", "/etc/workers.conf": "workers=2\n"},
+		"current": {"/etc/app.conf": "port=8080\n", "/etc/workers.conf": "workers=4\n"},
+	}
+	stubSSH(t, func(host, command string) (string, error) {
+		path, _ := strings.CutPrefix(command, "cat ")
+		return remote[host][strings.Trim(path, "'")], nil
+	})
+	out := captureRunOutput(t)
+	prevTerminal, prevDiffCounts := printer.Terminal, printer.DiffCounts
+	printer.Terminal, printer.DiffCounts = false, true
+	t.Cleanup(func() { printer.Terminal, printer.DiffCounts = prevTerminal, prevDiffCounts })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "stale"}, {Address: "half"}, {Address: "current"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "cfg"}}}}
+	result, err := runPlaybook(pb, inv, RunOptions{ServicesPath: dir, DryRun: true, Diff: true})
+	if !errors.Is(err, ErrWouldChange) {
+		t.Fatalf("expected ErrWouldChange, got %v", err)
+	}
+
+	want := map[string]int{"stale": 2, "half": 1, "current": 0}
+	for _, s := range result.Hosts {
+		if s.Diffs != want[s.Host] {
+			t.Errorf("%s: expected %d diffs, got %d", s.Host, want[s.Host], s.Diffs)
+		}
+	}
+	got := out.String()
+	for _, line := range []string{
+		"  stale   : ok=0 changed=2 diff=2 failed=0 skipped=0 ignored=0\n",
+		"  half    : ok=1 changed=1 diff=1 failed=0 skipped=0 ignored=0\n",
+		"  current : ok=2 changed=0 diff=0 failed=0 skipped=0 ignored=0\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("expected the recap line %q, got %q", line, got)
+		}
+	}
+}
+
+func TestRunPlaybook_CheckRecap(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	ran := stubFailingHosts(t)
+
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, DryRun: true}); err != nil {
+		t.Fatalf("expected no error when nothing would change, got %v", err)
+	}
+	if len(*ran) != 0 {
+		t.Errorf("expected nothing to run in check mode, ran on %v", *ran)
+	}
+	if !strings.Contains(out.String(), "Total: 0 would change on 0 of 2 hosts") {
+		t.Errorf("expected a check recap, got %q", out.String())
+	}
+}
+
+func TestRunPlaybook_HostVarsAndGroups(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "probe", "- name: probe\n  command: probe\n  register: release\n")
+	writeService(t, dir, "lb", `- name: backends
+  command: 'backends{{ range .groups.web }} {{ index $.hostvars . "default_ipv4" }}{{ end }} release={{ index .hostvars "w2" "release" }} role={{ index .hostvars "w1" "role" }}'
+  when: '{{ eq .inventory_hostname "w1" }}'
+`)
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		switch {
+		case strings.Contains(command, "FOR_HOST="):
+			return "default_ipv4=10.0.0." + strings.TrimPrefix(host, "w") + "\n", nil
+		case command == "probe":
+			return "v" + strings.TrimPrefix(host, "w"), nil
+		}
+		mu.Lock()
+		ran = append(ran, command)
+		mu.Unlock()
+		return "", nil
+	})
+
+	inv := &inventory.Inventory{
+		Hosts:     map[string][]inventory.Host{"web": {{Address: "w1", Vars: map[string]interface{}{"role": "primary"}}, {Address: "w2"}}},
+		GroupVars: map[string]map[string]interface{}{"web": {"role": "member"}},
+	}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "probe"}, {ServiceName: "lb"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, GatherFacts: true, Forks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	want := "backends 10.0.0.1 10.0.0.2 release=v2 role=primary"
+	if len(ran) != 1 || ran[0] != want {
+		t.Errorf("expected %q, got %q", want, ran)
+	}
+}
+
+func TestHostVars_LeavesInventoryVarsAlone(t *testing.T) {
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "w1", Vars: map[string]interface{}{"role": "web"}}},
+	}}
+	opts := RunOptions{invVars: inventoryVars(inv), facts: newResults(), results: newResults()}
+	opts.results.set("w1", "release", "v2")
+	opts.results.set("w9", "release", "v3")
+
+	vars := hostVars(opts)
+	if w1, _ := vars["w1"].(map[string]interface{}); w1["role"] != "web" || w1["release"] != "v2" {
+		t.Errorf("expected w1's inventory vars and results, got %v", vars["w1"])
+	}
+	if w9, _ := vars["w9"].(map[string]interface{}); w9["release"] != "v3" {
+		t.Errorf("expected a host with only results, got %v", vars["w9"])
+	}
+	if _, ok := opts.invVars["w1"]["release"]; ok {
+		t.Errorf("expected the shared inventory vars untouched, got %v", opts.invVars["w1"])
+	}
+}
+
+func TestRunPlaybook_GatherSubset(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "web", "- name: noop\n  command: true\n")
+	commands := stubConnection(t, ConnectionSSH, "")
+	captureRunOutput(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", GatherSubset: []string{"!hardware"}, Services: []Service{{ServiceName: "web"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, GatherFacts: true}); err != nil {
+		t.Fatal(err)
+	}
+	var script string
+	for _, command := range *commands {
+		if strings.Contains(command, "FOR_HOST=") {
+			script = command
+		}
+	}
+	if !strings.Contains(script, "uname -r") || strings.Contains(script, "nproc") || strings.Contains(script, "free -m") {
+		t.Errorf("expected every fact command but the hardware ones, got:\n%s", script)
+	}
+}
+
+func TestRunPlaybook_FactTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "web", "- name: arch\n  command: echo {{ if .arch }}{{ .arch }}{{ else }}none{{ end }}\n")
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		if strings.Contains(command, "FOR_HOST=") {
+			if host == "slow" {
+				<-release
+			}
+			return "os=linux\narch=x86_64\n", nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, command)
+		return "", nil
+	})
+	out := captureRunOutput(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "slow"}, {Address: "fast"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "web"}}}}
+	opts := RunOptions{ServicesPath: dir, GatherFacts: true, FactTimeout: 50 * time.Millisecond}
+	if err := RunPlaybook(pb, inv, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(ran)
+	if want := []string{"echo none", "echo x86_64"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("expected the slow host to run without its facts, got %q", ran)
+	}
+	got := out.String()
+	if !strings.Contains(got, "Warning: gathering facts from slow timed out after 50ms; continuing with the 0 facts received") {
+		t.Errorf("expected a timeout warning for the slow host, got %q", got)
+	}
+	if strings.Contains(got, "facts from fast") {
+		t.Errorf("expected no warning for the fast host, got %q", got)
+	}
+}
+
+func TestRunPlaybook_TypedInventoryVars(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"hosts.ini":          "[web]\nw1\n\n[web:vars]\nenv=production\nworkers=8\n",
+		"group_vars/web.yml": "max_clients: 200\ntls: true\n",
+	} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inv, err := inventory.LoadInventory(filepath.Join(dir, "hosts.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "200" > "99" is false as strings, so these only run when max_clients
+	// is compared as a number.
+	writeService(t, dir, "app", `- name: numeric
+  command: numeric
+  when: '{{ gt .max_clients 99 }}'
+- name: bool
+  command: bool
+  when: '{{ and .tls (eq .env "production") }}'
+- name: ini string
+  command: workers={{ .workers }}
+  when: '{{ eq .workers "8" }}'
+`)
+	var ran []string
+	stubSSH(t, func(_, command string) (string, error) {
+		ran = append(ran, command)
+		return "", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir}); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	if want := []string{"numeric", "bool", "workers=8"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("got %q, want %q\n%s", ran, want, out.String())
+	}
+}
+
+func TestRunPlaybook_UpstreamFromGroup(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "lb", `- name: upstream
+  shell: |
+    cat > app.conf <<'CONF'
+    upstream app {
+    {{- range .groups.app }}
+        server {{ . }}:{{ index $.hostvars . "port" }};
+    {{- end }}
+    }
+    # {{ len .groups.all }} hosts
+    CONF
+`)
+	var ran []string
+	stubSSH(t, func(host, command string) (string, error) {
+		ran = append(ran, host+": "+command)
+		return "", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{
+		Hosts: map[string][]inventory.Host{
+			"lb":  {{Address: "lb1"}},
+			"app": {{Address: "app1"}, {Address: "app2", Vars: map[string]interface{}{"port": "8081"}}, {Address: "app3"}},
+		},
+		GroupVars: map[string]map[string]interface{}{"app": {"port": "8080"}},
+	}
+	pb := Playbook{{Name: "lb", Hosts: "lb", Services: []Service{{ServiceName: "lb"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir}); err != nil {
+		t.Fatal(err)
+	}
+	want := `lb1: cat > app.conf <<'CONF'
+upstream app {
+    server app1:8080;
+    server app2:8081;
+    server app3:8080;
+}
+# 4 hosts
+CONF
+`
+	if len(ran) != 1 || ran[0] != want {
+		t.Errorf("got %q, want %q", ran, want)
+	}
+}
+
+func TestRunAdHoc_TemplateGroupsAndHostVars(t *testing.T) {
+	var ran []string
+	stubSSH(t, func(host, command string) (string, error) {
+		ran = append(ran, command)
+		return "", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{
+		Hosts: map[string][]inventory.Host{
+			"lb": {{Address: "lb1"}},
+			"db": {{Address: "db1", Vars: map[string]interface{}{"role": "primary"}}, {Address: "db2"}},
+		},
+		GroupVars: map[string]map[string]interface{}{"db": {"role": "replica"}},
+	}
+	command := `check{{ range .groups.db }} {{ . }}={{ index $.hostvars . "role" }}{{ end }} all={{ .groups.all | join "," }}`
+	if _, err := runAdHoc(inv, "lb", []string{command}, true, RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "check db1=primary db2=replica all=db1,db2,lb1"; len(ran) != 1 || ran[0] != want {
+		t.Errorf("got %q, want %q", ran, want)
+	}
+}
+
+func TestRunAdHoc_ChangedAndFailedWhen(t *testing.T) {
+	stubSSH(t, func(host, command string) (string, error) {
+		switch host {
+		case "w1":
+			return "nginx/stable 1.26 upgradable", nil
+		case "w2":
+			return "", nil
+		case "w3":
+			return "", exitStatusErr(1)
+		}
+		return "disk full", exitStatusErr(2)
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}, {Address: "w3"}, {Address: "w4"}}}}
+	opts := RunOptions{
+		AdHocChangedWhen: `{{ ne .output "" }}`,
+		AdHocFailedWhen:  "{{ gt .rc 1 }}",
+	}
+	res, err := runAdHoc(inv, "web", []string{"apt list --upgradable"}, false, opts)
+	if !errors.Is(err, ErrTaskFailed) {
+		t.Errorf("expected ErrTaskFailed for w4, got %v", err)
+	}
+	want := map[string]printer.HostSummary{
+		"w1": {Host: "w1", Changed: 1},
+		"w2": {Host: "w2", OK: 1},
+		"w3": {Host: "w3", OK: 1},
+		"w4": {Host: "w4", Failed: 1},
+	}
+	for _, sum := range res.Hosts {
+		if sum != want[sum.Host] {
+			t.Errorf("expected %+v, got %+v", want[sum.Host], sum)
+		}
+	}
+
+	// Without the options every successful command is ok, as before.
+	res, _ = runAdHoc(inv, "web", []string{"apt list --upgradable"}, false, RunOptions{})
+	if sum := res.Hosts[0]; sum.OK != 1 || sum.Changed != 0 {
+		t.Errorf("expected w1 ok without --changed-when, got %+v", sum)
+	}
+	if sum := res.Hosts[2]; sum.Failed != 1 {
+		t.Errorf("expected w3 failed without --failed-when, got %+v", sum)
+	}
+
+	// failed_when can fail a command that exited 0.
+	res, _ = runAdHoc(inv, "web", []string{"check"}, false, RunOptions{AdHocFailedWhen: `{{ eq .output "" }}`})
+	if sum := res.Hosts[1]; sum.Failed != 1 || res.Failures[0].Host != "w2" {
+		t.Errorf("expected w2 failed by --failed-when, got %+v and %+v", sum, res.Failures)
+	}
+
+	// A condition that cannot be evaluated fails the host instead of
+	// passing it.
+	res, _ = runAdHoc(inv, "web", []string{"check"}, false, RunOptions{AdHocFailedWhen: "{{ gt .rcx 1 }}"})
+	if len(res.Failures) != 4 || !strings.Contains(res.Failures[0].Err.Error(), "evaluating --failed-when") {
+		t.Errorf("expected every host failed by the broken --failed-when, got %+v", res.Failures)
+	}
+	res, _ = runAdHoc(inv, "web", []string{"check"}, false, RunOptions{AdHocChangedWhen: "{{ gt .rcx 1 }}"})
+	if sum := res.Hosts[0]; sum.Failed != 1 {
+		t.Errorf("expected w1 failed by the broken --changed-when, got %+v", sum)
+	}
+
+	if _, err := runAdHoc(inv, "web", []string{"check"}, false, RunOptions{AdHocChangedWhen: "{{ .output"}); err == nil || !strings.Contains(err.Error(), "invalid ad hoc condition") {
+		t.Errorf("expected an invalid condition error, got %v", err)
+	}
+}
+
+func TestRunLocalAdHocCommand_RunOptions(t *testing.T) {
+	out := captureRunOutput(t)
+	start := time.Now()
+	if err := RunLocalAdHocCommand("sleep 5", RunOptions{RunTimeout: 50 * time.Millisecond}); !errors.Is(err, ErrRunTimedOut) {
+		t.Errorf("expected ErrRunTimedOut, got %v", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("expected the command to be cancelled at the run timeout, took %v", d)
+	}
+
+	out.Reset()
+	if err := RunLocalAdHocCommand("echo 0123456789 | tr 0-9 a-j", RunOptions{MaxOutputBytes: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "abcdefghij") || !strings.Contains(out.String(), "truncated, 7 more bytes") {
+		t.Errorf("expected the output truncated after 4 bytes, got:\n%s", out.String())
+	}
+}
+
+func TestParseAdHocCommands(t *testing.T) {
+	if got, err := ParseAdHocCommands("uptime"); err != nil || len(got) != 1 || got[0] != "uptime" {
+		t.Errorf("expected a single command, got %v, %v", got, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "commands.txt")
+	if err := os.WriteFile(file, []byte("# audit\nuptime\n\n  df -h /  \n# end\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseAdHocCommands("@" + file)
+	if err != nil || strings.Join(got, "|") != "uptime|df -h /" {
+		t.Errorf("expected blanks and comments to be skipped, got %q, %v", got, err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(empty, []byte("# nothing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseAdHocCommands("@" + empty); err == nil || !strings.Contains(err.Error(), "no commands") {
+		t.Errorf("expected an error for an empty file, got %v", err)
+	}
+}
+
+func TestRunAdHocCommands_RunsInOrderPerHost(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "commands.txt")
+	if err := os.WriteFile(file, []byte("uptime\n# disk\ndf -h {{ .mount }}\necho {{ .inventory_hostname }}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	commands, err := ParseAdHocCommands("@" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu  sync.Mutex
+		ran = map[string][]string{}
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran[host] = append(ran[host], command)
+		return "ok", nil
+	})
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{
+		Hosts:     map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2", Vars: map[string]interface{}{"mount": "/srv"}}}},
+		GroupVars: map[string]map[string]interface{}{"web": {"mount": "/"}},
+	}
+	if err := RunAdHocCommands(inv, "web", commands, RunOptions{Forks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"w1": "uptime|df -h /|echo w1",
+		"w2": "uptime|df -h /srv|echo w2",
+	} {
+		if got := strings.Join(ran[host], "|"); got != want {
+			t.Errorf("%s: expected %q, got %q", host, want, got)
+		}
+	}
+	if n := strings.Count(out.String(), "ad hoc: "); n != 6 {
+		t.Errorf("expected one task line per command and host, got %d in:\n%s", n, out.String())
+	}
+}
+
+func TestTaskProfile_AggregatesAcrossHosts(t *testing.T) {
+	p := newTaskProfile()
+	runs := []struct {
+		task, host string
+		d          time.Duration
+	}{
+		{"install", "w1", 3 * time.Second},
+		{"install", "w2", 5 * time.Second},
+		{"restart", "w1", 1 * time.Second},
+		{"restart", "w1", 1 * time.Second},
+		{"restart", "w2", 2 * time.Second},
+		{"ping", "w1", 100 * time.Millisecond},
+		{"check", "w2", 4 * time.Second},
+	}
+	var wg sync.WaitGroup
+	for _, r := range runs {
+		wg.Add(1)
+		go func(task, host string, d time.Duration) {
+			defer wg.Done()
+			p.add(task, host, d)
+		}(r.task, r.host, r.d)
+	}
+	wg.Wait()
+
+	got := p.timings()
+	want := []printer.TaskTiming{
+		{Task: "install", Total: 8 * time.Second, Count: 2, Hosts: 2},
+		{Task: "check", Total: 4 * time.Second, Count: 1, Hosts: 1},
+		{Task: "restart", Total: 4 * time.Second, Count: 3, Hosts: 2},
+		{Task: "ping", Total: 100 * time.Millisecond, Count: 1, Hosts: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d tasks, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("row %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+	if avg := got[0].Average(); avg != 4*time.Second {
+		t.Errorf("expected install to average 4s per host, got %s", avg)
+	}
+	if avg := got[2].Average(); avg != 2*time.Second {
+		t.Errorf("expected restart to average 2s per host, got %s", avg)
+	}
+}
+
+func TestRunPlaybook_ProfileTasks(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: install\n  command: install\n- name: restart\n  command: restart\n")
+	stubConnection(t, ConnectionSSH, "ok")
+	var out bytes.Buffer
+	prevOut := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prevOut) })
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}, {Address: "w2"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", Services: []Service{{ServiceName: "app"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Forks: 2, ProfileTasks: true}); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	profile := strings.Index(got, "TASKS PROFILE")
+	if profile < strings.Index(got, "PLAY RECAP") {
+		t.Fatalf("expected a tasks profile after the recap, got:\n%s", got)
+	}
+	for _, task := range []string{"install", "restart"} {
+		if !strings.Contains(got[profile:], task) || !strings.Contains(got[profile:], "count=2") {
+			t.Errorf("expected %s to be profiled twice, got:\n%s", task, got[profile:])
+		}
+	}
+}
+
+func TestRunOnce_CopyValidate(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sshd_config.new")
+	dest := filepath.Join(dir, "sshd_config")
+	if err := os.WriteFile(dest, []byte("PermitRootLogin no\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	host := inventory.Host{Address: "localhost"}
+	opts := RunOptions{RunLocally: true}
+
+	if err := os.WriteFile(src, []byte("PermitRootLogin yes\nbroken\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{Copy: &CopyTask{Src: src, Dest: dest, Validate: "! grep -q broken %s"}}
+	res, err := runOnce(host, task, opts, map[string]interface{}{})
+	if err == nil || !res.Failed || !strings.Contains(err.Error(), "left unchanged") {
+		t.Fatalf("expected the failing validator to fail the task, got %+v, %v", res, err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "PermitRootLogin no\n" {
+		t.Errorf("expected the original to be preserved, got %q", data)
+	}
+
+	if err := os.WriteFile(src, []byte("PermitRootLogin yes\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	task.Copy.Validate = "grep -q {{ .key }} %s"
+	out := captureRunOutput(t)
+	res, err = runOnce(host, task, opts, map[string]interface{}{"key": "PermitRootLogin"})
+	if err != nil || !res.Changed {
+		t.Fatalf("expected the passing validator to replace the file, got %+v, %v", res, err)
+	}
+	if !strings.Contains(out.String(), "Copied "+src+" -> "+dest) {
+		t.Errorf("expected the copy reported through the printer, got %q", out.String())
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "PermitRootLogin yes\n" {
+		t.Errorf("expected the file to be replaced, got %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("expected no staged files left behind, got %v", entries)
+	}
+
+	task.Copy.Validate = "sshd -t"
+	if _, err := runOnce(host, task, opts, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "%s") {
+		t.Errorf("expected a validate without %%s to be rejected, got %v", err)
+	}
+}
+
+func TestRunOnce_CopyValidateKeepsMode(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sudoers.new")
+	dest := filepath.Join(dir, "sudoers")
+	if err := os.WriteFile(src, []byte("root ALL=(ALL) ALL\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, []byte("\n"), 0o440); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{Copy: &CopyTask{Src: src, Dest: dest, Validate: "grep -q root %s"}}
+	if _, err := runOnce(inventory.Host{Address: "localhost"}, task, RunOptions{RunLocally: true}, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o440 {
+		t.Errorf("expected dest to keep mode 0440, got %v", info.Mode().Perm())
+	}
+
+	fresh := filepath.Join(dir, "sudoers.d")
+	task.Copy.Dest = fresh
+	if _, err := runOnce(inventory.Host{Address: "localhost"}, task, RunOptions{RunLocally: true}, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("expected a new dest to get mode 0644, got %v", info.Mode().Perm())
+	}
+}
+
+func TestRunOnce_CopyBackup(t *testing.T) {
+	prev := backupTime
+	backupTime = func() time.Time { return time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC) }
+	t.Cleanup(func() { backupTime = prev })
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app.conf.new")
+	dest := filepath.Join(dir, "app.conf")
+	if err := os.WriteFile(src, []byte("port=8080\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, []byte("port=80\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	host := inventory.Host{Address: "localhost"}
+	task := Task{Copy: &CopyTask{Src: src, Dest: dest, Backup: true}}
+
+	res, err := runOnce(host, task, RunOptions{RunLocally: true}, map[string]interface{}{})
+	want := dest + ".20260314T150926.bak"
+	if err != nil || !res.Changed || res.Output != want {
+		t.Fatalf("expected a changed copy reporting %s, got %+v, %v", want, res, err)
+	}
+	if data, _ := os.ReadFile(want); string(data) != "port=80\n" {
+		t.Errorf("expected the backup to hold the old content, got %q", data)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "port=8080\n" {
+		t.Errorf("expected dest to be replaced, got %q", data)
+	}
+
+	backupTime = func() time.Time { return time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC) }
+	res, err = runOnce(host, task, RunOptions{RunLocally: true}, map[string]interface{}{})
+	if err != nil || res.Changed || res.Output != "" {
+		t.Fatalf("expected an unchanged copy to be a no-op, got %+v, %v", res, err)
+	}
+	if matches, _ := filepath.Glob(dest + ".*.bak"); len(matches) != 1 {
+		t.Errorf("expected no backup on a no-op, got %v", matches)
+	}
+}
+
+func TestRunOnce_CopyBackupOnlySkippedWhenDestMissing(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app.conf")
+	if err := os.WriteFile(src, []byte("port=8080\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{Copy: &CopyTask{Src: src, Dest: "/etc/app.conf", Backup: true}}
+	var (
+		commands []string
+		readErr  error
+	)
+	stubSSH(t, func(_, command string) (string, error) {
+		commands = append(commands, command)
+		switch {
+		case strings.HasPrefix(command, "test -e "):
+			return "", readErr
+		case strings.HasPrefix(command, "cat "):
+			return "cat: /etc/app.conf: Permission denied", exitStatusErr(1)
+		}
+		return "", nil
+	})
+	host := inventory.Host{Address: "web1"}
+
+	readErr = exitStatusErr(1)
+	res, err := runOnce(host, task, RunOptions{}, map[string]interface{}{})
+	if err != nil || !res.Changed || res.Output != "" {
+		t.Fatalf("expected a missing dest to be copied without a backup, got %+v, %v", res, err)
+	}
+
+	commands, readErr = nil, nil
+	_, err = runOnce(host, task, RunOptions{}, map[string]interface{}{})
+	if err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Fatalf("expected the unreadable dest to fail the task, got %v", err)
+	}
+	for _, c := range commands {
+		if strings.HasPrefix(c, "copy ") {
+			t.Errorf("expected no copy over a dest that could not be backed up, got %q", commands)
+		}
+	}
+}
+
+func TestRunPlaybook_RetriesPerHost(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: a\n  command: a\n- name: b\n  command: b\n")
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "h1"}, {Address: "h2"}, {Address: "h3"}},
+	}}
+	// h2 fails b on its first attempt, h3 on its first two.
+	failUntil := map[string]int{"h2": 1, "h3": 2}
+
+	run := func(t *testing.T, play Play, opts RunOptions) ([]string, Result, error) {
+		var (
+			mu    sync.Mutex
+			order []string
+			tries = make(map[string]int)
+		)
+		stubSSH(t, func(host, command string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, host+":"+command)
+			if command == "b" {
+				tries[host]++
+				if tries[host] <= failUntil[host] {
+					return "", errors.New("boom")
+				}
+			}
+			return "ok", nil
+		})
+		var out bytes.Buffer
+		prevOut := printer.SetOutput(&out)
+		defer printer.SetOutput(prevOut)
+		opts.ServicesPath = dir
+		opts.Forks = 1
+		res, err := runPlaybook(Playbook{play}, inv, opts)
+		return order, res, err
+	}
+	play := Play{Name: "deploy", Hosts: "web", Services: []Service{{ServiceName: "app"}}}
+
+	t.Run("eventual success", func(t *testing.T) {
+		p := play
+		p.RetriesPerHost = 2
+		order, res, err := run(t, p, RunOptions{RetriesPerHost: 1})
+		if err != nil {
+			t.Fatalf("expected every host to succeed in the end, got %v", err)
+		}
+		want := []string{
+			"h1:a", "h1:b", "h2:a", "h2:b", "h3:a", "h3:b",
+			"h2:a", "h2:b", "h3:a", "h3:b",
+			"h3:a", "h3:b",
+		}
+		if strings.Join(order, " ") != strings.Join(want, " ") {
+			t.Errorf("got %v, want %v", order, want)
+		}
+		wantHosts := []printer.HostSummary{{Host: "h1", Changed: 2}, {Host: "h2", Changed: 2}, {Host: "h3", Changed: 2}}
+		if !reflect.DeepEqual(res.Hosts, wantHosts) || res.Failed || len(res.Failures) != 0 {
+			t.Errorf("expected the recap to show only the last attempts, got %+v", res)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		order, res, err := run(t, play, RunOptions{RetriesPerHost: 1, RetryDelay: time.Millisecond})
+		if !errors.Is(err, ErrTaskFailed) {
+			t.Fatalf("expected ErrTaskFailed, got %v", err)
+		}
+		if len(order) != 10 {
+			t.Errorf("expected one retry of h2 and h3, got %v", order)
+		}
+		wantHosts := []printer.HostSummary{{Host: "h1", Changed: 2}, {Host: "h2", Changed: 2}, {Host: "h3", Changed: 1, Failed: 1}}
+		if !reflect.DeepEqual(res.Hosts, wantHosts) {
+			t.Errorf("got %+v, want %+v", res.Hosts, wantHosts)
+		}
+		if len(res.Failures) != 1 || res.Failures[0].Host != "h3" {
+			t.Errorf("expected only h3's last failure, got %+v", res.Failures)
+		}
+	})
+}
+
+func TestRunPlaybook_IgnoreUnreachable(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: a\n  command: a\n- name: b\n  command: b\n")
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{
+		"web": {{Address: "w1"}, {Address: "down"}, {Address: "w2"}},
+	}}
+	pb := Playbook{
+		{Name: "first", Hosts: "web", Services: []Service{{ServiceName: "app"}}},
+		{Name: "second", Hosts: "web", Services: []Service{{ServiceName: "app"}}},
+	}
+
+	// stub makes "down" unreachable and failing fail, recording every
+	// command run.
+	stub := func(t *testing.T, failing string) *[]string {
+		var (
+			mu  sync.Mutex
+			ran []string
+		)
+		stubSSH(t, func(host, command string) (string, error) {
+			mu.Lock()
+			ran = append(ran, host+":"+command)
+			mu.Unlock()
+			switch host {
+			case "down":
+				return "", &ssh.UnreachableError{Host: host, Err: errors.New("connection refused")}
+			case failing:
+				return "", errors.New("boom")
+			}
+			return "ok", nil
+		})
+		var out bytes.Buffer
+		prevOut := printer.SetOutput(&out)
+		t.Cleanup(func() { printer.SetOutput(prevOut) })
+		return &ran
+	}
+	run := func(t *testing.T, opts RunOptions, failing string) ([]string, Result, error) {
+		ran := stub(t, failing)
+		opts.ServicesPath = dir
+		opts.Forks = 1
+		res, err := runPlaybook(pb, inv, opts)
+		return *ran, res, err
+	}
+
+	t.Run("counted as failed by default", func(t *testing.T) {
+		_, res, err := run(t, RunOptions{}, "")
+		if !errors.Is(err, ErrTaskFailed) || res.Hosts[1].Failed == 0 || res.Hosts[1].Unreachable != 0 {
+			t.Errorf("expected the unreachable host to fail the run, got %v, %+v", err, res.Hosts)
+		}
+	})
+
+	t.Run("reachable hosts finish", func(t *testing.T) {
+		ran, res, err := run(t, RunOptions{IgnoreUnreachable: true, FailFast: true}, "")
+		if !errors.Is(err, ErrHostsUnreachable) || errors.Is(err, ErrTaskFailed) {
+			t.Fatalf("expected ErrHostsUnreachable only, got %v", err)
+		}
+		want := []string{"w1:a", "w1:b", "down:a", "w2:a", "w2:b", "w1:a", "w1:b", "w2:a", "w2:b"}
+		if strings.Join(ran, " ") != strings.Join(want, " ") {
+			t.Errorf("got %v, want %v", ran, want)
+		}
+		wantHosts := []printer.HostSummary{{Host: "w1", Changed: 4}, {Host: "down", Unreachable: 1}, {Host: "w2", Changed: 4}}
+		if !reflect.DeepEqual(res.Hosts, wantHosts) || res.Failed || len(res.Failures) != 0 {
+			t.Errorf("got %+v, want hosts %+v", res, wantHosts)
+		}
+	})
+
+	t.Run("ok on unreachable", func(t *testing.T) {
+		if _, _, err := run(t, RunOptions{IgnoreUnreachable: true, OkOnUnreachable: true}, ""); err != nil {
+			t.Errorf("expected success, got %v", err)
+		}
+	})
+
+	t.Run("task failures still fail", func(t *testing.T) {
+		_, _, err := run(t, RunOptions{IgnoreUnreachable: true, OkOnUnreachable: true}, "w2")
+		if !errors.Is(err, ErrTaskFailed) {
+			t.Errorf("expected ErrTaskFailed, got %v", err)
+		}
+	})
+
+	t.Run("ad hoc", func(t *testing.T) {
+		stub(t, "")
+		_, err := runAdHoc(inv, "web", []string{"uptime"}, false, RunOptions{IgnoreUnreachable: true})
+		if !errors.Is(err, ErrHostsUnreachable) {
+			t.Errorf("expected ErrHostsUnreachable, got %v", err)
+		}
+	})
+}
+
+func TestRunPlaybook_GroupAndPlayForks(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "upgrade", "- name: upgrade\n  command: upgrade\n")
+	var (
+		mu      sync.Mutex
+		running = make(map[string]int)
+		peak    = make(map[string]int)
+	)
+	// web hosts wait for each other, so their play only finishes when all
+	// three run at once.
+	webArrived := make(chan struct{}, 3)
+	stubSSH(t, func(host, _ string) (string, error) {
+		group := host[:len(host)-1]
+		mu.Lock()
+		running[group]++
+		if running[group] > peak[group] {
+			peak[group] = running[group]
+		}
+		mu.Unlock()
+		if group == "web" {
+			webArrived <- struct{}{}
+			for len(webArrived) < 3 {
+				time.Sleep(time.Millisecond)
+			}
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mu.Lock()
+		running[group]--
+		mu.Unlock()
+		return "ok", nil
+	})
+	captureRunOutput(t)
+
+	inv := &inventory.Inventory{
+		Hosts: map[string][]inventory.Host{
+			"db":    {{Address: "db1"}, {Address: "db2"}, {Address: "db3"}},
+			"web":   {{Address: "web1"}, {Address: "web2"}, {Address: "web3"}},
+			"cache": {{Address: "cache1"}, {Address: "cache2"}, {Address: "cache3"}},
+		},
+		GroupVars: map[string]map[string]interface{}{"db": {"forks": "1"}},
+	}
+	pb := Playbook{
+		{Name: "db", Hosts: "db", Services: []Service{{ServiceName: "upgrade"}}},
+		{Name: "web", Hosts: "web", Services: []Service{{ServiceName: "upgrade"}}},
+		{Name: "cache", Hosts: "cache", Forks: 2, Services: []Service{{ServiceName: "upgrade"}}},
+	}
+	done := make(chan error, 1)
+	go func() { done <- RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Forks: 3}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the web hosts to run concurrently at the global forks")
+	}
+	if peak["db"] != 1 {
+		t.Errorf("expected db hosts one at a time, peak %d", peak["db"])
+	}
+	if peak["cache"] > 2 {
+		t.Errorf("expected at most 2 cache hosts at once, peak %d", peak["cache"])
+	}
+}
+
+func TestPlayForks(t *testing.T) {
+	inv := &inventory.Inventory{GroupVars: map[string]map[string]interface{}{
+		"db":  {"forks": "2"},
+		"bad": {"forks": "many"},
+	}}
+	for _, tc := range []struct {
+		play Play
+		want int
+	}{
+		{Play{Hosts: "web"}, 10},
+		{Play{Hosts: "web", Forks: 4}, 4},
+		{Play{Hosts: "web", Forks: 20}, 10},
+		{Play{Hosts: "db"}, 2},
+		{Play{Hosts: "db", Forks: 1}, 1},
+		{Play{Hosts: "db", Forks: 5}, 2},
+		{Play{Hosts: "bad"}, 10},
+	} {
+		if got := playForks(tc.play, inv, RunOptions{Forks: 10}); got != tc.want {
+			t.Errorf("playForks(%+v) = %d, want %d", tc.play, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package tasks
+
+import (
+	"context"
+	"sync"
+)
+
+// throttles holds a semaphore per task with a throttle, shared by every
+// host of a run, so at most Task.Throttle hosts run the task at once
+// whatever the forks. Hosts waiting for a slot hold their fork; the other
+// hosts carry on. A nil *throttles limits nothing.
+type throttles struct {
+	mu   sync.Mutex
+	sems map[*Task]chan struct{}
+}
+
+func newThrottles() *throttles {
+	return &throttles{sems: make(map[*Task]chan struct{})}
+}
+
+// acquire waits until task may start on one more host and returns the
+// function giving its slot back. It returns false, without a slot, when
+// ctx is done first. task must point into the task list every host runs,
+// as its address identifies the task.
+func (t *throttles) acquire(ctx context.Context, task *Task) (release func(), ok bool) {
+	if t == nil || task.Throttle <= 0 {
+		return func() {}, true
+	}
+	t.mu.Lock()
+	sem, found := t.sems[task]
+	if !found {
+		sem = make(chan struct{}, task.Throttle)
+		t.sems[task] = sem
+	}
+	t.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,46 @@
+package tasks
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"for/pkg/inventory"
+)
+
+func TestRunPlaybook_ThrottleCapsTaskConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "sync", "- name: prepare\n  command: prepare\n- name: mirror\n  command: mirror\n  throttle: 2\n")
+	var (
+		mu            sync.Mutex
+		running, peak = map[string]int{}, map[string]int{}
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		running[command]++
+		peak[command] = max(peak[command], running[command])
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running[command]--
+		mu.Unlock()
+		return "", nil
+	})
+
+	var hosts []inventory.Host
+	for i := range 10 {
+		hosts = append(hosts, inventory.Host{Address: fmt.Sprintf("w%d", i)})
+	}
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": hosts}}
+	pb := Playbook{{Name: "p", Hosts: "web", Strategy: StrategyFree, Services: []Service{{ServiceName: "sync"}}}}
+	if err := RunPlaybook(pb, inv, RunOptions{ServicesPath: dir, Forks: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if peak["mirror"] != 2 {
+		t.Errorf("expected at most and at some point 2 hosts running the throttled task, got %d", peak["mirror"])
+	}
+	if peak["prepare"] <= 2 {
+		t.Errorf("expected the unthrottled task to run on more than 2 hosts at once, got %d", peak["prepare"])
+	}
+}
@@ -0,0 +1,43 @@
+package tasks
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Conditions is a task's when: value, one condition or a list of them that
+// must all hold (implicit AND, as in Ansible).
+type Conditions []string
+
+// UnmarshalYAML accepts a single condition as well as a list of conditions.
+func (c *Conditions) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		*c = Conditions{n.Value}
+	case yaml.SequenceNode:
+		conds := make(Conditions, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: when entries must be conditions", item.Line)
+			}
+			conds = append(conds, item.Value)
+		}
+		*c = conds
+	default:
+		return fmt.Errorf("line %d: when must be a condition or a list of them", n.Line)
+	}
+	return nil
+}
+
+// evaluateConditions reports whether every condition of when holds, stopping
+// at the first that does not. No conditions always hold.
+func evaluateConditions(when Conditions, vars map[string]interface{}) (bool, error) {
+	for _, cond := range when {
+		ok, err := evaluateCondition(cond, vars)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
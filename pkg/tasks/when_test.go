@@ -0,0 +1,228 @@
+package tasks
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"for/pkg/inventory"
+	"for/pkg/printer"
+)
+
+// captureRunOutput sends printer output to a buffer for the rest of the test.
+func captureRunOutput(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	prev := printer.SetOutput(&out)
+	t.Cleanup(func() { printer.SetOutput(prev) })
+	return &out
+}
+
+func TestLoadServiceTasks_WhenList(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", `- name: single
+  command: a
+  when: '{{ .enabled }}'
+- name: both
+  command: b
+  when:
+    - '{{ .enabled }}'
+    - '{{ eq .env "prod" }}'
+`)
+	tasks, err := LoadServiceTasks(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Conditions{"{{ .enabled }}"}); !reflect.DeepEqual(tasks[0].When, want) {
+		t.Errorf("expected %q, got %q", want, tasks[0].When)
+	}
+	if want := (Conditions{"{{ .enabled }}", `{{ eq .env "prod" }}`}); !reflect.DeepEqual(tasks[1].When, want) {
+		t.Errorf("expected %q, got %q", want, tasks[1].When)
+	}
+
+	writeService(t, dir, "bad", "- name: bad\n  command: a\n  when:\n    enabled: true\n")
+	if _, err := LoadServiceTasks(dir, "bad"); err == nil || !strings.Contains(err.Error(), "when must be a condition or a list of them") {
+		t.Errorf("expected an invalid when error, got %v", err)
+	}
+}
+
+func TestRunHostTasks_WhenListIsAnd(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	captureRunOutput(t)
+	when := Conditions{"{{ .enabled }}", `{{ eq .env "prod" }}`}
+	tasks := []Task{{Name: "deploy", Command: "deploy", When: when}}
+
+	tests := []struct {
+		vars map[string]interface{}
+		runs bool
+	}{
+		{map[string]interface{}{"enabled": true, "env": "prod"}, true},
+		{map[string]interface{}{"enabled": true, "env": "staging"}, false},
+		{map[string]interface{}{"enabled": false, "env": "prod"}, false},
+	}
+	for _, tt := range tests {
+		*commands = nil
+		sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{}, tt.vars)
+		if ran := len(*commands) == 1; ran != tt.runs {
+			t.Errorf("%v: expected run=%v, got commands %q", tt.vars, tt.runs, *commands)
+		}
+		if skipped := sum.Skipped == 1; skipped == tt.runs {
+			t.Errorf("%v: expected skipped=%v, got %+v", tt.vars, !tt.runs, sum)
+		}
+	}
+}
+
+func TestRunHostTasks_WhenSkipsLoopItems(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	out := captureRunOutput(t)
+	tasks := []Task{{
+		Name:      "install",
+		Command:   "install {{ .item }}",
+		WithItems: []interface{}{"nginx", "telnet", "curl"},
+		When:      Conditions{`{{ ne .item "telnet" }}`},
+	}}
+
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{}, map[string]interface{}{})
+	want := []string{"install nginx", "install curl"}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("expected %q, got %q", want, *commands)
+	}
+	if sum.Changed != 1 || sum.Skipped != 0 {
+		t.Errorf("expected the task to count once as changed, got %+v", sum)
+	}
+	got := out.String()
+	if !strings.Contains(got, "skipping: [w1] => (item=telnet)") {
+		t.Errorf("expected the skipped item reported, got %q", got)
+	}
+	if strings.Contains(got, "item=nginx") || strings.Contains(got, "item=curl") {
+		t.Errorf("expected only the skipped item reported, got %q", got)
+	}
+}
+
+func TestRunHostTasks_WhenListWithLoopItems(t *testing.T) {
+	commands := stubConnection(t, ConnectionSSH, "")
+	out := captureRunOutput(t)
+	tasks := []Task{{
+		Name:      "open",
+		Command:   "open {{ .item }}",
+		WithItems: []interface{}{80, 443, 8080},
+		When:      Conditions{"{{ .firewall }}", "{{ lt .item 1024 }}"},
+	}}
+
+	sum := runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{}, map[string]interface{}{"firewall": true})
+	if want := []string{"open 80", "open 443"}; !reflect.DeepEqual(*commands, want) {
+		t.Errorf("expected %q, got %q", want, *commands)
+	}
+	if sum.Changed != 1 || !strings.Contains(out.String(), "skipping: [w1] => (item=8080)") {
+		t.Errorf("expected item 8080 skipped and the task changed, got %+v and %q", sum, out.String())
+	}
+
+	// With the first condition false every item is skipped, and so is the task.
+	*commands = nil
+	out.Reset()
+	sum = runHostTasks(inventory.Host{Address: "w1"}, tasks, nil, RunOptions{}, map[string]interface{}{"firewall": false})
+	if len(*commands) != 0 {
+		t.Errorf("expected nothing to run, got %q", *commands)
+	}
+	if sum.Skipped != 1 || sum.Changed != 0 {
+		t.Errorf("expected the task skipped, got %+v", sum)
+	}
+	if got := strings.Count(out.String(), "skipping: [w1] => (item="); got != 3 {
+		t.Errorf("expected every item reported skipped, got %d in %q", got, out.String())
+	}
+}
+
+func TestLoadTasks_PlayWhen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playbook.yml")
+	os.WriteFile(path, []byte(`- name: single
+  hosts: web
+  when: '{{ eq .env "prod" }}'
+  services: [{service: app}]
+- name: list
+  hosts: web
+  when:
+    - '{{ eq .env "prod" }}'
+    - '{{ eq .os "linux" }}'
+  services: [{service: app}]
+`), 0o644)
+	pb, err := LoadTasks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Conditions{`{{ eq .env "prod" }}`}); !reflect.DeepEqual(pb[0].When, want) {
+		t.Errorf("expected %q, got %q", want, pb[0].When)
+	}
+	if want := (Conditions{`{{ eq .env "prod" }}`, `{{ eq .os "linux" }}`}); !reflect.DeepEqual(pb[1].When, want) {
+		t.Errorf("expected %q, got %q", want, pb[1].When)
+	}
+}
+
+func TestRunPlaybook_PlayWhenSkipsHosts(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n- name: migrate\n  command: migrate\n  when: '{{ .primary }}'\n")
+	var (
+		mu  sync.Mutex
+		ran = map[string][]string{}
+	)
+	stubSSH(t, func(host, command string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran[host] = append(ran[host], command)
+		return "", nil
+	})
+	out := captureRunOutput(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {
+		{Address: "w1", Vars: map[string]interface{}{"env": "prod", "primary": true}},
+		{Address: "w2", Vars: map[string]interface{}{"env": "prod", "primary": false}},
+		{Address: "s1", Vars: map[string]interface{}{"env": "staging", "primary": true}},
+	}}}
+	pb := Playbook{{
+		Name:     "p",
+		Hosts:    "web",
+		When:     Conditions{`{{ eq .env "prod" }}`, "{{ .inventory_hostname | ne \"w3\" }}"},
+		Services: []Service{{ServiceName: "app"}},
+	}}
+	res, err := runPlaybook(pb, inv, RunOptions{ServicesPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The play's when and the task's when must both hold for migrate.
+	want := map[string][]string{"w1": {"deploy", "migrate"}, "w2": {"deploy"}}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("expected %v, got %v", want, ran)
+	}
+	if !strings.Contains(out.String(), "skipping: [s1]") {
+		t.Errorf("expected s1 reported skipped, got %q", out.String())
+	}
+	for _, sum := range res.Hosts {
+		if sum.Host == "s1" && (sum.Skipped != 1 || sum.Changed != 0) {
+			t.Errorf("expected s1 to count one skip, got %+v", sum)
+		}
+	}
+}
+
+func TestRunPlaybook_PlayWhenError(t *testing.T) {
+	dir := t.TempDir()
+	writeService(t, dir, "app", "- name: deploy\n  command: deploy\n")
+	commands := stubConnection(t, ConnectionSSH, "")
+	captureRunOutput(t)
+
+	inv := &inventory.Inventory{Hosts: map[string][]inventory.Host{"web": {{Address: "w1"}}}}
+	pb := Playbook{{Name: "p", Hosts: "web", When: Conditions{"{{ .missing.field }}"}, Services: []Service{{ServiceName: "app"}}}}
+	res, err := runPlaybook(pb, inv, RunOptions{ServicesPath: dir})
+	if err == nil {
+		t.Error("expected the run to fail")
+	}
+	if len(*commands) != 0 {
+		t.Errorf("expected nothing to run, got %q", *commands)
+	}
+	if !res.Failed || len(res.Failures) != 1 {
+		t.Errorf("expected the host to fail the play, got %+v", res)
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// SplitArgs splits s into words the way sh would, without expanding
+// anything: words are separated by blanks, single quotes keep their content
+// as is, double quotes keep theirs except for \", \\, \$ and \` escapes, and
+// a backslash outside quotes escapes the next character. Shell
+// metacharacters such as |, > or $VAR are ordinary characters.
+func SplitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		word    strings.Builder
+		inWord  bool
+		escaped bool
+		quote   rune
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\"\\$`", r) {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	switch {
+	case quote != 0:
+		return nil, errors.New("unterminated quote in " + s)
+	case escaped:
+		return nil, errors.New("trailing backslash in " + s)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// ShellJoin returns the command line sh splits back into args, quoting (see
+// ShellQuote) only the words that need it.
+func ShellJoin(args []string) string {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = arg
+		if arg == "" || strings.IndexFunc(arg, unsafeShellRune) >= 0 {
+			words[i] = ShellQuote(arg)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// unsafeShellRune reports whether r may mean something to sh in an unquoted
+// word.
+func unsafeShellRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_./:=,+@%", r)
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := map[string][]string{
+		"":                              nil,
+		"  uptime  ":                    {"uptime"},
+		"echo a | grep b":               {"echo", "a", "|", "grep", "b"},
+		`echo 'a b' "c d" e\ f`:         {"echo", "a b", "c d", "e f"},
+		`printf "%s" "say \"hi\" \n"`:   {"printf", "%s", `say "hi" \n`},
+		`echo $HOME 'it''s' ""`:         {"echo", "$HOME", "its", ""},
+		"ls\t-l\n/tmp":                  {"ls", "-l", "/tmp"},
+		`touch '$(id)' "semi;colon" \&`: {"touch", "$(id)", "semi;colon", "&"},
+	}
+	for in, want := range cases {
+		got, err := SplitArgs(in)
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestSplitArgs_Unterminated(t *testing.T) {
+	for _, in := range []string{`echo 'a`, `echo "a`, `echo a\`} {
+		if _, err := SplitArgs(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestShellJoin_RoundTrip(t *testing.T) {
+	args := []string{"plain", "with space", "", "it's", "a|b", "$HOME", "`id`", "/etc/app.conf", "--flag=x,y"}
+	line := ShellJoin(args)
+	if !strings.HasPrefix(line, "plain 'with space' '' ") || !strings.HasSuffix(line, " /etc/app.conf --flag=x,y") {
+		t.Errorf("expected only unsafe words quoted, got %s", line)
+	}
+	got, err := exec.Command("sh", "-c", `show() { for a in "$@"; do printf '[%s]' "$a"; done; }; show `+line).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ""
+	for _, a := range args {
+		want += "[" + a + "]"
+	}
+	if string(got) != want {
+		t.Errorf("expected sh to see %s, got %s", want, got)
+	}
+}
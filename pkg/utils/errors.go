@@ -0,0 +1,20 @@
+package utils
+
+// Mark returns err with kind added to its chain, so errors.Is(err, kind)
+// holds while the message and the errors err already wraps are unchanged.
+// It returns nil when err is nil.
+func Mark(err, kind error) error {
+	if err == nil {
+		return nil
+	}
+	return &markedError{err: err, kind: kind}
+}
+
+type markedError struct {
+	err  error
+	kind error
+}
+
+func (e *markedError) Error() string { return e.err.Error() }
+
+func (e *markedError) Unwrap() []error { return []error{e.err, e.kind} }
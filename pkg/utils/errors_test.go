@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestMark(t *testing.T) {
+	errKind := errors.New("kind")
+	yamlErr := &YAMLError{File: "a.yaml", Line: 3, Msg: "bad"}
+	err := Mark(yamlErr, errKind)
+	if err.Error() != "a.yaml:3: bad" {
+		t.Errorf("expected the message unchanged, got %q", err)
+	}
+	var got *YAMLError
+	if !errors.Is(err, errKind) || !errors.As(err, &got) || got != yamlErr {
+		t.Errorf("expected both the kind and the original error in the chain, got %v", err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Error("expected no other kinds to match")
+	}
+	if Mark(nil, errKind) != nil {
+		t.Error("expected nil for a nil error")
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ErrNoTerminal is returned by PromptSecret when in is a file that is not a
+// terminal, e.g. when stdin is redirected under cron or CI.
+var ErrNoTerminal = errors.New("no terminal to prompt on")
+
+// PromptSecret shows prompt on out and reads one line from in. When in is an
+// *os.File it must be a terminal and the answer is read without echo; any
+// other reader (as used in tests) is read as a plain line. The answer is
+// never written anywhere.
+func PromptSecret(in io.Reader, out io.Writer, prompt string) (string, error) {
+	if f, ok := in.(*os.File); ok {
+		if !term.IsTerminal(int(f.Fd())) {
+			return "", ErrNoTerminal
+		}
+		fmt.Fprint(out, prompt)
+		b, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(out)
+		return string(b), err
+	}
+	fmt.Fprint(out, prompt)
+	line, err := readLine(in)
+	fmt.Fprintln(out)
+	return line, err
+}
+
+// readLine reads up to a newline a byte at a time, so nothing after it is
+// consumed and the next prompt can read from the same reader.
+func readLine(in io.Reader) (string, error) {
+	var line strings.Builder
+	b := make([]byte, 1)
+	for {
+		n, err := in.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line.WriteByte(b[0])
+		}
+		if err == io.EOF && line.Len() > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimRight(line.String(), "\r"), nil
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPromptSecret_ReadsOneLineEach(t *testing.T) {
+	in := strings.NewReader("ssh-secret\r\nsudo-secret")
+	var out bytes.Buffer
+	first, err := PromptSecret(in, &out, "SSH password: ")
+	if err != nil || first != "ssh-secret" {
+		t.Fatalf("got %q, %v", first, err)
+	}
+	second, err := PromptSecret(in, &out, "BECOME password: ")
+	if err != nil || second != "sudo-secret" {
+		t.Fatalf("got %q, %v", second, err)
+	}
+	if got := out.String(); got != "SSH password: \nBECOME password: \n" {
+		t.Errorf("expected only the prompts on out, got %q", got)
+	}
+	if _, err := PromptSecret(in, &out, "again: "); err != io.EOF {
+		t.Errorf("expected EOF once the input is used up, got %v", err)
+	}
+}
+
+func TestPromptSecret_NotATerminal(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	if _, err := PromptSecret(f, &out, "SSH password: "); !errors.Is(err, ErrNoTerminal) {
+		t.Errorf("expected ErrNoTerminal, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no prompt without a terminal, got %q", out.String())
+	}
+}
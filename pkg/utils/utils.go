@@ -3,6 +3,7 @@ package utils
 import (
     "os"
     "path/filepath"
+    "strings"
 )
 
 // IsScript checks if the given command is a script file based on its extension and existence.
@@ -15,3 +16,13 @@ func IsScript(command string) bool {
     }
     return false
 }
+
+// ShellQuote returns s as a single POSIX shell word. The value is wrapped in
+// single quotes and embedded single quotes are written as '\'' so that no
+// character (spaces, $, backticks, newlines) is interpreted by sh.
+func ShellQuote(s string) string {
+    if s == "" {
+        return "''"
+    }
+    return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"os"
+	"os/exec"
 	"testing"
 )
 
@@ -34,3 +35,38 @@ func TestIsScript_NoExtension(t *testing.T) {
 		t.Error("expected false for file without script extension")
 	}
 }
+
+func TestShellQuote_RoundTrip(t *testing.T) {
+	cases := []string{
+		"",
+		"plain",
+		"with spaces  and\ttabs",
+		"it's",
+		"'''",
+		"$HOME ${PATH}",
+		"`id`",
+		"$(rm -rf /)",
+		"line1\nline2",
+		"semi; colon && pipe | amp &",
+		`back\slash "double"`,
+	}
+	for _, in := range cases {
+		out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(in)).Output()
+		if err != nil {
+			t.Errorf("sh failed for %q: %v", in, err)
+			continue
+		}
+		if string(out) != in {
+			t.Errorf("round trip mismatch: expected %q, got %q", in, out)
+		}
+	}
+}
+
+func TestShellQuote_Format(t *testing.T) {
+	if got := ShellQuote("it's"); got != `'it'\''s'` {
+		t.Errorf("unexpected quoting: %s", got)
+	}
+	if got := ShellQuote(""); got != "''" {
+		t.Errorf("expected empty string to quote as '', got %s", got)
+	}
+}
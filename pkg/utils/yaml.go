@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StrictYAML makes DecodeYAML reject keys that do not map to a struct field,
+// so typos such as "ssh_usr" fail loudly. Disabled by --no-strict.
+var StrictYAML = true
+
+// YAMLError is a parse or shape error at a position in a YAML file.
+// Line and Column are 1-based; zero means unknown.
+type YAMLError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *YAMLError) Error() string {
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+	case e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	default:
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+}
+
+// NodeError returns a YAMLError positioned at n.
+func NodeError(file string, n *yaml.Node, format string, args ...interface{}) error {
+	return &YAMLError{File: file, Line: n.Line, Column: n.Column, Msg: fmt.Sprintf(format, args...)}
+}
+
+// NodeKind describes n for error messages, e.g. "a list".
+func NodeKind(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.ScalarNode:
+		return fmt.Sprintf("the value %q", n.Value)
+	case yaml.AliasNode:
+		return "an alias"
+	default:
+		return "an empty document"
+	}
+}
+
+// Resolve follows alias nodes to the node they refer to.
+func Resolve(n *yaml.Node) *yaml.Node {
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+// ParseYAML parses data into a node tree for shape validation. It returns nil
+// for an empty document.
+func ParseYAML(file string, data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, yamlError(file, err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc.Content[0], nil
+}
+
+// DecodeYAML unmarshals data read from file into out. Errors carry the file
+// name and, where the library reports one, the line. An empty document
+// leaves out unchanged.
+func DecodeYAML(file string, data []byte, out interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(StrictYAML)
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return yamlError(file, err)
+	}
+	return nil
+}
+
+// DecodeNode decodes n, a node parsed from file, into out like DecodeYAML.
+// Errors are positioned at n: lines within it are not known once it is
+// decoded on its own.
+func DecodeNode(file string, n *yaml.Node, out interface{}) error {
+	data, err := yaml.Marshal(n)
+	if err != nil {
+		return NodeError(file, n, "%v", err)
+	}
+	err = DecodeYAML(file, data, out)
+	if err == nil {
+		return nil
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, e := range errs {
+		var yamlErr *YAMLError
+		if errors.As(e, &yamlErr) {
+			yamlErr.Line, yamlErr.Column = n.Line, n.Column
+		}
+	}
+	return err
+}
+
+var (
+	yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlTags   = strings.NewReplacer("!!map", "a mapping", "!!seq", "a list", "!!str", "a string",
+		"!!int", "an integer", "!!bool", "a boolean", "!!float", "a number")
+)
+
+// yamlError converts a yaml.v3 error into one or more YAMLErrors.
+func yamlError(file string, err error) error {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		errs := make([]error, 0, len(typeErr.Errors))
+		for _, msg := range typeErr.Errors {
+			errs = append(errs, lineError(file, msg))
+		}
+		return errors.Join(errs...)
+	}
+	return lineError(file, err.Error())
+}
+
+func lineError(file, msg string) *YAMLError {
+	if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &YAMLError{File: file, Line: line, Msg: yamlTags.Replace(m[2])}
+	}
+	return &YAMLError{File: file, Msg: yamlTags.Replace(strings.TrimPrefix(msg, "yaml: "))}
+}
@@ -0,0 +1,77 @@
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Edit opens the whole-file-encrypted file in editor, a shell command such
+// as $EDITOR that is run with the path to edit appended. The plaintext lives
+// only in a private temporary directory that is removed afterwards, also on
+// error. When the editor exits non-zero file is left untouched; otherwise
+// the edited content is encrypted with password and atomically replaces
+// file. Unchanged content is not re-encrypted.
+func Edit(file, password, editor string) error {
+	plain, err := DecryptFile(file, password)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "for-vault-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(file))
+	if err := os.WriteFile(tmp, []byte(plain), 0o600); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", tmp)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %q failed, %s left unchanged: %w", editor, file, err)
+	}
+	edited, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, []byte(plain)) {
+		return nil
+	}
+	enc, err := Encrypt(string(edited), password)
+	if err != nil {
+		return err
+	}
+	return replaceFile(file, []byte(enc+"\n"))
+}
+
+// replaceFile writes data to a temporary file next to file, with file's
+// permissions, and renames it over file.
+func replaceFile(file string, data []byte) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".for-vault-*")
+	if err != nil {
+		return fmt.Errorf("staging %s: %w", file, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("writing %s: %w", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeEncrypted writes plain, encrypted with password, to a new file.
+func writeEncrypted(t *testing.T, dir, plain, password string) string {
+	t.Helper()
+	enc, err := Encrypt(plain, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "secrets.yaml")
+	if err := os.WriteFile(file, []byte(enc+"\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// writeEditor writes a shell script that stands in for $EDITOR.
+func writeEditor(t *testing.T, dir, body string) string {
+	t.Helper()
+	editor := filepath.Join(dir, "editor.sh")
+	if err := os.WriteFile(editor, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return editor
+}
+
+func TestEdit_ReencryptsEditedContent(t *testing.T) {
+	dir := t.TempDir()
+	file := writeEncrypted(t, dir, "db_password: old\n", "pw")
+	seen := filepath.Join(dir, "seen")
+	editor := writeEditor(t, dir, `echo "$1" > `+seen+`
+sed -i 's/old/new/' "$1"
+echo "api_key: abc" >> "$1"
+`)
+
+	if err := Edit(file, "pw", editor); err != nil {
+		t.Fatalf("Edit: %v", err)
+	}
+	data, _ := os.ReadFile(file)
+	if !IsEncrypted(strings.TrimSpace(string(data))) {
+		t.Fatalf("expected the file to stay encrypted, got %q", data)
+	}
+	got, err := DecryptFile(file, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "db_password: new\napi_key: abc\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0o640 {
+		t.Errorf("expected the file mode to be kept, got %v", info.Mode().Perm())
+	}
+	tmp, _ := os.ReadFile(seen)
+	if _, err := os.Stat(strings.TrimSpace(string(tmp))); !os.IsNotExist(err) {
+		t.Errorf("expected the plaintext temp file to be removed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Errorf("expected no files left next to the original, got %v", entries)
+	}
+}
+
+func TestEdit_EditorFailureLeavesFileUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	file := writeEncrypted(t, dir, "db_password: old\n", "pw")
+	before, _ := os.ReadFile(file)
+	seen := filepath.Join(dir, "seen")
+	editor := writeEditor(t, dir, `echo "$1" > `+seen+`
+echo "half-written" > "$1"
+exit 1
+`)
+
+	err := Edit(file, "pw", editor)
+	if err == nil || !strings.Contains(err.Error(), "left unchanged") {
+		t.Fatalf("expected the editor failure to be reported, got %v", err)
+	}
+	if after, _ := os.ReadFile(file); string(after) != string(before) {
+		t.Error("expected the original file to be untouched")
+	}
+	tmp, _ := os.ReadFile(seen)
+	if _, err := os.Stat(strings.TrimSpace(string(tmp))); !os.IsNotExist(err) {
+		t.Errorf("expected the plaintext temp file to be removed, got %v", err)
+	}
+}
+
+func TestEdit_NotEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "plain.yaml")
+	os.WriteFile(file, []byte("a: b\n"), 0o600)
+	if err := Edit(file, "pw", writeEditor(t, dir, "exit 0\n")); err == nil || !strings.Contains(err.Error(), "not vault-encrypted") {
+		t.Errorf("expected a not encrypted error, got %v", err)
+	}
+}
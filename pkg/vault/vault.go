@@ -11,6 +11,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -20,6 +21,10 @@ import (
 // Prefix identifies vault-encrypted strings.
 const Prefix = "$FORVAULT;"
 
+// aadMarker follows Prefix in values bound to a label with EncryptWithAAD.
+// Removing it does not unbind a value: the label is still needed to open it.
+const aadMarker = "aad;"
+
 func deriveKey(password string) []byte {
 	h := sha256.Sum256([]byte(password))
 	return h[:]
@@ -28,39 +33,78 @@ func deriveKey(password string) []byte {
 // Encrypt encrypts plaintext with AES-256-GCM using the given password.
 // The result is prefixed with Prefix so it can later be identified and decrypted.
 func Encrypt(plaintext, password string) (string, error) {
-	key := deriveKey(password)
-	block, err := aes.NewCipher(key)
+	sealed, err := seal(plaintext, password, nil)
 	if err != nil {
 		return "", err
 	}
-	gcm, err := cipher.NewGCM(block)
+	return Prefix + sealed, nil
+}
+
+// EncryptWithAAD is Encrypt with the value bound to label (e.g. the config
+// key it is stored under), which is passed to GCM as additional data. Such a
+// value only decrypts with DecryptWithAAD and the same label, so moving it
+// to another key is detected.
+func EncryptWithAAD(plaintext, password, label string) (string, error) {
+	sealed, err := seal(plaintext, password, []byte(label))
 	if err != nil {
 		return "", err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
-	}
-	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return Prefix + base64.StdEncoding.EncodeToString(sealed), nil
+	return Prefix + aadMarker + sealed, nil
 }
 
 // Decrypt decrypts a vault-encrypted string. If the string does not start with
 // Prefix it is returned unchanged (pass-through for plain-text values).
+// Values bound to a label need DecryptWithAAD.
 func Decrypt(ciphertext, password string) (string, error) {
 	if !strings.HasPrefix(ciphertext, Prefix) {
 		return ciphertext, nil
 	}
-	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, Prefix))
+	body := strings.TrimPrefix(ciphertext, Prefix)
+	if strings.HasPrefix(body, aadMarker) {
+		return "", fmt.Errorf("vault decrypt: value is bound to a label")
+	}
+	return open(body, password, nil)
+}
+
+// DecryptWithAAD decrypts a value produced by EncryptWithAAD, failing unless
+// label matches the one it was encrypted with. Values from Encrypt (not bound
+// to any label) and plain text are accepted as with Decrypt.
+func DecryptWithAAD(ciphertext, password, label string) (string, error) {
+	if !strings.HasPrefix(ciphertext, Prefix) {
+		return ciphertext, nil
+	}
+	body := strings.TrimPrefix(ciphertext, Prefix)
+	if !strings.HasPrefix(body, aadMarker) {
+		return open(body, password, nil)
+	}
+	plain, err := open(strings.TrimPrefix(body, aadMarker), password, []byte(label))
 	if err != nil {
-		return "", fmt.Errorf("vault decode: %w", err)
+		return "", fmt.Errorf("%w (wrong password, or value not bound to %q)", err, label)
 	}
-	key := deriveKey(password)
-	block, err := aes.NewCipher(key)
+	return plain, nil
+}
+
+// seal encrypts plaintext and returns the base64 nonce and ciphertext.
+func seal(plaintext, password string, aad []byte) (string, error) {
+	gcm, err := newGCM(password)
 	if err != nil {
 		return "", err
 	}
-	gcm, err := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), aad)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open reverses seal.
+func open(encoded, password string, aad []byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("vault decode: %w", err)
+	}
+	gcm, err := newGCM(password)
 	if err != nil {
 		return "", err
 	}
@@ -68,13 +112,21 @@ func Decrypt(ciphertext, password string) (string, error) {
 	if len(data) < ns {
 		return "", fmt.Errorf("vault: ciphertext too short")
 	}
-	plain, err := gcm.Open(nil, data[:ns], data[ns:], nil)
+	plain, err := gcm.Open(nil, data[:ns], data[ns:], aad)
 	if err != nil {
 		return "", fmt.Errorf("vault decrypt: %w", err)
 	}
 	return string(plain), nil
 }
 
+func newGCM(password string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(password))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // IsEncrypted reports whether s is vault-encrypted.
 func IsEncrypted(s string) bool {
 	return strings.HasPrefix(s, Prefix)
@@ -89,10 +141,44 @@ func LoadPassword(file string) (string, error) {
 	return strings.TrimSpace(string(data)), nil
 }
 
-// DecryptMap decrypts every vault-encrypted value in m in-place.
+// ErrNotEncrypted is returned by DecryptFile and View for a file whose
+// content is not vault-encrypted.
+var ErrNotEncrypted = errors.New("not vault-encrypted")
+
+// DecryptFile returns the plaintext of a file whose whole content is
+// vault-encrypted. Nothing is written to disk.
+func DecryptFile(file, password string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	content := strings.TrimSpace(string(data))
+	if !IsEncrypted(content) {
+		return "", fmt.Errorf("%s: %w", file, ErrNotEncrypted)
+	}
+	plain, err := Decrypt(content, password)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	return plain, nil
+}
+
+// View writes the plaintext of the whole-file-encrypted file to w; see
+// DecryptFile.
+func View(w io.Writer, file, password string) error {
+	plain, err := DecryptFile(file, password)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, plain)
+	return err
+}
+
+// DecryptMap decrypts every vault-encrypted value in m in-place. Values bound
+// with EncryptWithAAD must be bound to their key.
 func DecryptMap(m map[string]string, password string) error {
 	for k, v := range m {
-		dec, err := Decrypt(v, password)
+		dec, err := DecryptWithAAD(v, password, k)
 		if err != nil {
 			return fmt.Errorf("decrypting key %q: %w", k, err)
 		}
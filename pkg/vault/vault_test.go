@@ -1,6 +1,13 @@
 package vault
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestEncryptDecrypt_RoundTrip(t *testing.T) {
 	plaintext := "super-secret-password"
@@ -79,3 +86,86 @@ func TestDecryptMap(t *testing.T) {
 		t.Errorf("expected decrypted value 'plain', got %q", m["enc"])
 	}
 }
+
+func TestEncryptWithAAD_LabelBinding(t *testing.T) {
+	enc, err := EncryptWithAAD("s3cret", "pw", "ssh_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(enc) {
+		t.Fatalf("expected a vault value, got %q", enc)
+	}
+
+	got, err := DecryptWithAAD(enc, "pw", "ssh_password")
+	if err != nil || got != "s3cret" {
+		t.Errorf("expected the correct label to decrypt, got %q, %v", got, err)
+	}
+	if _, err := DecryptWithAAD(enc, "pw", "winrm_password"); err == nil {
+		t.Error("expected a value moved to another key to fail")
+	}
+	if _, err := Decrypt(enc, "pw"); err == nil {
+		t.Error("expected Decrypt to refuse a bound value")
+	}
+	// Stripping the marker does not unbind the value.
+	stripped := Prefix + strings.TrimPrefix(enc, Prefix+aadMarker)
+	if _, err := Decrypt(stripped, "pw"); err == nil {
+		t.Error("expected a bound value with its marker removed to fail")
+	}
+
+	unbound, _ := Encrypt("plain", "pw")
+	if got, err := DecryptWithAAD(unbound, "pw", "any"); err != nil || got != "plain" {
+		t.Errorf("expected unbound values to decrypt under any label, got %q, %v", got, err)
+	}
+}
+
+func TestDecryptMap_BoundToKey(t *testing.T) {
+	bound, _ := EncryptWithAAD("hunter2", "pw", "db_password")
+	m := map[string]string{"db_password": bound}
+	if err := DecryptMap(m, "pw"); err != nil || m["db_password"] != "hunter2" {
+		t.Errorf("expected the value bound to its key to decrypt, got %v, %v", m, err)
+	}
+
+	m = map[string]string{"api_token": bound}
+	err := DecryptMap(m, "pw")
+	if err == nil || !strings.Contains(err.Error(), `"api_token"`) {
+		t.Errorf("expected a value moved to another key to fail naming it, got %v", err)
+	}
+}
+
+func TestView(t *testing.T) {
+	dir := t.TempDir()
+	plain := "[web]\nweb1 ansible_password=s3cret\n"
+	enc, err := Encrypt(plain, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(file, []byte(enc+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := View(&out, file, "pw"); err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if out.String() != plain {
+		t.Errorf("expected %q, got %q", plain, out.String())
+	}
+	if data, _ := os.ReadFile(file); string(data) != enc+"\n" {
+		t.Error("expected the encrypted file to be left unchanged")
+	}
+	if err := View(&out, file, "wrong"); err == nil || !strings.Contains(err.Error(), file) {
+		t.Errorf("expected a wrong password to fail naming the file, got %v", err)
+	}
+
+	plainFile := filepath.Join(dir, "plain")
+	os.WriteFile(plainFile, []byte(plain), 0o600)
+	out.Reset()
+	err = View(&out, plainFile, "pw")
+	if !errors.Is(err, ErrNotEncrypted) || err.Error() != plainFile+": not vault-encrypted" {
+		t.Errorf("expected a not encrypted error, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected nothing printed for a plaintext file, got %q", out.String())
+	}
+}
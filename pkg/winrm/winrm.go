@@ -0,0 +1,284 @@
+// Package winrm implements a minimal WS-Management (WinRM) client for running
+// commands on Windows hosts over HTTP(S) with basic authentication.
+package winrm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Config holds WinRM connection parameters.
+type Config struct {
+	User     string
+	Password string
+	// Port defaults to 5985 (HTTP) or 5986 (HTTPS).
+	Port  int
+	HTTPS bool
+	// Insecure skips TLS certificate verification when HTTPS is set.
+	Insecure bool
+	// Timeout bounds each HTTP round-trip. Defaults to 60s.
+	Timeout time.Duration
+}
+
+// ExitError reports a command that completed with a non-zero exit code.
+type ExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.Code)
+}
+
+// ExitStatus returns the remote exit code, mirroring ssh.ExitError.
+func (e *ExitError) ExitStatus() int {
+	return e.Code
+}
+
+// Client talks to a single WinRM endpoint.
+type Client struct {
+	endpoint string
+	cfg      Config
+	http     *http.Client
+}
+
+// NewClient returns a client for host using cfg.
+func NewClient(host string, cfg Config) *Client {
+	scheme := "http"
+	if cfg.HTTPS {
+		scheme = "https"
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 5985
+		if cfg.HTTPS {
+			cfg.Port = 5986
+		}
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 60 * time.Second
+	}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.Insecure}, // #nosec G402 – opt-in via winrm_insecure
+	}
+	return &Client{
+		endpoint: fmt.Sprintf("%s://%s:%d/wsman", scheme, host, cfg.Port),
+		cfg:      cfg,
+		http:     &http.Client{Transport: transport, Timeout: cfg.Timeout},
+	}
+}
+
+// Powershell wraps a PowerShell script as an encoded powershell.exe command line.
+func Powershell(script string) string {
+	u := utf16.Encode([]rune(script))
+	buf := make([]byte, len(u)*2)
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(buf[i*2:], r)
+	}
+	return "powershell.exe -NoProfile -NonInteractive -EncodedCommand " + base64.StdEncoding.EncodeToString(buf)
+}
+
+// Run executes command in a new remote cmd shell and returns its stdout,
+// stderr and exit code. A non-zero exit code is reported as *ExitError.
+func (c *Client) Run(command string) (string, string, int, error) {
+	shellID, err := c.createShell()
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer c.deleteShell(shellID)
+
+	cmdID, err := c.startCommand(shellID, command)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer c.signalTerminate(shellID, cmdID)
+
+	var stdout, stderr bytes.Buffer
+	for {
+		done, code, err := c.receive(shellID, cmdID, &stdout, &stderr)
+		if err != nil {
+			return stdout.String(), stderr.String(), 0, err
+		}
+		if done {
+			if code != 0 {
+				return stdout.String(), stderr.String(), code, &ExitError{Code: code, Stderr: stderr.String()}
+			}
+			return stdout.String(), stderr.String(), 0, nil
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WS-Management operations
+// ---------------------------------------------------------------------------
+
+const (
+	nsShell       = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell"
+	resourceCmd   = nsShell + "/cmd"
+	actionCreate  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	actionDelete  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	actionCommand = nsShell + "/Command"
+	actionReceive = nsShell + "/Receive"
+	actionSignal  = nsShell + "/Signal"
+	stateDone     = nsShell + "/CommandState/Done"
+	signalTerm    = nsShell + "/signal/terminate"
+)
+
+func (c *Client) createShell() (string, error) {
+	body := `<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`
+	opts := `<w:OptionSet><w:Option Name="WINRS_NOPROFILE">FALSE</w:Option><w:Option Name="WINRS_CODEPAGE">65001</w:Option></w:OptionSet>`
+	var resp struct {
+		ShellID   string `xml:"Body>Shell>ShellId"`
+		Selectors []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Body>ResourceCreated>ReferenceParameters>SelectorSet>Selector"`
+	}
+	if err := c.call(actionCreate, "", opts, body, &resp); err != nil {
+		return "", fmt.Errorf("winrm create shell: %w", err)
+	}
+	if resp.ShellID != "" {
+		return resp.ShellID, nil
+	}
+	for _, s := range resp.Selectors {
+		if s.Name == "ShellId" {
+			return s.Value, nil
+		}
+	}
+	return "", fmt.Errorf("winrm create shell: no ShellId in response")
+}
+
+func (c *Client) startCommand(shellID, command string) (string, error) {
+	opts := `<w:OptionSet><w:Option Name="WINRS_CONSOLEMODE_STDIN">TRUE</w:Option><w:Option Name="WINRS_SKIP_CMD_SHELL">FALSE</w:Option></w:OptionSet>`
+	body := `<rsp:CommandLine><rsp:Command>` + xmlEscape(command) + `</rsp:Command></rsp:CommandLine>`
+	var resp struct {
+		CommandID string `xml:"Body>CommandResponse>CommandId"`
+	}
+	if err := c.call(actionCommand, shellID, opts, body, &resp); err != nil {
+		return "", fmt.Errorf("winrm command: %w", err)
+	}
+	if resp.CommandID == "" {
+		return "", fmt.Errorf("winrm command: no CommandId in response")
+	}
+	return resp.CommandID, nil
+}
+
+func (c *Client) receive(shellID, cmdID string, stdout, stderr io.Writer) (bool, int, error) {
+	body := `<rsp:Receive><rsp:DesiredStream CommandId="` + xmlEscape(cmdID) + `">stdout stderr</rsp:DesiredStream></rsp:Receive>`
+	var resp struct {
+		Streams []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Body>ReceiveResponse>Stream"`
+		State struct {
+			State    string `xml:"State,attr"`
+			ExitCode int    `xml:"ExitCode"`
+		} `xml:"Body>ReceiveResponse>CommandState"`
+	}
+	if err := c.call(actionReceive, shellID, "", body, &resp); err != nil {
+		return false, 0, fmt.Errorf("winrm receive: %w", err)
+	}
+	for _, s := range resp.Streams {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s.Value))
+		if err != nil {
+			return false, 0, fmt.Errorf("winrm receive: decoding %s: %w", s.Name, err)
+		}
+		if s.Name == "stderr" {
+			stderr.Write(data)
+		} else {
+			stdout.Write(data)
+		}
+	}
+	return resp.State.State == stateDone, resp.State.ExitCode, nil
+}
+
+func (c *Client) signalTerminate(shellID, cmdID string) {
+	body := `<rsp:Signal CommandId="` + xmlEscape(cmdID) + `"><rsp:Code>` + signalTerm + `</rsp:Code></rsp:Signal>`
+	_ = c.call(actionSignal, shellID, "", body, nil)
+}
+
+func (c *Client) deleteShell(shellID string) {
+	_ = c.call(actionDelete, shellID, "", "", nil)
+}
+
+// call posts a SOAP envelope and decodes the response into out (if non-nil).
+func (c *Client) call(action, shellID, options, body string, out interface{}) error {
+	envelope := c.envelope(action, shellID, options, body)
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, strings.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.SetBasicAuth(c.cfg.User, c.cfg.Password)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("authentication failed for user %q", c.cfg.User)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Reason string `xml:"Body>Fault>Reason>Text"`
+		}
+		if xml.Unmarshal(data, &fault) == nil && fault.Reason != "" {
+			return fmt.Errorf("http %d: %s", resp.StatusCode, strings.TrimSpace(fault.Reason))
+		}
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, out)
+}
+
+func (c *Client) envelope(action, shellID, options, body string) string {
+	var b strings.Builder
+	b.WriteString(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"`)
+	b.WriteString(` xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing"`)
+	b.WriteString(` xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"`)
+	b.WriteString(` xmlns:rsp="` + nsShell + `"><s:Header>`)
+	b.WriteString(`<a:To>` + xmlEscape(c.endpoint) + `</a:To>`)
+	b.WriteString(`<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`)
+	b.WriteString(`<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize>`)
+	b.WriteString(`<a:MessageID>uuid:` + newUUID() + `</a:MessageID>`)
+	b.WriteString(`<w:Locale xml:lang="en-US" s:mustUnderstand="false"/>`)
+	b.WriteString(fmt.Sprintf(`<w:OperationTimeout>PT%dS</w:OperationTimeout>`, int(c.cfg.Timeout.Seconds())))
+	b.WriteString(`<w:ResourceURI s:mustUnderstand="true">` + resourceCmd + `</w:ResourceURI>`)
+	b.WriteString(`<a:Action s:mustUnderstand="true">` + action + `</a:Action>`)
+	if shellID != "" {
+		b.WriteString(`<w:SelectorSet><w:Selector Name="ShellId">` + xmlEscape(shellID) + `</w:Selector></w:SelectorSet>`)
+	}
+	b.WriteString(options)
+	b.WriteString(`</s:Header><s:Body>` + body + `</s:Body></s:Envelope>`)
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func newUUID() string {
+	var u [16]byte
+	_, _ = rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
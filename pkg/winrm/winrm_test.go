@@ -0,0 +1,95 @@
+package winrm
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeServer answers the WS-Management calls made by Client.Run.
+func fakeServer(t *testing.T, stdout string, exitCode int, seen *[]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "admin" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := string(body)
+		switch {
+		case strings.Contains(req, "transfer/Create"):
+			*seen = append(*seen, "create")
+			io.WriteString(w, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Body><rsp:Shell><rsp:ShellId>SHELL-1</rsp:ShellId></rsp:Shell></s:Body></s:Envelope>`)
+		case strings.Contains(req, "shell/Command<"):
+			*seen = append(*seen, "command")
+			io.WriteString(w, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Body><rsp:CommandResponse><rsp:CommandId>CMD-1</rsp:CommandId></rsp:CommandResponse></s:Body></s:Envelope>`)
+		case strings.Contains(req, "shell/Receive<"):
+			*seen = append(*seen, "receive")
+			io.WriteString(w, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Body><rsp:ReceiveResponse>`+
+				`<rsp:Stream Name="stdout" CommandId="CMD-1">`+base64.StdEncoding.EncodeToString([]byte(stdout))+`</rsp:Stream>`+
+				`<rsp:CommandState CommandId="CMD-1" State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"><rsp:ExitCode>`+strconv.Itoa(exitCode)+`</rsp:ExitCode></rsp:CommandState>`+
+				`</rsp:ReceiveResponse></s:Body></s:Envelope>`)
+		case strings.Contains(req, "shell/Signal<"):
+			*seen = append(*seen, "signal")
+		case strings.Contains(req, "transfer/Delete"):
+			*seen = append(*seen, "delete")
+		}
+	}))
+}
+
+func clientFor(t *testing.T, srv *httptest.Server, password string) *Client {
+	t.Helper()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("parsing server URL: %v", err)
+	}
+	p, _ := strconv.Atoi(port)
+	return NewClient(host, Config{User: "admin", Password: password, Port: p})
+}
+
+func TestClientRun_Success(t *testing.T) {
+	var seen []string
+	srv := fakeServer(t, "hello\r\n", 0, &seen)
+	defer srv.Close()
+
+	stdout, _, code, err := clientFor(t, srv, "secret").Run("echo hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stdout != "hello\r\n" || code != 0 {
+		t.Errorf("expected stdout 'hello' and code 0, got %q / %d", stdout, code)
+	}
+	if strings.Join(seen, ",") != "create,command,receive,signal,delete" {
+		t.Errorf("unexpected call sequence: %v", seen)
+	}
+}
+
+func TestClientRun_NonZeroExit(t *testing.T) {
+	var seen []string
+	srv := fakeServer(t, "", 3, &seen)
+	defer srv.Close()
+
+	_, _, code, err := clientFor(t, srv, "secret").Run("exit 3")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 || code != 3 {
+		t.Errorf("expected ExitError with status 3, got code=%d err=%v", code, err)
+	}
+}
+
+func TestClientRun_AuthFailure(t *testing.T) {
+	var seen []string
+	srv := fakeServer(t, "", 0, &seen)
+	defer srv.Close()
+
+	_, _, _, err := clientFor(t, srv, "wrong").Run("whoami")
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}